@@ -0,0 +1,227 @@
+// Package client is the Go client of the binary protocol served by smartstash-native.
+//
+// A Client keeps a pool of connections and every connection pipelines the requests of the
+// concurrent calls. A connection that fails is dialed again by the next call, and a call
+// that failed with its connection is retried once when that is safe: reads are always
+// retried, writes only if their request could not have reached the server.
+package client
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/protocol"
+	"SmartStashDB/storage"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Options struct {
+	// Addr is the address of the server.
+	Addr string
+	// PoolSize is the number of connections, the calls are spread over them.
+	PoolSize int
+	// DialTimeout bounds the dial of a connection.
+	DialTimeout time.Duration
+	// Timeout is the deadline of the calls whose context has none, zero means no deadline.
+	Timeout time.Duration
+	// MaxFrameLength bounds the responses, zero means protocol.DefaultMaxFrameLength.
+	MaxFrameLength uint32
+}
+
+var DefaultOptions = Options{
+	Addr:        "127.0.0.1:7379",
+	PoolSize:    4,
+	DialTimeout: 5 * time.Second,
+	Timeout:     10 * time.Second,
+
+	MaxFrameLength: protocol.DefaultMaxFrameLength,
+}
+
+// maxRetries is the number of times a call is retried on a new connection.
+const maxRetries = 1
+
+// Client is safe for concurrent use.
+type Client struct {
+	options Options
+	slots   []slot
+	next    atomic.Uint64
+	closed  atomic.Bool
+}
+
+// slot is a connection of the pool, it is dialed on first use and again once it failed.
+type slot struct {
+	mu   sync.Mutex
+	conn *conn
+}
+
+// Open creates a client and dials its first connection, so that a wrong address is
+// reported at once.
+func Open(options Options) (*Client, error) {
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultOptions.PoolSize
+	}
+	c := &Client{options: options, slots: make([]slot, options.PoolSize)}
+	ctx := context.Background()
+	if options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.DialTimeout)
+		defer cancel()
+	}
+	cn, err := dial(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	c.slots[0].conn = cn
+	return c, nil
+}
+
+// Close closes the connections, the calls in flight fail with ErrorClientClosed.
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	for i := range c.slots {
+		s := &c.slots[i]
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.close()
+			s.conn = nil
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// conn returns the next connection of the pool, dialing it if needed.
+func (c *Client) conn(ctx context.Context) (*conn, error) {
+	if c.closed.Load() {
+		return nil, _const.ErrorClientClosed
+	}
+	s := &c.slots[c.next.Add(1)%uint64(len(c.slots))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.closed.Load() {
+		return nil, _const.ErrorClientClosed
+	}
+	if s.conn == nil || s.conn.broken() {
+		cn, err := dial(ctx, c.options)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = cn
+	}
+	return s.conn, nil
+}
+
+// do sends the frames as one pipeline and waits for their responses until the deadline of
+// the context. It only fails if the responses could not be received, the error of every
+// request is in its call.
+func (c *Client) do(ctx context.Context, frames []*protocol.Frame, readOnly bool) ([]*call, error) {
+	if _, ok := ctx.Deadline(); !ok && c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	for attempt := 0; ; attempt++ {
+		// The calls of a failed attempt may still be referenced by their connection.
+		calls := make([]*call, len(frames))
+		for i, frame := range frames {
+			calls[i] = &call{frame: frame, done: make(chan struct{})}
+		}
+		cn, err := c.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// A request whose write failed never reached the server in full, unless other
+		// requests of the pipeline were written before it.
+		err = cn.send(deadline, calls)
+		if err != nil && ctx.Err() != nil {
+			// The write ran into the deadline.
+			return nil, ctx.Err()
+		}
+		unsent := err != nil && len(calls) == 1
+		failed := err != nil
+		if err == nil {
+			if err = wait(ctx, calls); err != nil {
+				return nil, err
+			}
+			for _, call := range calls {
+				failed = failed || isConnError(call.err)
+			}
+		}
+		if failed && (readOnly || unsent) && attempt < maxRetries && ctx.Err() == nil && !c.closed.Load() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return calls, nil
+	}
+}
+
+func wait(ctx context.Context, calls []*call) error {
+	for _, call := range calls {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Ping checks that the server answers.
+func (c *Client) Ping(ctx context.Context) error {
+	p := c.Pipeline()
+	r := p.Ping()
+	if err := p.Exec(ctx); err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+// Get reads the key, it fails with ErrorKeyNotFound if the key does not exist.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	p := c.Pipeline()
+	r := p.Get(key)
+	if err := p.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return r.Value()
+}
+
+// Put writes the key with the write options, nil uses the defaults of the server.
+func (c *Client) Put(ctx context.Context, key, value []byte, options *storage.WriteOptions) error {
+	p := c.Pipeline()
+	r := p.Put(key, value, options)
+	if err := p.Exec(ctx); err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+// Delete deletes the key, deleting a missing key succeeds.
+func (c *Client) Delete(ctx context.Context, key []byte, options *storage.WriteOptions) error {
+	p := c.Pipeline()
+	r := p.Delete(key, options)
+	if err := p.Exec(ctx); err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+// Scan returns the pairs selected by the options, they are streamed by the server and
+// collected here.
+func (c *Client) Scan(ctx context.Context, options ScanOptions) ([]storage.KV, error) {
+	p := c.Pipeline()
+	r := p.Scan(options)
+	if err := p.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return r.KVs()
+}
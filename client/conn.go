@@ -0,0 +1,174 @@
+package client
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/protocol"
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// bufferSize is the size of the read and write buffers of a connection.
+const bufferSize = 64 * 1024
+
+// connError is a failure of the connection, the calls that were waiting on it fail with it
+// and the connection is dialed again by the next call.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string {
+	return "connection failed: " + e.err.Error()
+}
+
+func (e *connError) Unwrap() error {
+	return e.err
+}
+
+// call is a request waiting for its response. The chunks are the payloads of the StatusMore
+// frames of a scan.
+type call struct {
+	frame   *protocol.Frame
+	done    chan struct{}
+	payload []byte
+	chunks  [][]byte
+	err     error
+}
+
+// conn is a connection that pipelines the requests of concurrent calls, the responses
+// come back in the order of the requests and are matched to the pending calls.
+type conn struct {
+	nc net.Conn
+	// maxFrameLength bounds the responses.
+	maxFrameLength uint32
+
+	// wmu serializes the writers, the ids and the pending calls are in the order written.
+	wmu    sync.Mutex
+	w      *bufio.Writer
+	nextId uint64
+
+	mu      sync.Mutex
+	pending []*call
+	// err is set once the connection failed, it is never used again.
+	err error
+}
+
+func dial(ctx context.Context, options Options) (*conn, error) {
+	dialer := net.Dialer{Timeout: options.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", options.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, maxFrameLength: options.MaxFrameLength, w: bufio.NewWriterSize(nc, bufferSize)}
+	go cn.readLoop()
+	return cn, nil
+}
+
+func (cn *conn) broken() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.err != nil
+}
+
+// send writes the requests of the calls as one pipeline, the write fails at the deadline.
+func (cn *conn) send(deadline time.Time, calls []*call) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+
+	cn.mu.Lock()
+	if cn.err != nil {
+		cn.mu.Unlock()
+		return cn.err
+	}
+	for _, c := range calls {
+		cn.nextId++
+		c.frame.Id = cn.nextId
+		cn.pending = append(cn.pending, c)
+	}
+	cn.mu.Unlock()
+
+	_ = cn.nc.SetWriteDeadline(deadline)
+	for _, c := range calls {
+		if err := protocol.WriteFrame(cn.w, c.frame); err != nil {
+			return cn.fail(err)
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return cn.fail(err)
+	}
+	return nil
+}
+
+// readLoop hands the responses to the pending calls until the connection fails.
+func (cn *conn) readLoop() {
+	r := bufio.NewReaderSize(cn.nc, bufferSize)
+	for {
+		frame, err := protocol.ReadFrame(r, cn.maxFrameLength)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+
+		cn.mu.Lock()
+		if len(cn.pending) == 0 || cn.pending[0].frame.Id != frame.Id {
+			cn.mu.Unlock()
+			if frame.Kind == protocol.StatusError {
+				// The server could not read a request and closes the connection.
+				cn.fail(protocol.DecodeError(frame.Payload))
+			} else {
+				cn.fail(_const.ErrorMalformedFrame)
+			}
+			return
+		}
+		c := cn.pending[0]
+		switch frame.Kind {
+		case protocol.StatusMore:
+			c.chunks = append(c.chunks, frame.Payload)
+			cn.mu.Unlock()
+			continue
+		case protocol.StatusOK:
+			c.payload = frame.Payload
+		case protocol.StatusError:
+			c.err = protocol.DecodeError(frame.Payload)
+		default:
+			cn.mu.Unlock()
+			cn.fail(_const.ErrorMalformedFrame)
+			return
+		}
+		cn.pending = cn.pending[1:]
+		cn.mu.Unlock()
+		close(c.done)
+	}
+}
+
+// fail closes the connection and fails the pending calls, it returns the error they got.
+func (cn *conn) fail(err error) error {
+	cn.mu.Lock()
+	if cn.err == nil {
+		cn.err = &connError{err: err}
+	}
+	err = cn.err
+	pending := cn.pending
+	cn.pending = nil
+	cn.mu.Unlock()
+
+	_ = cn.nc.Close()
+	for _, c := range pending {
+		c.err = err
+		close(c.done)
+	}
+	return err
+}
+
+func (cn *conn) close() {
+	cn.fail(_const.ErrorClientClosed)
+}
+
+// isConnError reports whether the error is a failure of the connection, not of the request.
+func isConnError(err error) bool {
+	var ce *connError
+	return errors.As(err, &ce)
+}
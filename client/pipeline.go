@@ -0,0 +1,248 @@
+package client
+
+import (
+	"SmartStashDB/protocol"
+	"SmartStashDB/storage"
+	"context"
+	"time"
+)
+
+// Pipeline queues requests that are sent together by Exec, their responses are read in
+// one round trip. A Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	client   *Client
+	frames   []*protocol.Frame
+	results  []*Result
+	readOnly bool
+}
+
+// Pipeline creates an empty pipeline.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c, readOnly: true}
+}
+
+// Result is the result of a request of a pipeline, it is set by Exec.
+type Result struct {
+	op  protocol.Op
+	err error
+	// value is the value of a get.
+	value []byte
+	// kvs are the pairs of a scan.
+	kvs []storage.KV
+}
+
+// Err is the error of the request.
+func (r *Result) Err() error {
+	return r.err
+}
+
+// Value is the value read by a get.
+func (r *Result) Value() ([]byte, error) {
+	return r.value, r.err
+}
+
+// KVs are the pairs returned by a scan.
+func (r *Result) KVs() ([]storage.KV, error) {
+	return r.kvs, r.err
+}
+
+func (p *Pipeline) add(op protocol.Op, flags byte, payload []byte) *Result {
+	result := &Result{op: op}
+	p.frames = append(p.frames, &protocol.Frame{Kind: op, Flags: flags, Payload: payload})
+	p.results = append(p.results, result)
+	if op != protocol.OpPing && op != protocol.OpGet && op != protocol.OpScan {
+		p.readOnly = false
+	}
+	return result
+}
+
+// writeFlags converts the write options into the flags of a write request.
+func writeFlags(options *storage.WriteOptions) byte {
+	var flags byte
+	if options == nil {
+		return flags
+	}
+	if options.Sync {
+		flags |= protocol.FlagSync
+	}
+	if options.DisableWal {
+		flags |= protocol.FlagDisableWal
+	}
+	return flags
+}
+
+// ttlOf is the time to live of a write without its own, zero means never.
+func ttlOf(options *storage.WriteOptions) time.Duration {
+	if options == nil {
+		return 0
+	}
+	return options.TTL
+}
+
+func (p *Pipeline) Ping() *Result {
+	return p.add(protocol.OpPing, 0, nil)
+}
+
+func (p *Pipeline) Get(key []byte) *Result {
+	return p.add(protocol.OpGet, 0, protocol.EncodeRecord(&storage.LogRecord{Key: key, Type: storage.LogRecordNormal}))
+}
+
+// Put writes the key, the TTL of the options makes it expire.
+func (p *Pipeline) Put(key, value []byte, options *storage.WriteOptions) *Result {
+	record := &storage.LogRecord{Key: key, Value: value, Type: storage.LogRecordNormal, Expire: uint64(ttlOf(options))}
+	return p.add(protocol.OpPut, writeFlags(options), protocol.EncodeRecord(record))
+}
+
+func (p *Pipeline) Delete(key []byte, options *storage.WriteOptions) *Result {
+	record := &storage.LogRecord{Key: key, Type: storage.LogRecordDeleted}
+	return p.add(protocol.OpDelete, writeFlags(options), protocol.EncodeRecord(record))
+}
+
+// Write commits the batch atomically, the TTL of the options applies to the puts of the
+// batch without their own.
+func (p *Pipeline) Write(batch *Batch, options *storage.WriteOptions) *Result {
+	ttl := uint64(ttlOf(options))
+	var payload []byte
+	for _, record := range batch.records {
+		if record.Type == storage.LogRecordNormal && record.Expire == 0 {
+			record = &storage.LogRecord{Key: record.Key, Value: record.Value, Type: record.Type, Expire: ttl}
+		}
+		payload = protocol.AppendRecord(payload, record)
+	}
+	return p.add(protocol.OpBatch, writeFlags(options), payload)
+}
+
+// ScanOptions select the pairs of a scan.
+type ScanOptions struct {
+	// Start is the inclusive lower bound, nil means no bound.
+	Start []byte
+	// End is the exclusive upper bound, nil means no bound.
+	End []byte
+	// Prefix narrows the range to the keys that start with it.
+	Prefix []byte
+	// Limit is the maximum number of pairs, zero returns all of them.
+	Limit int
+	// Reverse returns the pairs from the biggest key down.
+	Reverse bool
+	// KeysOnly leaves the values out.
+	KeysOnly bool
+}
+
+func (p *Pipeline) Scan(options ScanOptions) *Result {
+	req := &protocol.ScanRequest{
+		Start:    options.Start,
+		End:      options.End,
+		Reverse:  options.Reverse,
+		KeysOnly: options.KeysOnly,
+	}
+	if options.Limit > 0 {
+		req.Limit = uint64(options.Limit)
+	}
+	if prefix := options.Prefix; len(prefix) > 0 {
+		// The bigger lower bound and the smaller upper bound win.
+		if req.Start == nil || string(prefix) > string(req.Start) {
+			req.Start = prefix
+		}
+		if end := storage.PrefixEnd(prefix); end != nil && (req.End == nil || string(end) < string(req.End)) {
+			req.End = end
+		}
+	}
+	return p.add(protocol.OpScan, 0, protocol.EncodeScan(req))
+}
+
+// Exec sends the queued requests and sets their results, it only fails if the responses
+// could not be received. The pipeline is empty afterwards.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	frames, results, readOnly := p.frames, p.results, p.readOnly
+	p.frames, p.results, p.readOnly = nil, nil, true
+	if len(frames) == 0 {
+		return nil
+	}
+
+	calls, err := p.client.do(ctx, frames, readOnly)
+	if err != nil {
+		for _, result := range results {
+			result.err = err
+		}
+		return err
+	}
+	for i, call := range calls {
+		results[i].set(call)
+	}
+	return nil
+}
+
+// set decodes the response of the call.
+func (r *Result) set(c *call) {
+	r.err = c.err
+	if r.err != nil {
+		return
+	}
+	switch r.op {
+	case protocol.OpGet:
+		var record *storage.LogRecord
+		if record, r.err = protocol.DecodeRecord(c.payload); r.err == nil {
+			r.value = record.Value
+		}
+	case protocol.OpScan:
+		for _, chunk := range append(c.chunks, c.payload) {
+			records, err := protocol.DecodeRecords(chunk)
+			if err != nil {
+				r.kvs, r.err = nil, err
+				return
+			}
+			for _, record := range records {
+				r.kvs = append(r.kvs, storage.KV{Key: record.Key, Value: record.Value})
+			}
+		}
+	}
+}
+
+// Batch collects writes that are committed atomically by Commit.
+type Batch struct {
+	client  *Client
+	records []*storage.LogRecord
+}
+
+// NewBatch creates an empty batch.
+func (c *Client) NewBatch() *Batch {
+	return &Batch{client: c}
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.records = append(b.records, &storage.LogRecord{Key: key, Value: value, Type: storage.LogRecordNormal})
+}
+
+// PutWithTTL writes the key, it expires ttl after the commit.
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.records = append(b.records, &storage.LogRecord{Key: key, Value: value, Type: storage.LogRecordNormal, Expire: uint64(ttl)})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.records = append(b.records, &storage.LogRecord{Key: key, Type: storage.LogRecordDeleted})
+}
+
+// DeleteRange deletes the keys start <= key < end, a nil bound is open.
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.records = append(b.records, &storage.LogRecord{Key: start, Value: end, Type: storage.LogRecordRangeDeleted})
+}
+
+// Merge writes a merge operand of the key, the server combines it with its MergeOperator.
+func (b *Batch) Merge(key, operand []byte) {
+	b.records = append(b.records, &storage.LogRecord{Key: key, Value: operand, Type: storage.LogRecordMerge})
+}
+
+// Len is the number of writes of the batch.
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+// Commit sends the batch, the server applies all of its writes or none.
+func (b *Batch) Commit(ctx context.Context, options *storage.WriteOptions) error {
+	p := b.client.Pipeline()
+	r := p.Write(b, options)
+	if err := p.Exec(ctx); err != nil {
+		return err
+	}
+	return r.Err()
+}
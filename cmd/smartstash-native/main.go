@@ -0,0 +1,59 @@
+// Command smartstash-native serves a SmartStashDB database over the binary protocol of the
+// protocol package, the client package is its Go client.
+package main
+
+import (
+	"SmartStashDB/protocol"
+	"SmartStashDB/storage"
+	"flag"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	var (
+		addr     = flag.String("addr", ":7379", "the address to listen on")
+		dir      = flag.String("dir", "data", "the directory of the database")
+		syncWal  = flag.Bool("sync", false, "sync the WAL on every write")
+		maxFrame = flag.Uint("max-frame", protocol.DefaultMaxFrameLength, "the size limit of a request frame in bytes")
+	)
+	flag.Parse()
+	if *maxFrame == 0 || *maxFrame > math.MaxUint32 {
+		log.Fatalf("-max-frame must be between 1 and %d", uint32(math.MaxUint32))
+	}
+
+	options := storage.DefaultOptions
+	options.DirPath = *dir
+	options.Sync = *syncWal
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		log.Fatalf("open the database: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		_ = db.Close()
+		log.Fatalf("listen on %s: %v", *addr, err)
+	}
+	srv := newServer(db, listener, uint32(*maxFrame))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.close()
+	}()
+
+	log.Printf("serving %s on %s", *dir, listener.Addr())
+	if err := srv.serve(); err != nil {
+		log.Printf("accept: %v", err)
+		srv.close()
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("close the database: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/protocol"
+	"SmartStashDB/storage"
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// scanChunkSize is the size of the records sent in one StatusMore frame of a scan.
+	scanChunkSize = 256 * 1024
+	// bufferSize is the size of the read and write buffers of a connection.
+	bufferSize = 64 * 1024
+)
+
+// server serves a database over the binary protocol, every connection has its own goroutine.
+type server struct {
+	db       *storage.DB
+	listener net.Listener
+	// maxFrameLength bounds the requests, a longer one is refused and closes the connection.
+	maxFrameLength uint32
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newServer(db *storage.DB, listener net.Listener, maxFrameLength uint32) *server {
+	return &server{
+		db:             db,
+		listener:       listener,
+		maxFrameLength: maxFrameLength,
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts connections until the server is closed.
+func (s *server) serve() error {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = nc.Close()
+			return nil
+		}
+		s.conns[nc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(nc)
+	}
+}
+
+// close stops accepting connections, closes the open ones and waits for their goroutines.
+func (s *server) close() {
+	s.mu.Lock()
+	s.closed = true
+	_ = s.listener.Close()
+	for nc := range s.conns {
+		_ = nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// serveConn answers the requests of the connection in order, the responses of pipelined
+// requests are sent together.
+func (s *server) serveConn(nc net.Conn) {
+	defer func() {
+		_ = nc.Close()
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReaderSize(nc, bufferSize)
+	w := bufio.NewWriterSize(nc, bufferSize)
+	for {
+		req, err := protocol.ReadFrame(r, s.maxFrameLength)
+		if err != nil {
+			// A malformed frame can not be skipped, it is reported and the connection closed.
+			if errors.Is(err, _const.ErrorMalformedFrame) || errors.Is(err, _const.ErrorFrameTooLarge) {
+				_ = protocol.WriteFrame(w, &protocol.Frame{Kind: protocol.StatusError, Payload: protocol.EncodeError(err)})
+				_ = w.Flush()
+			}
+			return
+		}
+		if err := s.handle(w, req); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle runs the request and writes its response, it only fails if the response can not
+// be written.
+func (s *server) handle(w *bufio.Writer, req *protocol.Frame) error {
+	if req.Kind == protocol.OpScan {
+		return s.scan(w, req)
+	}
+	payload, err := s.execute(req)
+	resp := &protocol.Frame{Kind: protocol.StatusOK, Id: req.Id, Payload: payload}
+	if err != nil {
+		resp.Kind = protocol.StatusError
+		resp.Payload = protocol.EncodeError(err)
+	}
+	return protocol.WriteFrame(w, resp)
+}
+
+func (s *server) execute(req *protocol.Frame) ([]byte, error) {
+	options := &storage.WriteOptions{
+		Sync:       req.Flags&protocol.FlagSync != 0,
+		DisableWal: req.Flags&protocol.FlagDisableWal != 0,
+	}
+	switch req.Kind {
+	case protocol.OpPing:
+		return nil, nil
+	case protocol.OpGet:
+		record, err := protocol.DecodeRecord(req.Payload)
+		if err != nil {
+			return nil, err
+		}
+		value, err := s.db.Get(string(record.Key))
+		if err != nil {
+			return nil, err
+		}
+		return protocol.EncodeRecord(&storage.LogRecord{Key: record.Key, Value: value, Type: storage.LogRecordNormal}), nil
+	case protocol.OpPut, protocol.OpDelete:
+		record, err := protocol.DecodeRecord(req.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if (req.Kind == protocol.OpPut) != (record.Type == storage.LogRecordNormal) ||
+			(req.Kind == protocol.OpDelete) != (record.Type == storage.LogRecordDeleted) {
+			return nil, _const.ErrorLogRecordCorrupted
+		}
+		return nil, s.write([]*storage.LogRecord{record}, options)
+	case protocol.OpBatch:
+		records, err := protocol.DecodeRecords(req.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.write(records, options)
+	default:
+		return nil, _const.ErrorUnknownOp
+	}
+}
+
+// write commits the records atomically, the Expire of a record is its time to live.
+func (s *server) write(records []*storage.LogRecord, options *storage.WriteOptions) error {
+	batch := s.db.NewBatch(storage.BatchOptions{})
+	for _, record := range records {
+		var err error
+		switch record.Type {
+		case storage.LogRecordNormal:
+			if record.Expire == 0 {
+				err = batch.Put(record.Key, record.Value)
+			} else {
+				err = batch.PutWithTTL(record.Key, record.Value, time.Duration(record.Expire))
+			}
+		case storage.LogRecordDeleted:
+			err = batch.Delete(record.Key)
+		case storage.LogRecordRangeDeleted:
+			err = batch.DeleteRange(record.Key, record.Value)
+		case storage.LogRecordMerge:
+			err = batch.Merge(record.Key, record.Value)
+		default:
+			err = _const.ErrorLogRecordCorrupted
+		}
+		if err != nil {
+			_ = batch.Rollback()
+			return err
+		}
+	}
+	return batch.Commit(options)
+}
+
+// scan streams the pairs in StatusMore frames of about scanChunkSize bytes, the last pairs
+// are sent in the StatusOK frame.
+func (s *server) scan(w *bufio.Writer, req *protocol.Frame) error {
+	writeError := func(err error) error {
+		return protocol.WriteFrame(w, &protocol.Frame{Kind: protocol.StatusError, Id: req.Id, Payload: protocol.EncodeError(err)})
+	}
+	scan, err := protocol.DecodeScan(req.Payload)
+	if err != nil {
+		return writeError(err)
+	}
+	it, err := s.db.NewIterator(storage.IteratorOptions{
+		LowerBound: scan.Start,
+		UpperBound: scan.End,
+		Reverse:    scan.Reverse,
+		KeysOnly:   scan.KeysOnly,
+	})
+	if err != nil {
+		return writeError(err)
+	}
+
+	var (
+		chunk []byte
+		n     uint64
+	)
+	for it.Rewind(); it.Valid() && (scan.Limit == 0 || n < scan.Limit); it.Next() {
+		chunk = protocol.AppendRecord(chunk, &storage.LogRecord{Key: it.Key(), Value: it.Value(), Type: storage.LogRecordNormal})
+		n++
+		if len(chunk) >= scanChunkSize {
+			if err := protocol.WriteFrame(w, &protocol.Frame{Kind: protocol.StatusMore, Id: req.Id, Payload: chunk}); err != nil {
+				_ = it.Close()
+				return err
+			}
+			chunk = nil
+		}
+	}
+	if err := it.Close(); err != nil {
+		return writeError(err)
+	}
+	return protocol.WriteFrame(w, &protocol.Frame{Kind: protocol.StatusOK, Id: req.Id, Payload: chunk})
+}
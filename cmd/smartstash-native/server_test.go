@@ -0,0 +1,356 @@
+package main
+
+import (
+	"SmartStashDB/client"
+	_const "SmartStashDB/const"
+	"SmartStashDB/protocol"
+	"SmartStashDB/storage"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) *server {
+	t.Helper()
+	return startTestServerWithLimit(t, protocol.DefaultMaxFrameLength)
+}
+
+// startTestServerWithLimit starts a server that refuses the frames longer than maxFrameLength.
+func startTestServerWithLimit(t *testing.T, maxFrameLength uint32) *server {
+	t.Helper()
+	options := storage.DefaultOptions
+	options.DirPath = t.TempDir()
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = db.Close()
+		t.Fatal(err)
+	}
+	srv := newServer(db, listener, maxFrameLength)
+	go func() {
+		_ = srv.serve()
+	}()
+	t.Cleanup(func() {
+		srv.close()
+		_ = db.Close()
+	})
+	return srv
+}
+
+func openTestClient(t *testing.T, srv *server, poolSize int) *client.Client {
+	t.Helper()
+	options := client.DefaultOptions
+	options.PoolSize = poolSize
+	return openTestClientWithOptions(t, srv, options)
+}
+
+func openTestClientWithOptions(t *testing.T, srv *server, options client.Options) *client.Client {
+	t.Helper()
+	options.Addr = srv.listener.Addr().String()
+	c, err := client.Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+func mustGet(t *testing.T, c *client.Client, key, want string) {
+	t.Helper()
+	value, err := c.Get(context.Background(), []byte(key))
+	if err != nil || string(value) != want {
+		t.Fatalf("get %q: %q %v, want %q", key, value, err, want)
+	}
+}
+
+func mustNotFind(t *testing.T, c *client.Client, key string) {
+	t.Helper()
+	if value, err := c.Get(context.Background(), []byte(key)); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get %q: %q %v, want ErrorKeyNotFound", key, value, err)
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	srv := startTestServer(t)
+	c := openTestClient(t, srv, 2)
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, c, "a")
+	if err := c.Put(ctx, []byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, []byte("short"), []byte("2"), &storage.WriteOptions{TTL: 500 * time.Millisecond, Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, c, "a", "1")
+	mustGet(t, c, "short", "2")
+	if ttl, err := srv.db.TTL("short"); err != nil || ttl <= 0 || ttl > 500*time.Millisecond {
+		t.Fatalf("TTL of a key written with a TTL: %v %v", ttl, err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	mustNotFind(t, c, "short")
+
+	if err := c.Delete(ctx, []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, c, "a")
+	if err := c.Delete(ctx, []byte("a"), nil); err != nil {
+		t.Fatalf("delete of a missing key: %v", err)
+	}
+	if err := c.Put(ctx, nil, []byte("1"), nil); !errors.Is(err, _const.ErrorKeyIsEmpty) {
+		t.Fatalf("put of an empty key: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(ctx); !errors.Is(err, _const.ErrorClientClosed) {
+		t.Fatalf("ping on a closed client: %v", err)
+	}
+}
+
+func TestClientBatchIsAtomic(t *testing.T) {
+	srv := startTestServer(t)
+	c := openTestClient(t, srv, 1)
+	ctx := context.Background()
+	for _, key := range []string{"r1", "r2", "s"} {
+		if err := c.Put(ctx, []byte(key), []byte("old"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := c.NewBatch()
+	batch.Put([]byte("a"), []byte("1"))
+	batch.PutWithTTL([]byte("b"), []byte("2"), time.Hour)
+	batch.Delete([]byte("s"))
+	batch.DeleteRange([]byte("r"), []byte("r2"))
+	if err := batch.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, c, "a", "1")
+	mustGet(t, c, "b", "2")
+	mustGet(t, c, "r2", "old")
+	mustNotFind(t, c, "r1")
+	mustNotFind(t, c, "s")
+	if ttl, err := srv.db.TTL("b"); err != nil || ttl <= time.Hour-time.Minute {
+		t.Fatalf("TTL of a batch put with a TTL: %v %v", ttl, err)
+	}
+
+	// A write that fails fails the whole batch.
+	batch = c.NewBatch()
+	batch.Put([]byte("c"), []byte("3"))
+	batch.Merge([]byte("d"), []byte("4"))
+	if err := batch.Commit(ctx, nil); !errors.Is(err, _const.ErrorNoMergeOperator) {
+		t.Fatalf("batch with a merge and no merge operator: %v", err)
+	}
+	mustNotFind(t, c, "c")
+}
+
+func TestClientScan(t *testing.T) {
+	srv := startTestServer(t)
+	c := openTestClient(t, srv, 1)
+	ctx := context.Background()
+	// More pairs than fit in one frame of the scan.
+	value := bytes.Repeat([]byte("v"), 1000)
+	for i := 0; i < 600; i++ {
+		batch := c.NewBatch()
+		batch.Put([]byte(fmt.Sprintf("a:%04d", i)), value)
+		batch.Put([]byte(fmt.Sprintf("b:%04d", i)), value)
+		if err := batch.Commit(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kvs, err := c.Scan(ctx, client.ScanOptions{Prefix: []byte("a:")})
+	if err != nil || len(kvs) != 600 {
+		t.Fatalf("prefix scan returned %d pairs: %v", len(kvs), err)
+	}
+	for i, kv := range kvs {
+		if string(kv.Key) != fmt.Sprintf("a:%04d", i) || !bytes.Equal(kv.Value, value) {
+			t.Fatalf("pair %d is %q", i, kv.Key)
+		}
+	}
+	kvs, err = c.Scan(ctx, client.ScanOptions{Start: []byte("a:0598"), End: []byte("b:0002")})
+	if err != nil || len(kvs) != 4 || string(kvs[3].Key) != "b:0001" {
+		t.Fatalf("range scan returned %d pairs: %v", len(kvs), err)
+	}
+	kvs, err = c.Scan(ctx, client.ScanOptions{Prefix: []byte("b:"), Reverse: true, KeysOnly: true, Limit: 2})
+	if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "b:0599" || string(kvs[1].Key) != "b:0598" || len(kvs[0].Value) != 0 {
+		t.Fatalf("reverse scan of the keys returned %+v: %v", kvs, err)
+	}
+	if kvs, err := c.Scan(ctx, client.ScanOptions{Prefix: []byte("c:")}); err != nil || len(kvs) != 0 {
+		t.Fatalf("scan of a missing prefix returned %d pairs: %v", len(kvs), err)
+	}
+}
+
+func TestPipelinedConcurrentCalls(t *testing.T) {
+	srv := startTestServer(t)
+	c := openTestClient(t, srv, 2)
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	puts := make([]*client.Result, 100)
+	for i := range puts {
+		puts[i] = p.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprint(i)), nil)
+	}
+	get := p.Get([]byte("key-042"))
+	missing := p.Get([]byte("missing"))
+	if err := p.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range puts {
+		if r.Err() != nil {
+			t.Fatalf("put %d: %v", i, r.Err())
+		}
+	}
+	if value, err := get.Value(); err != nil || string(value) != "42" {
+		t.Fatalf("get in the pipeline: %q %v", value, err)
+	}
+	if _, err := missing.Value(); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get of a missing key in the pipeline: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("g%02d-%02d", g, i))
+				if err := c.Put(ctx, key, key, nil); err != nil {
+					errs <- err
+					return
+				}
+				if value, err := c.Get(ctx, key); err != nil || !bytes.Equal(value, key) {
+					errs <- fmt.Errorf("get %s: %q %v", key, value, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRedialsAfterAFailure(t *testing.T) {
+	srv := startTestServer(t)
+	c := openTestClient(t, srv, 1)
+	ctx := context.Background()
+	if err := c.Put(ctx, []byte("key"), []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server drops the connection, the read is retried on a new one.
+	srv.mu.Lock()
+	for nc := range srv.conns {
+		_ = nc.Close()
+	}
+	srv.mu.Unlock()
+	mustGet(t, c, "key", "value")
+	if err := c.Put(ctx, []byte("key"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, c, "key", "new")
+}
+
+func TestMalformedFrameClosesTheConnection(t *testing.T) {
+	srv := startTestServer(t)
+	nc, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	w := bufio.NewWriter(nc)
+	// An unknown op is answered, the connection stays usable.
+	if err := protocol.WriteFrame(w, &protocol.Frame{Kind: 99, Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte{0, 0, 0, 3, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(nc)
+	for _, want := range []error{_const.ErrorUnknownOp, _const.ErrorMalformedFrame} {
+		frame, err := protocol.ReadFrame(r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Kind != protocol.StatusError || protocol.DecodeError(frame.Payload) != want {
+			t.Fatalf("response %d %q, want %v", frame.Kind, frame.Payload, want)
+		}
+	}
+	if _, err := protocol.ReadFrame(r, 0); err != io.EOF {
+		t.Fatalf("read after a malformed frame: %v", err)
+	}
+}
+
+func TestFramesOverTheLimitAreRefused(t *testing.T) {
+	srv := startTestServerWithLimit(t, 4096)
+	c := openTestClient(t, srv, 1)
+	ctx := context.Background()
+	if err := c.Put(ctx, []byte("small"), bytes.Repeat([]byte("v"), 1000), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The server refuses the request and closes the connection, the next call dials again.
+	if err := c.Put(ctx, []byte("large"), bytes.Repeat([]byte("v"), 5000), nil); !errors.Is(err, _const.ErrorFrameTooLarge) {
+		t.Fatalf("put over the limit of the server: %v", err)
+	}
+	mustGet(t, c, "small", strings.Repeat("v", 1000))
+
+	// The client bounds the responses with its own limit.
+	options := client.DefaultOptions
+	options.MaxFrameLength = 512
+	small := openTestClientWithOptions(t, srv, options)
+	if _, err := small.Get(ctx, []byte("small")); !errors.Is(err, _const.ErrorFrameTooLarge) {
+		t.Fatalf("response over the limit of the client: %v", err)
+	}
+}
+
+func TestMaxFrameFlagRange(t *testing.T) {
+	if value := os.Getenv("SMARTSTASH_TEST_MAX_FRAME"); value != "" {
+		// The child process runs main with the flag.
+		os.Args = []string{"smartstash-native", "-dir", t.TempDir(), "-addr", "127.0.0.1:0", "-max-frame", value}
+		main()
+		return
+	}
+	for _, value := range []string{"0", strconv.FormatUint(math.MaxUint32+1, 10)} {
+		// Without the check the server would start, it is killed after the timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestMaxFrameFlagRange$")
+		cmd.Env = append(os.Environ(), "SMARTSTASH_TEST_MAX_FRAME="+value)
+		output, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || !strings.Contains(string(output), "-max-frame must be between 1 and 4294967295") {
+			t.Fatalf("-max-frame %s: %v %s", value, err, output)
+		}
+	}
+}
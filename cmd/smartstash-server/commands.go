@@ -0,0 +1,607 @@
+package main
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serverName    = "smartstash"
+	serverVersion = "1.0.0"
+	// redisVersion is reported to the clients that check the features of the server.
+	redisVersion = "7.0.0"
+
+	// defaultScanCount is the number of keys a SCAN looks at without COUNT.
+	defaultScanCount = 10
+)
+
+// command is a command of the server, arity counts the name, a negative arity is a minimum.
+type command struct {
+	arity   int
+	handler func(c *conn, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":     {2, getCommand},
+		"set":     {-3, setCommand},
+		"del":     {-2, delCommand},
+		"exists":  {-2, existsCommand},
+		"mget":    {-2, mgetCommand},
+		"mset":    {-3, msetCommand},
+		"scan":    {-2, scanCommand},
+		"expire":  {3, expireCommand},
+		"pexpire": {3, expireCommand},
+		"ttl":     {2, ttlCommand},
+		"pttl":    {2, ttlCommand},
+		"ping":    {-1, pingCommand},
+		"echo":    {2, echoCommand},
+		"info":    {-1, infoCommand},
+		"hello":   {-1, helloCommand},
+		"client":  {-2, clientCommand},
+		"command": {-1, commandCommand},
+		"select":  {2, selectCommand},
+		"quit":    {-1, quitCommand},
+	}
+}
+
+var (
+	errSyntax      = errors.New("ERR syntax error")
+	errNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errInvalidTime = errors.New("ERR invalid expire time")
+)
+
+// writeStorageError reports an error of the database.
+func (c *conn) writeStorageError(err error) {
+	c.writer.writeError("ERR " + err.Error())
+}
+
+func parseInt(arg []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+// parseDuration converts an expire time given in units, it fails on overflow.
+func parseDuration(arg []byte, unit time.Duration) (time.Duration, error) {
+	n, err := parseInt(arg)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, errInvalidTime
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// update runs fn in an optimistic transaction until it commits without a conflict.
+func (c *conn) update(fn func(txn *storage.Txn) error) error {
+	for {
+		txn := c.server.db.BeginTxn()
+		if err := fn(txn); err != nil {
+			_ = txn.Rollback()
+			return err
+		}
+		err := txn.Commit(nil)
+		if !errors.Is(err, _const.ErrTxnConflict) {
+			return err
+		}
+	}
+}
+
+func getCommand(c *conn, args [][]byte) {
+	value, err := c.server.db.Get(string(args[1]))
+	if errors.Is(err, _const.ErrorKeyNotFound) {
+		c.writer.writeNull()
+		return
+	}
+	if err != nil {
+		c.writeStorageError(err)
+		return
+	}
+	c.writer.writeBulk(value)
+}
+
+// SET key value [NX | XX] [EX seconds | PX milliseconds]
+func setCommand(c *conn, args [][]byte) {
+	var (
+		nx, xx bool
+		ttl    time.Duration
+		hasTTL bool
+	)
+	for i := 3; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "nx" && !xx:
+			nx = true
+		case option == "xx" && !nx:
+			xx = true
+		case (option == "ex" || option == "px") && !hasTTL && i+1 < len(args):
+			unit := time.Second
+			if option == "px" {
+				unit = time.Millisecond
+			}
+			var err error
+			if ttl, err = parseDuration(args[i+1], unit); err != nil {
+				c.writer.writeError(err.Error())
+				return
+			}
+			if ttl <= 0 {
+				c.writer.writeError(errInvalidTime.Error() + " in 'set' command")
+				return
+			}
+			hasTTL = true
+			i++
+		default:
+			c.writer.writeError(errSyntax.Error())
+			return
+		}
+	}
+
+	key, value := args[1], args[2]
+	db := c.server.db
+	if !nx && !xx {
+		var err error
+		if hasTTL {
+			err = db.PutWithTTL(string(key), string(value), ttl, nil)
+		} else {
+			err = db.Put(string(key), string(value), nil)
+		}
+		if err != nil {
+			c.writeStorageError(err)
+			return
+		}
+		c.writer.writeOK()
+		return
+	}
+
+	written := false
+	err := c.update(func(txn *storage.Txn) error {
+		_, err := txn.Get(key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, _const.ErrorKeyNotFound) {
+			return err
+		}
+		written = exists == xx
+		if !written {
+			return nil
+		}
+		if hasTTL {
+			return txn.PutWithTTL(key, value, ttl)
+		}
+		return txn.Put(key, value)
+	})
+	switch {
+	case err != nil:
+		c.writeStorageError(err)
+	case written:
+		c.writer.writeOK()
+	default:
+		c.writer.writeNull()
+	}
+}
+
+func delCommand(c *conn, args [][]byte) {
+	var deleted int64
+	err := c.update(func(txn *storage.Txn) error {
+		deleted = 0
+		seen := make(map[string]bool)
+		for _, key := range args[1:] {
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			_, err := txn.Get(key)
+			if errors.Is(err, _const.ErrorKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		c.writeStorageError(err)
+		return
+	}
+	c.writer.writeInt(deleted)
+}
+
+func existsCommand(c *conn, args [][]byte) {
+	var count int64
+	for _, key := range args[1:] {
+		_, err := c.server.db.Get(string(key))
+		if errors.Is(err, _const.ErrorKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			c.writeStorageError(err)
+			return
+		}
+		count++
+	}
+	c.writer.writeInt(count)
+}
+
+func mgetCommand(c *conn, args [][]byte) {
+	values := make([][]byte, len(args)-1)
+	for i, key := range args[1:] {
+		value, err := c.server.db.Get(string(key))
+		if err != nil && !errors.Is(err, _const.ErrorKeyNotFound) {
+			c.writeStorageError(err)
+			return
+		}
+		values[i] = value
+	}
+	c.writer.writeArray(len(values))
+	for _, value := range values {
+		if value == nil {
+			c.writer.writeNull()
+			continue
+		}
+		c.writer.writeBulk(value)
+	}
+}
+
+func msetCommand(c *conn, args [][]byte) {
+	if len(args)%2 != 1 {
+		c.writer.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batch := c.server.db.NewBatch(storage.BatchOptions{})
+	for i := 1; i < len(args); i += 2 {
+		if err := batch.Put(args[i], args[i+1]); err != nil {
+			_ = batch.Rollback()
+			c.writeStorageError(err)
+			return
+		}
+	}
+	if err := batch.Commit(nil); err != nil {
+		c.writeStorageError(err)
+		return
+	}
+	c.writer.writeOK()
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(c *conn, args [][]byte) {
+	start, ok := decodeCursor(string(args[1]))
+	if !ok {
+		c.writer.writeError("ERR invalid cursor")
+		return
+	}
+	var (
+		pattern []byte
+		count   = int64(defaultScanCount)
+		onlyStr = true
+		err     error
+	)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.writer.writeError(errSyntax.Error())
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = parseInt(args[i+1]); err != nil || count < 1 {
+				c.writer.writeError(errSyntax.Error())
+				return
+			}
+		case "type":
+			// Every value is a string.
+			onlyStr = strings.EqualFold(string(args[i+1]), "string")
+		default:
+			c.writer.writeError(errSyntax.Error())
+			return
+		}
+	}
+
+	keys, next, err := scanKeys(c.server.db, start, pattern, int(count))
+	if err != nil {
+		c.writeStorageError(err)
+		return
+	}
+	if !onlyStr {
+		keys = nil
+	}
+	cursor := "0"
+	if next != nil {
+		cursor = encodeCursor(next)
+	}
+	c.writer.writeArray(2)
+	c.writer.writeBulkString(cursor)
+	c.writer.writeArray(len(keys))
+	for _, key := range keys {
+		c.writer.writeBulk(key)
+	}
+}
+
+// scanKeys looks at up to count keys from start on and returns the ones that match the
+// pattern, next is the first key that was not looked at, nil at the end.
+func scanKeys(db *storage.DB, start, pattern []byte, count int) (keys [][]byte, next []byte, err error) {
+	options := storage.IteratorOptions{KeysOnly: true, LowerBound: start}
+	// The keys that match a pattern with a literal prefix all start with it.
+	if prefix := globPrefix(pattern); len(prefix) > 0 {
+		if string(prefix) > string(start) {
+			options.LowerBound = prefix
+		}
+		options.UpperBound = storage.PrefixEnd(prefix)
+	}
+	it, err := db.NewIterator(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := 0
+	for it.Rewind(); it.Valid() && seen < count; it.Next() {
+		seen++
+		if pattern == nil || globMatch(pattern, it.Key()) {
+			keys = append(keys, append([]byte(nil), it.Key()...))
+		}
+	}
+	if it.Valid() {
+		next = append([]byte(nil), it.Key()...)
+	}
+	return keys, next, it.Close()
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds
+func expireCommand(c *conn, args [][]byte) {
+	unit := time.Second
+	if strings.EqualFold(string(args[0]), "pexpire") {
+		unit = time.Millisecond
+	}
+	ttl, err := parseDuration(args[2], unit)
+	if err != nil {
+		c.writer.writeError(err.Error())
+		return
+	}
+	key := args[1]
+	found := false
+	err = c.update(func(txn *storage.Txn) error {
+		value, err := txn.Get(key)
+		found = err == nil
+		if errors.Is(err, _const.ErrorKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// A time in the past deletes the key.
+		if ttl <= 0 {
+			return txn.Delete(key)
+		}
+		return txn.PutWithTTL(key, value, ttl)
+	})
+	if err != nil {
+		c.writeStorageError(err)
+		return
+	}
+	if found {
+		c.writer.writeInt(1)
+	} else {
+		c.writer.writeInt(0)
+	}
+}
+
+// TTL key, PTTL key: -2 for a missing key, -1 for a key without expiry.
+func ttlCommand(c *conn, args [][]byte) {
+	ttl, err := c.server.db.TTL(string(args[1]))
+	switch {
+	case errors.Is(err, _const.ErrorKeyNotFound):
+		c.writer.writeInt(-2)
+	case err != nil:
+		c.writeStorageError(err)
+	case ttl == storage.NoTTL:
+		c.writer.writeInt(-1)
+	case strings.EqualFold(string(args[0]), "pttl"):
+		c.writer.writeInt(int64((ttl + time.Millisecond/2) / time.Millisecond))
+	default:
+		c.writer.writeInt(int64((ttl + time.Second/2) / time.Second))
+	}
+}
+
+func pingCommand(c *conn, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.writer.writeSimple("PONG")
+	case 2:
+		c.writer.writeBulk(args[1])
+	default:
+		c.writer.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echoCommand(c *conn, args [][]byte) {
+	c.writer.writeBulk(args[1])
+}
+
+// INFO [section ...]
+func infoCommand(c *conn, args [][]byte) {
+	sections := make(map[string]bool)
+	for _, arg := range args[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	all := len(sections) == 0 || sections["all"] || sections["everything"] || sections["default"]
+	var b strings.Builder
+	section := func(name string, fields ...string) {
+		if !all && !sections[strings.ToLower(name)] {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + name + "\r\n")
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteString(fields[i] + ":" + fields[i+1] + "\r\n")
+		}
+	}
+
+	s := c.server
+	section("Server",
+		"redis_version", redisVersion,
+		"smartstash_version", serverVersion,
+		"redis_mode", "standalone",
+		"os", runtime.GOOS,
+		"arch_bits", strconv.Itoa(strconv.IntSize),
+		"go_version", runtime.Version(),
+		"process_id", strconv.Itoa(os.Getpid()),
+		"tcp_port", portOf(s.listener.Addr().String()),
+		"uptime_in_seconds", strconv.FormatInt(int64(time.Since(s.started)/time.Second), 10),
+	)
+	section("Clients",
+		"connected_clients", strconv.Itoa(s.connectedClients()),
+	)
+	section("Stats",
+		"total_connections_received", strconv.FormatInt(s.totalConnections.Load(), 10),
+		"total_commands_processed", strconv.FormatInt(s.totalCommands.Load(), 10),
+	)
+	if stats, err := s.db.Stats(); err == nil {
+		fields := []string{"seq", strconv.FormatUint(stats.Seq, 10)}
+		for _, family := range stats.ColumnFamilies {
+			prefix := "cf_" + family.Name + "_"
+			tables, bytes := 0, int64(0)
+			for _, level := range family.Levels {
+				tables += level.Tables
+				bytes += level.Bytes
+			}
+			fields = append(fields,
+				prefix+"memtables", strconv.Itoa(family.MemTables),
+				prefix+"memtable_bytes", strconv.FormatInt(family.MemTableBytes, 10),
+				prefix+"tables", strconv.Itoa(tables),
+				prefix+"table_bytes", strconv.FormatInt(bytes, 10),
+			)
+		}
+		fields = append(fields,
+			"value_log_segments", strconv.Itoa(stats.ValueLog.Segments),
+			"value_log_bytes", strconv.FormatInt(stats.ValueLog.Bytes, 10),
+		)
+		section("Storage", fields...)
+	}
+	c.writer.writeVerbatim(b.String())
+}
+
+func portOf(addr string) string {
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		return addr[i+1:]
+	}
+	return addr
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *conn, args [][]byte) {
+	proto := c.writer.proto
+	if len(args) > 1 {
+		version, err := parseInt(args[1])
+		if err != nil || (version != 2 && version != 3) {
+			c.writer.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = int(version)
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "auth":
+			// No authentication is configured, every user is accepted.
+			if i+2 >= len(args) {
+				c.writer.writeError(errSyntax.Error())
+				return
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				c.writer.writeError(errSyntax.Error())
+				return
+			}
+			c.name = string(args[i+1])
+			i++
+		default:
+			c.writer.writeError(errSyntax.Error())
+			return
+		}
+	}
+	c.writer.proto = proto
+
+	c.writer.writeMap(7)
+	c.writer.writeBulkString("server")
+	c.writer.writeBulkString(serverName)
+	c.writer.writeBulkString("version")
+	c.writer.writeBulkString(redisVersion)
+	c.writer.writeBulkString("proto")
+	c.writer.writeInt(int64(proto))
+	c.writer.writeBulkString("id")
+	c.writer.writeInt(c.id)
+	c.writer.writeBulkString("mode")
+	c.writer.writeBulkString("standalone")
+	c.writer.writeBulkString("role")
+	c.writer.writeBulkString("master")
+	c.writer.writeBulkString("modules")
+	c.writer.writeArray(0)
+}
+
+// CLIENT ID | GETNAME | SETNAME name | SETINFO attr value
+func clientCommand(c *conn, args [][]byte) {
+	switch sub := strings.ToLower(string(args[1])); {
+	case sub == "id" && len(args) == 2:
+		c.writer.writeInt(c.id)
+	case sub == "getname" && len(args) == 2:
+		if c.name == "" {
+			c.writer.writeNull()
+			return
+		}
+		c.writer.writeBulkString(c.name)
+	case sub == "setname" && len(args) == 3:
+		c.name = string(args[2])
+		c.writer.writeOK()
+	case sub == "setinfo" && len(args) == 4:
+		c.writer.writeOK()
+	default:
+		c.writer.writeError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", args[1]))
+	}
+}
+
+// COMMAND is answered with no command documentation.
+func commandCommand(c *conn, args [][]byte) {
+	if len(args) > 1 && strings.EqualFold(string(args[1]), "count") {
+		c.writer.writeInt(int64(len(commands)))
+		return
+	}
+	c.writer.writeArray(0)
+}
+
+// SELECT index, only the database 0 exists.
+func selectCommand(c *conn, args [][]byte) {
+	index, err := parseInt(args[1])
+	if err != nil {
+		c.writer.writeError(err.Error())
+		return
+	}
+	if index != 0 {
+		c.writer.writeError("ERR DB index is out of range")
+		return
+	}
+	c.writer.writeOK()
+}
+
+func quitCommand(c *conn, args [][]byte) {
+	c.quit = true
+	c.writer.writeOK()
+}
@@ -0,0 +1,29 @@
+package main
+
+import "math/big"
+
+// The cursors of SCAN carry the key the scan goes on from, so that a cursor can always be
+// resumed, by any connection and after a restart. A cursor is the decimal number of the
+// key behind a 1 byte, which keeps the leading zero bytes of the key, and 0 starts and ends
+// a scan, so the clients that expect numeric cursors keep working.
+
+// encodeCursor returns the cursor that resumes a scan at the key.
+func encodeCursor(key []byte) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// decodeCursor returns the key the cursor resumes at, nil for the cursor 0.
+func decodeCursor(cursor string) ([]byte, bool) {
+	n, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || n.Sign() < 0 {
+		return nil, false
+	}
+	if n.Sign() == 0 {
+		return nil, true
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return nil, false
+	}
+	return b[1:], true
+}
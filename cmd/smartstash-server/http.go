@@ -0,0 +1,527 @@
+package main
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxValueLength bounds the body of a PUT, as maxBulkLength bounds a RESP argument.
+	maxValueLength = maxBulkLength
+	// maxBatchLength bounds the JSON body of a batch.
+	maxBatchLength = 64 * 1024 * 1024
+	// scanFlushInterval is the number of scanned pairs sent to the client at once.
+	scanFlushInterval = 128
+)
+
+// The headers of the writes, every write is committed with the WriteOptions they give.
+// If-None-Match: * only creates the key and If-Match: * only replaces an existing one.
+const (
+	headerSync       = "X-Sync"
+	headerDisableWal = "X-Disable-WAL"
+	headerTTL        = "X-TTL"
+	headerIfMatch    = "If-Match"
+	headerIfNone     = "If-None-Match"
+)
+
+var (
+	errPreconditionFailed = errors.New("the precondition of the request failed")
+	errBadEncoding        = errors.New("the encoding must be utf8 or base64")
+	errNotUTF8            = errors.New("the data is not valid utf8, use the base64 encoding")
+	errBadBatchOp         = errors.New("the batch op must be put, delete or delete_range")
+)
+
+// badRequest is an invalid request, it is reported with 400.
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// httpServer serves a database over HTTP: the keys under /kv/, atomic batches from a JSON
+// body under /batch and the range and prefix scans under /scan as NDJSON.
+type httpServer struct {
+	db *storage.DB
+}
+
+func newHTTPHandler(db *storage.DB) http.Handler {
+	s := &httpServer{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key...}", s.get)
+	mux.HandleFunc("PUT /kv/{key...}", s.put)
+	mux.HandleFunc("DELETE /kv/{key...}", s.delete)
+	mux.HandleFunc("POST /batch", s.batch)
+	mux.HandleFunc("GET /scan", s.scan)
+	return mux
+}
+
+// statusOf maps an error of the database onto the status of the response.
+func statusOf(err error) int {
+	var bad badRequest
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &bad), errors.Is(err, _const.ErrorKeyIsEmpty),
+		errors.Is(err, _const.ErrorInvalidRange), errors.Is(err, errBadEncoding),
+		errors.Is(err, errBadBatchOp):
+		return http.StatusBadRequest
+	case errors.Is(err, _const.ErrorKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, _const.ErrTxnConflict):
+		return http.StatusConflict
+	case errors.Is(err, errPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errNotUTF8):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, _const.ErrorReadOnlyDB):
+		return http.StatusForbidden
+	case errors.As(err, &tooLarge), errors.Is(err, _const.ErrorDataToLarge),
+		errors.Is(err, _const.ErrorPendingSizeTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, _const.ErrorDBClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError reports the error as a JSON object with the status it maps onto.
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeOptions reads the WriteOptions of the request from its headers.
+func writeOptions(r *http.Request) (*storage.WriteOptions, error) {
+	options := &storage.WriteOptions{}
+	var err error
+	if options.Sync, err = boolHeader(r, headerSync); err != nil {
+		return nil, err
+	}
+	if options.DisableWal, err = boolHeader(r, headerDisableWal); err != nil {
+		return nil, err
+	}
+	if ttl := r.Header.Get(headerTTL); ttl != "" {
+		if options.TTL, err = parseTTL(ttl); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+func boolHeader(r *http.Request, name string) (bool, error) {
+	value := r.Header.Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, badRequest("invalid " + name + " header: " + value)
+	}
+	return b, nil
+}
+
+// parseTTL accepts a Go duration such as 1m30s or a number of seconds.
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, intErr := strconv.ParseInt(s, 10, 64)
+		if intErr != nil || seconds > int64(time.Duration(1<<63-1)/time.Second) {
+			return 0, badRequest("invalid ttl: " + s)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, badRequest("invalid ttl: " + s)
+	}
+	return ttl, nil
+}
+
+// precondition reads the If-Match and If-None-Match headers, only * is supported as no
+// versions of the keys are exposed.
+func precondition(r *http.Request) (mustExist, mustNotExist bool, err error) {
+	for _, h := range []string{headerIfMatch, headerIfNone} {
+		if value := r.Header.Get(h); value != "" && strings.TrimSpace(value) != "*" {
+			return false, false, badRequest("only * is supported in the " + h + " header")
+		}
+	}
+	return r.Header.Get(headerIfMatch) != "", r.Header.Get(headerIfNone) != "", nil
+}
+
+// update runs fn in an optimistic transaction until it commits without a conflict.
+func (s *httpServer) update(options *storage.WriteOptions, fn func(txn *storage.Txn) error) error {
+	for {
+		txn := s.db.BeginTxn()
+		if err := fn(txn); err != nil {
+			_ = txn.Rollback()
+			return err
+		}
+		err := txn.Commit(options)
+		if !errors.Is(err, _const.ErrTxnConflict) {
+			return err
+		}
+	}
+}
+
+// checkExists fails with errPreconditionFailed when the existence of the key does not match.
+func checkExists(txn *storage.Txn, key []byte, mustExist, mustNotExist bool) error {
+	_, err := txn.Get(key)
+	if err != nil && !errors.Is(err, _const.ErrorKeyNotFound) {
+		return err
+	}
+	exists := err == nil
+	if (mustExist && !exists) || (mustNotExist && exists) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// GET /kv/{key} returns the value as the body, the remaining time to live is in X-TTL.
+func (s *httpServer) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	// The value and its time to live are read from the same version of the key.
+	snapshot := s.db.NewSnapshot()
+	defer s.db.ReleaseSnapshot(snapshot)
+	options := &storage.ReadOptions{Snapshot: snapshot}
+	value, err := s.db.GetWithOptions(key, options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if ttl, err := s.db.TTLWithOptions(key, options); err == nil && ttl != storage.NoTTL {
+		w.Header().Set(headerTTL, strconv.FormatInt(int64(ttl.Round(time.Second)/time.Second), 10))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	_, _ = w.Write(value)
+}
+
+// PUT /kv/{key} writes the body as the value.
+func (s *httpServer) put(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	options, err := writeOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	mustExist, mustNotExist, err := precondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueLength))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !mustExist && !mustNotExist {
+		err = s.db.Put(key, string(value), options)
+	} else {
+		err = s.update(options, func(txn *storage.Txn) error {
+			if err := checkExists(txn, []byte(key), mustExist, mustNotExist); err != nil {
+				return err
+			}
+			return txn.Put([]byte(key), value)
+		})
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /kv/{key} deletes the key, deleting a missing key succeeds unless If-Match is given.
+func (s *httpServer) delete(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	options, err := writeOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	mustExist, mustNotExist, err := precondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !mustExist && !mustNotExist {
+		err = s.db.Delete(key, options)
+	} else {
+		err = s.update(options, func(txn *storage.Txn) error {
+			if err := checkExists(txn, key, mustExist, mustNotExist); err != nil {
+				return err
+			}
+			return txn.Delete(key)
+		})
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchRequest is the body of POST /batch, the keys and values are decoded as Encoding.
+type batchRequest struct {
+	Encoding string    `json:"encoding"`
+	Ops      []batchOp `json:"ops"`
+}
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// TTL is a Go duration or a number of seconds, it overrides the X-TTL header.
+	TTL string `json:"ttl"`
+	// Start and End are the range of delete_range, an omitted bound is open.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// POST /batch commits the ops of the body atomically.
+func (s *httpServer) batch(w http.ResponseWriter, r *http.Request) {
+	options, err := writeOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req batchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchLength))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if !errors.As(err, &tooLarge) {
+			err = badRequest("invalid batch: " + err.Error())
+		}
+		writeError(w, err)
+		return
+	}
+	decode, err := decoderOf(req.Encoding)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	batch := s.db.NewBatch(storage.BatchOptions{})
+	if err := addBatchOps(batch, req.Ops, decode); err != nil {
+		_ = batch.Rollback()
+		writeError(w, err)
+		return
+	}
+	if err := batch.Commit(options); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"written": len(req.Ops)})
+}
+
+func addBatchOps(batch *storage.Batch, ops []batchOp, decode func(string) ([]byte, error)) error {
+	for i, op := range ops {
+		fields := []string{op.Key, op.Value, op.Start, op.End}
+		decoded := make([][]byte, len(fields))
+		for j, field := range fields {
+			var err error
+			if decoded[j], err = decode(field); err != nil {
+				return badRequest("op " + strconv.Itoa(i) + ": " + err.Error())
+			}
+		}
+		key, value, start, end := decoded[0], decoded[1], decoded[2], decoded[3]
+
+		var err error
+		switch op.Op {
+		case "put":
+			if op.TTL == "" {
+				err = batch.Put(key, value)
+				break
+			}
+			var ttl time.Duration
+			if ttl, err = parseTTL(op.TTL); err == nil {
+				err = batch.PutWithTTL(key, value, ttl)
+			}
+		case "delete":
+			err = batch.Delete(key)
+		case "delete_range":
+			err = batch.DeleteRange(start, end)
+		default:
+			err = errBadBatchOp
+		}
+		if err != nil {
+			return badRequest("op " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// decoderOf returns the decoder of the keys and values of the encoding, utf8 by default.
+func decoderOf(encoding string) (func(string) ([]byte, error), error) {
+	switch encoding {
+	case "", "utf8":
+		return func(s string) ([]byte, error) { return []byte(s), nil }, nil
+	case "base64":
+		return base64.StdEncoding.DecodeString, nil
+	default:
+		return nil, errBadEncoding
+	}
+}
+
+// encoderOf returns the encoder of the keys and values of the encoding, utf8 by default.
+// The utf8 encoding fails on data that is not valid UTF-8, JSON would replace it.
+func encoderOf(encoding string) (func([]byte) (string, error), error) {
+	switch encoding {
+	case "", "utf8":
+		return func(b []byte) (string, error) {
+			if !utf8.Valid(b) {
+				return "", errNotUTF8
+			}
+			return string(b), nil
+		}, nil
+	case "base64":
+		return func(b []byte) (string, error) { return base64.StdEncoding.EncodeToString(b), nil }, nil
+	default:
+		return nil, errBadEncoding
+	}
+}
+
+// scanLine is a line of the NDJSON body of GET /scan, the last line carries the error that
+// stopped a scan that was already being sent.
+type scanLine struct {
+	Key   string  `json:"key,omitempty"`
+	Value *string `json:"value,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// GET /scan?start=&end=&prefix=&limit=&reverse=&keys_only=&encoding= streams the pairs
+// with start <= key < end that start with the prefix as NDJSON, in key order unless
+// reverse is given. The bounds are decoded as the encoding, as the returned pairs. A pair
+// the utf8 encoding can not carry fails the scan with 422 if it is the first one, and ends
+// the body with an error line otherwise.
+func (s *httpServer) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	encoding := query.Get("encoding")
+	decode, err := decoderOf(encoding)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	encode, _ := encoderOf(encoding)
+
+	var bounds [3][]byte
+	for i, name := range []string{"start", "end", "prefix"} {
+		if !query.Has(name) {
+			continue
+		}
+		if bounds[i], err = decode(query.Get(name)); err != nil {
+			writeError(w, badRequest("invalid "+name+": "+err.Error()))
+			return
+		}
+	}
+	options := storage.IteratorOptions{LowerBound: bounds[0], UpperBound: bounds[1]}
+	if prefix := bounds[2]; len(prefix) > 0 {
+		// The prefix narrows the range, the bigger lower bound and smaller upper bound win.
+		if options.LowerBound == nil || string(prefix) > string(options.LowerBound) {
+			options.LowerBound = prefix
+		}
+		if end := storage.PrefixEnd(prefix); end != nil &&
+			(options.UpperBound == nil || string(end) < string(options.UpperBound)) {
+			options.UpperBound = end
+		}
+	}
+	limit := 0
+	if query.Has("limit") {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 0 {
+			writeError(w, badRequest("invalid limit: "+query.Get("limit")))
+			return
+		}
+	}
+	for _, name := range []string{"reverse", "keys_only"} {
+		if !query.Has(name) {
+			continue
+		}
+		b, err := strconv.ParseBool(query.Get(name))
+		if query.Get(name) == "" {
+			b, err = true, nil
+		}
+		if err != nil {
+			writeError(w, badRequest("invalid "+name+": "+query.Get(name)))
+			return
+		}
+		if name == "reverse" {
+			options.Reverse = b
+		} else {
+			options.KeysOnly = b
+		}
+	}
+
+	it, err := s.db.NewIterator(options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// The status is only sent with the first line, so an error before it gets its own.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+
+	n := 0
+	for it.Rewind(); it.Valid() && (limit == 0 || n < limit); it.Next() {
+		line, err := encodeScanLine(encode, it.Key(), it.Value(), options.KeysOnly)
+		if err != nil {
+			_ = it.Close()
+			if n == 0 {
+				writeError(w, err)
+				return
+			}
+			_ = encoder.Encode(scanLine{Error: err.Error()})
+			_ = buf.Flush()
+			return
+		}
+		if err := encoder.Encode(line); err != nil {
+			break
+		}
+		if n++; n%scanFlushInterval == 0 {
+			if buf.Flush() != nil || r.Context().Err() != nil {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := it.Close(); err != nil {
+		_ = encoder.Encode(scanLine{Error: err.Error()})
+	}
+	_ = buf.Flush()
+}
+
+func encodeScanLine(encode func([]byte) (string, error), key, value []byte, keysOnly bool) (scanLine, error) {
+	var line scanLine
+	var err error
+	if line.Key, err = encode(key); err != nil {
+		return line, err
+	}
+	if !keysOnly {
+		encoded, err := encode(value)
+		if err != nil {
+			return line, err
+		}
+		line.Value = &encoded
+	}
+	return line, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startTestHTTPServer serves a new database over the HTTP API.
+func startTestHTTPServer(t *testing.T) (*httptest.Server, *storage.DB) {
+	t.Helper()
+	options := storage.DefaultOptions
+	options.DirPath = t.TempDir()
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newHTTPHandler(db))
+	t.Cleanup(func() {
+		ts.Close()
+		_ = db.Close()
+	})
+	return ts, db
+}
+
+// doHTTP sends the request and returns the status and the body of the response.
+func doHTTP(t *testing.T, method, url, body string, header map[string]string) (int, http.Header, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+func expectStatus(t *testing.T, want int, method, url, body string, header map[string]string) string {
+	t.Helper()
+	status, _, data := doHTTP(t, method, url, body, header)
+	if status != want {
+		t.Fatalf("%s %s: %d %s, want %d", method, url, status, data, want)
+	}
+	return data
+}
+
+func TestHTTPKeyValue(t *testing.T) {
+	ts, _ := startTestHTTPServer(t)
+	kv := ts.URL + "/kv/"
+	expectStatus(t, http.StatusNotFound, "GET", kv+"a", "", nil)
+	expectStatus(t, http.StatusNoContent, "PUT", kv+"a", "1", nil)
+	if body := expectStatus(t, http.StatusOK, "GET", kv+"a", "", nil); body != "1" {
+		t.Fatalf("GET a: %q", body)
+	}
+	// The key is the rest of the path.
+	expectStatus(t, http.StatusNoContent, "PUT", kv+"dir/file", "2", nil)
+	if body := expectStatus(t, http.StatusOK, "GET", kv+"dir/file", "", nil); body != "2" {
+		t.Fatalf("GET dir/file: %q", body)
+	}
+
+	expectStatus(t, http.StatusNoContent, "PUT", kv+"ttl", "3", map[string]string{headerTTL: "1m"})
+	_, header, _ := doHTTP(t, "GET", kv+"ttl", "", nil)
+	if ttl := header.Get(headerTTL); ttl != "60" && ttl != "59" {
+		t.Fatalf("X-TTL of a key written with 1m: %q", ttl)
+	}
+	if _, header, _ := doHTTP(t, "GET", kv+"a", "", nil); header.Get(headerTTL) != "" {
+		t.Fatalf("X-TTL of a key without expiry: %q", header.Get(headerTTL))
+	}
+	expectStatus(t, http.StatusBadRequest, "PUT", kv+"a", "1", map[string]string{headerTTL: "-5"})
+	expectStatus(t, http.StatusBadRequest, "PUT", kv+"a", "1", map[string]string{headerSync: "maybe"})
+
+	// If-None-Match: * only creates the key, If-Match: * only replaces it.
+	expectStatus(t, http.StatusPreconditionFailed, "PUT", kv+"a", "4", map[string]string{headerIfNone: "*"})
+	expectStatus(t, http.StatusNoContent, "PUT", kv+"a", "4", map[string]string{headerIfMatch: "*"})
+	expectStatus(t, http.StatusPreconditionFailed, "PUT", kv+"b", "5", map[string]string{headerIfMatch: "*"})
+	expectStatus(t, http.StatusNoContent, "PUT", kv+"b", "5", map[string]string{headerIfNone: "*"})
+	expectStatus(t, http.StatusBadRequest, "PUT", kv+"b", "5", map[string]string{headerIfMatch: `"v1"`})
+	if body := expectStatus(t, http.StatusOK, "GET", kv+"a", "", nil); body != "4" {
+		t.Fatalf("GET a after If-Match: %q", body)
+	}
+
+	expectStatus(t, http.StatusNoContent, "DELETE", kv+"a", "", nil)
+	expectStatus(t, http.StatusNotFound, "GET", kv+"a", "", nil)
+	expectStatus(t, http.StatusNoContent, "DELETE", kv+"a", "", nil)
+	expectStatus(t, http.StatusPreconditionFailed, "DELETE", kv+"a", "", map[string]string{headerIfMatch: "*"})
+	expectStatus(t, http.StatusBadRequest, "PUT", kv, "6", nil)
+}
+
+func TestHTTPBatch(t *testing.T) {
+	ts, db := startTestHTTPServer(t)
+	for _, key := range []string{"r1", "r2", "r3", "s"} {
+		if err := db.Put(key, "old", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := `{"ops": [
+		{"op": "put", "key": "a", "value": "1"},
+		{"op": "put", "key": "b", "value": "2", "ttl": "1h"},
+		{"op": "delete", "key": "s"},
+		{"op": "delete_range", "start": "r", "end": "r3"}
+	]}`
+	if got := expectStatus(t, http.StatusOK, "POST", ts.URL+"/batch", body, nil); strings.TrimSpace(got) != `{"written":4}` {
+		t.Fatalf("batch reply %s", got)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "r3": "old"} {
+		if got := expectStatus(t, http.StatusOK, "GET", ts.URL+"/kv/"+key, "", nil); got != want {
+			t.Fatalf("GET %s: %q, want %q", key, got, want)
+		}
+	}
+	for _, key := range []string{"s", "r1", "r2"} {
+		expectStatus(t, http.StatusNotFound, "GET", ts.URL+"/kv/"+key, "", nil)
+	}
+
+	binary := base64.StdEncoding.EncodeToString([]byte{0, 0xff})
+	body = `{"encoding": "base64", "ops": [{"op": "put", "key": "` + binary + `", "value": "` + binary + `"}]}`
+	expectStatus(t, http.StatusOK, "POST", ts.URL+"/batch", body, nil)
+	if value, err := db.Get(string([]byte{0, 0xff})); err != nil || string(value) != string([]byte{0, 0xff}) {
+		t.Fatalf("binary key: %q %v", value, err)
+	}
+
+	// A bad op fails the whole batch.
+	for _, body := range []string{
+		`{"ops": [{"op": "put", "key": "c", "value": "3"}, {"op": "rename", "key": "a"}]}`,
+		`{"ops": [{"op": "put", "key": "c", "value": "3"}, {"op": "put", "key": ""}]}`,
+		`{"ops": [{"op": "put", "key": "c", "value": "3", "ttl": "soon"}]}`,
+		`{"ops": [{"op": "put", "key": "c", "value": "3", "extra": 1}]}`,
+		`{"encoding": "hex", "ops": [{"op": "put", "key": "c", "value": "3"}]}`,
+		`{"ops": [`,
+	} {
+		expectStatus(t, http.StatusBadRequest, "POST", ts.URL+"/batch", body, nil)
+	}
+	expectStatus(t, http.StatusNotFound, "GET", ts.URL+"/kv/c", "", nil)
+}
+
+// scanHTTP runs the scan and returns its lines.
+func scanHTTP(t *testing.T, ts *httptest.Server, query url.Values) []scanLine {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/scan?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("scan %s: %d %s", query.Encode(), resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var lines []scanLine
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line scanLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("scan line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func scanKeysOf(lines []scanLine) []string {
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		keys[i] = line.Key
+	}
+	return keys
+}
+
+func TestHTTPScan(t *testing.T) {
+	ts, db := startTestHTTPServer(t)
+	for i := 0; i < 300; i++ {
+		for _, prefix := range []string{"a:", "b:"} {
+			key := prefix + strconv.Itoa(1000+i)
+			if err := db.Put(key, "v"+key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// More pairs than are flushed at once.
+	lines := scanHTTP(t, ts, url.Values{"prefix": {"b:"}})
+	if len(lines) != 300 || lines[0].Key != "b:1000" || *lines[0].Value != "vb:1000" || lines[299].Key != "b:1299" {
+		t.Fatalf("prefix scan returned %d lines", len(lines))
+	}
+	lines = scanHTTP(t, ts, url.Values{"start": {"a:1100"}, "end": {"a:1103"}})
+	if keys := scanKeysOf(lines); !reflect.DeepEqual(keys, []string{"a:1100", "a:1101", "a:1102"}) {
+		t.Fatalf("range scan returned %q", keys)
+	}
+	// The prefix narrows the range.
+	lines = scanHTTP(t, ts, url.Values{"start": {"a:1298"}, "prefix": {"b:"}, "limit": {"2"}})
+	if keys := scanKeysOf(lines); !reflect.DeepEqual(keys, []string{"b:1000", "b:1001"}) {
+		t.Fatalf("scan with a prefix past the start returned %q", keys)
+	}
+	lines = scanHTTP(t, ts, url.Values{"prefix": {"a:"}, "reverse": {""}, "keys_only": {"true"}, "limit": {"2"}})
+	if keys := scanKeysOf(lines); !reflect.DeepEqual(keys, []string{"a:1299", "a:1298"}) || lines[0].Value != nil {
+		t.Fatalf("reverse scan of the keys returned %+v", lines)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("b:1299"))
+	lines = scanHTTP(t, ts, url.Values{"encoding": {"base64"}, "start": {encoded}})
+	if len(lines) != 1 || lines[0].Key != encoded {
+		t.Fatalf("base64 scan returned %+v", lines)
+	}
+
+	for _, query := range []string{"limit=-1", "reverse=sometimes", "encoding=hex", "encoding=base64&start=!"} {
+		expectStatus(t, http.StatusBadRequest, "GET", ts.URL+"/scan?"+query, "", nil)
+	}
+}
+
+func TestHTTPScanRefusesBinaryDataInUTF8(t *testing.T) {
+	ts, db := startTestHTTPServer(t)
+	for _, key := range []string{"a", "b", "c\xff", "d"} {
+		if err := db.Put(key, "v", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("e", "\xfe", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The status is still to be sent when the first pair fails.
+	expectStatus(t, http.StatusUnprocessableEntity, "GET", ts.URL+"/scan?start=c", "", nil)
+	expectStatus(t, http.StatusUnprocessableEntity, "GET", ts.URL+"/scan?start=e", "", nil)
+	lines := scanHTTP(t, ts, url.Values{"start": {"e"}, "keys_only": {"true"}})
+	if len(lines) != 1 || lines[0].Key != "e" {
+		t.Fatalf("keys only scan of a binary value: %+v", lines)
+	}
+
+	lines = scanHTTP(t, ts, url.Values{})
+	if len(lines) != 3 || lines[1].Key != "b" || lines[2].Error == "" {
+		t.Fatalf("scan reaching a binary key: %+v", lines)
+	}
+	lines = scanHTTP(t, ts, url.Values{"encoding": {"base64"}})
+	if len(lines) != 5 || lines[2].Key != base64.StdEncoding.EncodeToString([]byte("c\xff")) {
+		t.Fatalf("base64 scan: %+v", lines)
+	}
+}
+
+func TestHTTPReadOnlyDatabase(t *testing.T) {
+	options := storage.DefaultOptions
+	options.DirPath = t.TempDir()
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	options.ReadOnly = true
+	if db, err = storage.OpenDB(options); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newHTTPHandler(db))
+	defer func() {
+		ts.Close()
+		_ = db.Close()
+	}()
+
+	if body := expectStatus(t, http.StatusOK, "GET", ts.URL+"/kv/a", "", nil); body != "1" {
+		t.Fatalf("GET a: %q", body)
+	}
+	expectStatus(t, http.StatusForbidden, "PUT", ts.URL+"/kv/a", "2", nil)
+	expectStatus(t, http.StatusForbidden, "DELETE", ts.URL+"/kv/a", "", nil)
+	expectStatus(t, http.StatusForbidden, "POST", ts.URL+"/batch", `{"ops": [{"op": "put", "key": "b", "value": "2"}]}`, nil)
+}
@@ -0,0 +1,115 @@
+// Command smartstash-server serves a SmartStashDB database over the Redis protocol, RESP2
+// and RESP3, so that redis-cli and the Redis client libraries can use it, and over an
+// HTTP/JSON API when -http is given.
+package main
+
+import (
+	"SmartStashDB/storage"
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds the wait for the HTTP requests in flight on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	var (
+		addr     = flag.String("addr", ":6379", "the address of the Redis protocol, empty disables it")
+		httpAddr = flag.String("http", "", "the address of the HTTP API, empty disables it")
+		dir      = flag.String("dir", "data", "the directory of the database")
+		syncWal  = flag.Bool("sync", false, "sync the WAL on every write")
+	)
+	flag.Parse()
+	if *addr == "" && *httpAddr == "" {
+		log.Fatalf("nothing to serve, both -addr and -http are empty")
+	}
+
+	options := storage.DefaultOptions
+	options.DirPath = *dir
+	options.Sync = *syncWal
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		log.Fatalf("open the database: %v", err)
+	}
+
+	var (
+		srv     *server
+		httpSrv *http.Server
+		servers []func() error
+	)
+	if *addr != "" {
+		listener, err := net.Listen("tcp", *addr)
+		if err != nil {
+			_ = db.Close()
+			log.Fatalf("listen on %s: %v", *addr, err)
+		}
+		srv = newServer(db, listener)
+		log.Printf("serving %s over the Redis protocol on %s", *dir, listener.Addr())
+		servers = append(servers, srv.serve)
+	}
+	if *httpAddr != "" {
+		listener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			if srv != nil {
+				srv.close()
+			}
+			_ = db.Close()
+			log.Fatalf("listen on %s: %v", *httpAddr, err)
+		}
+		httpSrv = &http.Server{Handler: newHTTPHandler(db), ReadHeaderTimeout: 10 * time.Second}
+		log.Printf("serving %s over HTTP on %s", *dir, listener.Addr())
+		servers = append(servers, func() error {
+			if err := httpSrv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			if srv != nil {
+				srv.close()
+			}
+			if httpSrv != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				_ = httpSrv.Shutdown(ctx)
+			}
+		})
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdown()
+	}()
+
+	// A server that fails stops the others, the database is closed once all of them returned.
+	var wg sync.WaitGroup
+	for _, serve := range servers {
+		wg.Add(1)
+		go func(serve func() error) {
+			defer wg.Done()
+			if err := serve(); err != nil {
+				log.Printf("serve: %v", err)
+				shutdown()
+			}
+		}(serve)
+	}
+	wg.Wait()
+	shutdown()
+	if err := db.Close(); err != nil {
+		log.Fatalf("close the database: %v", err)
+	}
+}
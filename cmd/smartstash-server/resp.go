@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLength and maxArrayLength bound the size of a request, as the defaults of Redis.
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+	// maxInlineLength bounds a command sent as a plain line, as by telnet.
+	maxInlineLength = 64 * 1024
+	// bulkReadSize is the initial buffer of a bulk string, it grows as the bulk arrives so
+	// that a client can not make the server allocate a bulk it never sends.
+	bulkReadSize = 64 * 1024
+)
+
+// protocolError is a malformed request, the connection is closed after it is reported.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// respReader reads the commands of a connection, either RESP arrays of bulk strings or
+// inline commands separated by spaces.
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRespReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// buffered reports whether the next command was already received, the replies are only
+// flushed once the pipelined commands are answered.
+func (r *respReader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// readCommand returns the arguments of the next command, it skips empty inline lines and
+// empty arrays.
+func (r *respReader) readCommand() ([][]byte, error) {
+	for {
+		prefix, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if prefix[0] == '*' {
+			args, err := r.readArray()
+			if err != nil || len(args) > 0 {
+				return args, err
+			}
+			continue
+		}
+		line, err := r.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			continue
+		}
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+		return args, nil
+	}
+}
+
+// readArray reads an array of bulk strings, an empty or null array has no arguments.
+func (r *respReader) readArray() ([][]byte, error) {
+	line, err := r.readLine(maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArrayLength {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	// The arguments are allocated as they arrive, like the bulks.
+	args := make([][]byte, 0, min(n, 1024))
+	for len(args) < n {
+		line, err := r.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$'")
+		}
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		var buf bytes.Buffer
+		buf.Grow(min(length+2, bulkReadSize))
+		if _, err := buf.ReadFrom(io.LimitReader(r.r, int64(length)+2)); err != nil {
+			return nil, err
+		}
+		if buf.Len() < length+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		arg := buf.Bytes()
+		if arg[length] != '\r' || arg[length+1] != '\n' {
+			return nil, protocolError("invalid bulk terminator")
+		}
+		args = append(args, arg[:length])
+	}
+	return args, nil
+}
+
+// readLine returns the next line without its CRLF, a bare LF is accepted too.
+func (r *respReader) readLine(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if len(line) > limit {
+			return nil, protocolError("too big inline request")
+		}
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// respWriter writes the replies of a connection in the protocol version chosen by HELLO,
+// the RESP3 types are written as their RESP2 equivalents for a RESP2 client.
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriterSize(w, 64*1024), proto: 2}
+}
+
+func (w *respWriter) flush() error {
+	return w.w.Flush()
+}
+
+func (w *respWriter) writeLine(prefix byte, s string) {
+	_ = w.w.WriteByte(prefix)
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) writeSimple(s string) {
+	w.writeLine('+', s)
+}
+
+func (w *respWriter) writeOK() {
+	w.writeSimple("OK")
+}
+
+// writeError writes an error reply, msg starts with the error code such as ERR.
+func (w *respWriter) writeError(msg string) {
+	w.writeLine('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+func (w *respWriter) writeInt(n int64) {
+	w.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+func (w *respWriter) writeBulk(b []byte) {
+	w.writeLine('$', strconv.Itoa(len(b)))
+	_, _ = w.w.Write(b)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+func (w *respWriter) writeBulkString(s string) {
+	w.writeBulk([]byte(s))
+}
+
+func (w *respWriter) writeNull() {
+	if w.proto == 3 {
+		_, _ = w.w.WriteString("_\r\n")
+		return
+	}
+	_, _ = w.w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) writeArray(n int) {
+	w.writeLine('*', strconv.Itoa(n))
+}
+
+// writeMap starts a map of n pairs, a flat array of keys and values in RESP2.
+func (w *respWriter) writeMap(n int) {
+	if w.proto == 3 {
+		w.writeLine('%', strconv.Itoa(n))
+		return
+	}
+	w.writeArray(2 * n)
+}
+
+// writeVerbatim writes a text for humans, a bulk string in RESP2.
+func (w *respWriter) writeVerbatim(s string) {
+	if w.proto == 3 {
+		w.writeLine('=', strconv.Itoa(len(s)+4))
+		_, _ = w.w.WriteString("txt:")
+		_, _ = w.w.WriteString(s)
+		_, _ = w.w.WriteString("\r\n")
+		return
+	}
+	w.writeBulkString(s)
+}
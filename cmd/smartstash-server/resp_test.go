@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestEmptyArraysAreSkipped(t *testing.T) {
+	// Every empty array must not take a stack frame.
+	defer debug.SetMaxStack(debug.SetMaxStack(8 * 1024 * 1024))
+	request := strings.Repeat("*0\r\n*-1\r\n", 1<<19) + "*1\r\n$4\r\nPING\r\n"
+	args, err := newRespReader(strings.NewReader(request)).readCommand()
+	if err != nil || len(args) != 1 || string(args[0]) != "PING" {
+		t.Fatalf("command after the empty arrays: %q %v", args, err)
+	}
+}
+
+func TestBulksAreReadAsTheyArrive(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), 100*1024)
+	request := "*2\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n"
+	r := newRespReader(iotest.HalfReader(strings.NewReader(request)))
+	args, err := r.readCommand()
+	if err != nil || len(args) != 2 || string(args[0]) != "SET" || !bytes.Equal(args[1], value) {
+		t.Fatalf("command with a large bulk: %d arguments, %v", len(args), err)
+	}
+}
+
+func TestAnnouncedBulkIsNotAllocated(t *testing.T) {
+	request := "*1\r\n$" + strconv.Itoa(maxBulkLength) + "\r\nshort"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := newRespReader(strings.NewReader(request)).readCommand()
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated bulk: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Fatalf("%d bytes allocated for a bulk of 5 bytes", allocated)
+	}
+}
+
+func TestArgumentsAreNotPreallocated(t *testing.T) {
+	request := "*" + strconv.Itoa(maxArrayLength) + "\r\n$3\r\nGET\r\n"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := newRespReader(strings.NewReader(request)).readCommand()
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("truncated array: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Fatalf("%d bytes allocated for an array of 1 argument", allocated)
+	}
+}
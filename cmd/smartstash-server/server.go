@@ -0,0 +1,150 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// server serves a database over the Redis protocol, every connection has its own goroutine.
+type server struct {
+	db       *storage.DB
+	listener net.Listener
+	started  time.Time
+
+	mu     sync.Mutex
+	conns  map[*conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	nextClientId     atomic.Int64
+	totalConnections atomic.Int64
+	totalCommands    atomic.Int64
+}
+
+func newServer(db *storage.DB, listener net.Listener) *server {
+	return &server{
+		db:       db,
+		listener: listener,
+		started:  time.Now(),
+		conns:    make(map[*conn]struct{}),
+	}
+}
+
+// serve accepts connections until the server is closed.
+func (s *server) serve() error {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		c := &conn{
+			server: s,
+			nc:     nc,
+			id:     s.nextClientId.Add(1),
+			reader: newRespReader(nc),
+			writer: newRespWriter(nc),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = nc.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		s.totalConnections.Add(1)
+		go c.serve()
+	}
+}
+
+// close stops accepting connections, closes the open ones and waits for their goroutines.
+func (s *server) close() {
+	s.mu.Lock()
+	s.closed = true
+	_ = s.listener.Close()
+	for c := range s.conns {
+		_ = c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *server) connectedClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// conn is a client connection, its commands are answered in order.
+type conn struct {
+	server *server
+	nc     net.Conn
+	id     int64
+	name   string
+	reader *respReader
+	writer *respWriter
+	// quit closes the connection once the reply of QUIT is written.
+	quit bool
+}
+
+func (c *conn) serve() {
+	defer func() {
+		_ = c.nc.Close()
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+		c.server.wg.Done()
+	}()
+
+	for {
+		args, err := c.reader.readCommand()
+		if err != nil {
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				c.writer.writeError("ERR " + protoErr.Error())
+				_ = c.writer.flush()
+			}
+			return
+		}
+		c.server.totalCommands.Add(1)
+		c.execute(args)
+		// The replies of pipelined commands are sent together.
+		if !c.reader.buffered() || c.quit {
+			if err := c.writer.flush(); err != nil || c.quit {
+				return
+			}
+		}
+	}
+}
+
+// execute runs the command and writes its reply.
+func (c *conn) execute(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.writer.writeError("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.writer.writeError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	cmd.handler(c, args)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respError is an error reply read by the test client.
+type respError string
+
+// testClient sends commands to a test server and parses its replies: simple strings and
+// verbatim texts as string, bulks as []byte, nulls as nil, maps as flat []any.
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func startTestServer(t *testing.T) *server {
+	t.Helper()
+	srv, _ := startTestServerIn(t, t.TempDir())
+	return srv
+}
+
+// startTestServerIn serves the database in dir, the returned function stops the server
+// and closes the database before the end of the test.
+func startTestServerIn(t *testing.T, dir string) (*server, func()) {
+	t.Helper()
+	options := storage.DefaultOptions
+	options.DirPath = dir
+	db, err := storage.OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = db.Close()
+		t.Fatal(err)
+	}
+	srv := newServer(db, listener)
+	go func() {
+		_ = srv.serve()
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			srv.close()
+			_ = db.Close()
+		})
+	}
+	t.Cleanup(stop)
+	return srv, stop
+}
+
+func dialTestServer(t *testing.T, srv *server) *testClient {
+	t.Helper()
+	nc, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = nc.Close()
+	})
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+// encodeCommand encodes the arguments as a RESP array of bulk strings.
+func encodeCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func (c *testClient) send(data string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.nc, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	c.send(encodeCommand(args...))
+	return c.read()
+}
+
+func (c *testClient) read() any {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read a reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	prefix, rest := line[0], line[1:]
+	switch prefix {
+	case '+':
+		return rest
+	case '-':
+		return respError(rest)
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			c.t.Fatalf("integer reply %q", line)
+		}
+		return n
+	case '_':
+		return nil
+	case '$', '=':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			c.t.Fatalf("bulk reply %q", line)
+		}
+		if n < 0 {
+			return nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			c.t.Fatal(err)
+		}
+		if prefix == '=' {
+			return string(data[:n])
+		}
+		return data[:n]
+	case '*', '%':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			c.t.Fatalf("aggregate reply %q", line)
+		}
+		if prefix == '%' {
+			n *= 2
+		}
+		if n < 0 {
+			return nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("unknown reply %q", line)
+	return nil
+}
+
+// expect sends the command and checks its reply, a bulk reply is compared as a string.
+func (c *testClient) expect(want any, args ...string) {
+	c.t.Helper()
+	got := c.do(args...)
+	if b, ok := got.([]byte); ok {
+		got = string(b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%q: %#v, want %#v", args, got, want)
+	}
+}
+
+// expectError sends the command and checks that the error reply starts with the prefix.
+func (c *testClient) expectError(prefix string, args ...string) {
+	c.t.Helper()
+	got, ok := c.do(args...).(respError)
+	if !ok || !strings.HasPrefix(string(got), prefix) {
+		c.t.Fatalf("%q: %#v, want an error starting with %q", args, got, prefix)
+	}
+}
+
+func TestStringCommands(t *testing.T) {
+	c := dialTestServer(t, startTestServer(t))
+	c.expect("PONG", "PING")
+	c.expect("hello", "ECHO", "hello")
+	c.expect(nil, "GET", "a")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("1", "GET", "a")
+
+	// NX only sets a missing key, XX only an existing one.
+	c.expect(nil, "SET", "a", "2", "NX")
+	c.expect("OK", "SET", "a", "2", "XX")
+	c.expect(nil, "SET", "b", "2", "XX")
+	c.expect("OK", "SET", "b", "2", "NX")
+	c.expectError("ERR syntax error", "SET", "a", "1", "NX", "XX")
+
+	c.expect("OK", "MSET", "c", "3", "d", "4")
+	c.expectError("ERR wrong number of arguments", "MSET", "c", "3", "d")
+	got := c.do("MGET", "a", "missing", "d")
+	want := []any{[]byte("2"), nil, []byte("4")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MGET: %#v", got)
+	}
+	c.expect(int64(3), "EXISTS", "a", "b", "a", "missing")
+	c.expect(int64(2), "DEL", "a", "b", "a", "missing")
+	c.expect(nil, "GET", "a")
+
+	c.expectError("ERR unknown command", "NOSUCH")
+	c.expectError("ERR wrong number of arguments for 'get'", "GET")
+	c.expect("OK", "SELECT", "0")
+	c.expectError("ERR DB index is out of range", "SELECT", "1")
+}
+
+func TestExpiryCommands(t *testing.T) {
+	c := dialTestServer(t, startTestServer(t))
+	c.expect(int64(-2), "TTL", "key")
+	c.expect("OK", "SET", "key", "value")
+	c.expect(int64(-1), "TTL", "key")
+
+	c.expect("OK", "SET", "key", "value", "EX", "100")
+	if ttl := c.do("TTL", "key").(int64); ttl < 99 || ttl > 100 {
+		t.Fatalf("TTL %d", ttl)
+	}
+	c.expect(int64(1), "PEXPIRE", "key", "50000")
+	if pttl := c.do("PTTL", "key").(int64); pttl <= 40000 || pttl > 50000 {
+		t.Fatalf("PTTL %d", pttl)
+	}
+	c.expect("value", "GET", "key")
+	c.expect(int64(0), "EXPIRE", "missing", "10")
+	c.expectError("ERR invalid expire time", "SET", "key", "value", "EX", "0")
+
+	// A time in the past deletes the key.
+	c.expect(int64(1), "EXPIRE", "key", "-1")
+	c.expect(nil, "GET", "key")
+
+	c.expect("OK", "SET", "short", "value", "PX", "20")
+	time.Sleep(50 * time.Millisecond)
+	c.expect(nil, "GET", "short")
+	c.expect(int64(-2), "PTTL", "short")
+}
+
+// scanAll runs SCAN until the cursor comes back to 0 and returns the sorted keys.
+func scanAll(c *testClient, args ...string) []string {
+	c.t.Helper()
+	var keys []string
+	cursor := "0"
+	for {
+		reply, ok := c.do(append([]string{"SCAN", cursor}, args...)...).([]any)
+		if !ok || len(reply) != 2 {
+			c.t.Fatalf("SCAN reply %#v", reply)
+		}
+		for _, key := range reply[1].([]any) {
+			keys = append(keys, string(key.([]byte)))
+		}
+		cursor = string(reply[0].([]byte))
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestScanVisitsEveryKey(t *testing.T) {
+	c := dialTestServer(t, startTestServer(t))
+	var users, all []string
+	for i := 0; i < 50; i++ {
+		for _, prefix := range []string{"user:", "item:"} {
+			key := fmt.Sprintf("%s%02d", prefix, i)
+			c.expect("OK", "SET", key, "v")
+			all = append(all, key)
+			if prefix == "user:" {
+				users = append(users, key)
+			}
+		}
+	}
+	sort.Strings(all)
+
+	if keys := scanAll(c, "COUNT", "7"); !reflect.DeepEqual(keys, all) {
+		t.Fatalf("SCAN returned %d of %d keys", len(keys), len(all))
+	}
+	if keys := scanAll(c, "MATCH", "user:*", "COUNT", "7"); !reflect.DeepEqual(keys, users) {
+		t.Fatalf("SCAN MATCH returned %q", keys)
+	}
+	if keys := scanAll(c, "MATCH", "*:1?"); len(keys) != 20 {
+		t.Fatalf("SCAN MATCH *:1? returned %q", keys)
+	}
+	if keys := scanAll(c, "TYPE", "hash"); len(keys) != 0 {
+		t.Fatalf("SCAN TYPE hash returned %q", keys)
+	}
+	c.expectError("ERR invalid cursor", "SCAN", "abc")
+	c.expectError("ERR syntax error", "SCAN", "0", "COUNT", "0")
+}
+
+func TestHelloSwitchesTheProtocol(t *testing.T) {
+	c := dialTestServer(t, startTestServer(t))
+	c.send("*1\r\n$3\r\nGET\r\n")
+	if reply, ok := c.read().(respError); !ok {
+		t.Fatalf("GET without a key: %#v", reply)
+	}
+
+	c.send(encodeCommand("HELLO", "3", "SETNAME", "tester"))
+	if line, _ := c.r.Peek(1); line[0] != '%' {
+		t.Fatalf("HELLO 3 replied with %q, want a map", line)
+	}
+	reply := c.read().([]any)
+	fields := make(map[string]any)
+	for i := 0; i < len(reply); i += 2 {
+		fields[string(reply[i].([]byte))] = reply[i+1]
+	}
+	if fields["proto"] != int64(3) || string(fields["server"].([]byte)) != serverName {
+		t.Fatalf("HELLO 3: %#v", fields)
+	}
+	c.expect("tester", "CLIENT", "GETNAME")
+
+	// RESP3 has its own null.
+	c.send(encodeCommand("GET", "missing"))
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Fatalf("null in RESP3: %q", line)
+	}
+	c.expectError("NOPROTO", "HELLO", "4")
+
+	// Back in RESP2 the map is an array and the null a null bulk.
+	if reply := c.do("HELLO", "2").([]any); len(reply) != 14 || reply[5] != int64(2) {
+		t.Fatalf("HELLO 2: %#v", reply)
+	}
+	c.send(encodeCommand("GET", "missing"))
+	if line, _ := c.r.ReadString('\n'); line != "$-1\r\n" {
+		t.Fatalf("null in RESP2: %q", line)
+	}
+}
+
+func TestPipelinedAndInlineCommands(t *testing.T) {
+	c := dialTestServer(t, startTestServer(t))
+	c.send(encodeCommand("SET", "a", "1") + "\r\nGET a\r\n" + encodeCommand("PING", "pipelined") + "*0\r\nQUIT\r\n")
+	for _, want := range []any{"OK", "1", "pipelined", "OK"} {
+		got := c.read()
+		if b, ok := got.([]byte); ok {
+			got = string(b)
+		}
+		if got != want {
+			t.Fatalf("pipelined reply %#v, want %#v", got, want)
+		}
+	}
+	// QUIT closes the connection once its reply is sent.
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after QUIT: %v", err)
+	}
+}
+
+func TestProtocolErrorClosesTheConnection(t *testing.T) {
+	srv := startTestServer(t)
+	for _, request := range []string{"*abc\r\n", "*1\r\n+GET\r\n", "*1\r\n$3\r\nGETxx"} {
+		c := dialTestServer(t, srv)
+		c.send(request)
+		reply, ok := c.read().(respError)
+		if !ok || !strings.HasPrefix(string(reply), "ERR Protocol error") {
+			t.Fatalf("%q: %#v", request, reply)
+		}
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Fatalf("%q: the connection is still open: %v", request, err)
+		}
+	}
+}
+
+func TestScanCursorOutlivesTheServer(t *testing.T) {
+	dir := t.TempDir()
+	srv, stop := startTestServerIn(t, dir)
+	c := dialTestServer(t, srv)
+	for i := 0; i < 20; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("key-%02d", i), "v")
+	}
+	reply := c.do("SCAN", "0", "COUNT", "5").([]any)
+	cursor := string(reply[0].([]byte))
+	keys := len(reply[1].([]any))
+	stop()
+
+	// The cursor holds the key to resume at, a new server goes on where the old one stopped.
+	srv, _ = startTestServerIn(t, dir)
+	c = dialTestServer(t, srv)
+	for cursor != "0" {
+		reply := c.do("SCAN", cursor, "COUNT", "5").([]any)
+		cursor = string(reply[0].([]byte))
+		keys += len(reply[1].([]any))
+	}
+	if keys != 20 {
+		t.Fatalf("the scan returned %d of 20 keys", keys)
+	}
+}
+
+func TestCursorKeepsTheKey(t *testing.T) {
+	for _, key := range [][]byte{{0}, {0, 0, 'a'}, []byte("key"), {0xff, 0xff}} {
+		cursor := encodeCursor(key)
+		if cursor == "0" {
+			t.Fatalf("the cursor of %q ends the scan", key)
+		}
+		if got, ok := decodeCursor(cursor); !ok || !bytes.Equal(got, key) {
+			t.Fatalf("cursor %s of %q decoded as %q %v", cursor, key, got, ok)
+		}
+	}
+	if key, ok := decodeCursor("0"); !ok || key != nil {
+		t.Fatalf("cursor 0: %q %v", key, ok)
+	}
+	for _, cursor := range []string{"-1", "2", "abc", "", "1x"} {
+		if _, ok := decodeCursor(cursor); ok {
+			t.Fatalf("cursor %q is accepted", cursor)
+		}
+	}
+}
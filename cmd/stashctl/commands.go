@@ -0,0 +1,236 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// command is a command of stashctl, args are the arguments after its name.
+type command struct {
+	usage   string
+	summary string
+	run     func(c *ctl, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"get":    {"get <key>", "print the value of the key", getCommand},
+		"put":    {"put [-ttl duration] [-sync] <key> <value>", "write the key", putCommand},
+		"delete": {"delete [-sync] <key>", "delete the key", deleteCommand},
+		"scan": {"scan [-prefix p] [-start s] [-end e] [-limit n] [-reverse] [-keys-only]",
+			"print the pairs in key order", scanCommand},
+		"count":  {"count [-prefix p] [-start s] [-end e]", "count the keys", countCommand},
+		"stats":  {"stats", "print the statistics of the database", statsCommand},
+		"help":   {"help", "print the commands", helpCommand},
+		"repair": {"repair", "repair the database, the files it drops are moved into lost/", repairCommand},
+		"wal": {"wal dump [-chunks=false] [-records=false] [path...]",
+			"dump the WAL segments of the paths or of -dir", walCommand},
+	}
+}
+
+func printCommands(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-70s %s\n", commands[name].usage, commands[name].summary)
+	}
+}
+
+// newFlagSet returns the flags of a command, a wrong flag is reported by the set itself.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	return flags
+}
+
+// parseFlags parses the flags of the command and checks the number of its arguments.
+func parseFlags(flags *flag.FlagSet, args []string, narg int) error {
+	if err := flags.Parse(args); err != nil || flags.NArg() != narg {
+		return errUsage
+	}
+	return nil
+}
+
+// rangeFlags are the flags that select the keys of scan and count.
+type rangeFlags struct {
+	prefix, start, end *string
+}
+
+func addRangeFlags(flags *flag.FlagSet) rangeFlags {
+	return rangeFlags{
+		prefix: flags.String("prefix", "", "only the keys with the prefix"),
+		start:  flags.String("start", "", "the inclusive lower bound"),
+		end:    flags.String("end", "", "the exclusive upper bound"),
+	}
+}
+
+// iteratorOptions narrows the bounds by the prefix, the bigger lower bound and the
+// smaller upper bound win.
+func (r rangeFlags) iteratorOptions(cf *storage.ColumnFamily) storage.IteratorOptions {
+	options := storage.IteratorOptions{ColumnFamily: cf}
+	if *r.start != "" {
+		options.LowerBound = []byte(*r.start)
+	}
+	if *r.end != "" {
+		options.UpperBound = []byte(*r.end)
+	}
+	if prefix := []byte(*r.prefix); len(prefix) > 0 {
+		if options.LowerBound == nil || string(prefix) > string(options.LowerBound) {
+			options.LowerBound = prefix
+		}
+		if end := storage.PrefixEnd(prefix); end != nil &&
+			(options.UpperBound == nil || string(end) < string(options.UpperBound)) {
+			options.UpperBound = end
+		}
+	}
+	return options
+}
+
+func getCommand(c *ctl, args []string) error {
+	flags := newFlagSet("get")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	db, cf, err := c.columnFamily()
+	if err != nil {
+		return err
+	}
+	value, err := db.GetCF(cf, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	c.printValue([]byte(flags.Arg(0)), value)
+	return nil
+}
+
+func putCommand(c *ctl, args []string) error {
+	flags := newFlagSet("put")
+	ttl := flags.Duration("ttl", 0, "expire the key after the duration")
+	sync := flags.Bool("sync", false, "sync the WAL")
+	if err := parseFlags(flags, args, 2); err != nil {
+		return err
+	}
+	db, cf, err := c.columnFamily()
+	if err != nil {
+		return err
+	}
+	return db.PutCF(cf, flags.Arg(0), flags.Arg(1), &storage.WriteOptions{Sync: *sync, TTL: *ttl})
+}
+
+func deleteCommand(c *ctl, args []string) error {
+	flags := newFlagSet("delete")
+	sync := flags.Bool("sync", false, "sync the WAL")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	db, cf, err := c.columnFamily()
+	if err != nil {
+		return err
+	}
+	return db.DeleteCF(cf, []byte(flags.Arg(0)), &storage.WriteOptions{Sync: *sync})
+}
+
+func scanCommand(c *ctl, args []string) error {
+	flags := newFlagSet("scan")
+	bounds := addRangeFlags(flags)
+	limit := flags.Int("limit", 0, "the maximum number of pairs, zero prints all of them")
+	reverse := flags.Bool("reverse", false, "from the biggest key down")
+	keysOnly := flags.Bool("keys-only", false, "only print the keys")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	db, cf, err := c.columnFamily()
+	if err != nil {
+		return err
+	}
+	options := bounds.iteratorOptions(cf)
+	options.Reverse = *reverse
+	options.KeysOnly = *keysOnly
+	it, err := db.NewIterator(options)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for it.Rewind(); it.Valid() && (*limit <= 0 || n < *limit); it.Next() {
+		if *keysOnly {
+			c.printKey(it.Key())
+		} else {
+			c.printPair(it.Key(), it.Value())
+		}
+		n++
+	}
+	return it.Close()
+}
+
+func countCommand(c *ctl, args []string) error {
+	flags := newFlagSet("count")
+	bounds := addRangeFlags(flags)
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	db, cf, err := c.columnFamily()
+	if err != nil {
+		return err
+	}
+	options := bounds.iteratorOptions(cf)
+	options.KeysOnly = true
+	it, err := db.NewIterator(options)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	c.printCount(count)
+	return nil
+}
+
+func statsCommand(c *ctl, args []string) error {
+	if err := parseFlags(newFlagSet("stats"), args, 0); err != nil {
+		return err
+	}
+	db, err := c.database()
+	if err != nil {
+		return err
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	c.printStats(stats)
+	return nil
+}
+
+// repairCommand repairs the database in place, it is closed first if a command opened it.
+func repairCommand(c *ctl, args []string) error {
+	if err := parseFlags(newFlagSet("repair"), args, 0); err != nil {
+		return err
+	}
+	if err := c.close(); err != nil {
+		return err
+	}
+	report, err := storage.RepairDB(c.options)
+	if err != nil {
+		return fmt.Errorf("repair %s: %w", c.options.DirPath, err)
+	}
+	c.printRepairReport(report)
+	return nil
+}
+
+func helpCommand(c *ctl, args []string) error {
+	printCommands(c.out)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errUsage = errors.New("wrong arguments")
+
+// ctl runs the commands, the database is only opened by the commands that need it.
+type ctl struct {
+	options storage.Options
+	family  string
+	format  format
+	out     *bufio.Writer
+
+	db *storage.DB
+}
+
+// database opens the database on first use, a directory that does not exist is not
+// created.
+func (c *ctl) database() (*storage.DB, error) {
+	if c.db != nil {
+		return c.db, nil
+	}
+	if _, err := os.Stat(c.options.DirPath); err != nil {
+		return nil, fmt.Errorf("no database at %s: %w", c.options.DirPath, err)
+	}
+	db, err := storage.OpenDB(c.options)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", c.options.DirPath, err)
+	}
+	c.db = db
+	return db, nil
+}
+
+// columnFamily returns the database and the family chosen by -cf, nil is the default one.
+func (c *ctl) columnFamily() (*storage.DB, *storage.ColumnFamily, error) {
+	db, err := c.database()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.family == "" {
+		return db, nil, nil
+	}
+	cf, err := db.ColumnFamily(c.family)
+	if err != nil {
+		return nil, nil, fmt.Errorf("column family %q: %w", c.family, err)
+	}
+	return db, cf, nil
+}
+
+func (c *ctl) close() error {
+	if c.db == nil {
+		return nil
+	}
+	db := c.db
+	c.db = nil
+	return db.Close()
+}
+
+// run runs the command named by the first argument.
+func (c *ctl) run(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see stashctl help", args[0])
+	}
+	err := cmd.run(c, args[1:])
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCtl is a ctl on a fresh database in a temporary directory, out collects what it prints.
+type testCtl struct {
+	*ctl
+	t   *testing.T
+	buf *bytes.Buffer
+}
+
+func newTestCtl(t *testing.T) *testCtl {
+	t.Helper()
+	options := storage.DefaultOptions
+	options.DirPath = t.TempDir()
+	return newTestCtlIn(t, options)
+}
+
+func newTestCtlIn(t *testing.T, options storage.Options) *testCtl {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	c := &testCtl{ctl: &ctl{options: options, out: bufio.NewWriter(buf)}, t: t, buf: buf}
+	t.Cleanup(func() {
+		if err := c.close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+// output runs the command and returns what it printed.
+func (c *testCtl) output(args ...string) string {
+	c.t.Helper()
+	c.buf.Reset()
+	if err := c.run(args); err != nil {
+		c.t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	if err := c.out.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.buf.String()
+}
+
+func (c *testCtl) expect(want string, args ...string) {
+	c.t.Helper()
+	if got := c.output(args...); got != want {
+		c.t.Fatalf("%s printed %q, want %q", strings.Join(args, " "), got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c := newTestCtl(t)
+	for _, key := range []string{"b", "a", "c", "ab"} {
+		c.expect("", "put", key, "v"+key)
+	}
+	c.expect("va\n", "get", "a")
+	c.expect("a\tva\nab\tvab\nb\tvb\nc\tvc\n", "scan")
+	c.expect("c\tvc\nb\tvb\n", "scan", "-reverse", "-limit", "2")
+	c.expect("a\nab\n", "scan", "-prefix", "a", "-keys-only")
+	c.expect("ab\tvab\nb\tvb\n", "scan", "-start", "ab", "-end", "c")
+	c.expect("ab\n", "scan", "-prefix", "a", "-start", "aa", "-keys-only")
+	c.expect("4\n", "count")
+	c.expect("2\n", "count", "-prefix", "a")
+
+	c.expect("", "delete", "a")
+	if err := c.run([]string{"get", "a"}); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get of a deleted key: %v", err)
+	}
+	c.expect("3\n", "count")
+	if out := c.output("stats"); !strings.Contains(out, `column family "default"`) {
+		t.Fatalf("stats printed %q", out)
+	}
+	if out := c.output("help"); !strings.Contains(out, "scan [-prefix p]") {
+		t.Fatalf("help printed %q", out)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	c := newTestCtl(t)
+	c.expect("", "put", "key", "value")
+	c.expect("", "put", "bin", "\xff\x00")
+
+	c.format = formatHex
+	c.expect("76616c7565\n", "get", "key")
+	c.expect("62696e\tff00\n6b6579\t76616c7565\n", "scan")
+
+	c.format = formatJSON
+	c.expect(`{"key":"key","value":"value"}`+"\n", "get", "key")
+	c.expect(`{"key":"bin","value_hex":"ff00"}`+"\n"+`{"key":"key","value":"value"}`+"\n", "scan")
+	c.expect(`{"key":"bin"}`+"\n", "scan", "-keys-only", "-limit", "1")
+	c.expect(`{"count":2}`+"\n", "count")
+
+	for _, s := range []string{"utf8", "utf-8", "hex", "json"} {
+		if _, err := parseFormat(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := parseFormat("xml"); err == nil {
+		t.Fatal("an unknown format is accepted")
+	}
+}
+
+func TestColumnFamilyFlag(t *testing.T) {
+	c := newTestCtl(t)
+	db, err := c.database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateColumnFamily("other", storage.DefaultColumnFamilyOptions); err != nil {
+		t.Fatal(err)
+	}
+	c.family = "other"
+	c.expect("", "put", "key", "other")
+	c.expect("other\n", "get", "key")
+	c.family = ""
+	if err := c.run([]string{"get", "key"}); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("the key is written to the default family: %v", err)
+	}
+	c.family = "missing"
+	if err := c.run([]string{"get", "key"}); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Fatalf("get in a missing family: %v", err)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	c := newTestCtl(t)
+	for _, args := range [][]string{
+		{"get"},
+		{"get", "a", "b"},
+		{"put", "key"},
+		{"put", "-ttl", "soon", "key", "value"},
+		{"scan", "extra"},
+		{"count", "-limit", "1"},
+	} {
+		err := c.run(args)
+		if err == nil || !strings.HasPrefix(err.Error(), "usage: "+args[0]) {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if err := c.run([]string{"frobnicate"}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("unknown command: %v", err)
+	}
+}
+
+func TestMissingDirectoryIsNotCreated(t *testing.T) {
+	options := storage.DefaultOptions
+	options.DirPath = filepath.Join(t.TempDir(), "missing")
+	c := newTestCtlIn(t, options)
+	if err := c.run([]string{"put", "key", "value"}); err == nil {
+		t.Fatal("a put opens a database that does not exist")
+	}
+	if _, err := os.Stat(options.DirPath); !os.IsNotExist(err) {
+		t.Fatalf("the directory was created: %v", err)
+	}
+	// Help does not need the database.
+	c.output("help")
+}
+
+func TestReadOnlyCtl(t *testing.T) {
+	options := storage.DefaultOptions
+	options.DirPath = t.TempDir()
+	writer := newTestCtlIn(t, options)
+	writer.expect("", "put", "key", "value")
+	if err := writer.close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.ReadOnly = true
+	c := newTestCtlIn(t, options)
+	c.expect("value\n", "get", "key")
+	c.expect("1\n", "count")
+	for _, args := range [][]string{{"put", "key", "other"}, {"delete", "key"}} {
+		if err := c.run(args); !errors.Is(err, _const.ErrorReadOnlyDB) {
+			t.Fatalf("%v on a read-only database: %v", args, err)
+		}
+	}
+	c.expect("value\n", "get", "key")
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadDir(options.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(entries) {
+		t.Fatalf("the read-only ctl changed the directory from %v to %v", entries, after)
+	}
+}
+
+func TestREPL(t *testing.T) {
+	c := newTestCtl(t)
+	in := strings.NewReader("put 'a key' \"a \\\"value\\\"\"\n\nget 'a key'\ncount\nexit\nget 'a key'\n")
+	if err := c.repl(in); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.out.Flush()
+	want := prompt + prompt + prompt + "a \"value\"\n" + prompt + "1\n" + prompt
+	if got := c.buf.String(); got != want {
+		t.Fatalf("the REPL printed %q, want %q", got, want)
+	}
+
+	// An error does not stop the REPL, the end of the input does.
+	c.buf.Reset()
+	if err := c.repl(strings.NewReader("get missing\nget 'open\ncount\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.out.Flush()
+	if got, want := c.buf.String(), prompt+prompt+prompt+"1\n"+prompt+"\n"; got != want {
+		t.Fatalf("the REPL printed %q, want %q", got, want)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"  get\tkey  ", []string{"get", "key"}},
+		{`put 'a b' "c d"`, []string{"put", "a b", "c d"}},
+		{`put 'it\s' "say \"hi\""`, []string{"put", `it\s`, `say "hi"`}},
+		{`a\ b ''`, []string{"a b", ""}},
+		{`pre'fix'"ed"`, []string{"prefixed"}},
+	}
+	for _, tt := range tests {
+		args, err := splitArgs(tt.line)
+		if err != nil || !reflect.DeepEqual(args, tt.args) {
+			t.Fatalf("split %q into %q %v, want %q", tt.line, args, err, tt.args)
+		}
+	}
+	for _, line := range []string{`'open`, `"open`, `trailing\`} {
+		if _, err := splitArgs(line); err == nil {
+			t.Fatalf("%q is split", line)
+		}
+	}
+}
+
+func TestRepairCommand(t *testing.T) {
+	c := newTestCtl(t)
+	path := writeWalTestData(c)
+	// The batch end of the last batch is cut off.
+	if err := os.Truncate(path, 221); err != nil {
+		t.Fatal(err)
+	}
+	// The database opened by count is closed before the repair.
+	c.expect("1\n", "count")
+
+	out := c.output("repair")
+	for _, line := range []string{
+		"recovered 3 batches, 3 records\n",
+		"dropped 1 batches, 2 records\n",
+		"moved " + filepath.Join(storage.LostDirName, "0000000001.MEM.1") + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("repair printed %q, without %q", out, line)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.options.DirPath, storage.LostDirName, "0000000001.MEM.1")); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("b\t2\n", "scan")
+
+	c.format = formatJSON
+	out = c.output("repair")
+	var report storage.RepairReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("decode %q: %v", out, err)
+	}
+	if report.RecoveredBatches != 3 || report.DroppedBatches != 0 {
+		t.Fatalf("second repair %+v", report)
+	}
+	if err := c.run([]string{"repair", "now"}); err == nil || !strings.HasPrefix(err.Error(), "usage: repair") {
+		t.Fatalf("repair with an argument: %v", err)
+	}
+
+	c.options.ReadOnly = true
+	if err := c.run([]string{"repair"}); !errors.Is(err, _const.ErrorReadOnlyDB) {
+		t.Fatalf("read-only repair: %v", err)
+	}
+}
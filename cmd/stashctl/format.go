@@ -0,0 +1,137 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// format is how the keys and values are printed.
+type format int
+
+const (
+	// formatUTF8 prints the bytes as they are, a pair is the key and the value separated by
+	// a tab.
+	formatUTF8 format = iota
+	// formatHex prints the bytes in hex.
+	formatHex
+	// formatJSON prints a JSON object per line, a key or value that is not valid UTF-8 is
+	// printed in hex under key_hex or value_hex.
+	formatJSON
+)
+
+func parseFormat(s string) (format, error) {
+	switch s {
+	case "utf8", "utf-8":
+		return formatUTF8, nil
+	case "hex":
+		return formatHex, nil
+	case "json":
+		return formatJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q, it must be utf8, hex or json", s)
+	}
+}
+
+func (c *ctl) bytes(b []byte) string {
+	if c.format == formatHex {
+		return hex.EncodeToString(b)
+	}
+	return string(b)
+}
+
+// addJSON adds the bytes to the object, in hex if they are not valid UTF-8.
+func addJSON(object map[string]any, name string, b []byte) {
+	if utf8.Valid(b) {
+		object[name] = string(b)
+	} else {
+		object[name+"_hex"] = hex.EncodeToString(b)
+	}
+}
+
+func (c *ctl) printJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Every value printed here can be marshaled.
+		panic(err)
+	}
+	_, _ = c.out.Write(append(b, '\n'))
+}
+
+// printValue prints the value read by get.
+func (c *ctl) printValue(key, value []byte) {
+	if c.format == formatJSON {
+		object := make(map[string]any, 2)
+		addJSON(object, "key", key)
+		addJSON(object, "value", value)
+		c.printJSON(object)
+		return
+	}
+	fmt.Fprintln(c.out, c.bytes(value))
+}
+
+func (c *ctl) printPair(key, value []byte) {
+	if c.format == formatJSON {
+		object := make(map[string]any, 2)
+		addJSON(object, "key", key)
+		addJSON(object, "value", value)
+		c.printJSON(object)
+		return
+	}
+	fmt.Fprintf(c.out, "%s\t%s\n", c.bytes(key), c.bytes(value))
+}
+
+func (c *ctl) printKey(key []byte) {
+	if c.format == formatJSON {
+		object := make(map[string]any, 1)
+		addJSON(object, "key", key)
+		c.printJSON(object)
+		return
+	}
+	fmt.Fprintln(c.out, c.bytes(key))
+}
+
+func (c *ctl) printCount(count int) {
+	if c.format == formatJSON {
+		c.printJSON(map[string]int{"count": count})
+		return
+	}
+	fmt.Fprintln(c.out, count)
+}
+
+func (c *ctl) printStats(stats storage.Stats) {
+	if c.format == formatJSON {
+		c.printJSON(stats)
+		return
+	}
+	fmt.Fprintf(c.out, "seq %d\n", stats.Seq)
+	for _, cf := range stats.ColumnFamilies {
+		fmt.Fprintf(c.out, "column family %q (id %d)\n", cf.Name, cf.ID)
+		fmt.Fprintf(c.out, "  memtables %d, %d bytes\n", cf.MemTables, cf.MemTableBytes)
+		for level, stats := range cf.Levels {
+			if stats.Tables > 0 {
+				fmt.Fprintf(c.out, "  level %d: %d tables, %d bytes\n", level, stats.Tables, stats.Bytes)
+			}
+		}
+	}
+	fmt.Fprintf(c.out, "value log %d segments, %d bytes\n", stats.ValueLog.Segments, stats.ValueLog.Bytes)
+}
+
+func (c *ctl) printRepairReport(report *storage.RepairReport) {
+	if c.format == formatJSON {
+		c.printJSON(report)
+		return
+	}
+	if report.ManifestRebuilt {
+		fmt.Fprintln(c.out, "the MANIFEST could not be read and was rebuilt from the files")
+	}
+	fmt.Fprintf(c.out, "recovered %d batches, %d records\n", report.RecoveredBatches, report.RecoveredRecords)
+	fmt.Fprintf(c.out, "dropped %d batches, %d records\n", report.DroppedBatches, report.DroppedRecords)
+	fmt.Fprintf(c.out, "skipped %d corrupted chunks, %d bytes\n", report.CorruptedChunks, report.DroppedBytes)
+	fmt.Fprintf(c.out, "dropped %d tables\n", report.DroppedTables)
+	for _, file := range report.LostFiles {
+		fmt.Fprintf(c.out, "moved %s\n", file)
+	}
+}
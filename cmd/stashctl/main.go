@@ -0,0 +1,64 @@
+// Command stashctl inspects and edits a SmartStashDB data directory offline, the database
+// must not be opened by another process. Without a command it starts a REPL.
+//
+//	stashctl [-dir data] [-read-only] [-format utf8|hex|json] [-cf family] <command> [args]
+package main
+
+import (
+	"SmartStashDB/storage"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	var (
+		dir      = flag.String("dir", "data", "the directory of the database")
+		readOnly = flag.Bool("read-only", false, "never write or create any file of the database")
+		output   = flag.String("format", "utf8", "the output format: utf8, hex or json")
+		family   = flag.String("cf", "", "the column family, the default one if empty")
+	)
+	flag.Usage = usage
+	flag.Parse()
+
+	format, err := parseFormat(*output)
+	if err != nil {
+		fatal(err)
+	}
+	options := storage.DefaultOptions
+	options.DirPath = *dir
+	options.ReadOnly = *readOnly
+	c := &ctl{
+		options: options,
+		family:  *family,
+		format:  format,
+		out:     bufio.NewWriter(os.Stdout),
+	}
+
+	if flag.NArg() == 0 {
+		err = c.repl(os.Stdin)
+	} else {
+		err = c.run(flag.Args())
+	}
+	_ = c.out.Flush()
+	if closeErr := c.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: stashctl [flags] <command> [args], a REPL is started without a command\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\ncommands:\n")
+	printCommands(out)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "stashctl: %v\n", err)
+	os.Exit(1)
+}
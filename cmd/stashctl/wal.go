@@ -0,0 +1,425 @@
+package main
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// walFileName matches the segment files of the memtable WALs, %010d.MEM.<memtable id>.
+var walFileName = regexp.MustCompile(`^(\d+)\.MEM\.(\d+)$`)
+
+// walSegment is a segment file of a WAL.
+type walSegment struct {
+	id   uint64
+	path string
+}
+
+// walFiles are the segments of the WAL of a memtable, sorted by id.
+type walFiles struct {
+	dir      string
+	memTable int
+	segments []walSegment
+}
+
+func (w *walFiles) name() string {
+	return filepath.Join(w.dir, "*.MEM."+strconv.Itoa(w.memTable))
+}
+
+// walDump is what wal dump prints of a WAL.
+type walDump struct {
+	WAL      string         `json:"wal"`
+	Segments []*segmentDump `json:"segments"`
+	Batches  []*batchDump   `json:"batches,omitempty"`
+	Damage   []*damageDump  `json:"damage,omitempty"`
+	Summary  walSummary     `json:"summary"`
+	pending  map[batchKey]*batchDump
+}
+
+// batchKey groups the records of a batch, the ids of batches written by different runs
+// may collide.
+type batchKey struct {
+	id  uint64
+	seq uint64
+}
+
+type segmentDump struct {
+	Path   string       `json:"path"`
+	Size   int64        `json:"size"`
+	Chunks []*chunkDump `json:"chunks,omitempty"`
+	// TornAt is the offset of the chunk the segment ends in the middle of, -1 if none.
+	TornAt int64 `json:"torn_at"`
+}
+
+type chunkDump struct {
+	Block      uint32 `json:"block"`
+	Offset     uint32 `json:"offset"`
+	Type       string `json:"type"`
+	Compressed bool   `json:"compressed"`
+	Length     uint32 `json:"length"`
+	CRC        string `json:"crc"`
+}
+
+type batchDump struct {
+	BatchId  uint64        `json:"batch_id"`
+	Seq      uint64        `json:"seq"`
+	Complete bool          `json:"complete"`
+	Families []uint32      `json:"families,omitempty"`
+	Records  []*recordDump `json:"records"`
+}
+
+type recordDump struct {
+	Segment   uint64 `json:"segment"`
+	Block     uint32 `json:"block"`
+	Offset    uint32 `json:"offset"`
+	Type      string `json:"type"`
+	BatchId   uint64 `json:"batch_id"`
+	Key       string `json:"key,omitempty"`
+	KeyHex    string `json:"key_hex,omitempty"`
+	ValueSize int    `json:"value_size"`
+	Expire    uint64 `json:"expire,omitempty"`
+	key       []byte
+}
+
+// damageDump is a place where no record could be read.
+type damageDump struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Error   string `json:"error"`
+	Skipped int64  `json:"skipped"`
+}
+
+type walSummary struct {
+	Chunks            int `json:"chunks"`
+	BadChunks         int `json:"bad_chunks"`
+	Records           int `json:"records"`
+	Batches           int `json:"batches"`
+	IncompleteBatches int `json:"incomplete_batches"`
+}
+
+func walCommand(c *ctl, args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return errUsage
+	}
+	flags := newFlagSet("wal dump")
+	chunks := flags.Bool("chunks", true, "list the blocks and the chunks")
+	records := flags.Bool("records", true, "list the records grouped by batch")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{c.options.DirPath}
+	}
+
+	wals, err := findWalFiles(paths)
+	if err != nil {
+		return err
+	}
+	for _, wal := range wals {
+		dump, err := dumpWal(wal)
+		if err != nil {
+			return err
+		}
+		if !*chunks {
+			for _, segment := range dump.Segments {
+				segment.Chunks = nil
+			}
+		}
+		if !*records {
+			dump.Batches = nil
+		}
+		if c.format == formatJSON {
+			c.printJSON(dump)
+		} else {
+			c.printWalDump(dump, *chunks, *records)
+		}
+	}
+	return nil
+}
+
+// findWalFiles returns the WALs of the segment files, the directories are searched with
+// their column family directories.
+func findWalFiles(paths []string) ([]*walFiles, error) {
+	wals := make(map[string]*walFiles)
+	add := func(path string) bool {
+		match := walFileName.FindStringSubmatch(filepath.Base(path))
+		if match == nil {
+			return false
+		}
+		id, err1 := strconv.ParseUint(match[1], 10, 32)
+		memTable, err2 := strconv.Atoi(match[2])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		wal := &walFiles{dir: filepath.Dir(path), memTable: memTable}
+		if existing := wals[wal.name()]; existing != nil {
+			wal = existing
+		} else {
+			wals[wal.name()] = wal
+		}
+		wal.segments = append(wal.segments, walSegment{id: id, path: path})
+		return true
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if !add(path) {
+				return nil, fmt.Errorf("%s is not a WAL segment file", path)
+			}
+			continue
+		}
+		err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() {
+				add(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := make([]*walFiles, 0, len(wals))
+	for _, wal := range wals {
+		sort.Slice(wal.segments, func(i, j int) bool { return wal.segments[i].id < wal.segments[j].id })
+		sorted = append(sorted, wal)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].dir != sorted[j].dir {
+			return sorted[i].dir < sorted[j].dir
+		}
+		return sorted[i].memTable < sorted[j].memTable
+	})
+	return sorted, nil
+}
+
+// dumpWal reads the chunks and the records of the segments of the WAL, a batch may span
+// several segments.
+func dumpWal(wal *walFiles) (*walDump, error) {
+	dump := &walDump{WAL: wal.name(), pending: make(map[batchKey]*batchDump)}
+	for _, file := range wal.segments {
+		segment, err := storage.OpenSegmentFileForRead(file.path)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", file.path, err)
+		}
+		err = dump.readSegment(segment, file)
+		_ = segment.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", file.path, err)
+		}
+	}
+	for _, batch := range dump.Batches {
+		if !batch.Complete {
+			dump.Summary.IncompleteBatches++
+		}
+	}
+	dump.Summary.Batches = len(dump.Batches)
+	return dump, nil
+}
+
+func (d *walDump) readSegment(segment *storage.SegmentFile, file walSegment) error {
+	dump := &segmentDump{Path: file.path, Size: segment.Size(), TornAt: -1}
+	d.Segments = append(d.Segments, dump)
+
+	reader := segment.NewSegmentReader()
+	for {
+		offset := reader.Offset()
+		chunk, err := reader.NextChunk()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, _const.ErrorTornChunk) {
+			dump.TornAt = offset
+			break
+		}
+		if err != nil {
+			return err
+		}
+		crc := "ok"
+		if !chunk.Valid {
+			crc = "bad"
+			d.Summary.BadChunks++
+		}
+		d.Summary.Chunks++
+		dump.Chunks = append(dump.Chunks, &chunkDump{
+			Block:      chunk.BlockIndex,
+			Offset:     chunk.ChunkOffset,
+			Type:       chunkTypeName(chunk.Type),
+			Compressed: chunk.Compressed,
+			Length:     chunk.Length,
+			CRC:        crc,
+		})
+	}
+
+	reader = segment.NewSegmentReader()
+	for {
+		offset := reader.Offset()
+		data, position, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			skipped, more := reader.Skip()
+			d.Damage = append(d.Damage, &damageDump{Segment: file.id, Offset: offset, Error: err.Error(), Skipped: skipped})
+			if !more {
+				return nil
+			}
+			continue
+		}
+
+		record := storage.NewLogRecord()
+		if err := record.DecodeChecked(data); err != nil {
+			d.Damage = append(d.Damage, &damageDump{Segment: file.id, Offset: offset, Error: err.Error()})
+			continue
+		}
+		d.Summary.Records++
+		d.addRecord(record, file.id, position)
+	}
+}
+
+// addRecord adds the record to its batch, a LogRecordBatchEnd completes the batch.
+func (d *walDump) addRecord(record *storage.LogRecord, segment uint64, position *storage.ChunkPosition) {
+	dump := &recordDump{
+		Segment:   segment,
+		Block:     position.BlockIndex,
+		Offset:    position.ChunkOffset,
+		Type:      recordTypeName(record.Type),
+		BatchId:   record.BatchId,
+		ValueSize: len(record.Value),
+		Expire:    record.Expire,
+		key:       record.Key,
+	}
+	batchId := record.BatchId
+	var families []uint32
+	if record.Type == storage.LogRecordBatchEnd {
+		var err error
+		if batchId, families, err = storage.DecodeBatchEnd(record); err != nil {
+			offset := int64(position.BlockIndex)*_const.BlockSize + int64(position.ChunkOffset)
+			d.Damage = append(d.Damage, &damageDump{Segment: segment, Offset: offset, Error: err.Error()})
+			return
+		}
+		dump.BatchId = batchId
+	} else if utf8.Valid(record.Key) {
+		dump.Key = string(record.Key)
+	} else {
+		dump.KeyHex = fmt.Sprintf("%x", record.Key)
+	}
+
+	key := batchKey{id: batchId, seq: record.Seq}
+	batch := d.pending[key]
+	if batch == nil {
+		batch = &batchDump{BatchId: batchId, Seq: record.Seq}
+		d.pending[key] = batch
+		d.Batches = append(d.Batches, batch)
+	}
+	batch.Records = append(batch.Records, dump)
+	if record.Type == storage.LogRecordBatchEnd {
+		batch.Complete = true
+		batch.Families = families
+		delete(d.pending, key)
+	}
+}
+
+func chunkTypeName(t storage.ChunkType) string {
+	switch t {
+	case storage.ChunkTypeFull:
+		return "full"
+	case storage.ChunkTypeStart:
+		return "start"
+	case storage.ChunkTypeMiddle:
+		return "middle"
+	case storage.ChunkTypeEnd:
+		return "end"
+	default:
+		return "unknown(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+func recordTypeName(t storage.LogRecordType) string {
+	switch t {
+	case storage.LogRecordNormal:
+		return "put"
+	case storage.LogRecordDeleted:
+		return "delete"
+	case storage.LogRecordBatchEnd:
+		return "batch-end"
+	case storage.LogRecordRangeDeleted:
+		return "delete-range"
+	case storage.LogRecordMerge:
+		return "merge"
+	case storage.LogRecordValuePointer:
+		return "value-pointer"
+	default:
+		return "unknown(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+func (c *ctl) printWalDump(dump *walDump, chunks, records bool) {
+	fmt.Fprintf(c.out, "WAL %s\n", dump.WAL)
+	for _, segment := range dump.Segments {
+		fmt.Fprintf(c.out, "segment %s, %d bytes\n", segment.Path, segment.Size)
+		block := int64(-1)
+		for _, chunk := range segment.Chunks {
+			if int64(chunk.Block) != block {
+				block = int64(chunk.Block)
+				fmt.Fprintf(c.out, "  block %d\n", block)
+			}
+			compressed := ""
+			if chunk.Compressed {
+				compressed = " compressed"
+			}
+			fmt.Fprintf(c.out, "    chunk at %-6d %-6s%s length %d crc %s\n", chunk.Offset, chunk.Type, compressed, chunk.Length, chunk.CRC)
+		}
+		if segment.TornAt >= 0 {
+			fmt.Fprintf(c.out, "  torn chunk at offset %d\n", segment.TornAt)
+		}
+	}
+
+	if records {
+		for _, batch := range dump.Batches {
+			if batch.Complete {
+				fmt.Fprintf(c.out, "batch %d seq %d, %d records", batch.BatchId, batch.Seq, len(batch.Records)-1)
+				if batch.Families != nil {
+					fmt.Fprintf(c.out, ", families %v", batch.Families)
+				}
+				fmt.Fprintln(c.out)
+			} else {
+				fmt.Fprintf(c.out, "batch %d seq %d INCOMPLETE, no batch end, %d records\n", batch.BatchId, batch.Seq, len(batch.Records))
+			}
+			for _, record := range batch.Records {
+				if record.Type == "batch-end" {
+					continue
+				}
+				key := c.bytes(record.key)
+				if c.format == formatUTF8 {
+					key = strconv.Quote(key)
+				}
+				fmt.Fprintf(c.out, "  %-13s key %s value %d bytes (segment %d block %d offset %d)\n",
+					record.Type, key, record.ValueSize, record.Segment, record.Block, record.Offset)
+			}
+		}
+	}
+	for _, damage := range dump.Damage {
+		fmt.Fprintf(c.out, "damage in segment %d at offset %d: %s, %d bytes skipped\n", damage.Segment, damage.Offset, damage.Error, damage.Skipped)
+	}
+	s := dump.Summary
+	fmt.Fprintf(c.out, "%d chunks (%d bad), %d records, %d batches (%d incomplete)\n\n",
+		s.Chunks, s.BadChunks, s.Records, s.Batches, s.IncompleteBatches)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"SmartStashDB/storage"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeWalTestData writes three single record batches and a batch of two records, and
+// closes the database. It returns the path of the WAL segment.
+func writeWalTestData(c *testCtl) string {
+	c.t.Helper()
+	c.output("put", "a", "1")
+	c.output("put", "b", "2")
+	c.output("delete", "a")
+	db, err := c.database()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	batch := db.NewBatch(storage.BatchOptions{})
+	if err := batch.Put([]byte("x"), []byte("yy")); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := batch.Delete([]byte("z")); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := batch.Commit(nil); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		c.t.Fatal(err)
+	}
+	return filepath.Join(c.options.DirPath, "0000000001.MEM.1")
+}
+
+// walDumps runs wal dump in the JSON format and decodes what it printed.
+func (c *testCtl) walDumps(args ...string) []*walDump {
+	c.t.Helper()
+	format := c.format
+	c.format = formatJSON
+	out := c.output(append([]string{"wal", "dump"}, args...)...)
+	c.format = format
+
+	var dumps []*walDump
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		dump := new(walDump)
+		if err := decoder.Decode(dump); err != nil {
+			c.t.Fatalf("decode %q: %v", out, err)
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps
+}
+
+// recordKeys lists the type and the key of the records of the batch sorted, a batch does
+// not keep the order of its writes.
+func recordKeys(batch *batchDump) []string {
+	var keys []string
+	for _, record := range batch.Records {
+		keys = append(keys, record.Type+" "+record.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestWalDump(t *testing.T) {
+	c := newTestCtl(t)
+	path := writeWalTestData(c)
+
+	dumps := c.walDumps()
+	if len(dumps) != 1 {
+		t.Fatalf("%d WALs dumped, want 1", len(dumps))
+	}
+	dump := dumps[0]
+	if len(dump.Segments) != 1 || dump.Segments[0].Path != path || dump.Segments[0].TornAt != -1 {
+		t.Fatalf("segments %+v", dump.Segments)
+	}
+	want := walSummary{Chunks: 9, Records: 9, Batches: 4}
+	if dump.Summary != want || len(dump.Segments[0].Chunks) != 9 || len(dump.Damage) != 0 {
+		t.Fatalf("summary %+v with %d chunks and %d damages, want %+v", dump.Summary, len(dump.Segments[0].Chunks), len(dump.Damage), want)
+	}
+	for _, chunk := range dump.Segments[0].Chunks {
+		if chunk.Type != "full" || chunk.CRC != "ok" || chunk.Block != 0 {
+			t.Fatalf("chunk %+v", chunk)
+		}
+	}
+	batches := [][]string{
+		{"batch-end ", "put a"},
+		{"batch-end ", "put b"},
+		{"batch-end ", "delete a"},
+		{"batch-end ", "delete z", "put x"},
+	}
+	for i, batch := range dump.Batches {
+		if !batch.Complete || batch.Seq != uint64(i+1) || !reflect.DeepEqual(recordKeys(batch), batches[i]) {
+			t.Fatalf("batch %d: %+v %v, want %v", i, batch, recordKeys(batch), batches[i])
+		}
+		for _, record := range batch.Records {
+			if record.BatchId != batch.BatchId {
+				t.Fatalf("record %+v in batch %d", record, batch.BatchId)
+			}
+		}
+	}
+	for _, record := range dump.Batches[3].Records {
+		if record.Key == "x" && record.ValueSize != 2 {
+			t.Fatalf("value size %d, want 2", record.ValueSize)
+		}
+	}
+
+	if dump := c.walDumps("-chunks=false", "-records=false")[0]; dump.Segments[0].Chunks != nil || dump.Batches != nil || dump.Summary != want {
+		t.Fatalf("dump without chunks and records: %+v", dump)
+	}
+	// A segment file is dumped on its own.
+	if dumps := c.walDumps(path); len(dumps) != 1 || dumps[0].Summary != want {
+		t.Fatalf("dump of the segment file: %+v", dumps)
+	}
+
+	out := c.output("wal", "dump")
+	for _, line := range []string{
+		"segment " + path + ", 242 bytes\n",
+		"  block 0\n",
+		"    chunk at 0      full   length 16 crc ok\n",
+		`  put           key "a" value 1 bytes (segment 1 block 0 offset 0)` + "\n",
+		"9 chunks (0 bad), 9 records, 4 batches (0 incomplete)\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("wal dump printed %q, without %q", out, line)
+		}
+	}
+}
+
+func TestWalDumpOfATornSegment(t *testing.T) {
+	c := newTestCtl(t)
+	path := writeWalTestData(c)
+	// The batch end of the last batch is cut in half.
+	if err := os.Truncate(path, 221); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := c.walDumps()[0]
+	if dump.Segments[0].TornAt != 210 {
+		t.Fatalf("torn at %d, want 210", dump.Segments[0].TornAt)
+	}
+	last := dump.Batches[len(dump.Batches)-1]
+	if last.Complete || !reflect.DeepEqual(recordKeys(last), []string{"delete z", "put x"}) {
+		t.Fatalf("last batch %+v %v", last, recordKeys(last))
+	}
+	if s := dump.Summary; s.Chunks != 8 || s.Records != 8 || s.Batches != 4 || s.IncompleteBatches != 1 {
+		t.Fatalf("summary %+v", s)
+	}
+	out := c.output("wal", "dump")
+	for _, line := range []string{"torn chunk at offset 210\n", "INCOMPLETE, no batch end, 2 records\n"} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("wal dump printed %q, without %q", out, line)
+		}
+	}
+}
+
+func TestWalDumpOfACorruptedChunk(t *testing.T) {
+	c := newTestCtl(t)
+	path := writeWalTestData(c)
+	// A byte of the data of the record that puts b.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[55+7+3] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rest of the block can not be trusted, the records after the chunk are skipped
+	// as the recovery skips them.
+	dump := c.walDumps()[0]
+	if s := dump.Summary; s.Chunks != 9 || s.BadChunks != 1 || s.Records != 2 || s.Batches != 1 {
+		t.Fatalf("summary %+v", s)
+	}
+	if bad := dump.Segments[0].Chunks[2]; bad.CRC != "bad" || bad.Offset != 55 {
+		t.Fatalf("the damaged chunk is listed as %+v", bad)
+	}
+	if len(dump.Damage) != 1 || dump.Damage[0].Segment != 1 || dump.Damage[0].Offset != 55 || dump.Damage[0].Skipped != 242-55 {
+		t.Fatalf("damage %+v", dump.Damage)
+	}
+	if out := c.output("wal", "dump"); !strings.Contains(out, "damage in segment 1 at offset 55: ") ||
+		!strings.Contains(out, ", 187 bytes skipped\n") || !strings.Contains(out, "9 chunks (1 bad), 2 records") {
+		t.Fatalf("wal dump printed %q", out)
+	}
+}
+
+func TestWalDumpOfSeveralFamilies(t *testing.T) {
+	c := newTestCtl(t)
+	db, err := c.database()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := db.CreateColumnFamily("other", storage.DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch(storage.BatchOptions{})
+	if err := batch.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.PutCF(cf, []byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dumps := c.walDumps()
+	if len(dumps) != 2 {
+		t.Fatalf("%d WALs dumped, want one of every family", len(dumps))
+	}
+	for i, key := range []string{"a", "b"} {
+		batches := dumps[i].Batches
+		if len(batches) != 1 || len(batches[0].Families) != 2 || recordKeys(batches[0])[1] != "put "+key {
+			t.Fatalf("WAL %s: %+v", dumps[i].WAL, batches)
+		}
+		if batches[0].BatchId != dumps[0].Batches[0].BatchId {
+			t.Fatalf("the parts of the batch have the ids %d and %d", dumps[0].Batches[0].BatchId, batches[0].BatchId)
+		}
+	}
+	if !strings.HasPrefix(dumps[1].WAL, filepath.Join(c.options.DirPath, "1.CF")) {
+		t.Fatalf("the WAL of the family is %s", dumps[1].WAL)
+	}
+}
+
+func TestWalDumpArguments(t *testing.T) {
+	c := newTestCtl(t)
+	writeWalTestData(c)
+	for _, args := range [][]string{{"wal"}, {"wal", "list"}, {"wal", "dump", "-pages"}} {
+		if err := c.run(args); err == nil || !strings.HasPrefix(err.Error(), "usage: wal dump") {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if err := c.run([]string{"wal", "dump", filepath.Join(c.options.DirPath, "CURRENT")}); err == nil ||
+		!strings.Contains(err.Error(), "is not a WAL segment file") {
+		t.Fatalf("dump of CURRENT: %v", err)
+	}
+	if err := c.run([]string{"wal", "dump", filepath.Join(c.options.DirPath, "missing")}); !os.IsNotExist(err) {
+		t.Fatalf("dump of a missing file: %v", err)
+	}
+	// The database is not opened, an open one does not stop the dump.
+	if _, err := c.database(); err != nil {
+		t.Fatal(err)
+	}
+	if dumps := c.walDumps(); len(dumps) != 1 {
+		t.Fatalf("%d WALs dumped", len(dumps))
+	}
+}
@@ -9,10 +9,41 @@ var (
 	ErrorDBClosed            = errors.New("the database is closed")
 	ErrorReadOnlyBatch       = errors.New("the read-only batch exists")
 	ErrorBatchCommited       = errors.New("the batch commited")
+	ErrorBatchRollbacked     = errors.New("the batch rolled back")
 	ErrorKeyNotFound         = errors.New("key not found")
 	ErrorKeyIsEmpty          = errors.New("the key is empty")
-	ErrorFileExtError        = errors.New("segmentFileExt must not start with '.'")
+	ErrorFileExtError        = errors.New("segmentFileExt must start with '.'")
 	ErrorDataToLarge         = errors.New("data is too large")
 	ErrorPendingSizeTooLarge = errors.New("pending size is too large")
 	ErrClosed                = errors.New("closed")
+	ErrorInvalidCRC          = errors.New("invalid crc, the data may be corrupted")
+	ErrorTornChunk           = errors.New("the segment file ends in the middle of a chunk")
+	ErrorTableCorrupted      = errors.New("the table file is corrupted")
+	ErrTxnConflict           = errors.New("transaction conflict, a key it read was written by another commit")
+	ErrorInvalidRange        = errors.New("the range is empty, start must be smaller than end")
+	ErrorNoMergeOperator     = errors.New("no merge operator is configured")
+	ErrorColumnFamilyExists  = errors.New("the column family already exists")
+	ErrorColumnFamilyMissing = errors.New("the column family does not exist")
+	ErrorColumnFamilyDropped = errors.New("the column family was dropped")
+	ErrorDropDefaultFamily   = errors.New("the default column family can not be dropped")
+	ErrorFamilyNameIsEmpty   = errors.New("the column family name is empty")
+	ErrorFamilyFileCorrupted = errors.New("the column family file is corrupted")
+	ErrorUnknownCompressor   = errors.New("the compressor is not registered")
+	ErrorCompressorConflict  = errors.New("the compressor id is already used")
+	ErrorManifestCorrupted   = errors.New("the manifest is corrupted")
+	ErrorValueLogCorrupted   = errors.New("the value log is corrupted")
+	ErrorNoValueLogRewrite   = errors.New("no value log segment has enough garbage to be rewritten")
+	ErrorInvalidDiscardRatio = errors.New("the discard ratio must be between 0 and 1")
+	ErrorCheckpointExists    = errors.New("the checkpoint directory already exists")
+	ErrorBackupDirIsUsing    = errors.New("the backup directory is used by another process")
+	ErrorBackupNotFound      = errors.New("the backup does not exist")
+	ErrorBackupCorrupted     = errors.New("the backup is corrupted")
+	ErrorRestoreDirNotEmpty  = errors.New("the restore directory is not empty")
+	ErrorLogRecordCorrupted  = errors.New("the log record is corrupted")
+	ErrorMalformedFrame      = errors.New("the frame is malformed")
+	ErrorFrameTooLarge       = errors.New("the frame is too large")
+	ErrorUnknownOp           = errors.New("the op of the frame is unknown")
+	ErrorClientClosed        = errors.New("the client is closed")
+	ErrorReadOnlyDB          = errors.New("the database is opened read-only")
+	ErrorInvalidThreshold    = errors.New("the value threshold must be between 0 and 65535")
 )
@@ -0,0 +1,128 @@
+// Package protocol is the binary protocol of SmartStashDB, a stream of length-prefixed
+// frames whose payloads are encoded LogRecords, so no text has to be parsed.
+//
+// A frame is the length of the rest of the frame as a big-endian uint32, the kind, the
+// flags, the id as a big-endian uint64 and the payload. The kind of a request is its Op and
+// the kind of a response is its Status. The responses are sent in the order of the
+// requests and carry their ids, a scan is answered by StatusMore frames followed by one
+// StatusOK or StatusError frame.
+package protocol
+
+import (
+	_const "SmartStashDB/const"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const (
+	// headerSize is the size of the kind, the flags and the id of a frame.
+	headerSize = 1 + 1 + 8
+	// DefaultMaxFrameLength bounds the frames that are read when no other limit is given.
+	DefaultMaxFrameLength = 64 * 1024 * 1024
+	// readSize is the initial buffer of a frame, it grows as the payload arrives so that a
+	// peer can not make the reader allocate a frame it never sends.
+	readSize = 64 * 1024
+)
+
+// Op is the kind of a request.
+type Op = byte
+
+const (
+	// OpPing has no payload and is answered with an empty StatusOK frame.
+	OpPing Op = iota + 1
+	// OpGet carries a record with the key, the response carries a record with the key and
+	// the value.
+	OpGet
+	// OpPut carries a LogRecordNormal record, its Expire is the time to live in
+	// nanoseconds and zero means never.
+	OpPut
+	// OpDelete carries a LogRecordDeleted record with the key.
+	OpDelete
+	// OpBatch carries the records of a batch, see EncodeRecords, they are committed
+	// atomically.
+	OpBatch
+	// OpScan carries a scan request, see EncodeScan, the responses carry the records of
+	// the pairs that are found.
+	OpScan
+)
+
+// Status is the kind of a response.
+type Status = byte
+
+const (
+	StatusOK Status = iota + 1
+	// StatusMore is a part of the response, more frames with the same id follow.
+	StatusMore
+	// StatusError carries an error, see EncodeError.
+	StatusError
+)
+
+// The flags of the write requests, they are the WriteOptions of the write.
+const (
+	FlagSync byte = 1 << iota
+	FlagDisableWal
+)
+
+// Frame is a request or a response.
+type Frame struct {
+	Kind    byte
+	Flags   byte
+	Id      uint64
+	Payload []byte
+}
+
+// ReadFrame reads the next frame, it returns io.EOF if the stream ends between frames and
+// io.ErrUnexpectedEOF if it ends in the middle of one. A frame longer than maxLength fails
+// with ErrorFrameTooLarge, zero means DefaultMaxFrameLength.
+func ReadFrame(r *bufio.Reader, maxLength uint32) (*Frame, error) {
+	if maxLength == 0 {
+		maxLength = DefaultMaxFrameLength
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n < headerSize {
+		return nil, _const.ErrorMalformedFrame
+	}
+	if n > maxLength {
+		return nil, _const.ErrorFrameTooLarge
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(min(n, readSize)))
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(n))); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := buf.Bytes()
+	return &Frame{
+		Kind:    b[0],
+		Flags:   b[1],
+		Id:      binary.BigEndian.Uint64(b[2:headerSize]),
+		Payload: b[headerSize:],
+	}, nil
+}
+
+// WriteFrame writes the frame, it is only sent once w is flushed. The peer refuses a frame
+// longer than its own limit.
+func WriteFrame(w *bufio.Writer, frame *Frame) error {
+	if len(frame.Payload) > math.MaxUint32-headerSize {
+		return _const.ErrorFrameTooLarge
+	}
+	var header [4 + headerSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(headerSize+len(frame.Payload)))
+	header[4] = frame.Kind
+	header[5] = frame.Flags
+	binary.BigEndian.PutUint64(header[6:], frame.Id)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame.Payload)
+	return err
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+	"encoding/binary"
+	"errors"
+)
+
+// EncodeRecord encodes the payload of a frame that carries one record.
+func EncodeRecord(record *storage.LogRecord) []byte {
+	return record.Encode()
+}
+
+// DecodeRecord decodes the payload of a frame that carries one record.
+func DecodeRecord(b []byte) (*storage.LogRecord, error) {
+	record := storage.NewLogRecord()
+	if err := record.DecodeChecked(b); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// EncodeRecords encodes the records as the uvarint length of every encoded record
+// followed by the record.
+func EncodeRecords(records []*storage.LogRecord) []byte {
+	var b []byte
+	for _, record := range records {
+		b = AppendRecord(b, record)
+	}
+	return b
+}
+
+// AppendRecord appends the record to the records encoded in b.
+func AppendRecord(b []byte, record *storage.LogRecord) []byte {
+	encoded := record.Encode()
+	b = binary.AppendUvarint(b, uint64(len(encoded)))
+	return append(b, encoded...)
+}
+
+// DecodeRecords decodes the records encoded by EncodeRecords.
+func DecodeRecords(b []byte) ([]*storage.LogRecord, error) {
+	var records []*storage.LogRecord
+	for len(b) > 0 {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return nil, _const.ErrorMalformedFrame
+		}
+		record, err := DecodeRecord(b[n : n+int(length)])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		b = b[n+int(length):]
+	}
+	return records, nil
+}
+
+// ScanRequest is the payload of OpScan. It returns the pairs with Start <= key < End,
+// an empty bound is open, and a Limit of zero returns all of them.
+type ScanRequest struct {
+	Start    []byte
+	End      []byte
+	Limit    uint64
+	Reverse  bool
+	KeysOnly bool
+}
+
+const (
+	scanReverse byte = 1 << iota
+	scanKeysOnly
+)
+
+// EncodeScan encodes the request as its flags, the uvarint limit and a record whose key is
+// the start and whose value is the end.
+func EncodeScan(req *ScanRequest) []byte {
+	var flags byte
+	if req.Reverse {
+		flags |= scanReverse
+	}
+	if req.KeysOnly {
+		flags |= scanKeysOnly
+	}
+	b := []byte{flags}
+	b = binary.AppendUvarint(b, req.Limit)
+	record := &storage.LogRecord{Key: req.Start, Value: req.End, Type: storage.LogRecordNormal}
+	return append(b, record.Encode()...)
+}
+
+// DecodeScan decodes the request encoded by EncodeScan.
+func DecodeScan(b []byte) (*ScanRequest, error) {
+	if len(b) == 0 {
+		return nil, _const.ErrorMalformedFrame
+	}
+	limit, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return nil, _const.ErrorMalformedFrame
+	}
+	record, err := DecodeRecord(b[1+n:])
+	if err != nil {
+		return nil, err
+	}
+	req := &ScanRequest{
+		Limit:    limit,
+		Reverse:  b[0]&scanReverse != 0,
+		KeysOnly: b[0]&scanKeysOnly != 0,
+	}
+	if len(record.Key) > 0 {
+		req.Start = record.Key
+	}
+	if len(record.Value) > 0 {
+		req.End = record.Value
+	}
+	return req, nil
+}
+
+// knownErrors are the errors that keep their identity across the wire, the code of an
+// error is its index. Code zero is any other error, only its message is sent.
+var knownErrors = []error{
+	nil,
+	_const.ErrorKeyNotFound,
+	_const.ErrorDBClosed,
+	_const.ErrorKeyIsEmpty,
+	_const.ErrorInvalidRange,
+	_const.ErrorDataToLarge,
+	_const.ErrorPendingSizeTooLarge,
+	_const.ErrTxnConflict,
+	_const.ErrorNoMergeOperator,
+	_const.ErrorLogRecordCorrupted,
+	_const.ErrorMalformedFrame,
+	_const.ErrorFrameTooLarge,
+	_const.ErrorUnknownOp,
+}
+
+// EncodeError encodes the error as its code followed by its message.
+func EncodeError(err error) []byte {
+	code := byte(0)
+	for i := 1; i < len(knownErrors); i++ {
+		if errors.Is(err, knownErrors[i]) {
+			code = byte(i)
+			break
+		}
+	}
+	return append([]byte{code}, err.Error()...)
+}
+
+// DecodeError decodes the error encoded by EncodeError, a known error is returned as is so
+// that errors.Is works on both sides.
+func DecodeError(b []byte) error {
+	if len(b) == 0 {
+		return _const.ErrorMalformedFrame
+	}
+	if code := int(b[0]); code > 0 && code < len(knownErrors) {
+		return knownErrors[code]
+	}
+	return errors.New(string(b[1:]))
+}
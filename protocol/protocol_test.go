@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+
+	_const "SmartStashDB/const"
+	"SmartStashDB/storage"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		{Kind: OpPing, Id: 1},
+		{Kind: OpPut, Flags: FlagSync | FlagDisableWal, Id: 1 << 40, Payload: []byte("payload")},
+		{Kind: StatusMore, Id: 3, Payload: bytes.Repeat([]byte{0xab}, 3*readSize+5)},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, frame := range frames {
+		if err := WriteFrame(w, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range frames {
+		got, err := ReadFrame(r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Kind != want.Kind || got.Flags != want.Flags || got.Id != want.Id || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("read frame %d %d %d, want %d %d %d", got.Kind, got.Flags, got.Id, want.Kind, want.Flags, want.Id)
+		}
+	}
+	if _, err := ReadFrame(r, 0); err != io.EOF {
+		t.Fatalf("read after the last frame: %v", err)
+	}
+}
+
+// frameBytes encodes the frame and returns its bytes.
+func frameBytes(t *testing.T, frame *Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := WriteFrame(w, frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBrokenFrames(t *testing.T) {
+	encoded := frameBytes(t, &Frame{Kind: OpGet, Id: 7, Payload: []byte("key")})
+	tooShort := binary.BigEndian.AppendUint32(nil, headerSize-1)
+	tooLarge := binary.BigEndian.AppendUint32(nil, DefaultMaxFrameLength+1)
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{encoded[:2], io.ErrUnexpectedEOF},
+		{encoded[:4], io.ErrUnexpectedEOF},
+		{encoded[:len(encoded)-1], io.ErrUnexpectedEOF},
+		{append(tooShort, make([]byte, headerSize)...), _const.ErrorMalformedFrame},
+		{tooLarge, _const.ErrorFrameTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(tt.data)), 0); !errors.Is(err, tt.err) {
+			t.Fatalf("read %x: %v, want %v", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	encoded := frameBytes(t, &Frame{Kind: OpPut, Id: 1, Payload: make([]byte, 100)})
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(encoded)), headerSize+99); !errors.Is(err, _const.ErrorFrameTooLarge) {
+		t.Fatalf("frame over the limit: %v", err)
+	}
+	frame, err := ReadFrame(bufio.NewReader(bytes.NewReader(encoded)), headerSize+100)
+	if err != nil || len(frame.Payload) != 100 {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+}
+
+func TestAnnouncedFrameIsNotAllocated(t *testing.T) {
+	// The frame announces the largest length allowed but only sends its header.
+	data := binary.BigEndian.AppendUint32(nil, math.MaxUint32)
+	data = append(data, make([]byte, headerSize)...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadFrame(bufio.NewReader(bytes.NewReader(data)), math.MaxUint32)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated frame: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Fatalf("%d bytes allocated for a frame of %d bytes", allocated, headerSize)
+	}
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+	records := []*storage.LogRecord{
+		{Key: []byte("a"), Value: []byte("1"), Type: storage.LogRecordNormal, Expire: uint64(1e9)},
+		{Key: []byte("b"), Type: storage.LogRecordDeleted},
+		{Key: []byte("c"), Value: []byte("d"), Type: storage.LogRecordRangeDeleted},
+		{Key: []byte("e"), Value: bytes.Repeat([]byte("v"), 1000), Type: storage.LogRecordMerge},
+	}
+	decoded, err := DecodeRecords(EncodeRecords(records))
+	if err != nil || len(decoded) != len(records) {
+		t.Fatalf("decoded %d records: %v", len(decoded), err)
+	}
+	for i, record := range records {
+		got := decoded[i]
+		if got.Type != record.Type || got.Expire != record.Expire ||
+			!bytes.Equal(got.Key, record.Key) || !bytes.Equal(got.Value, record.Value) {
+			t.Fatalf("record %d decoded as %+v, want %+v", i, got, record)
+		}
+	}
+	if records, err := DecodeRecords(nil); err != nil || len(records) != 0 {
+		t.Fatalf("no records decoded as %d records: %v", len(records), err)
+	}
+
+	encoded := EncodeRecords(records[:1])
+	for _, b := range [][]byte{encoded[:len(encoded)-1], {0xff}, {5, 1, 2}} {
+		if _, err := DecodeRecords(b); err == nil {
+			t.Fatalf("broken records %x are decoded", b)
+		}
+	}
+	if _, err := DecodeRecord(encoded[1 : len(encoded)-1]); !errors.Is(err, _const.ErrorLogRecordCorrupted) {
+		t.Fatalf("truncated record: %v", err)
+	}
+}
+
+func TestScanRequestRoundTrip(t *testing.T) {
+	requests := []*ScanRequest{
+		{},
+		{Start: []byte("a"), End: []byte("b"), Limit: 1 << 40, Reverse: true},
+		{End: []byte("z"), KeysOnly: true},
+	}
+	for _, req := range requests {
+		got, err := DecodeScan(EncodeScan(req))
+		if err != nil || !reflect.DeepEqual(got, req) {
+			t.Fatalf("decoded %+v %v, want %+v", got, err, req)
+		}
+	}
+	if _, err := DecodeScan(nil); !errors.Is(err, _const.ErrorMalformedFrame) {
+		t.Fatalf("empty scan request: %v", err)
+	}
+}
+
+func TestErrorsKeepTheirIdentity(t *testing.T) {
+	for _, err := range knownErrors[1:] {
+		if got := DecodeError(EncodeError(err)); got != err {
+			t.Fatalf("%v decoded as %v", err, got)
+		}
+	}
+	wrapped := errors.Join(errors.New("context"), _const.ErrorKeyNotFound)
+	if got := DecodeError(EncodeError(wrapped)); got != _const.ErrorKeyNotFound {
+		t.Fatalf("wrapped error decoded as %v", got)
+	}
+	other := errors.New("disk on fire")
+	if got := DecodeError(EncodeError(other)); got.Error() != other.Error() {
+		t.Fatalf("unknown error decoded as %v", got)
+	}
+	if err := DecodeError(nil); !errors.Is(err, _const.ErrorMalformedFrame) {
+		t.Fatalf("empty error: %v", err)
+	}
+}
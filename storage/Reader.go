@@ -1,16 +1,15 @@
-package _const
+package storage
 
 import (
-	"SmartStashDB/storage"
 	"io"
 )
 
 type Reader struct {
-	AllSegmentReader []*storage.SegmentReader
+	AllSegmentReader []*SegmentReader
 	Progress         int
 }
 
-func (r *Reader) Next() ([]byte, *storage.ChunkPosition, error) {
+func (r *Reader) Next() ([]byte, *ChunkPosition, error) {
 	if r.Progress >= len(r.AllSegmentReader) {
 		return nil, nil, io.EOF
 	}
@@ -11,6 +11,17 @@ type SegmentReader struct {
 	chunkoffset uint32
 }
 
+// offset returns the position of the next chunk in the file.
+func (s *SegmentReader) offset() int64 {
+	return int64(s.blockidx)*_const.BlockSize + int64(s.chunkoffset)
+}
+
+// seek moves the reader to the chunk at the offset.
+func (s *SegmentReader) seek(offset int64) {
+	s.blockidx = uint32(offset / _const.BlockSize)
+	s.chunkoffset = uint32(offset % _const.BlockSize)
+}
+
 func (s *SegmentReader) Next() ([]byte, *ChunkPosition, error) {
 	if s.seg.closed {
 		return nil, nil, io.EOF
@@ -26,8 +37,8 @@ func (s *SegmentReader) Next() ([]byte, *ChunkPosition, error) {
 		return nil, nil, err
 	}
 	curChunk.ChunkSize = nextChunk.BlockIndex*_const.BlockSize + nextChunk.ChunkOffset -
-		(s.chunkoffset*_const.BlockSize + curChunk.ChunkOffset)
+		(curChunk.BlockIndex*_const.BlockSize + curChunk.ChunkOffset)
 	s.blockidx = nextChunk.BlockIndex
-	s.chunkoffset = curChunk.ChunkOffset
+	s.chunkoffset = nextChunk.ChunkOffset
 	return data, curChunk, nil
 }
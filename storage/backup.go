@@ -0,0 +1,457 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	backupSharedDir = "shared"
+	backupMetaDir   = "meta"
+	// backupWorkDir holds the checkpoint of the backup that is being created.
+	backupWorkDir = "work"
+
+	backupMetaHeader = "smartstash-backup 1"
+)
+
+// BackupEngine keeps numbered backups of a database in a directory. Every backup is a
+// checkpoint whose files are stored once in the shared directory, keyed by their path, size
+// and checksum, so a backup only copies the files that changed since the previous ones.
+// A meta file per backup lists its files.
+type BackupEngine struct {
+	dir      string
+	mu       sync.Mutex
+	fileLock *flock.Flock
+}
+
+// BackupInfo describes a backup.
+type BackupInfo struct {
+	ID        uint32
+	Timestamp time.Time
+	// Seq is the sequence number of the last batch in the backup.
+	Seq uint64
+	// Files and Size count the files of the backup, the ones shared with other backups included.
+	Files int
+	Size  int64
+}
+
+// backupFile is a file of a backup, path is relative to the database directory.
+type backupFile struct {
+	path   string
+	shared string
+	size   int64
+	crc    uint32
+}
+
+type backupMeta struct {
+	info  BackupInfo
+	files []backupFile
+}
+
+// OpenBackupEngine opens the backups in dir, it is created if it does not exist. The files
+// left by an interrupted backup are deleted.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	for _, sub := range []string{backupSharedDir, backupMetaDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	fileLock := flock.New(filepath.Join(dir, FileLockName))
+	lock, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !lock {
+		return nil, _const.ErrorBackupDirIsUsing
+	}
+
+	engine := &BackupEngine{dir: dir, fileLock: fileLock}
+	err = os.RemoveAll(filepath.Join(dir, backupWorkDir))
+	if err == nil {
+		err = os.RemoveAll(filepath.Join(dir, backupWorkDir) + tmpFileExt)
+	}
+	if err == nil {
+		err = engine.removeUnreferencedFiles()
+	}
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	return engine, nil
+}
+
+// Close releases the backup directory.
+func (e *BackupEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.fileLock.Unlock()
+}
+
+// CreateBackup takes a checkpoint of the live database and stores it as a new backup, the
+// files already stored by a previous backup are shared.
+func (e *BackupEngine) CreateBackup(db *DB) (BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	metas, err := e.readMetas()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	id := uint32(1)
+	if len(metas) > 0 {
+		id = metas[len(metas)-1].info.ID + 1
+	}
+
+	work := filepath.Join(e.dir, backupWorkDir)
+	seq, err := db.checkpoint(work)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer func() {
+		_ = os.RemoveAll(work)
+	}()
+
+	meta := &backupMeta{info: BackupInfo{ID: id, Timestamp: time.Now(), Seq: seq}}
+	err = filepath.WalkDir(work, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(work, path)
+		if err != nil {
+			return err
+		}
+		file, err := e.storeFile(path, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		meta.files = append(meta.files, file)
+		meta.info.Files++
+		meta.info.Size += file.size
+		return nil
+	})
+	if err == nil && len(meta.files) > 0 {
+		err = syncDir(filepath.Join(e.dir, backupSharedDir, meta.files[0].shared))
+	}
+	if err == nil {
+		err = e.writeMeta(meta)
+	}
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return meta.info, nil
+}
+
+// storeFile moves the file of the checkpoint into the shared directory unless a previous
+// backup stored it already.
+func (e *BackupEngine) storeFile(path, rel string) (backupFile, error) {
+	size, crc, err := fileChecksum(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+	file := backupFile{
+		path:   rel,
+		shared: fmt.Sprintf("%s_%d_%08x", strings.ReplaceAll(rel, "/", "_"), size, crc),
+		size:   size,
+		crc:    crc,
+	}
+	shared := filepath.Join(e.dir, backupSharedDir, file.shared)
+	if _, err := os.Stat(shared); err == nil {
+		return file, nil
+	} else if !os.IsNotExist(err) {
+		return backupFile{}, err
+	}
+	return file, os.Rename(path, shared)
+}
+
+// Backups returns the backups, the oldest first.
+func (e *BackupEngine) Backups() ([]BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metas, err := e.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, 0, len(metas))
+	for _, meta := range metas {
+		infos = append(infos, meta.info)
+	}
+	return infos, nil
+}
+
+// VerifyBackup checks that every file of the backup is stored with its size and checksum.
+func (e *BackupEngine) VerifyBackup(id uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range meta.files {
+		size, crc, err := fileChecksum(filepath.Join(e.dir, backupSharedDir, file.shared))
+		if os.IsNotExist(err) {
+			return _const.ErrorBackupCorrupted
+		}
+		if err != nil {
+			return err
+		}
+		if size != file.size || crc != file.crc {
+			return _const.ErrorBackupCorrupted
+		}
+	}
+	return nil
+}
+
+// DeleteBackup deletes the backup and the files no other backup shares.
+func (e *BackupEngine) DeleteBackup(id uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := os.Remove(e.metaPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return _const.ErrorBackupNotFound
+		}
+		return err
+	}
+	return e.removeUnreferencedFiles()
+}
+
+// PurgeOldBackups deletes all but the keep newest backups.
+func (e *BackupEngine) PurgeOldBackups(keep int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metas, err := e.readMetas()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(metas)-keep; i++ {
+		if err := os.Remove(e.metaPath(metas[i].info.ID)); err != nil {
+			return err
+		}
+	}
+	return e.removeUnreferencedFiles()
+}
+
+// RestoreBackup copies the files of the backup into dirPath, which must not exist or be
+// empty, the database is then opened with OpenDB and Options.DirPath set to dirPath. The
+// files are checked against their checksums while they are copied.
+func (e *BackupEngine) RestoreBackup(id uint32, dirPath string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return _const.ErrorRestoreDirNotEmpty
+	}
+
+	for _, file := range meta.files {
+		dst := filepath.Join(dirPath, filepath.FromSlash(file.path))
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		if err := restoreFile(filepath.Join(e.dir, backupSharedDir, file.shared), dst, file); err != nil {
+			return err
+		}
+	}
+	return syncTree(dirPath)
+}
+
+// restoreFile copies the stored file to dst and checks its size and checksum.
+func restoreFile(src, dst string, file backupFile) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return _const.ErrorBackupCorrupted
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err == nil && (size != file.size || hash.Sum32() != file.crc) {
+		err = _const.ErrorBackupCorrupted
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func fileChecksum(path string) (int64, uint32, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, fd)
+	return size, hash.Sum32(), err
+}
+
+// removeUnreferencedFiles deletes the shared files that no backup lists.
+func (e *BackupEngine) removeUnreferencedFiles() error {
+	metas, err := e.readMetas()
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, meta := range metas {
+		for _, file := range meta.files {
+			referenced[file.shared] = true
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(e.dir, backupSharedDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if referenced[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(e.dir, backupSharedDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *BackupEngine) metaPath(id uint32) string {
+	return filepath.Join(e.dir, backupMetaDir, strconv.FormatUint(uint64(id), 10))
+}
+
+// readMetas reads the meta files of all backups, the oldest first.
+func (e *BackupEngine) readMetas() ([]*backupMeta, error) {
+	entries, err := os.ReadDir(filepath.Join(e.dir, backupMetaDir))
+	if err != nil {
+		return nil, err
+	}
+	var metas []*backupMeta
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			// A meta file that was being written.
+			continue
+		}
+		meta, err := e.readMeta(uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].info.ID < metas[j].info.ID })
+	return metas, nil
+}
+
+// A meta file starts with backupMetaHeader, followed by the lines
+//
+//	timestamp <unix nanoseconds>
+//	seq <sequence number>
+//	file <path> <shared name> <size> <crc32>
+func (e *BackupEngine) readMeta(id uint32) (*backupMeta, error) {
+	fd, err := os.Open(e.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, _const.ErrorBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+
+	meta := &backupMeta{info: BackupInfo{ID: id}}
+	scanner := bufio.NewScanner(fd)
+	if !scanner.Scan() || scanner.Text() != backupMetaHeader {
+		return nil, _const.ErrorBackupCorrupted
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "timestamp" && len(fields) == 2:
+			nanos, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, _const.ErrorBackupCorrupted
+			}
+			meta.info.Timestamp = time.Unix(0, nanos)
+		case fields[0] == "seq" && len(fields) == 2:
+			if meta.info.Seq, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return nil, _const.ErrorBackupCorrupted
+			}
+		case fields[0] == "file" && len(fields) == 5:
+			size, sizeErr := strconv.ParseInt(fields[3], 10, 64)
+			crc, crcErr := strconv.ParseUint(fields[4], 16, 32)
+			if sizeErr != nil || crcErr != nil {
+				return nil, _const.ErrorBackupCorrupted
+			}
+			meta.files = append(meta.files, backupFile{path: fields[1], shared: fields[2], size: size, crc: uint32(crc)})
+			meta.info.Files++
+			meta.info.Size += size
+		default:
+			return nil, _const.ErrorBackupCorrupted
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeMeta writes the meta file of the backup, the backup exists once it is renamed in place.
+func (e *BackupEngine) writeMeta(meta *backupMeta) error {
+	var b strings.Builder
+	b.WriteString(backupMetaHeader + "\n")
+	fmt.Fprintf(&b, "timestamp %d\n", meta.info.Timestamp.UnixNano())
+	fmt.Fprintf(&b, "seq %d\n", meta.info.Seq)
+	for _, file := range meta.files {
+		fmt.Fprintf(&b, "file %s %s %d %08x\n", file.path, file.shared, file.size, file.crc)
+	}
+
+	path := e.metaPath(meta.info.ID)
+	fd, err := os.OpenFile(path+tmpFileExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.WriteString(b.String()); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpFileExt, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
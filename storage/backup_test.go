@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func openTestBackupEngine(t *testing.T, dir string) *BackupEngine {
+	t.Helper()
+	engine, err := OpenBackupEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = engine.Close()
+	})
+	return engine
+}
+
+// restoreTestBackup restores the backup into a new directory and opens it.
+func restoreTestBackup(t *testing.T, engine *BackupEngine, id uint32, options Options) *DB {
+	t.Helper()
+	options.DirPath = filepath.Join(t.TempDir(), "restored")
+	if err := engine.RestoreBackup(id, options.DirPath); err != nil {
+		t.Fatalf("restore %d: %v", id, err)
+	}
+	return openTestDB(t, options)
+}
+
+func TestIncrementalBackups(t *testing.T) {
+	options := vlogTestOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupDir := t.TempDir()
+	engine := openTestBackupEngine(t, backupDir)
+	if _, err := OpenBackupEngine(backupDir); !errors.Is(err, _const.ErrorBackupDirIsUsing) {
+		t.Fatalf("second engine on the directory: %v", err)
+	}
+
+	writeCheckpointData(t, db, cf, "first")
+	first, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCheckpointData(t, db, cf, "second")
+	second, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID+1 || second.Seq <= first.Seq {
+		t.Fatalf("backups %+v and %+v", first, second)
+	}
+
+	// The table files of the first backup are not stored again.
+	shared, err := os.ReadDir(filepath.Join(backupDir, backupSharedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) >= first.Files+second.Files {
+		t.Fatalf("%d files stored for backups of %d and %d files", len(shared), first.Files, second.Files)
+	}
+	for _, id := range []uint32{first.ID, second.ID} {
+		if err := engine.VerifyBackup(id); err != nil {
+			t.Fatalf("verify %d: %v", id, err)
+		}
+	}
+
+	restored := restoreTestBackup(t, engine, first.ID, options)
+	checkCheckpointData(t, restored, "first")
+	mustNotFind(t, restored, "second-00000")
+	restored = restoreTestBackup(t, engine, second.ID, options)
+	checkCheckpointData(t, restored, "first")
+	checkCheckpointData(t, restored, "second")
+
+	if err := engine.RestoreBackup(second.ID, options.DirPath); !errors.Is(err, _const.ErrorRestoreDirNotEmpty) {
+		t.Fatalf("restore into the live database: %v", err)
+	}
+
+	// The files the second backup shares with the first one are kept.
+	if err := engine.PurgeOldBackups(1); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := engine.Backups(); err != nil || len(infos) != 1 || infos[0].ID != second.ID {
+		t.Fatalf("backups after the purge: %+v %v", infos, err)
+	}
+	if err := engine.VerifyBackup(first.ID); !errors.Is(err, _const.ErrorBackupNotFound) {
+		t.Fatalf("verify of a purged backup: %v", err)
+	}
+	restored = restoreTestBackup(t, engine, second.ID, options)
+	checkCheckpointData(t, restored, "first")
+
+	if err := engine.DeleteBackup(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if shared, err := os.ReadDir(filepath.Join(backupDir, backupSharedDir)); err != nil || len(shared) != 0 {
+		t.Fatalf("%d files left after the last backup was deleted: %v", len(shared), err)
+	}
+}
+
+func TestCorruptedBackup(t *testing.T) {
+	options := vlogTestOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCheckpointData(t, db, cf, "key")
+	engine := openTestBackupEngine(t, t.TempDir())
+	info, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(engine.dir, backupSharedDir, "*"+tableFileExt+"*"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no stored table file: %v", err)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(paths[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.VerifyBackup(info.ID); !errors.Is(err, _const.ErrorBackupCorrupted) {
+		t.Fatalf("verify of a corrupted backup: %v", err)
+	}
+	if err := engine.RestoreBackup(info.ID, filepath.Join(t.TempDir(), "restored")); !errors.Is(err, _const.ErrorBackupCorrupted) {
+		t.Fatalf("restore of a corrupted backup: %v", err)
+	}
+}
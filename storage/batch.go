@@ -2,173 +2,392 @@ package storage
 
 import (
 	_const "SmartStashDB/const"
+	"bytes"
 	"sync"
+	"time"
 )
-import "github.com/bwmarrin/snowflake"
 
 func makeBatch() interface{} {
-	node, err := snowflake.NewNode(1)
-	if err != nil {
-		panic(err)
-	}
 	return &Batch{
 		options: DefaultBatchOptions,
 		m:       sync.RWMutex{},
-		batchId: node,
 	}
 }
 
+// Batch collects writes in memory and commits them atomically: after a crash either all
+// of them are replayed from the WAL or none, even if they span several column families.
+// The DB lock is only held during Commit.
 type Batch struct {
-	db            *DB
-	pendingWrites map[string]*LogRecord
+	db *DB
+	// pendingWrites are the pending writes of every column family the batch writes.
+	pendingWrites map[*ColumnFamily]*familyWrites
 	options       BatchOptions
 	m             sync.RWMutex
 	commited      bool
-	batchId       *snowflake.Node
+	rollbacked    bool
 }
 
-func (batch *Batch) reset() {
+// familyWrites are the pending writes of a batch into one column family.
+type familyWrites struct {
+	records map[string]*LogRecord
+	// rangeDeletes are the pending range deletions, they hide the writes made before them.
+	rangeDeletes []*LogRecord
+}
 
+// NewBatch creates a batch, it must be finished with Commit or Rollback.
+func (db *DB) NewBatch(options BatchOptions) *Batch {
+	batch := makeBatch().(*Batch)
+	batch.init(options, db)
+	return batch
+}
+
+func (batch *Batch) reset() {
+	batch.db = nil
+	batch.pendingWrites = nil
+	batch.commited = false
+	batch.rollbacked = false
 }
 
-func (batch *Batch) init(readOnly bool, sync bool, db *DB) *Batch {
+func (batch *Batch) init(options BatchOptions, db *DB) *Batch {
 	batch.db = db
-	batch.options.ReadOnly = readOnly
-	batch.options.Sync = sync
-	batch.lock()
+	batch.options = options
+	if !options.ReadOnly {
+		batch.pendingWrites = make(map[*ColumnFamily]*familyWrites)
+	}
 	return batch
 }
 
-func (batch *Batch) lock() {
+// checkWritable must be called with batch.m held.
+func (batch *Batch) checkWritable() error {
 	if batch.options.ReadOnly {
-		batch.db.m.RLock()
-	} else {
-		batch.db.m.Lock()
+		return _const.ErrorReadOnlyBatch
+	}
+	if batch.commited {
+		return _const.ErrorBatchCommited
+	}
+	if batch.rollbacked {
+		return _const.ErrorBatchRollbacked
 	}
+	return nil
 }
 
-func (batch *Batch) writePendingWrites() *Batch {
-	batch.pendingWrites = make(map[string]*LogRecord)
-	return batch
+// family returns the column family of the handle, nil is the default family.
+func (batch *Batch) family(cf *ColumnFamily) *ColumnFamily {
+	if cf == nil {
+		return batch.db.defaultFamily
+	}
+	return cf
 }
 
-func (batch *Batch) put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return _const.ErrorKeyIsEmpty
+// writes returns the pending writes of the family, it must be called with batch.m held.
+func (batch *Batch) writes(cf *ColumnFamily) *familyWrites {
+	writes := batch.pendingWrites[cf]
+	if writes == nil {
+		writes = &familyWrites{records: make(map[string]*LogRecord)}
+		batch.pendingWrites[cf] = writes
 	}
+	return writes
+}
 
-	if batch.db.Closed {
-		return _const.ErrorDBClosed
-	}
+// Put adds the key to the batch, a later write of the same key replaces it.
+func (batch *Batch) Put(key []byte, value []byte) error {
+	return batch.PutCF(nil, key, value)
+}
 
-	if batch.options.ReadOnly {
-		return _const.ErrorReadOnlyBatch
-	}
-	batch.m.Lock()
-	defer batch.m.Unlock()
-	batch.pendingWrites[string(key)] = &LogRecord{
+// PutCF adds the key of the column family to the batch.
+func (batch *Batch) PutCF(cf *ColumnFamily, key []byte, value []byte) error {
+	return batch.putRecord(cf, &LogRecord{
 		Key:   key,
 		Value: value,
 		Type:  LogRecordNormal,
-	}
-	return nil
+	})
 }
 
-func (batch *Batch) unLock() {
-	if batch.options.ReadOnly {
-		batch.db.m.RUnlock()
-	} else {
-		batch.db.m.Unlock()
-	}
+// PutWithTTL adds the key to the batch, it expires ttl after the call.
+func (batch *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return batch.putRecord(nil, &LogRecord{
+		Key:    key,
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expireTime(ttl),
+	})
+}
 
+// Delete adds a deletion of the key to the batch.
+func (batch *Batch) Delete(key []byte) error {
+	return batch.DeleteCF(nil, key)
 }
 
-func (batch *Batch) commit(w *WriteOptions) error {
-	if w == nil {
-		w = &WriteOptions{
-			Sync:       false,
-			DisableWal: false,
-		}
+// DeleteCF adds a deletion of the key of the column family to the batch.
+func (batch *Batch) DeleteCF(cf *ColumnFamily, key []byte) error {
+	return batch.putRecord(cf, &LogRecord{
+		Key:  key,
+		Type: LogRecordDeleted,
+	})
+}
+
+func (batch *Batch) putRecord(cf *ColumnFamily, record *LogRecord) error {
+	if len(record.Key) == 0 {
+		return _const.ErrorKeyIsEmpty
 	}
-	defer batch.unLock()
-	if batch.db.Closed {
-		return _const.ErrorDBClosed
+
+	batch.m.Lock()
+	defer batch.m.Unlock()
+	if err := batch.checkWritable(); err != nil {
+		return err
 	}
+	batch.writes(batch.family(cf)).records[string(record.Key)] = record
+	return nil
+}
 
-	if batch.options.ReadOnly || len(batch.pendingWrites) == 0 {
-		return nil
+// DeleteRange adds a deletion of the keys start <= key < end to the batch, it drops the
+// pending writes of the range. A nil start deletes from the first key and a nil end up to
+// the last one.
+func (batch *Batch) DeleteRange(start, end []byte) error {
+	return batch.DeleteRangeCF(nil, start, end)
+}
+
+// DeleteRangeCF adds a deletion of the keys start <= key < end of the column family to the batch.
+func (batch *Batch) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return _const.ErrorInvalidRange
 	}
 
 	batch.m.Lock()
 	defer batch.m.Unlock()
-	if batch.commited {
-		return _const.ErrorBatchCommited
+	if err := batch.checkWritable(); err != nil {
+		return err
+	}
+	writes := batch.writes(batch.family(cf))
+	r := rangeTombstone{start: start, end: end}
+	for key := range writes.records {
+		if r.contains([]byte(key)) {
+			delete(writes.records, key)
+		}
 	}
+	writes.rangeDeletes = append(writes.rangeDeletes, &LogRecord{
+		Key:   start,
+		Value: end,
+		Type:  LogRecordRangeDeleted,
+	})
+	return nil
+}
 
-	if err := batch.db.waitMemTableSpace(); err != nil {
-		return err
+// DeletePrefix adds a deletion of the keys that start with the prefix to the batch, an
+// empty prefix deletes every key.
+func (batch *Batch) DeletePrefix(prefix []byte) error {
+	return batch.DeleteRange(prefix, PrefixEnd(prefix))
+}
+
+// Merge adds a merge operand of the key to the batch. It is applied right away to a value
+// written by the batch, otherwise it is stacked on the value in the database.
+func (batch *Batch) Merge(key []byte, operand []byte) error {
+	return batch.MergeCF(nil, key, operand)
+}
+
+// MergeCF adds a merge operand of the key of the column family to the batch.
+func (batch *Batch) MergeCF(cf *ColumnFamily, key []byte, operand []byte) error {
+	if len(key) == 0 {
+		return _const.ErrorKeyIsEmpty
+	}
+	cf = batch.family(cf)
+	if cf.options.MergeOperator == nil {
+		return _const.ErrorNoMergeOperator
 	}
 
-	batchId := batch.batchId.Generate()
-	if err := batch.db.activeMem.putBatch(batch.pendingWrites, batchId, w); err != nil {
+	batch.m.Lock()
+	defer batch.m.Unlock()
+	if err := batch.checkWritable(); err != nil {
 		return err
 	}
-	batch.commited = true
+	writes := batch.writes(cf)
+	record := writes.records[string(key)]
+	switch {
+	case record == nil:
+		writes.records[string(key)] = &LogRecord{
+			Key:   key,
+			Value: appendMergeOperand(nil, operand),
+			Type:  LogRecordMerge,
+		}
+	case record.Type == LogRecordMerge:
+		record.Value = appendMergeOperand(record.Value, operand)
+	default:
+		var existing []byte
+		if record.Type == LogRecordNormal && !record.expired() {
+			existing = record.Value
+		}
+		value, err := cf.options.MergeOperator.Merge(key, existing, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+		writes.records[string(key)] = &LogRecord{
+			Key:   key,
+			Value: value,
+			Type:  LogRecordNormal,
+		}
+	}
 	return nil
 }
 
+// Get reads the key from the pending writes of the batch first, then from the database.
 func (batch *Batch) Get(key []byte) ([]byte, error) {
+	return batch.GetCF(nil, key)
+}
+
+// GetCF reads the key of the column family through the pending writes of the batch.
+func (batch *Batch) GetCF(cf *ColumnFamily, key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, _const.ErrorKeyIsEmpty
 	}
 
-	if batch.db.Closed {
-		return nil, _const.ErrorDBClosed
-	}
+	batch.m.RLock()
+	defer batch.m.RUnlock()
+	value, _, err := batch.get(cf, key, nil)
+	return value, err
+}
 
-	if batch.pendingWrites != nil {
-		batch.m.RLock()
-		defer batch.m.RUnlock()
-		if record := batch.pendingWrites[string(key)]; record != nil {
-			if record.Type == LogRecordDeleted {
-				return nil, _const.ErrorKeyNotFound
-			}
-			return record.Value, nil
+// get reads the key of the family through the pending writes, the database is read as of
+// the snapshot, or the latest data if it is nil, when they do not decide the value. read
+// reports whether the database was read. It must be called with batch.m held.
+func (batch *Batch) get(cf *ColumnFamily, key []byte, snapshot *Snapshot) (value []byte, read bool, err error) {
+	cf = batch.family(cf)
+	writes := batch.pendingWrites[cf]
+	var record *LogRecord
+	if writes != nil {
+		record = writes.records[string(key)]
+	}
+	if record != nil && record.Type != LogRecordMerge {
+		if record.Type == LogRecordDeleted || record.expired() {
+			return nil, false, _const.ErrorKeyNotFound
 		}
+		return record.Value, false, nil
+	}
+	rangeDeleted := writes.rangeDeleted(key)
+	if record == nil && rangeDeleted {
+		return nil, false, _const.ErrorKeyNotFound
 	}
 
-	tables := batch.db.getMemTables()
+	db := batch.db
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return nil, false, _const.ErrorDBClosed
+	}
+	if cf, err = db.family(cf); err != nil {
+		return nil, false, err
+	}
+	readTs := db.seq
+	if snapshot != nil {
+		readTs = snapshot.seq
+	}
+	if record == nil {
+		value, err := cf.get(key, readTs)
+		return value, true, err
+	}
 
-	for _, table := range tables {
-		deleted, value := table.get(key)
-		if deleted {
-			return nil, _const.ErrorKeyNotFound
+	// A pending merge is applied to the value in the database.
+	var existing []byte
+	if !rangeDeleted {
+		existing, err = cf.get(key, readTs)
+		if err != nil && err != _const.ErrorKeyNotFound {
+			return nil, true, err
 		}
-		if len(value) != 0 {
-			return value, nil
+	}
+	value, err = cf.fullMerge(key, existing, [][]byte{record.Value})
+	return value, !rangeDeleted, err
+}
+
+// Commit writes all pending writes to the WAL and the memtable as one unit. If w is nil
+// the Sync setting of the BatchOptions is used. A batch that does not fit into an empty
+// memtable of a family it writes fails with ErrorDataToLarge.
+func (batch *Batch) Commit(w *WriteOptions) error {
+	if w == nil {
+		w = &WriteOptions{
+			Sync:       batch.options.Sync,
+			DisableWal: false,
 		}
 	}
 
-	return nil, _const.ErrorKeyNotFound
+	batch.m.Lock()
+	defer batch.m.Unlock()
+	if batch.commited {
+		return _const.ErrorBatchCommited
+	}
+	if batch.rollbacked {
+		return _const.ErrorBatchRollbacked
+	}
+	if batch.options.ReadOnly || batch.empty() {
+		batch.commited = true
+		return nil
+	}
+	return batch.commit(w, nil)
+}
+
+// empty must be called with batch.m held.
+func (batch *Batch) empty() bool {
+	for _, writes := range batch.pendingWrites {
+		if len(writes.records) > 0 || len(writes.rangeDeletes) > 0 {
+			return false
+		}
+	}
+	return true
 }
 
-func (batch *Batch) delete(key []byte) error {
-	if len(key) == 0 {
-		return _const.ErrorKeyIsEmpty
+// rangeDeleted reports whether a pending range deletion contains the key, writes may be nil.
+func (writes *familyWrites) rangeDeleted(key []byte) bool {
+	if writes == nil {
+		return false
+	}
+	for _, record := range writes.rangeDeletes {
+		if (rangeTombstone{start: record.Key, end: record.Value}).contains(key) {
+			return true
+		}
 	}
+	return false
+}
 
-	if batch.db.Closed {
-		return _const.ErrorDBClosed
+// commit applies the pending writes through the commit queue of the database, check runs
+// right before the batch is written if it is not nil. It must be called with batch.m held.
+func (batch *Batch) commit(w *WriteOptions, check func() error) error {
+	writes := make(map[*ColumnFamily]*familyWrites, len(batch.pendingWrites))
+	ttl := expireTime(w.TTL)
+	for cf, familyWrites := range batch.pendingWrites {
+		if len(familyWrites.records) == 0 && len(familyWrites.rangeDeletes) == 0 {
+			continue
+		}
+		writes[cf] = familyWrites
+		if ttl == 0 {
+			continue
+		}
+		for _, record := range familyWrites.records {
+			if record.Type == LogRecordNormal && record.Expire == 0 {
+				record.Expire = ttl
+			}
+		}
 	}
 
-	if batch.options.ReadOnly {
-		return _const.ErrorReadOnlyBatch
+	err := batch.db.write(&commitRequest{
+		writes:     writes,
+		batchId:    batch.db.batchIds.Generate(),
+		sync:       w.Sync,
+		disableWal: w.DisableWal,
+		check:      check,
+	})
+	if err != nil {
+		return err
 	}
+	batch.commited = true
+	return nil
+}
+
+// Rollback discards the pending writes, the batch can not be used afterwards.
+func (batch *Batch) Rollback() error {
 	batch.m.Lock()
-	batch.pendingWrites[string(key)] = &LogRecord{
-		Key:  key,
-		Type: LogRecordDeleted,
+	defer batch.m.Unlock()
+	if batch.commited {
+		return _const.ErrorBatchCommited
 	}
-	batch.m.Unlock()
+	batch.pendingWrites = nil
+	batch.rollbacked = true
 	return nil
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func TestBatchCommitsAllWrites(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("b", "old", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	if err := batch.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	// The last write of a key wins.
+	if err := batch.Put([]byte("c"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch reads its own writes, the database does not see them yet.
+	if value, err := batch.Get([]byte("c")); err != nil || string(value) != "3" {
+		t.Fatalf("batch get c: %q %v", value, err)
+	}
+	if _, err := batch.Get([]byte("b")); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("batch get of a deleted key: %v", err)
+	}
+	mustNotFind(t, db, "a")
+	mustGet(t, db, "b", "old")
+
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "1")
+	mustNotFind(t, db, "b")
+	mustGet(t, db, "c", "3")
+
+	if err := batch.Put([]byte("d"), []byte("4")); !errors.Is(err, _const.ErrorBatchCommited) {
+		t.Fatalf("put after commit: %v", err)
+	}
+	if err := batch.Commit(nil); !errors.Is(err, _const.ErrorBatchCommited) {
+		t.Fatalf("second commit: %v", err)
+	}
+	if err := batch.Rollback(); !errors.Is(err, _const.ErrorBatchCommited) {
+		t.Fatalf("rollback after commit: %v", err)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	batch := db.NewBatch(DefaultBatchOptions)
+	if err := batch.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "a")
+	if err := batch.Put([]byte("a"), []byte("1")); !errors.Is(err, _const.ErrorBatchRollbacked) {
+		t.Fatalf("put after rollback: %v", err)
+	}
+	if err := batch.Commit(nil); !errors.Is(err, _const.ErrorBatchRollbacked) {
+		t.Fatalf("commit after rollback: %v", err)
+	}
+}
+
+func TestReadOnlyBatch(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("a", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch(BatchOptions{ReadOnly: true})
+	if value, err := batch.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("get a: %q %v", value, err)
+	}
+	if err := batch.Put([]byte("b"), []byte("2")); !errors.Is(err, _const.ErrorReadOnlyBatch) {
+		t.Fatalf("put into a read-only batch: %v", err)
+	}
+	if err := batch.Delete([]byte("a")); !errors.Is(err, _const.ErrorReadOnlyBatch) {
+		t.Fatalf("delete in a read-only batch: %v", err)
+	}
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Get(nil); !errors.Is(err, _const.ErrorKeyIsEmpty) {
+		t.Fatalf("get of an empty key: %v", err)
+	}
+}
+
+func TestBatchIsReplayedAsAWhole(t *testing.T) {
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	batch := db.NewBatch(DefaultBatchOptions)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := batch.Put([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Commit(&WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	options.DirPath = crashCopy(t, options.DirPath)
+	recovered := openTestDB(t, options)
+	for _, key := range []string{"a", "b", "c"} {
+		mustGet(t, recovered, key, "value-"+key)
+	}
+}
+
+func TestBatchBiggerThanMemTable(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 1 * _const.MB
+	db := openTestDB(t, options)
+
+	value := bytes.Repeat([]byte{'v'}, 1024)
+	batch := db.NewBatch(DefaultBatchOptions)
+	for i := 0; i < 4000; i++ {
+		if err := batch.Put([]byte(fmt.Sprintf("key-%04d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Commit(nil); !errors.Is(err, _const.ErrorDataToLarge) {
+		t.Fatalf("commit of a batch bigger than the memtable: %v", err)
+	}
+
+	// Batches that fit into an empty memtable go to a new one when the active memtable has
+	// no room left for them.
+	for b := 0; b < 10; b++ {
+		batch := db.NewBatch(DefaultBatchOptions)
+		for i := 0; i < 700; i++ {
+			if err := batch.Put([]byte(fmt.Sprintf("b%d-key-%04d", b, i)), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Commit(nil); err != nil {
+			t.Fatalf("batch %d: %v", b, err)
+		}
+	}
+	for b := 0; b < 10; b++ {
+		for i := 0; i < 700; i += 99 {
+			key := fmt.Sprintf("b%d-key-%04d", b, i)
+			if got, err := db.Get(key); err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("get %s: %d bytes, %v", key, len(got), err)
+			}
+		}
+	}
+}
+
+func TestConcurrentBatchIdsAreUnique(t *testing.T) {
+	const (
+		writers = 8
+		batches = 100
+	)
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < batches; i++ {
+				key := []byte(fmt.Sprintf("w%d-b%03d", w, i))
+				batch := db.NewBatch(DefaultBatchOptions)
+				if err := batch.Put(key, key); err != nil {
+					errs <- err
+					return
+				}
+				if err := batch.PutCF(cf, key, key); err != nil {
+					errs <- err
+					return
+				}
+				if err := batch.Commit(&WriteOptions{Sync: false}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Every batch logs one BatchEnd record in each family, the records of two batches
+	// with the same id would be replayed as one batch.
+	options.DirPath = crashCopy(t, options.DirPath)
+	for _, familyDir := range []string{options.DirPath, columnFamilyDir(options.DirPath, cf.ID())} {
+		ids := walBatches(t, familyDir)
+		if len(ids) != writers*batches {
+			t.Fatalf("%s: %d batches logged, want %d", familyDir, len(ids), writers*batches)
+		}
+		seen := make(map[uint64]bool, len(ids))
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("%s: the batch id %d is logged twice", familyDir, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	recovered := openTestDB(t, options)
+	if report := recovered.RecoveryReport(); report.DroppedBatches != 0 {
+		t.Fatalf("no batch should be dropped: %+v", report)
+	}
+	other, err := recovered.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < batches; i++ {
+			key := fmt.Sprintf("w%d-b%03d", w, i)
+			mustGet(t, recovered, key, key)
+			mustGetCF(t, recovered, other, key, key)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// bloomFilter answers whether a key may be in a memtable or a table, a false answer is
+// always right. The encoding is the bit array followed by one byte with the probe count.
+type bloomFilter []byte
+
+// bloomProbes returns the number of hash probes that gives the lowest false positive rate
+// for the bits per key, it is bitsPerKey * ln(2).
+func bloomProbes(bitsPerKey int) int {
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return k
+}
+
+// newBloomFilter returns an empty filter sized for the number of keys.
+func newBloomFilter(keys int, bitsPerKey int) bloomFilter {
+	bits := keys * bitsPerKey
+	// A tiny filter has a very high false positive rate.
+	if bits < 64 {
+		bits = 64
+	}
+	filter := make(bloomFilter, (bits+7)/8+1)
+	filter[len(filter)-1] = byte(bloomProbes(bitsPerKey))
+	return filter
+}
+
+// buildBloomFilter returns a filter of the key hashes.
+func buildBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	filter := newBloomFilter(len(hashes), bitsPerKey)
+	for _, h := range hashes {
+		filter.addHash(h)
+	}
+	return filter
+}
+
+func (f bloomFilter) add(key []byte) {
+	f.addHash(bloomHash(key))
+}
+
+// addHash sets the probe bits of the hash, the probes are derived from it by double hashing.
+func (f bloomFilter) addHash(h uint32) {
+	bits := uint32(len(f)-1) * 8
+	delta := h>>17 | h<<15
+	for i := byte(0); i < f[len(f)-1]; i++ {
+		pos := h % bits
+		f[pos/8] |= 1 << (pos % 8)
+		h += delta
+	}
+}
+
+// mayContain reports whether the key may have been added, an invalid filter matches everything.
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	k := f[len(f)-1]
+	if k > 30 {
+		return true
+	}
+	h := bloomHash(key)
+	bits := uint32(len(f)-1) * 8
+	delta := h>>17 | h<<15
+	for i := byte(0); i < k; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// bloomHash is the murmur like hash of leveldb.
+func bloomHash(b []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+	h := uint32(seed) ^ uint32(len(b))*m
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(b) {
+	case 3:
+		h += uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(b[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	const keys = 10000
+	var hashes []uint32
+	for i := 0; i < keys; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	filter := buildBloomFilter(hashes, 10)
+	for i := 0; i < keys; i++ {
+		if !filter.mayContain([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("key-%d was added but is not in the filter", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < keys; i++ {
+		if filter.mayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	// 10 bits per key give about 1%.
+	if rate := float64(falsePositives) / keys; rate > 0.02 {
+		t.Fatalf("false positive rate %.3f", rate)
+	}
+}
+
+func TestInvalidBloomFilterMatchesEverything(t *testing.T) {
+	for _, filter := range []bloomFilter{nil, {0}, {0, 0, 0, 31}} {
+		if !filter.mayContain([]byte("key")) {
+			t.Fatalf("the filter %v rejects a key", filter)
+		}
+	}
+	filter := newBloomFilter(1, 10)
+	if filter.mayContain([]byte("key")) {
+		t.Fatal("an empty filter matches a key")
+	}
+	filter.add([]byte("key"))
+	if !filter.mayContain([]byte("key")) {
+		t.Fatal("the added key is not in the filter")
+	}
+}
+
+func TestTableFilters(t *testing.T) {
+	for _, bitsPerKey := range []int{0, 10} {
+		options := compactionTestOptions(t)
+		options.BloomBitsPerKey = bitsPerKey
+		db, err := OpenDB(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillMemTables(t, db, "key", 3000)
+		waitForCompaction(t, db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The filters are read back from the table files.
+		db = openTestDB(t, options)
+		db.m.RLock()
+		for _, tables := range db.defaultFamily.levels {
+			for _, table := range tables {
+				if (table.filter != nil) != (bitsPerKey > 0) {
+					t.Fatalf("bits per key %d: table %d has the filter %v", bitsPerKey, table.id, table.filter != nil)
+				}
+				if table.filter != nil && !table.filter.mayContain(y.ParseKey(table.smallest)) {
+					t.Fatalf("table %d: the filter rejects its smallest key", table.id)
+				}
+			}
+		}
+		db.m.RUnlock()
+		for _, i := range []int{0, 1500, 2999} {
+			mustGet(t, db, fmt.Sprintf("key-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+		}
+		mustNotFind(t, db, "key-99999")
+	}
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// activeFile is a file that is still appended to, the checkpoint copies its first size bytes.
+type activeFile struct {
+	fd   *os.File
+	path string
+	size int64
+}
+
+// Checkpoint writes a consistent copy of the database into dir, which must not exist, that
+// OpenDB opens like the database itself. The writers are only held while the WALs are synced
+// and the immutable files, the table files, the WALs of the immutable memtables and the
+// full value log segments, are hard-linked, the active segments are copied up to their
+// synced size afterwards. A file is copied instead of linked if dir is on another file
+// system. The batches written with WriteOptions.DisableWal and not flushed yet are not in
+// the checkpoint.
+func (db *DB) Checkpoint(dir string) error {
+	_, err := db.checkpoint(dir)
+	return err
+}
+
+// checkpoint writes the checkpoint and returns the sequence number of its last batch.
+func (db *DB) checkpoint(dir string) (uint64, error) {
+	// The WALs of a read-only database may have no active segment to copy.
+	if db.options.ReadOnly {
+		return 0, _const.ErrorReadOnlyDB
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return 0, _const.ErrorCheckpointExists
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	// The checkpoint is written next to dir and renamed once it is complete.
+	tmp := dir + tmpFileExt
+	if err := os.RemoveAll(tmp); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return 0, err
+	}
+	seq, err := db.writeCheckpoint(tmp)
+	if err == nil {
+		err = syncTree(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return 0, err
+	}
+	return seq, nil
+}
+
+func (db *DB) writeCheckpoint(dir string) (uint64, error) {
+	// No segment of the value log is deleted and no flush or compaction changes the files
+	// while they are linked.
+	db.vlog.gcMu.Lock()
+	defer db.vlog.gcMu.Unlock()
+	db.commitMu.Lock()
+	db.m.RLock()
+	if db.Closed {
+		db.m.RUnlock()
+		db.commitMu.Unlock()
+		return 0, _const.ErrorDBClosed
+	}
+	families := db.sortedFamilies()
+	db.m.RUnlock()
+	for _, cf := range families {
+		cf.bgMu.Lock()
+	}
+	defer func() {
+		for _, cf := range families {
+			cf.bgMu.Unlock()
+		}
+	}()
+
+	seq, active, err := db.linkCheckpoint(dir, families)
+	db.commitMu.Unlock()
+	defer func() {
+		for _, file := range active {
+			_ = file.fd.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	// The writers only append after the recorded sizes.
+	for _, file := range active {
+		if err := copyFilePrefix(file.fd, filepath.Join(dir, file.path), file.size); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// linkCheckpoint syncs the active files, links the immutable ones into dir, opens the active
+// ones and writes the MANIFEST. It must be called with db.commitMu and the bgMu of the
+// families held.
+func (db *DB) linkCheckpoint(dir string, families []*ColumnFamily) (uint64, []*activeFile, error) {
+	var active []*activeFile
+	fail := func(err error) (uint64, []*activeFile, error) {
+		return 0, active, err
+	}
+	// addWal links the full segments of the WAL and records its active segment.
+	addWal := func(wal *TinyWAL, whole bool) error {
+		if err := wal.Sync(); err != nil {
+			return err
+		}
+		immutable, activeSegment := wal.segments()
+		if whole {
+			immutable = append(immutable, activeSegment)
+		}
+		for _, segment := range immutable {
+			if err := db.linkIntoCheckpoint(dir, segment.fd.Name()); err != nil {
+				return err
+			}
+		}
+		if whole {
+			return nil
+		}
+		path, err := filepath.Rel(db.options.DirPath, activeSegment.fd.Name())
+		if err != nil {
+			return err
+		}
+		fd, err := os.Open(activeSegment.fd.Name())
+		if err != nil {
+			return err
+		}
+		active = append(active, &activeFile{fd: fd, path: path, size: activeSegment.Size()})
+		return nil
+	}
+
+	db.m.RLock()
+	seq := db.seq
+	memTables := make(map[*ColumnFamily][]*MemTable, len(families))
+	for _, cf := range families {
+		memTables[cf] = cf.getMemTables()
+	}
+	db.m.RUnlock()
+
+	for _, cf := range families {
+		if err := os.MkdirAll(columnFamilyDir(dir, cf.id), os.ModePerm); err != nil {
+			return fail(err)
+		}
+		for _, mem := range memTables[cf] {
+			if err := addWal(mem.tinyWal, mem != cf.activeMem); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := addWal(db.vlog.wal, false); err != nil {
+		return fail(err)
+	}
+
+	manifest, tables := db.versions.checkpointState(seq)
+	for _, table := range tables {
+		if err := db.linkIntoCheckpoint(dir, tableFileName(columnFamilyDir(db.options.DirPath, table.family), table.id)); err != nil {
+			return fail(err)
+		}
+	}
+	if err := writeManifest(dir, manifest); err != nil {
+		return fail(err)
+	}
+	return seq, active, nil
+}
+
+// linkIntoCheckpoint links the file of the database into the same place of dir.
+func (db *DB) linkIntoCheckpoint(dir string, path string) error {
+	rel, err := filepath.Rel(db.options.DirPath, path)
+	if err != nil {
+		return err
+	}
+	return linkOrCopyFile(path, filepath.Join(dir, rel))
+}
+
+// checkpointState returns the MANIFEST of a checkpoint whose last batch is seq and the
+// recorded tables.
+func (vs *versionSet) checkpointState(seq uint64) ([]byte, []tableMeta) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	edit := vs.snapshot()
+	edit.lastSeq = max(edit.lastSeq, seq)
+	return edit.encode(), edit.addedTables
+}
+
+// writeManifest writes the encoded snapshot into the first MANIFEST of dir and points
+// CURRENT to it.
+func writeManifest(dir string, snapshot []byte) error {
+	manifest, err := openSegmentFile(dir, manifestFileExt, 1, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := manifest.Write(snapshot); err != nil {
+		_ = manifest.Close()
+		return err
+	}
+	if err := manifest.Sync(); err != nil {
+		_ = manifest.Close()
+		return err
+	}
+	if err := manifest.Close(); err != nil {
+		return err
+	}
+	return setCurrentFile(dir, filepath.Base(manifest.fd.Name()))
+}
+
+// segments returns the full segments and the active segment of the WAL.
+func (w *TinyWAL) segments() ([]*SegmentFile, *SegmentFile) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	immutable := make([]*SegmentFile, 0, len(w.immutableSegment))
+	for _, segment := range w.immutableSegment {
+		immutable = append(immutable, segment)
+	}
+	return immutable, w.activeSegment
+}
+
+// linkOrCopyFile hard-links src to dst, or copies it if they are on different file systems.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	return copyFilePrefix(fd, dst, info.Size())
+}
+
+// copyFilePrefix copies the first size bytes of src into the new file dst.
+func copyFilePrefix(src *os.File, dst string, size int64) error {
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, io.NewSectionReader(src, 0, size)); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// syncTree syncs the files and the directories below dir.
+func syncTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if err := fd.Sync(); err != nil {
+			_ = fd.Close()
+			return err
+		}
+		return fd.Close()
+	})
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+// writeCheckpointData writes keys into the tables, the memtables and the value log of the
+// default family and of cf.
+func writeCheckpointData(t *testing.T, db *DB, cf *ColumnFamily, prefix string) {
+	t.Helper()
+	fillMemTables(t, db, prefix, 3000)
+	waitForFlush(t, db)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%s-big-%d", prefix, i)
+		if err := db.Put(key, bigValue(key, 0), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutCF(cf, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkCheckpointData(t *testing.T, db *DB, prefix string) {
+	t.Helper()
+	cf, err := db.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, prefix+"-00000", strings.Repeat("v", 100)+"0")
+	mustGet(t, db, prefix+"-02999", strings.Repeat("v", 100)+"2999")
+	for i := 0; i < 10; i += 3 {
+		key := fmt.Sprintf("%s-big-%d", prefix, i)
+		mustGet(t, db, key, bigValue(key, 0))
+		mustGetCF(t, db, cf, key, key)
+	}
+}
+
+func TestCheckpointIsAConsistentCopy(t *testing.T) {
+	options := vlogTestOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCheckpointData(t, db, cf, "before")
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(dir); !errors.Is(err, _const.ErrorCheckpointExists) {
+		t.Fatalf("checkpoint into an existing directory: %v", err)
+	}
+	// The database goes on after the checkpoint, its files must stay apart.
+	writeCheckpointData(t, db, cf, "after")
+	if err := db.Delete([]byte("before-00000"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := options
+	copied.DirPath = dir
+	checkpoint := openTestDB(t, copied)
+	checkCheckpointData(t, checkpoint, "before")
+	mustNotFind(t, checkpoint, "after-00000")
+
+	checkCheckpointData(t, db, "after")
+	mustNotFind(t, db, "before-00000")
+}
@@ -1,5 +1,10 @@
 package storage
 
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+)
+
 type ChunkType = byte
 
 const (
@@ -9,9 +14,40 @@ const (
 	ChunkTypeEnd
 )
 
+// chunkCompressedFlag is set in the type of every chunk of a compressed record.
+const chunkCompressedFlag ChunkType = 0x80
+
 type ChunkPosition struct {
 	SegmentFileId SegmentFileId
 	BlockIndex    uint32
 	ChunkOffset   uint32
 	ChunkSize     uint32
 }
+
+// Encode returns the position as a list of uvarints.
+func (p *ChunkPosition) Encode() []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen32*4)
+	buf = binary.AppendUvarint(buf, uint64(p.SegmentFileId))
+	buf = binary.AppendUvarint(buf, uint64(p.BlockIndex))
+	buf = binary.AppendUvarint(buf, uint64(p.ChunkOffset))
+	return binary.AppendUvarint(buf, uint64(p.ChunkSize))
+}
+
+// DecodeChunkPosition decodes a position written by ChunkPosition.Encode.
+func DecodeChunkPosition(b []byte) (*ChunkPosition, error) {
+	var fields [4]uint32
+	for i := range fields {
+		value, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, _const.ErrorValueLogCorrupted
+		}
+		fields[i] = uint32(value)
+		b = b[n:]
+	}
+	return &ChunkPosition{
+		SegmentFileId: fields[0],
+		BlockIndex:    fields[1],
+		ChunkOffset:   fields[2],
+		ChunkSize:     fields[3],
+	}, nil
+}
@@ -0,0 +1,435 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultColumnFamilyName is the family used by the methods without a family handle,
+	// its files stay in the database directory.
+	DefaultColumnFamilyName = "default"
+
+	defaultColumnFamilyId = 0
+	columnFamilyDirFmt    = "%d.CF"
+)
+
+// ColumnFamily is a handle of a column family, a key space of the database with its own
+// memtables, WAL and table files, so that every family gets its own memtable size and
+// settings. The families share the sequence numbers, the snapshots and the commit queue:
+// a Batch that writes several families is committed atomically.
+type ColumnFamily struct {
+	db      *DB
+	id      uint32
+	name    string
+	options ColumnFamilyOptions
+	dir     string
+
+	activeMem    *MemTable   // Active memory
+	immutableMem []*MemTable // Immutable memory
+	levels       [][]*Table  // Table files of every level
+	// compactPointer records where the next compaction of a level starts.
+	compactPointer [][]byte
+	// flushedSeq is the biggest sequence number of the flushed memtables, every batch up
+	// to it is stored in the table files of the family.
+	flushedSeq uint64
+	dropped    bool
+
+	// walCompression and tableCompression compress the WAL records and the table blocks
+	// written by the family and count the saved bytes.
+	walCompression   *compression
+	tableCompression *compression
+
+	// bgMu is held for reading by the flushes and compactions of the family, dropping the
+	// family takes it for writing to wait for them before the files are deleted.
+	bgMu sync.RWMutex
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// ID returns the id of the column family, ids are never reused.
+func (cf *ColumnFamily) ID() uint32 {
+	return cf.id
+}
+
+func columnFamilyDir(dir string, id uint32) string {
+	if id == defaultColumnFamilyId {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf(columnFamilyDirFmt, id))
+}
+
+// removeStaleFamilyDirs deletes the directories of the families that are not recorded,
+// they are left by a crash while a family was created or dropped.
+func removeStaleFamilyDirs(dir string, families map[uint32]*familyVersion) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var id uint32
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), columnFamilyDirFmt, &id); err != nil || families[id] != nil {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openColumnFamily opens the recorded table files of the family and replays its recorded
+// WALs, the dropped data is added to the report. The unset options are taken from
+// DefaultColumnFamilyOptions.
+func (db *DB) openColumnFamily(fv *familyVersion, options ColumnFamilyOptions, report *WALRecoveryReport) (*ColumnFamily, error) {
+	options = options.withDefaults()
+	cf := &ColumnFamily{
+		db:             db,
+		id:             fv.id,
+		name:           fv.name,
+		options:        options,
+		dir:            columnFamilyDir(db.options.DirPath, fv.id),
+		compactPointer: make([][]byte, maxLevels),
+		flushedSeq:     fv.flushedSeq,
+
+		walCompression:   newCompression(options.Compressor),
+		tableCompression: newCompression(options.Compressor),
+	}
+	if options.Compressor != nil {
+		if err := registerCompressor(options.Compressor); err != nil {
+			return nil, err
+		}
+	}
+	if !db.options.ReadOnly {
+		if err := os.MkdirAll(cf.dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	memTables, err := openAllMemTables(db.memTableOptions(cf), fv.walIds(), fv.flushedSeq, report)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := openAllTables(cf.dir, fv.tables)
+	if err != nil {
+		for _, table := range memTables {
+			_ = table.close()
+		}
+		return nil, err
+	}
+	cf.activeMem = memTables[len(memTables)-1]
+	cf.immutableMem = memTables[:len(memTables)-1]
+	cf.levels = levels
+	return cf, nil
+}
+
+// memTableOptions returns the options of the first memtable of the family.
+func (db *DB) memTableOptions(cf *ColumnFamily) memTableOptions {
+	return memTableOptions{
+		sklMemSize:      cf.options.MemTableSize,
+		id:              initTableId,
+		walDir:          cf.dir,
+		walCacheSize:    db.options.BlockCache,
+		walIsSync:       db.options.Sync,
+		walBytesPerSync: db.options.BytesPerSync,
+		bloomBitsPerKey: cf.options.BloomBitsPerKey,
+		walRecoveryMode: db.options.WALRecoveryMode,
+		walCompression:  cf.walCompression,
+		walReadOnly:     db.options.ReadOnly,
+	}
+}
+
+// close closes the memtables and the table files of the family.
+func (cf *ColumnFamily) close() error {
+	for _, table := range cf.immutableMem {
+		if err := table.close(); err != nil {
+			return err
+		}
+	}
+	if err := cf.activeMem.close(); err != nil {
+		return err
+	}
+	for _, tables := range cf.levels {
+		for _, table := range tables {
+			if err := table.close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily creates an empty column family with the options.
+func (db *DB) CreateColumnFamily(name string, options ColumnFamilyOptions) (*ColumnFamily, error) {
+	if len(name) == 0 {
+		return nil, _const.ErrorFamilyNameIsEmpty
+	}
+	if db.options.ReadOnly {
+		return nil, _const.ErrorReadOnlyDB
+	}
+	// Holding the commit queue keeps the families unchanged while a commit group is written.
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	db.m.Lock()
+	if db.Closed {
+		db.m.Unlock()
+		return nil, _const.ErrorDBClosed
+	}
+	if db.familyByName(name) != nil {
+		db.m.Unlock()
+		return nil, _const.ErrorColumnFamilyExists
+	}
+	id := db.nextFamilyId
+	db.nextFamilyId++
+	fv := newFamilyVersion(id, name)
+	fv.wals[initTableId] = true
+	cf, err := db.openColumnFamily(fv, options, &WALRecoveryReport{})
+	if err != nil {
+		db.m.Unlock()
+		return nil, err
+	}
+	db.families[id] = cf
+	db.m.Unlock()
+
+	// A crash before the family is recorded leaves a directory that the next open deletes.
+	edit := &versionEdit{
+		nextFamilyId:  id + 1,
+		addedFamilies: []*familyVersion{fv},
+		addedWals:     []walRef{{family: id, id: initTableId}},
+	}
+	if err := db.versions.logAndApply(edit); err != nil {
+		db.m.Lock()
+		delete(db.families, id)
+		db.m.Unlock()
+		_ = cf.close()
+		_ = os.RemoveAll(cf.dir)
+		return nil, err
+	}
+	return cf, nil
+}
+
+// DropColumnFamily deletes the column family and its data. The iterators that are open on
+// it keep working, every other use of the handle fails with ErrorColumnFamilyDropped.
+func (db *DB) DropColumnFamily(cf *ColumnFamily) error {
+	if cf == nil || cf.id == defaultColumnFamilyId {
+		return _const.ErrorDropDefaultFamily
+	}
+	if db.options.ReadOnly {
+		return _const.ErrorReadOnlyDB
+	}
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	db.m.Lock()
+	if db.Closed {
+		db.m.Unlock()
+		return _const.ErrorDBClosed
+	}
+	if cf.dropped {
+		db.m.Unlock()
+		return _const.ErrorColumnFamilyDropped
+	}
+	cf.dropped = true
+	delete(db.families, cf.id)
+	db.m.Unlock()
+
+	if err := db.versions.logAndApply(&versionEdit{droppedFamilies: []uint32{cf.id}}); err != nil {
+		db.m.Lock()
+		cf.dropped = false
+		db.families[cf.id] = cf
+		db.m.Unlock()
+		return err
+	}
+
+	// Wait for the running flush and compaction of the family.
+	cf.bgMu.Lock()
+	defer cf.bgMu.Unlock()
+	db.m.Lock()
+	err := cf.close()
+	db.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(cf.dir)
+}
+
+// ColumnFamily returns the handle of the column family with the name.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return nil, _const.ErrorDBClosed
+	}
+	cf := db.familyByName(name)
+	if cf == nil {
+		return nil, _const.ErrorColumnFamilyMissing
+	}
+	return cf, nil
+}
+
+// DefaultColumnFamily returns the handle of the default column family.
+func (db *DB) DefaultColumnFamily() *ColumnFamily {
+	return db.defaultFamily
+}
+
+// ColumnFamilies returns the names of the column families in the order of their creation.
+func (db *DB) ColumnFamilies() []string {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	var names []string
+	for _, cf := range db.sortedFamilies() {
+		names = append(names, cf.name)
+	}
+	return names
+}
+
+// family resolves a handle, nil is the default family. It must be called with db.m held.
+func (db *DB) family(cf *ColumnFamily) (*ColumnFamily, error) {
+	if cf == nil {
+		return db.defaultFamily, nil
+	}
+	if cf.dropped || cf.db != db {
+		return nil, _const.ErrorColumnFamilyDropped
+	}
+	return cf, nil
+}
+
+// familyByName must be called with db.m held.
+func (db *DB) familyByName(name string) *ColumnFamily {
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// sortedFamilies returns the families ordered by id, it must be called with db.m held.
+func (db *DB) sortedFamilies() []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(db.families))
+	for _, cf := range db.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+// encodeFamilyIds encodes the ids of the families written by a batch, the list is stored in
+// the BatchEnd record of every part of the batch.
+func encodeFamilyIds(ids []uint32) []byte {
+	var buf []byte
+	for _, id := range ids {
+		buf = binary.AppendUvarint(buf, uint64(id))
+	}
+	return buf
+}
+
+func decodeFamilyIds(b []byte) ([]uint32, error) {
+	var ids []uint32
+	for len(b) > 0 {
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, _const.ErrorFamilyFileCorrupted
+		}
+		ids = append(ids, uint32(id))
+		b = b[n:]
+	}
+	return ids, nil
+}
+
+// recoverFamilyBatches applies the replayed parts of the batches that wrote several column
+// families. A part is only applied if every family of the batch logged its part or already
+// flushed it, otherwise the crash hit the commit of the batch and all parts are dropped.
+// A family that was dropped since has nothing left to check. If a point-in-time recovery
+// stopped, every family is cut at the same sequence number first.
+func (db *DB) recoverFamilyBatches(report *WALRecoveryReport) error {
+	if report.stopSeq != 0 {
+		for _, cf := range db.families {
+			if err := cf.cutReplayed(report); err != nil {
+				return err
+			}
+		}
+	}
+
+	logged := make(map[batchKey]map[uint32]bool)
+	for _, cf := range db.families {
+		for _, mem := range cf.getMemTables() {
+			for _, part := range mem.pending {
+				key := batchKey{id: part.batchId, seq: part.seq}
+				if logged[key] == nil {
+					logged[key] = make(map[uint32]bool)
+				}
+				logged[key][cf.id] = true
+			}
+		}
+	}
+
+	dropped := make(map[batchKey]bool)
+	for _, cf := range db.families {
+		for _, mem := range cf.getMemTables() {
+			for _, part := range mem.pending {
+				key := batchKey{id: part.batchId, seq: part.seq}
+				complete := true
+				for _, id := range part.families {
+					family, ok := db.families[id]
+					if ok && !logged[key][id] && family.flushedSeq < part.seq {
+						complete = false
+						break
+					}
+				}
+				if !complete {
+					dropped[key] = true
+					continue
+				}
+				for _, record := range part.records {
+					mem.put(record, part.seq)
+				}
+				mem.maxSeq = max(mem.maxSeq, part.seq)
+			}
+			mem.pending = nil
+		}
+	}
+	report.DroppedBatches += len(dropped)
+	return nil
+}
+
+// cutReplayed drops the replayed batches of the family from the first one at or after the
+// sequence number where a point-in-time recovery stopped, the WAL is cut there and the
+// WALs of the newer memtables are removed.
+func (cf *ColumnFamily) cutReplayed(report *WALRecoveryReport) error {
+	tables := append(append([]*MemTable{}, cf.immutableMem...), cf.activeMem)
+	for i, table := range tables {
+		for j, part := range table.pending {
+			if part.seq < report.stopSeq {
+				continue
+			}
+			report.DroppedBatches += len(table.pending) - j
+			table.pending = table.pending[:j]
+			if err := table.tinyWal.cut(part.position, report); err != nil {
+				return err
+			}
+			for _, newer := range tables[i+1:] {
+				report.DroppedBatches += len(newer.pending)
+				if err := dropWal(newer.tinyWal, report); err != nil {
+					return err
+				}
+			}
+			cf.activeMem = table
+			cf.immutableMem = tables[:i]
+			return nil
+		}
+	}
+	return nil
+}
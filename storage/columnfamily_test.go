@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func mustGetCF(t *testing.T, db *DB, cf *ColumnFamily, key, want string) {
+	t.Helper()
+	value, err := db.GetCF(cf, key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("get %s: %q, want %q", key, value, want)
+	}
+}
+
+func mustNotFindCF(t *testing.T, db *DB, cf *ColumnFamily, key string) {
+	t.Helper()
+	if value, err := db.GetCF(cf, key); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get %s: %q %v, want ErrorKeyNotFound", key, value, err)
+	}
+}
+
+func TestColumnFamiliesKeepTheirKeysApart(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateColumnFamily("users", DefaultColumnFamilyOptions); !errors.Is(err, _const.ErrorColumnFamilyExists) {
+		t.Fatalf("create of an existing family: %v", err)
+	}
+	if err := db.Put("key", "default", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(users, "key", "users", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(users, "only-users", "users", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key", "default")
+	mustGetCF(t, db, users, "key", "users")
+	mustNotFind(t, db, "only-users")
+
+	// A range deletion only deletes the keys of its family.
+	if err := db.DeleteRange(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "key")
+	mustGetCF(t, db, users, "key", "users")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	if names := db.ColumnFamilies(); !reflect.DeepEqual(names, []string{"default", "users"}) {
+		t.Fatalf("families after reopening: %q", names)
+	}
+	users, err = db.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustGetCF(t, db, users, "only-users", "users")
+	if _, err := db.ColumnFamily("missing"); !errors.Is(err, _const.ErrorColumnFamilyMissing) {
+		t.Fatalf("lookup of a missing family: %v", err)
+	}
+}
+
+func TestDropColumnFamily(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := db.CreateColumnFamily("dropped", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(cf, "key", "value", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropColumnFamily(db.DefaultColumnFamily()); err == nil {
+		t.Fatal("the default family was dropped")
+	}
+	if err := db.DropColumnFamily(cf); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(cf, "key", "value", nil); !errors.Is(err, _const.ErrorColumnFamilyDropped) {
+		t.Fatalf("write into a dropped family: %v", err)
+	}
+	if _, err := db.GetCF(cf, "key"); !errors.Is(err, _const.ErrorColumnFamilyDropped) {
+		t.Fatalf("read from a dropped family: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files of the family are gone and the name can be used again.
+	db = openTestDB(t, options)
+	if paths, _ := filepath.Glob(filepath.Join(columnFamilyDir(options.DirPath, cf.ID()), "*")); len(paths) != 0 {
+		t.Fatalf("the files of the dropped family are left: %q", paths)
+	}
+	cf, err = db.CreateColumnFamily("dropped", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNotFindCF(t, db, cf, "key")
+}
+
+func TestColumnFamiliesFlushAndCompactOnTheirOwn(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := options.columnFamilyOptions()
+	small.MemTableSize = 16 * 1024
+	cf, err := db.CreateColumnFamily("small", small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := db.PutCF(cf, key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompaction(t, db)
+
+	db.m.RLock()
+	tables := 0
+	for _, level := range cf.levels {
+		tables += len(level)
+	}
+	defaultTables := 0
+	for _, level := range db.defaultFamily.levels {
+		defaultTables += len(level)
+	}
+	db.m.RUnlock()
+	if tables == 0 || defaultTables != 0 {
+		t.Fatalf("%d tables in the written family, %d in the default one", tables, defaultTables)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.ColumnFamilies = map[string]ColumnFamilyOptions{"small": small}
+	db = openTestDB(t, options)
+	cf, err = db.ColumnFamily("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i += 111 {
+		key := fmt.Sprintf("key-%05d", i)
+		mustGetCF(t, db, cf, key, key)
+		mustNotFind(t, db, key)
+	}
+}
+
+func TestCrossFamilyBatchIsAtomic(t *testing.T) {
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCrashBatches(t, db, cf)
+
+	// The other family loses the tail of its WAL, the batches whose part is lost there are
+	// dropped in the default family too.
+	options.DirPath = crashCopy(t, options.DirPath)
+	paths, err := filepath.Glob(filepath.Join(columnFamilyDir(options.DirPath, cf.ID()), "*.MEM.*"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("want one WAL segment, got %v %v", paths, err)
+	}
+	tearTail(t, paths[0])
+
+	recovered := openTestDB(t, options)
+	n := recoveredBatches(t, recovered)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the torn ones must be dropped", n, crashBatches)
+	}
+	if report := recovered.RecoveryReport(); report.DroppedBatches == 0 {
+		t.Fatalf("the dropped batches are not reported: %+v", report)
+	}
+}
+
+func TestPointInTimeRecoveryStopsEveryFamily(t *testing.T) {
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The families take turns, so the batches of the default family interleave with the
+	// ones lost in the other family.
+	for i := 0; i < crashBatches; i++ {
+		for _, family := range []*ColumnFamily{nil, cf} {
+			batch := db.NewBatch(DefaultBatchOptions)
+			for j := 0; j < crashBatchKeys; j++ {
+				key := []byte(fmt.Sprintf("b%03d-k%02d", i, j))
+				if err := batch.PutCF(family, key, []byte(crashValue(string(key)))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := batch.Commit(&WriteOptions{Sync: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	options.DirPath = crashCopy(t, options.DirPath)
+	paths, err := filepath.Glob(filepath.Join(columnFamilyDir(options.DirPath, cf.ID()), "*.MEM.*"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("want one WAL segment, got %v %v", paths, err)
+	}
+	corruptBlock(t, paths[0])
+	options.WALRecoveryMode = WALRecoveryPointInTime
+
+	// found returns how many of the batches in a row are in the family.
+	found := func(db *DB, family *ColumnFamily) int {
+		t.Helper()
+		for i := 0; i < crashBatches; i++ {
+			key := fmt.Sprintf("b%03d-k00", i)
+			if _, err := db.GetCF(family, key); errors.Is(err, _const.ErrorKeyNotFound) {
+				return i
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return crashBatches
+	}
+	recovered, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := recovered.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := found(recovered, other)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the recovery must stop at the corruption", n, crashBatches)
+	}
+	// The default family stops right before the first batch the other family lost.
+	if got := found(recovered, nil); got != n {
+		t.Fatalf("the default family kept %d batches, the other family %d", got, n)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.WALRecoveryMode = WALRecoveryTolerateCorruptedTail
+	reopened := openTestDB(t, options)
+	other, err = reopened.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found(reopened, nil) != n || found(reopened, other) != n {
+		t.Fatal("the dropped batches came back after reopening")
+	}
+}
+
+func TestZeroColumnFamilyOptionsUseTheDefaults(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := db.CreateColumnFamily("zero", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.options.MemTableSize != DefaultColumnFamilyOptions.MemTableSize ||
+		cf.options.L0CompactionTrigger != DefaultColumnFamilyOptions.L0CompactionTrigger ||
+		cf.options.LevelSizeMultiplier != DefaultColumnFamilyOptions.LevelSizeMultiplier {
+		t.Fatalf("the unset options were not filled: %+v", cf.options)
+	}
+	if cf.options.BloomBitsPerKey != 0 {
+		t.Fatal("a zero BloomBitsPerKey must keep the filters disabled")
+	}
+	if err := db.PutCF(cf, "key", "value", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The options of a family opened with zero values are filled too.
+	options.ColumnFamilies = map[string]ColumnFamilyOptions{"zero": {}}
+	db = openTestDB(t, options)
+	cf, err = db.ColumnFamily("zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.options.MemTableSize != DefaultColumnFamilyOptions.MemTableSize {
+		t.Fatalf("the unset options were not filled on open: %+v", cf.options)
+	}
+	mustGetCF(t, db, cf, "key", "value")
+}
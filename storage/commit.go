@@ -0,0 +1,232 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"sort"
+	"sync"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// maxCommitGroupSize limits the data a leader commits for the writers behind it.
+const maxCommitGroupSize = 1 * _const.MB
+
+// commitRequest is a batch waiting in the commit queue.
+type commitRequest struct {
+	// writes are the records of every column family the batch writes. The range deletions
+	// are written before the records, they never hide the records of the same batch.
+	writes map[*ColumnFamily]*familyWrites
+	// sizes bound the skip-list memory the request takes in every family it writes.
+	sizes      map[*ColumnFamily]int64
+	batchId    snowflake.ID
+	sync       bool
+	disableWal bool
+	// check runs right before the batch is written, a transaction checks its reads there.
+	// A request with a check is always committed alone.
+	check func() error
+
+	seq  uint64
+	err  error
+	done bool
+	cond *sync.Cond
+}
+
+func (req *commitRequest) size() int64 {
+	var size int64
+	for _, familySize := range req.sizes {
+		size += familySize
+	}
+	return size
+}
+
+// groupSizes returns the skip-list memory the requests take in every family they write.
+func groupSizes(requests []*commitRequest) map[*ColumnFamily]int64 {
+	sizes := make(map[*ColumnFamily]int64)
+	for _, req := range requests {
+		for cf, size := range req.sizes {
+			sizes[cf] += size
+		}
+	}
+	return sizes
+}
+
+// familyIds returns the ids of the column families written by the request in order.
+func (req *commitRequest) familyIds() []uint32 {
+	ids := make([]uint32, 0, len(req.writes))
+	for cf := range req.writes {
+		ids = append(ids, cf.id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// write commits the request through the commit queue. The writer at the front of the
+// queue becomes the leader: it commits the batches of the writers queued behind it with
+// one WAL append and one sync and wakes each of them with its own result.
+func (db *DB) write(req *commitRequest) error {
+	if db.options.ReadOnly {
+		return _const.ErrorReadOnlyDB
+	}
+	if err := db.vlog.checkSizes(req); err != nil {
+		return err
+	}
+	req.cond = sync.NewCond(&db.writeMu)
+
+	db.writeMu.Lock()
+	element := db.writers.PushBack(req)
+	for !req.done && db.writers.Front() != element {
+		req.cond.Wait()
+	}
+	if req.done {
+		db.writeMu.Unlock()
+		return req.err
+	}
+	group := db.commitGroup()
+	db.writeMu.Unlock()
+
+	db.writeGroup(group)
+
+	db.writeMu.Lock()
+	for range group {
+		follower := db.writers.Remove(db.writers.Front()).(*commitRequest)
+		if follower != req {
+			follower.done = true
+			follower.cond.Signal()
+		}
+	}
+	if front := db.writers.Front(); front != nil {
+		front.Value.(*commitRequest).cond.Signal()
+	}
+	db.writeMu.Unlock()
+	return req.err
+}
+
+// commitGroup returns the requests the leader at the front of the queue commits, a sync
+// request never waits for a leader that does not sync. The part of the group written into
+// a family never exceeds the memtable size of the family, so that it fits into an empty
+// memtable. It must be called with db.writeMu held.
+func (db *DB) commitGroup() []*commitRequest {
+	front := db.writers.Front()
+	leader := front.Value.(*commitRequest)
+	group := []*commitRequest{leader}
+	if leader.check != nil {
+		return group
+	}
+
+	size := leader.size()
+	sizes := groupSizes(group)
+	for e := front.Next(); e != nil; e = e.Next() {
+		req := e.Value.(*commitRequest)
+		if req.check != nil || (req.sync && !leader.sync) {
+			break
+		}
+		size += req.size()
+		if size > maxCommitGroupSize {
+			return group
+		}
+		for cf, familySize := range req.sizes {
+			if sizes[cf]+familySize > int64(cf.options.MemTableSize) {
+				return group
+			}
+		}
+		for cf, familySize := range req.sizes {
+			sizes[cf] += familySize
+		}
+		group = append(group, req)
+	}
+	return group
+}
+
+// writeGroup writes the group into the active memtables of the column families, every batch
+// gets its own sequence number and the last one is published once all of them are readable.
+// Every family logs its part of the batches before any of them is written into a skip-list,
+// so a failed WAL write leaves no partial batch behind.
+func (db *DB) writeGroup(group []*commitRequest) {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	fail := func(requests []*commitRequest, err error) {
+		for _, req := range requests {
+			req.err = err
+		}
+	}
+
+	db.m.Lock()
+	if db.Closed {
+		db.m.Unlock()
+		fail(group, _const.ErrorDBClosed)
+		return
+	}
+	var families []*ColumnFamily
+	seen := make(map[*ColumnFamily]bool)
+	for _, req := range group {
+		for cf := range req.writes {
+			if _, err := db.family(cf); err != nil {
+				req.err = err
+			}
+		}
+		if req.err != nil {
+			continue
+		}
+		for cf := range req.writes {
+			if !seen[cf] {
+				seen[cf] = true
+				families = append(families, cf)
+			}
+		}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	seq := db.seq
+	db.m.Unlock()
+
+	// The active memtables only change under commitMu.
+	sizes := groupSizes(group)
+	mems := make([]*MemTable, len(families))
+	for i, cf := range families {
+		if err := cf.waitMemTableSpace(sizes[cf]); err != nil {
+			fail(group, err)
+			return
+		}
+		mems[i] = cf.activeMem
+	}
+
+	batches := make([]*commitRequest, 0, len(group))
+	for _, req := range group {
+		if req.err != nil {
+			continue
+		}
+		if req.check != nil {
+			if err := req.check(); err != nil {
+				req.err = err
+				continue
+			}
+		}
+		seq++
+		req.seq = seq
+		batches = append(batches, req)
+	}
+	if len(batches) == 0 {
+		return
+	}
+	sync := db.options.Sync
+	for _, batch := range batches {
+		sync = sync || batch.sync
+	}
+	if err := db.vlog.writeBatches(batches, sync); err != nil {
+		fail(batches, err)
+		return
+	}
+	for i, cf := range families {
+		if err := mems[i].logBatches(cf, batches); err != nil {
+			fail(batches, err)
+			return
+		}
+	}
+	for i, cf := range families {
+		mems[i].applyBatches(cf, batches)
+	}
+
+	db.m.Lock()
+	db.seq = seq
+	db.m.Unlock()
+}
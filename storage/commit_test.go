@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentWritersAreAllCommitted(t *testing.T) {
+	const (
+		writers = 16
+		writes  = 200
+	)
+	options := testOptions(t)
+	db := openTestDB(t, options)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("w%02d-%03d", w, i)
+				// Sync and non-sync writers are mixed in the queue.
+				if err := db.Put(key, key, &WriteOptions{Sync: i%10 == 0}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	options.DirPath = crashCopy(t, options.DirPath)
+	recovered := openTestDB(t, options)
+	for _, d := range []*DB{db, recovered} {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("w%02d-%03d", w, i)
+				mustGet(t, d, key, key)
+			}
+		}
+	}
+}
+
+func TestWritesOfOneWriterKeepTheirOrder(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("w%d", w), fmt.Sprint(i), nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 0; w < 8; w++ {
+		mustGet(t, db, fmt.Sprintf("w%d", w), "99")
+	}
+}
+
+func testCommitRequest(t *testing.T, cf *ColumnFamily, keys int, valueSize int, sync bool) *commitRequest {
+	t.Helper()
+	records := make(map[string]*LogRecord)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		records[key] = &LogRecord{Key: []byte(key), Value: bytes.Repeat([]byte{'v'}, valueSize)}
+	}
+	req := &commitRequest{writes: map[*ColumnFamily]*familyWrites{cf: {records: records}}, sync: sync}
+	if err := cf.db.vlog.checkSizes(req); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// testCommitGroup queues the requests and returns the group of the first one.
+func testCommitGroup(db *DB, requests ...*commitRequest) []*commitRequest {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	for _, req := range requests {
+		db.writers.PushBack(req)
+	}
+	group := db.commitGroup()
+	db.writers.Init()
+	return group
+}
+
+func TestCommitGroupLimits(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	db := openTestDB(t, options)
+	cf := db.defaultFamily
+
+	// The group stops before it outgrows an empty memtable.
+	var requests []*commitRequest
+	for i := 0; i < 10; i++ {
+		requests = append(requests, testCommitRequest(t, cf, 10, 2000, false))
+	}
+	group := testCommitGroup(db, requests...)
+	var size int64
+	for _, req := range group {
+		size += req.size()
+	}
+	if len(group) == len(requests) || size > int64(options.MemTableSize) ||
+		size+requests[len(group)].size() <= int64(options.MemTableSize) {
+		t.Fatalf("a group of %d requests with %d bytes", len(group), size)
+	}
+
+	// The limit holds for every family on its own, the group may be bigger than one memtable.
+	other, err := db.CreateColumnFamily("other", options.columnFamilyOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests = requests[:0]
+	for i := 0; i < 3; i++ {
+		requests = append(requests, testCommitRequest(t, cf, 10, 1500, false), testCommitRequest(t, other, 10, 1500, false))
+	}
+	if group = testCommitGroup(db, requests...); len(group) != len(requests) {
+		t.Fatalf("a group of %d requests for two families, want %d", len(group), len(requests))
+	}
+
+	// A sync request does not wait for a leader that does not sync, a non-sync request
+	// joins a sync leader.
+	group = testCommitGroup(db, testCommitRequest(t, cf, 1, 10, false), testCommitRequest(t, cf, 1, 10, true))
+	if len(group) != 1 {
+		t.Fatalf("a sync request joined a non-sync leader")
+	}
+	group = testCommitGroup(db, testCommitRequest(t, cf, 1, 10, true), testCommitRequest(t, cf, 1, 10, false))
+	if len(group) != 2 {
+		t.Fatalf("a non-sync request did not join a sync leader")
+	}
+
+	// A request with a check is committed alone.
+	checked := testCommitRequest(t, cf, 1, 10, false)
+	checked.check = func() error { return nil }
+	if group = testCommitGroup(db, checked, testCommitRequest(t, cf, 1, 10, false)); len(group) != 1 {
+		t.Fatal("a request joined a leader with a check")
+	}
+	if group = testCommitGroup(db, testCommitRequest(t, cf, 1, 10, false), checked); len(group) != 1 {
+		t.Fatal("a request with a check joined a group")
+	}
+}
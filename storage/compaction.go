@@ -0,0 +1,429 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	maxLevels = 7
+)
+
+// compaction merges inputs[0] from level with the overlapping inputs[1] from level+1.
+type compaction struct {
+	family   *ColumnFamily
+	level    int
+	inputs   [2][]*Table
+	smallest []byte
+	biggest  []byte
+}
+
+// compactLoop runs the leveled compactions in the background.
+func (db *DB) compactLoop() {
+	defer db.bgWait.Done()
+	for {
+		select {
+		case <-db.closeChan:
+			return
+		case <-db.compactChan:
+			for {
+				db.m.RLock()
+				c := db.pickCompaction()
+				db.m.RUnlock()
+				if c == nil {
+					break
+				}
+				// The inputs stay untouched on failure, the compaction is retried on the next trigger.
+				if err := c.family.runCompaction(c); err != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (db *DB) triggerCompaction() {
+	select {
+	case db.compactChan <- struct{}{}:
+	default:
+	}
+}
+
+// maxBytesForLevel returns the size limit of the level, level 0 is limited by the file count.
+func (cf *ColumnFamily) maxBytesForLevel(level int) float64 {
+	size := float64(cf.options.BaseLevelSize)
+	for l := 1; l < level; l++ {
+		size *= float64(cf.options.LevelSizeMultiplier)
+	}
+	return size
+}
+
+func levelSize(tables []*Table) int64 {
+	var size int64
+	for _, table := range tables {
+		size += table.size
+	}
+	return size
+}
+
+// pickCompaction chooses the level of any column family that exceeds its limit the most,
+// it must be called with db.m held.
+func (db *DB) pickCompaction() *compaction {
+	var (
+		best      *ColumnFamily
+		bestLevel = -1
+		bestScore = 1.0
+	)
+	for _, cf := range db.families {
+		for level := 0; level < maxLevels-1; level++ {
+			var score float64
+			if level == 0 {
+				score = float64(len(cf.levels[0])) / float64(cf.options.L0CompactionTrigger)
+			} else {
+				score = float64(levelSize(cf.levels[level])) / cf.maxBytesForLevel(level)
+			}
+			if score >= bestScore {
+				best, bestLevel, bestScore = cf, level, score
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.pickCompaction(bestLevel)
+}
+
+// pickCompaction chooses the inputs of a compaction of the level, it must be called with db.m held.
+func (cf *ColumnFamily) pickCompaction(bestLevel int) *compaction {
+	c := &compaction{family: cf, level: bestLevel}
+	if bestLevel == 0 {
+		c.inputs[0] = append(c.inputs[0], cf.levels[0]...)
+	} else {
+		// Rotate through the key space of the level so that every table gets its turn.
+		tables := cf.levels[bestLevel]
+		pointer := cf.compactPointer[bestLevel]
+		picked := tables[0]
+		for _, table := range tables {
+			if pointer == nil || y.CompareKeys(table.smallest, pointer) > 0 {
+				picked = table
+				break
+			}
+		}
+		c.inputs[0] = append(c.inputs[0], picked)
+	}
+
+	// Extend both inputs until they cover the same key range.
+	for {
+		c.smallest, c.biggest = keyRange(c.inputs[0], c.inputs[1])
+		inputs := [2][]*Table{
+			overlappingTables(cf.levels[bestLevel], c.smallest, c.biggest),
+			overlappingTables(cf.levels[bestLevel+1], c.smallest, c.biggest),
+		}
+		if len(inputs[0]) == len(c.inputs[0]) && len(inputs[1]) == len(c.inputs[1]) {
+			break
+		}
+		c.inputs = inputs
+	}
+	return c
+}
+
+func overlappingTables(tables []*Table, smallest, biggest []byte) []*Table {
+	var result []*Table
+	for _, table := range tables {
+		if table.overlaps(smallest, biggest) {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+func keyRange(inputs ...[]*Table) ([]byte, []byte) {
+	var smallest, biggest []byte
+	for _, tables := range inputs {
+		for _, table := range tables {
+			if smallest == nil || y.CompareKeys(table.smallest, smallest) < 0 {
+				smallest = table.smallest
+			}
+			if biggest == nil || y.CompareKeys(table.biggest, biggest) > 0 {
+				biggest = table.biggest
+			}
+		}
+	}
+	return smallest, biggest
+}
+
+// isBottommost reports whether no level below the output level may contain the user key,
+// a tombstone of such a key has nothing left to hide and can be dropped.
+func (cf *ColumnFamily) isBottommost(levels [][]*Table, outputLevel int, key []byte) bool {
+	for level := outputLevel + 1; level < maxLevels; level++ {
+		for _, table := range levels[level] {
+			if table.containsKey(key) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// runCompaction merges the inputs into new tables of level+1 and swaps them in.
+func (cf *ColumnFamily) runCompaction(c *compaction) error {
+	cf.bgMu.RLock()
+	defer cf.bgMu.RUnlock()
+	db := cf.db
+	db.m.RLock()
+	if cf.dropped {
+		db.m.RUnlock()
+		return nil
+	}
+	levels := make([][]*Table, maxLevels)
+	for level := range cf.levels {
+		levels[level] = append([]*Table(nil), cf.levels[level]...)
+	}
+	db.m.RUnlock()
+
+	// The newer table comes first so that the merge iterator prefers it for equal keys.
+	var iterators []y.Iterator
+	for _, tables := range c.inputs {
+		sorted := append([]*Table(nil), tables...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].id > sorted[j].id })
+		for _, table := range sorted {
+			iterators = append(iterators, table.newIterator(false))
+		}
+	}
+	var rangeDels rangeTombstones
+	for _, tables := range c.inputs {
+		for _, table := range tables {
+			rangeDels = append(rangeDels, table.rangeDels...)
+		}
+	}
+	rangeDels.sort()
+
+	outputLevel := c.level + 1
+	smallestSnapshot := db.smallestSnapshot()
+	kept := keptRangeTombstones(rangeDels, c, levels, smallestSnapshot)
+	// The merge operands are applied to the base value once it is found in the inputs, or
+	// to nothing if no deeper level holds the key.
+	merged := cf.newCollapsingIterator(y.NewMergeIterator(iterators, false), smallestSnapshot, rangeDels,
+		func(key []byte) bool { return cf.isBottommost(levels, outputLevel, key) }, uint64(time.Now().UnixNano()))
+	outputs, err := cf.writeCompactionOutputs(merged, levels, outputLevel, smallestSnapshot, rangeDels, kept)
+	if closeErr := merged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		for _, table := range outputs {
+			_ = table.remove()
+		}
+		return err
+	}
+
+	// The outputs replace the inputs in one edit, a crash leaves either of them recorded.
+	edit := &versionEdit{}
+	for level, tables := range c.inputs {
+		for _, table := range tables {
+			edit.deletedTables = append(edit.deletedTables, tableMetaOf(cf.id, c.level+level, table))
+		}
+	}
+	for _, table := range outputs {
+		edit.addedTables = append(edit.addedTables, tableMetaOf(cf.id, outputLevel, table))
+	}
+	db.m.RLock()
+	edit.nextTableId = db.nextTableId
+	db.m.RUnlock()
+	if err := db.versions.logAndApply(edit); err != nil {
+		for _, table := range outputs {
+			_ = table.remove()
+		}
+		return err
+	}
+
+	db.m.Lock()
+	cf.levels[c.level] = removeTables(cf.levels[c.level], c.inputs[0])
+	next := removeTables(cf.levels[outputLevel], c.inputs[1])
+	next = append(next, outputs...)
+	sort.Slice(next, func(i, j int) bool { return y.CompareKeys(next[i].smallest, next[j].smallest) < 0 })
+	cf.levels[outputLevel] = next
+	cf.compactPointer[c.level] = c.biggest
+	db.m.Unlock()
+
+	// The inputs are no longer recorded, their files are deleted once the running
+	// iterators are done with them.
+	for _, tables := range c.inputs {
+		for _, table := range tables {
+			if err := table.remove(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keptRangeTombstones returns the range tombstones of the inputs that are still needed. A
+// tombstone that every snapshot sees deletes the keys of the inputs during the compaction,
+// it is dropped if no other table overlaps its range.
+func keptRangeTombstones(rangeDels rangeTombstones, c *compaction, levels [][]*Table, smallestSnapshot uint64) rangeTombstones {
+	var kept rangeTombstones
+	for _, r := range rangeDels {
+		if r.seq > smallestSnapshot || overlapsOtherTables(r, c, levels) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func overlapsOtherTables(r rangeTombstone, c *compaction, levels [][]*Table) bool {
+	smallest, biggest := y.KeyWithTs(r.start, math.MaxUint64), r.endKey()
+	for _, tables := range levels {
+		for _, table := range tables {
+			if table.overlaps(smallest, biggest) && !c.isInput(table) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *compaction) isInput(table *Table) bool {
+	for _, tables := range c.inputs {
+		for _, t := range tables {
+			if t == table {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCompactionOutputs writes the merged entries into tables. A version is dropped once a
+// newer version of the key is visible to every snapshot, and a tombstone is dropped once it
+// is visible to every snapshot and no deeper level holds the key. An expired value is
+// invisible to every reader, it is handled like a tombstone, and a version deleted by a
+// range tombstone of the inputs that every snapshot sees is dropped too. The kept range
+// tombstones are split between the outputs so that their key ranges do not overlap.
+func (cf *ColumnFamily) writeCompactionOutputs(merged *collapsingIterator, levels [][]*Table, outputLevel int,
+	smallestSnapshot uint64, rangeDels, kept rangeTombstones) ([]*Table, error) {
+	var (
+		outputs []*Table
+		builder *tableBuilder
+		// lower is the first key of the current output, nil for the first one.
+		lower   []byte
+		lastKey []byte
+		// lastSeq is the sequence number of the previous version of the same key.
+		lastSeq uint64
+		// addedKey is the last key written, the versions of a key never span two tables.
+		addedKey []byte
+	)
+
+	// finishBuilder finishes the current output, upper is the first key of the next one.
+	finishBuilder := func(upper []byte) error {
+		for _, r := range kept {
+			if clipped, ok := r.clip(lower, upper); ok {
+				builder.addRangeTombstone(clipped)
+			}
+		}
+		lower = upper
+		if err := builder.finish(); err != nil {
+			builder.abandon()
+			return err
+		}
+		table, err := openTable(cf.dir, builder.id)
+		builder = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, table)
+		return nil
+	}
+
+	now := uint64(time.Now().UnixNano())
+	for merged.Rewind(); merged.Valid(); merged.Next() {
+		select {
+		case <-cf.db.closeChan:
+			if builder != nil {
+				builder.abandon()
+			}
+			return outputs, _const.ErrorDBClosed
+		default:
+		}
+
+		key := merged.Key()
+		userKey := y.ParseKey(key)
+		seq := y.ParseTs(key)
+		if lastKey == nil || !bytes.Equal(userKey, lastKey) {
+			lastKey = append(lastKey[:0], userKey...)
+			lastSeq = math.MaxUint64
+		}
+
+		value := merged.Value()
+		if isExpired(value, now) {
+			value = expiredTombstone
+		}
+		drop := false
+		if lastSeq <= smallestSnapshot {
+			drop = true
+		} else if value.Meta == LogRecordDeleted && seq <= smallestSnapshot &&
+			cf.isBottommost(levels, outputLevel, key) {
+			drop = true
+		} else if rangeDels.covers(userKey, seq, smallestSnapshot) {
+			drop = true
+		}
+		lastSeq = seq
+		if drop {
+			continue
+		}
+
+		if builder != nil && builder.estimateSize() >= cf.options.TableFileSize &&
+			!bytes.Equal(userKey, addedKey) {
+			if err := finishBuilder(y.Copy(userKey)); err != nil {
+				return outputs, err
+			}
+		}
+		if builder == nil {
+			var err error
+			builder, err = newTableBuilder(cf.dir, cf.db.newTableId(), outputLevel, cf.options.BloomBitsPerKey, cf.tableCompression)
+			if err != nil {
+				return outputs, err
+			}
+		}
+		if err := builder.add(key, value); err != nil {
+			builder.abandon()
+			return outputs, err
+		}
+		addedKey = append(addedKey[:0], userKey...)
+	}
+
+	if builder == nil && len(kept) > 0 {
+		var err error
+		builder, err = newTableBuilder(cf.dir, cf.db.newTableId(), outputLevel, cf.options.BloomBitsPerKey, cf.tableCompression)
+		if err != nil {
+			return outputs, err
+		}
+	}
+	if builder != nil {
+		if err := finishBuilder(nil); err != nil {
+			return outputs, err
+		}
+	}
+	return outputs, nil
+}
+
+func removeTables(tables []*Table, removed []*Table) []*Table {
+	result := make([]*Table, 0, len(tables))
+	for _, table := range tables {
+		keep := true
+		for _, r := range removed {
+			if table == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			result = append(result, table)
+		}
+	}
+	return result
+}
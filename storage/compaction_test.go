@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+func compactionTestOptions(t *testing.T) Options {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	options.L0CompactionTrigger = 2
+	options.BaseLevelSize = 256 * 1024
+	options.LevelSizeMultiplier = 2
+	options.TableFileSize = 64 * 1024
+	return options
+}
+
+// waitForCompaction waits until nothing is left to flush and no level exceeds its limit.
+func waitForCompaction(t *testing.T, db *DB) {
+	t.Helper()
+	waitForFlush(t, db)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		db.m.RLock()
+		done := db.pickCompaction() == nil
+		db.m.RUnlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the levels are still waiting for a compaction")
+		}
+		db.triggerCompaction()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkLevels verifies that the tables of every level below level 0 are sorted and disjoint.
+func checkLevels(t *testing.T, db *DB) {
+	t.Helper()
+	db.m.RLock()
+	defer db.m.RUnlock()
+	for level := 1; level < len(db.defaultFamily.levels); level++ {
+		tables := db.defaultFamily.levels[level]
+		for i := 1; i < len(tables); i++ {
+			if y.CompareKeys(y.KeyWithTs(y.ParseKey(tables[i-1].biggest), 0), tables[i].smallest) >= 0 {
+				t.Fatalf("level %d: table %d overlaps table %d", level, tables[i-1].id, tables[i].id)
+			}
+		}
+	}
+}
+
+func TestCompactionMovesTablesDown(t *testing.T) {
+	options := compactionTestOptions(t)
+	db := openTestDB(t, options)
+
+	// Every round overwrites the same keys, so the tables of level 0 overlap.
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 2000; i++ {
+			value := fmt.Sprintf("%s-%d-%d", strings.Repeat("v", 100), round, i)
+			if err := db.Put(fmt.Sprintf("key-%05d", i), value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForCompaction(t, db)
+	checkLevels(t, db)
+
+	db.m.RLock()
+	deeper := 0
+	for level := 1; level < len(db.defaultFamily.levels); level++ {
+		deeper += len(db.defaultFamily.levels[level])
+	}
+	l0 := len(db.defaultFamily.levels[0])
+	db.m.RUnlock()
+	if deeper == 0 || l0 >= options.L0CompactionTrigger {
+		t.Fatalf("%d tables in level 0 and %d below it after the compaction", l0, deeper)
+	}
+	for _, i := range []int{0, 999, 1999} {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), fmt.Sprintf("%s-%d-%d", strings.Repeat("v", 100), 3, i))
+	}
+}
+
+func TestCompactionKeepsDeletions(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fillMemTables(t, db, "key", 3000)
+	for i := 0; i < 3000; i += 2 {
+		if err := db.Delete([]byte(fmt.Sprintf("key-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fillMemTables(t, db, "other", 3000)
+	waitForCompaction(t, db)
+	checkLevels(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The levels are rebuilt from the table files.
+	db = openTestDB(t, options)
+	checkLevels(t, db)
+	for _, i := range []int{0, 1000, 2998} {
+		mustNotFind(t, db, fmt.Sprintf("key-%05d", i))
+	}
+	for _, i := range []int{1, 1001, 2999} {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+		mustGet(t, db, fmt.Sprintf("other-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+	}
+}
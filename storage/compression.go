@@ -0,0 +1,255 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The ids of the built-in codecs, the ids below 16 are reserved for them.
+const (
+	NoCompressionId    byte = 0
+	FlateCompressionId byte = 1
+	GzipCompressionId  byte = 2
+
+	reservedCompressionIds = 16
+)
+
+// Compressor compresses the WAL chunks and the table blocks. Its id is stored with every
+// compressed chunk and block, so a file written with several codecs reads back correctly
+// as long as they are all registered.
+type Compressor interface {
+	// ID identifies the codec in the files, it must never change.
+	ID() byte
+	// Name is shown in the stats.
+	Name() string
+	// Compress appends the compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	NoCompressor    Compressor = noCompressor{}
+	FlateCompressor            = NewFlateCompressor(flate.DefaultCompression)
+	GzipCompressor             = NewGzipCompressor(gzip.DefaultCompression)
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[byte]Compressor{
+		NoCompressionId:    NoCompressor,
+		FlateCompressionId: FlateCompressor,
+		GzipCompressionId:  GzipCompressor,
+	}
+)
+
+// RegisterCompressor makes a codec available to read the files, a codec given in the
+// Options is registered when the database is opened. It panics if another codec uses the
+// id or the id is reserved.
+func RegisterCompressor(c Compressor) {
+	if err := registerCompressor(c); err != nil {
+		panic(err)
+	}
+}
+
+// registerCompressor adds the codec to the registry. The built-in codecs may be given with
+// another level, their data decodes the same.
+func registerCompressor(c Compressor) error {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if registered, ok := compressors[c.ID()]; ok {
+		if registered == c || (c.ID() < reservedCompressionIds && registered.Name() == c.Name()) {
+			return nil
+		}
+		return fmt.Errorf("%w: id %d is used by %s", _const.ErrorCompressorConflict, c.ID(), registered.Name())
+	}
+	if c.ID() < reservedCompressionIds {
+		return fmt.Errorf("%w: id %d is reserved", _const.ErrorCompressorConflict, c.ID())
+	}
+	compressors[c.ID()] = c
+	return nil
+}
+
+// decompress decodes data written by the codec with the id.
+func decompress(id byte, data []byte) ([]byte, error) {
+	compressorsMu.RLock()
+	c, ok := compressors[id]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", _const.ErrorUnknownCompressor, id)
+	}
+	return c.Decompress(nil, data)
+}
+
+type noCompressor struct{}
+
+func (noCompressor) ID() byte {
+	return NoCompressionId
+}
+
+func (noCompressor) Name() string {
+	return "none"
+}
+
+func (noCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type flateCompressor struct {
+	level int
+}
+
+// NewFlateCompressor returns the raw deflate codec with the compression level of compress/flate.
+func NewFlateCompressor(level int) Compressor {
+	return flateCompressor{level: level}
+}
+
+func (c flateCompressor) ID() byte {
+	return FlateCompressionId
+}
+
+func (c flateCompressor) Name() string {
+	return "flate"
+}
+
+func (c flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readAllTo(dst, r)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// NewGzipCompressor returns the gzip codec with the compression level of compress/gzip.
+func NewGzipCompressor(level int) Compressor {
+	return gzipCompressor{level: level}
+}
+
+func (c gzipCompressor) ID() byte {
+	return GzipCompressionId
+}
+
+func (c gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c gzipCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := gzip.NewWriterLevel(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllTo(dst, r)
+}
+
+func readAllTo(dst []byte, r io.Reader) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compression compresses the data of a column family with its codec and counts the bytes
+// before and after the compression. A nil compression stores the data as it is.
+type compression struct {
+	compressor  Compressor
+	rawBytes    atomic.Int64
+	storedBytes atomic.Int64
+}
+
+func newCompression(c Compressor) *compression {
+	if c == nil {
+		c = NoCompressor
+	}
+	return &compression{compressor: c}
+}
+
+// compress returns the id of the codec and the stored data, the data is kept as it is if
+// the codec does not make it smaller.
+func (c *compression) compress(data []byte) (byte, []byte, error) {
+	if c == nil {
+		return NoCompressionId, data, nil
+	}
+	id := c.compressor.ID()
+	stored := data
+	if id != NoCompressionId {
+		compressed, err := c.compressor.Compress(nil, data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(compressed) < len(data) {
+			stored = compressed
+		} else {
+			id = NoCompressionId
+		}
+	}
+	c.rawBytes.Add(int64(len(data)))
+	c.storedBytes.Add(int64(len(stored)))
+	return id, stored, nil
+}
+
+// CompressionStats counts the bytes written since the database was opened.
+type CompressionStats struct {
+	Codec       string
+	RawBytes    int64
+	StoredBytes int64
+}
+
+// Ratio returns how many times smaller the stored data is, 1 if nothing was written.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+func (c *compression) stats() CompressionStats {
+	return CompressionStats{
+		Codec:       c.compressor.Name(),
+		RawBytes:    c.rawBytes.Load(),
+		StoredBytes: c.storedBytes.Load(),
+	}
+}
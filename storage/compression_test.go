@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+// renamedCompressor is a codec outside of the built-in ones, it stores its data as flate.
+type renamedCompressor struct {
+	Compressor
+	id byte
+}
+
+func (c renamedCompressor) ID() byte {
+	return c.id
+}
+
+func (c renamedCompressor) Name() string {
+	return fmt.Sprintf("renamed-%d", c.id)
+}
+
+// compressibleValue is a value the codecs make several times smaller.
+func compressibleValue(i int) string {
+	return strings.Repeat("value ", 40) + fmt.Sprint(i)
+}
+
+func writeCompressible(t *testing.T, db *DB, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := db.Put(fmt.Sprintf("%s-%05d", prefix, i), compressibleValue(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkCompressible(t *testing.T, db *DB, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i += 97 {
+		mustGet(t, db, fmt.Sprintf("%s-%05d", prefix, i), compressibleValue(i))
+	}
+}
+
+func TestCompressedDataReadsBack(t *testing.T) {
+	for _, compressor := range []Compressor{FlateCompressor, GzipCompressor, renamedCompressor{FlateCompressor, 100}} {
+		t.Run(compressor.Name(), func(t *testing.T) {
+			options := compactionTestOptions(t)
+			options.Compressor = compressor
+			db, err := OpenDB(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeCompressible(t, db, "key", 3000)
+			waitForCompaction(t, db)
+			// The tail stays in the WAL of the active memtable.
+			writeCompressible(t, db, "tail", 100)
+
+			stats, err := db.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			family := stats.ColumnFamilies[0]
+			if family.WALCompression.Codec != compressor.Name() || family.WALCompression.Ratio() < 2 {
+				t.Fatalf("WAL compression: %+v", family.WALCompression)
+			}
+			if family.TableCompression.Codec != compressor.Name() || family.TableCompression.Ratio() < 2 {
+				t.Fatalf("table compression: %+v", family.TableCompression)
+			}
+			checkCompressible(t, db, "key", 3000)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db = openTestDB(t, options)
+			checkCompressible(t, db, "key", 3000)
+			checkCompressible(t, db, "tail", 100)
+		})
+	}
+}
+
+func TestChangedCompressorKeepsTheOldDataReadable(t *testing.T) {
+	options := compactionTestOptions(t)
+	for round, compressor := range []Compressor{GzipCompressor, FlateCompressor, nil} {
+		options.Compressor = compressor
+		db, err := OpenDB(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := fmt.Sprintf("round%d", round)
+		writeCompressible(t, db, prefix, 1000)
+		// Every round reads the data of the rounds before it, some of it from the WAL.
+		for previous := 0; previous <= round; previous++ {
+			checkCompressible(t, db, fmt.Sprintf("round%d", previous), 1000)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterCompressorConflicts(t *testing.T) {
+	// The built-in codecs may be given with another level.
+	if err := registerCompressor(NewFlateCompressor(9)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerCompressor(renamedCompressor{FlateCompressor, FlateCompressionId}); !errors.Is(err, _const.ErrorCompressorConflict) {
+		t.Fatalf("register over a built-in codec: %v", err)
+	}
+	if err := registerCompressor(renamedCompressor{FlateCompressor, reservedCompressionIds - 1}); !errors.Is(err, _const.ErrorCompressorConflict) {
+		t.Fatalf("register with a reserved id: %v", err)
+	}
+	if err := registerCompressor(renamedCompressor{GzipCompressor, 101}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerCompressor(renamedCompressor{FlateCompressor, 101}); !errors.Is(err, _const.ErrorCompressorConflict) {
+		t.Fatalf("register of two codecs with one id: %v", err)
+	}
+	if _, err := decompress(250, []byte("data")); !errors.Is(err, _const.ErrorUnknownCompressor) {
+		t.Fatalf("decompress with an unknown codec: %v", err)
+	}
+}
@@ -2,11 +2,15 @@ package storage
 
 import (
 	_const "SmartStashDB/const"
-	"errors"
+	"container/list"
+	"github.com/bwmarrin/snowflake"
+	"github.com/dgraph-io/badger/y"
 	"github.com/gofrs/flock"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -14,116 +18,519 @@ const (
 )
 
 type DB struct {
-	m            sync.RWMutex
-	activeMem    *MemTable   // Active memory
-	immutableMem []*MemTable // Immutable memory
-	Closed       bool
-	batchPool    sync.Pool
+	m       sync.RWMutex
+	options Options
+	// families are the column families by id, defaultFamily is never dropped.
+	families      map[uint32]*ColumnFamily
+	defaultFamily *ColumnFamily
+	nextFamilyId  uint32
+	nextTableId   uint32
+	// versions records the live files in the MANIFEST.
+	versions *versionSet
+	// vlog holds the values bigger than Options.ValueThreshold.
+	vlog *valueLog
+	// batchIds generates the ids of the batches, one node for the database keeps them unique.
+	batchIds *snowflake.Node
+	// seq is the sequence number of the last committed batch.
+	seq       uint64
+	snapshots snapshotList
+	// recovery describes what the WAL replay dropped on open.
+	recovery    WALRecoveryReport
+	Closed      bool
+	batchPool   sync.Pool
+	fileLock    *flock.Flock
+	flushChan   chan struct{}
+	compactChan chan struct{}
+	closeChan   chan struct{}
+	bgWait      sync.WaitGroup
+
+	// writeMu guards the writers waiting in the commit queue.
+	writeMu sync.Mutex
+	writers *list.List
+	// commitMu is held by the leader while it writes a commit group.
+	commitMu sync.Mutex
 }
 
 func (db *DB) Close() error {
+	db.m.Lock()
+	if db.Closed {
+		db.m.Unlock()
+		return nil
+	}
+	db.Closed = true
+	close(db.closeChan)
+	db.m.Unlock()
+
+	// Wait for the commit group that is being written.
+	db.commitMu.Lock()
+	db.commitMu.Unlock()
+	// Wait for the running value log garbage collection.
+	db.vlog.gcMu.Lock()
+	db.vlog.gcMu.Unlock()
+
+	// Wait for the running flush before closing the files.
+	db.bgWait.Wait()
+
 	db.m.Lock()
 	defer db.m.Unlock()
 
-	for _, table := range db.immutableMem {
-		err := table.close()
-		if err != nil {
+	for _, cf := range db.families {
+		if err := cf.close(); err != nil {
 			return err
 		}
 	}
-	if err := db.activeMem.close(); err != nil {
+	if err := db.vlog.close(); err != nil {
 		return err
 	}
-	db.Closed = true
-	return nil
+	if err := db.versions.close(); err != nil {
+		return err
+	}
+	return db.fileLock.Unlock()
 }
 
 func (db *DB) Put(key string, value string, options *WriteOptions) error {
+	return db.PutCF(nil, key, value, options)
+}
+
+// PutCF writes the key into the column family, nil is the default family.
+func (db *DB) PutCF(cf *ColumnFamily, key string, value string, options *WriteOptions) error {
 	batch := db.batchPool.Get().(*Batch)
 	defer func() {
 		batch.reset()
 		db.batchPool.Put(batch)
 	}()
-	batch.init(false, false, db).writePendingWrites()
-	err := batch.put([]byte(key), []byte(value))
-	if err != nil {
-		batch.unLock()
+	batch.init(BatchOptions{}, db)
+	if err := batch.PutCF(cf, []byte(key), []byte(value)); err != nil {
 		return err
 	}
-	return batch.commit(options)
+	return batch.Commit(options)
 }
 
-func (db *DB) waitMemTableSpace() error {
-	if db.activeMem.isFull() {
+// PutWithTTL writes the key, it is treated as missing once ttl has passed.
+func (db *DB) PutWithTTL(key string, value string, ttl time.Duration, options *WriteOptions) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(BatchOptions{}, db)
+	if err := batch.PutWithTTL([]byte(key), []byte(value), ttl); err != nil {
+		return err
+	}
+	return batch.Commit(options)
+}
+
+// waitMemTableSpace replaces the active memtable of the family once it is full or can not
+// take size more bytes, it must be called with db.commitMu held and without db.m. The new
+// WAL is recorded in the MANIFEST first, db.m is only taken to switch the memtables.
+func (cf *ColumnFamily) waitMemTableSpace(size int64) error {
+	if !cf.activeMem.isFull() && cf.activeMem.hasRoom(size) {
 		return nil
 	}
-	db.immutableMem = append(db.immutableMem, db.activeMem)
-	option := db.activeMem.option
+	option := cf.activeMem.option
 	option.id++
-	table, err := openMemTable(option)
+	// The WAL is recorded before it is written, the recovery only replays recorded WALs.
+	if err := cf.db.versions.logAndApply(&versionEdit{addedWals: []walRef{{family: cf.id, id: option.id}}}); err != nil {
+		return err
+	}
+	table, err := openMemTable(option, &WALRecoveryReport{})
 	if err != nil {
 		return err
 	}
-	db.activeMem = table
+	cf.db.m.Lock()
+	cf.immutableMem = append(cf.immutableMem, cf.activeMem)
+	cf.activeMem = table
+	cf.db.m.Unlock()
+	cf.db.triggerFlush()
 	return nil
 }
 
 func (db *DB) Get(key string) ([]byte, error) {
+	return db.GetWithOptions(key, nil)
+}
+
+// GetCF reads the key of the column family, nil is the default family.
+func (db *DB) GetCF(cf *ColumnFamily, key string) ([]byte, error) {
+	return db.GetWithOptions(key, &ReadOptions{ColumnFamily: cf})
+}
+
+// get looks the key up from the newest data to the oldest and returns the version
+// visible at readTs, it must be called with db.m held.
+func (cf *ColumnFamily) get(key []byte, readTs uint64) ([]byte, error) {
+	value, ok, err := cf.lookup(key, readTs)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, _const.ErrorKeyNotFound
+	}
+	if value.Meta == LogRecordMerge {
+		versions, err := cf.versions(key, readTs)
+		if err != nil {
+			return nil, err
+		}
+		merged, ok, err := cf.resolve(key, versions, cf.rangeDeleteSeq(key, readTs), uint64(time.Now().UnixNano()))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, _const.ErrorKeyNotFound
+		}
+		return merged, nil
+	}
+	if value.Meta == LogRecordDeleted || isExpired(value, uint64(time.Now().UnixNano())) ||
+		cf.rangeDeleteSeq(key, readTs) > value.Version {
+		return nil, _const.ErrorKeyNotFound
+	}
+	return cf.db.valueOf(value)
+}
+
+// expiredTombstone replaces an expired value when it is written into a table.
+var expiredTombstone = y.ValueStruct{Meta: LogRecordDeleted}
+
+// expireTime returns the expiry time of a value written now with the ttl, zero for no ttl.
+func expireTime(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).UnixNano())
+}
+
+// isExpired reports whether the value expired at now, given in unix nanoseconds.
+func isExpired(value y.ValueStruct, now uint64) bool {
+	return value.ExpiresAt != 0 && value.ExpiresAt <= now
+}
+
+// lookup returns the newest version of the key visible at readTs, tombstones included.
+// The Version of the result is the sequence number of the batch that wrote it.
+func (cf *ColumnFamily) lookup(key []byte, readTs uint64) (y.ValueStruct, bool, error) {
+	for _, table := range cf.getMemTables() {
+		if value, ok := table.get(key, readTs); ok {
+			return value, true, nil
+		}
+	}
+
+	internalKey := y.KeyWithTs(key, readTs)
+	for _, table := range cf.getTables(internalKey) {
+		value, ok, err := table.get(internalKey)
+		if err != nil || ok {
+			return value, ok, err
+		}
+	}
+	return y.ValueStruct{}, false, nil
+}
+
+// GetWithOptions reads the key, as of the snapshot and from the column family if they are given.
+func (db *DB) GetWithOptions(key string, options *ReadOptions) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, _const.ErrorKeyIsEmpty
+	}
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return nil, _const.ErrorDBClosed
+	}
+	readTs := db.seq
+	var cf *ColumnFamily
+	if options != nil {
+		if options.Snapshot != nil {
+			readTs = options.Snapshot.seq
+		}
+		cf = options.ColumnFamily
+	}
+	cf, err := db.family(cf)
+	if err != nil {
+		return nil, err
+	}
+	return cf.get([]byte(key), readTs)
+}
+
+// NoTTL is the TTL of a key that never expires.
+const NoTTL time.Duration = -1
+
+// TTL returns the time the key of the default column family has left before it expires,
+// NoTTL if it never expires.
+func (db *DB) TTL(key string) (time.Duration, error) {
+	return db.TTLWithOptions(key, nil)
+}
+
+// TTLWithOptions returns the time the key has left before it expires, read as GetWithOptions
+// reads its value, so that a Snapshot gives the time to live of the value read with it.
+func (db *DB) TTLWithOptions(key string, options *ReadOptions) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, _const.ErrorKeyIsEmpty
+	}
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return 0, _const.ErrorDBClosed
+	}
+	readTs := db.seq
+	var cf *ColumnFamily
+	if options != nil {
+		if options.Snapshot != nil {
+			readTs = options.Snapshot.seq
+		}
+		cf = options.ColumnFamily
+	}
+	cf, err := db.family(cf)
+	if err != nil {
+		return 0, err
+	}
+	return cf.ttl([]byte(key), readTs)
+}
+
+// ttl returns the time the version of the key visible at readTs has left, it must be
+// called with db.m held.
+func (cf *ColumnFamily) ttl(key []byte, readTs uint64) (time.Duration, error) {
+	value, ok, err := cf.lookup(key, readTs)
+	if err != nil {
+		return 0, err
+	}
+	if ok && value.Meta == LogRecordMerge {
+		// The merge operands carry no expiry time, the merged value never expires.
+		if _, err := cf.get(key, readTs); err != nil {
+			return 0, err
+		}
+		return NoTTL, nil
+	}
+	now := uint64(time.Now().UnixNano())
+	if !ok || value.Meta == LogRecordDeleted || isExpired(value, now) ||
+		cf.rangeDeleteSeq(key, readTs) > value.Version {
+		return 0, _const.ErrorKeyNotFound
+	}
+	if value.ExpiresAt == 0 {
+		return NoTTL, nil
+	}
+	return time.Duration(value.ExpiresAt - now), nil
+}
+
+// getMemTables returns all memtables of the family, the newest one first.
+func (cf *ColumnFamily) getMemTables() []*MemTable {
+	tables := make([]*MemTable, 0, len(cf.immutableMem)+1)
+	tables = append(tables, cf.activeMem)
+	for i := len(cf.immutableMem) - 1; i >= 0; i-- {
+		tables = append(tables, cf.immutableMem[i])
+	}
+	return tables
+}
+
+func (db *DB) Delete(key []byte, options *WriteOptions) error {
+	return db.DeleteCF(nil, key, options)
+}
+
+// DeleteCF deletes the key of the column family, nil is the default family.
+func (db *DB) DeleteCF(cf *ColumnFamily, key []byte, options *WriteOptions) error {
 	batch := db.batchPool.Get().(*Batch)
-	batch.init(true, false, db)
 	defer func() {
-		_ = batch.commit(nil)
 		batch.reset()
 		db.batchPool.Put(batch)
 	}()
-	return batch.Get([]byte(key))
+	batch.init(BatchOptions{}, db)
+	if err := batch.DeleteCF(cf, key); err != nil {
+		return err
+	}
+	return batch.Commit(options)
 }
 
-func (db *DB) getMemTables() []*MemTable {
-	return db.immutableMem
+// Merge writes a merge operand of the key, it is combined with the value of the key by the
+// MergeOperator of the Options when the key is read, so the value is never read here.
+func (db *DB) Merge(key []byte, operand []byte, options *WriteOptions) error {
+	return db.MergeCF(nil, key, operand, options)
 }
 
-func (db *DB) Delete(key []byte, options *WriteOptions) error {
-	if len(key) == 0 {
-		return _const.ErrorKeyIsEmpty
+// MergeCF writes a merge operand of the key of the column family, it is combined by the
+// MergeOperator of the family.
+func (db *DB) MergeCF(cf *ColumnFamily, key []byte, operand []byte, options *WriteOptions) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(BatchOptions{}, db)
+	if err := batch.MergeCF(cf, key, operand); err != nil {
+		return err
 	}
+	return batch.Commit(options)
+}
+
+// DeleteRange deletes the keys start <= key < end with one range tombstone, a nil start
+// deletes from the first key and a nil end up to the last one.
+func (db *DB) DeleteRange(start, end []byte, options *WriteOptions) error {
 	batch := db.batchPool.Get().(*Batch)
-	batch.init(false, false, db)
 	defer func() {
 		batch.reset()
 		db.batchPool.Put(batch)
 	}()
-	if err := batch.delete(key); err != nil {
-		batch.unLock()
+	batch.init(BatchOptions{}, db)
+	if err := batch.DeleteRange(start, end); err != nil {
 		return err
 	}
-	return batch.commit(options)
+	return batch.Commit(options)
+}
+
+// DeletePrefix deletes the keys that start with the prefix with one range tombstone.
+func (db *DB) DeletePrefix(prefix []byte, options *WriteOptions) error {
+	return db.DeleteRange(prefix, PrefixEnd(prefix), options)
+}
+
+// lockDir locks the directory of the database, a shared lock is taken on a read-only
+// open. A read-only open of a directory that was never locked takes no lock, so that no
+// file is created.
+func lockDir(options Options) (*flock.Flock, error) {
+	path := filepath.Join(options.DirPath, FileLockName)
+	fileLock := flock.New(path)
+	var (
+		lock bool
+		err  error
+	)
+	if options.ReadOnly {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fileLock, nil
+		}
+		lock, err = fileLock.TryRLock()
+	} else {
+		lock, err = fileLock.TryLock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !lock {
+		return nil, _const.ErrDatabaseIsUsing
+	}
+	return fileLock, nil
 }
 
 func OpenDB(options Options) (*DB, error) {
+	if options.ValueThreshold < 0 || options.ValueThreshold > math.MaxUint16 {
+		return nil, _const.ErrorInvalidThreshold
+	}
 
 	// Check if file existed.
 	if _, err := os.Stat(options.DirPath); err != nil {
+		if options.ReadOnly {
+			return nil, err
+		}
 		if err := os.Mkdir(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
-	lock, err := flock.New(filepath.Join(options.DirPath, FileLockName)).TryLock()
+	fileLock, err := lockDir(options)
 	if err != nil {
 		return nil, err
 	}
-	if !lock {
-		return nil, errors.New("file locked")
-	}
 
-	memTables, err := openAllMemTables(options)
+	versions, err := recoverVersionSet(options.DirPath)
+	if err == nil && !options.ReadOnly {
+		err = removeStaleFamilyDirs(options.DirPath, versions.families)
+		for _, fv := range versions.sortedFamilies() {
+			if err != nil {
+				break
+			}
+			err = removeObsoleteFiles(columnFamilyDir(options.DirPath, fv.id), fv)
+		}
+	}
+	var batchIds *snowflake.Node
+	if err == nil {
+		batchIds, err = snowflake.NewNode(1)
+	}
+	var vlog *valueLog
+	if err == nil {
+		vlog, err = openValueLog(options)
+	}
 	if err != nil {
+		_ = fileLock.Unlock()
 		return nil, err
 	}
 	db := &DB{
-		activeMem:    memTables[len(memTables)-1],
-		immutableMem: memTables,
+		options:      options,
+		families:     make(map[uint32]*ColumnFamily, len(versions.families)),
+		nextFamilyId: max(versions.nextFamilyId, 1),
+		nextTableId:  versions.nextTableId,
+		versions:     versions,
+		vlog:         vlog,
+		batchIds:     batchIds,
+		writers:      list.New(),
 		batchPool:    sync.Pool{New: makeBatch},
+		fileLock:     fileLock,
+		snapshots:    newSnapshotList(),
+		flushChan:    make(chan struct{}, 1),
+		compactChan:  make(chan struct{}, 1),
+		closeChan:    make(chan struct{}),
+	}
+	closeAll := func() {
+		for _, cf := range db.families {
+			_ = cf.close()
+		}
+		_ = vlog.close()
+		_ = versions.close()
+		_ = fileLock.Unlock()
+	}
+
+	for _, fv := range versions.sortedFamilies() {
+		familyOptions, ok := options.ColumnFamilies[fv.name]
+		if fv.id == defaultColumnFamilyId || !ok {
+			familyOptions = options.columnFamilyOptions()
+		}
+		cf, err := db.openColumnFamily(fv, familyOptions, &db.recovery)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		db.families[cf.id] = cf
+	}
+	db.defaultFamily = db.families[defaultColumnFamilyId]
+	if db.defaultFamily == nil {
+		closeAll()
+		return nil, _const.ErrorFamilyFileCorrupted
+	}
+	if err := db.recoverFamilyBatches(&db.recovery); err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	recovered := false
+	// The WALs dropped by a point-in-time recovery are no longer recorded.
+	edit := &versionEdit{}
+	for _, cf := range db.families {
+		db.seq = max(db.seq, cf.flushedSeq)
+		opened := make(map[int]bool)
+		for _, table := range cf.getMemTables() {
+			db.seq = max(db.seq, table.maxSeq)
+			opened[table.option.id] = true
+		}
+		for _, id := range versions.families[cf.id].walIds() {
+			if !opened[id] {
+				edit.deletedWals = append(edit.deletedWals, walRef{family: cf.id, id: id})
+			}
+		}
+		for _, tables := range cf.levels {
+			for _, table := range tables {
+				db.seq = max(db.seq, table.maxSeq)
+			}
+		}
+		recovered = recovered || len(cf.immutableMem) > 0
+	}
+	db.seq = max(db.seq, versions.lastSeq)
+	edit.lastSeq = db.seq
+	versions.apply(edit)
+	// A read-only database keeps the files as they are and never flushes or compacts.
+	if options.ReadOnly {
+		return db, nil
+	}
+	// Every open starts a new MANIFEST.
+	if err := versions.createManifest(); err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	db.bgWait.Add(2)
+	go db.flushLoop()
+	go db.compactLoop()
+	// Memtables recovered from the WAL are flushed right away.
+	if recovered {
+		db.triggerFlush()
 	}
+	db.triggerCompaction()
 	return db, nil
 }
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func testOptions(t *testing.T) Options {
+	options := DefaultOptions
+	options.DirPath = t.TempDir()
+	return options
+}
+
+func openTestDB(t *testing.T, options Options) *DB {
+	t.Helper()
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatalf("open %s: %v", options.DirPath, err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+// crashCopy copies the files of the open database in dir into a new directory, as a crash
+// would leave them.
+func crashCopy(t *testing.T, dir string) string {
+	t.Helper()
+	dst := t.TempDir()
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), os.ModePerm)
+		}
+		if entry.Name() == FileLockName {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	if err != nil {
+		t.Fatalf("copy %s: %v", dir, err)
+	}
+	return dst
+}
+
+func mustGet(t *testing.T, db *DB, key, want string) {
+	t.Helper()
+	value, err := db.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("get %s: %q, want %q", key, value, want)
+	}
+}
+
+func mustNotFind(t *testing.T, db *DB, key string) {
+	t.Helper()
+	if value, err := db.Get(key); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get %s: %q %v, want ErrorKeyNotFound", key, value, err)
+	}
+}
+
+func TestReopenAfterClose(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDB(options); !errors.Is(err, _const.ErrDatabaseIsUsing) {
+		t.Fatalf("open of an open database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	openTestDB(t, options)
+}
+
+func TestGetReadsEveryMemTable(t *testing.T) {
+	options := testOptions(t)
+	// The writes fill several memtables.
+	options.MemTableSize = 64 * _const.KB
+	db := openTestDB(t, options)
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 2000; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("key-0001"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key-0002", "new", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key-0000", value)
+	mustNotFind(t, db, "key-0001")
+	mustGet(t, db, "key-0002", "new")
+	mustGet(t, db, "key-1999", value)
+}
+
+func TestWritesAreLoggedUnlessDisableWal(t *testing.T) {
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	if err := db.Put("nil-options", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("default", "2", &WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("sync", "3", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("no-wal", "4", &WriteOptions{DisableWal: true}); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "no-wal", "4")
+
+	options.DirPath = crashCopy(t, options.DirPath)
+	recovered := openTestDB(t, options)
+	mustGet(t, recovered, "nil-options", "1")
+	mustGet(t, recovered, "default", "2")
+	mustGet(t, recovered, "sync", "3")
+	mustNotFind(t, recovered, "no-wal")
+}
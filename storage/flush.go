@@ -0,0 +1,191 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"sort"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// openAllTables opens the recorded table files of a family and groups them by their
+// recorded level, level 0 is ordered from the newest table to the oldest, the other levels
+// by their smallest key.
+func openAllTables(dirPath string, metas map[uint32]tableMeta) ([][]*Table, error) {
+	ids := make([]uint32, 0, len(metas))
+	for id := range metas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	levels := make([][]*Table, maxLevels)
+	closeAll := func() {
+		for _, tables := range levels {
+			for _, t := range tables {
+				_ = t.close()
+			}
+		}
+	}
+	for _, id := range ids {
+		meta := metas[id]
+		if meta.level >= maxLevels {
+			closeAll()
+			return nil, _const.ErrorManifestCorrupted
+		}
+		table, err := openTable(dirPath, id)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		table.level = meta.level
+		levels[table.level] = append(levels[table.level], table)
+	}
+	for level := 1; level < maxLevels; level++ {
+		tables := levels[level]
+		sort.Slice(tables, func(i, j int) bool { return y.CompareKeys(tables[i].smallest, tables[j].smallest) < 0 })
+	}
+	return levels, nil
+}
+
+// flushLoop writes the immutable memtables into table files in the background.
+func (db *DB) flushLoop() {
+	defer db.bgWait.Done()
+	for {
+		select {
+		case <-db.closeChan:
+			return
+		case <-db.flushChan:
+			for {
+				db.m.RLock()
+				var (
+					cf    *ColumnFamily
+					table *MemTable
+				)
+				if !db.Closed {
+					cf, table = db.nextFlush()
+				}
+				db.m.RUnlock()
+				if table == nil {
+					break
+				}
+
+				// The memtable stays readable and its WAL stays on disk,
+				// the flush is retried on the next trigger.
+				if err := cf.flushMemTable(table); err != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// triggerFlush wakes up the flush loop without blocking the writer.
+func (db *DB) triggerFlush() {
+	select {
+	case db.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// nextFlush returns the oldest immutable memtable of the family that has the most of them,
+// it must be called with db.m held.
+func (db *DB) nextFlush() (*ColumnFamily, *MemTable) {
+	var picked *ColumnFamily
+	for _, cf := range db.families {
+		if len(cf.immutableMem) > 0 && (picked == nil || len(cf.immutableMem) > len(picked.immutableMem)) {
+			picked = cf
+		}
+	}
+	if picked == nil {
+		return nil, nil
+	}
+	return picked, picked.immutableMem[0]
+}
+
+// flushMemTable persists the oldest immutable memtable of the family into a table file,
+// records the table, how far the family is flushed and the end of the WAL of the memtable
+// in the MANIFEST, then replaces the memtable on the read path and deletes its WAL.
+func (cf *ColumnFamily) flushMemTable(mem *MemTable) error {
+	cf.bgMu.RLock()
+	defer cf.bgMu.RUnlock()
+	db := cf.db
+	db.m.RLock()
+	dropped := cf.dropped
+	db.m.RUnlock()
+	if dropped {
+		return nil
+	}
+
+	table, err := mem.flush(cf, db.newTableId(), db.smallestSnapshot())
+	if err != nil {
+		return err
+	}
+
+	edit := &versionEdit{
+		flushedSeqs: []familySeq{{family: cf.id, seq: mem.maxSeq}},
+		deletedWals: []walRef{{family: cf.id, id: mem.option.id}},
+	}
+	if table != nil {
+		edit.addedTables = []tableMeta{tableMetaOf(cf.id, 0, table)}
+	}
+	db.m.RLock()
+	edit.nextTableId = db.nextTableId
+	edit.lastSeq = db.seq
+	db.m.RUnlock()
+	if err := db.versions.logAndApply(edit); err != nil {
+		if table != nil {
+			_ = table.remove()
+		}
+		return err
+	}
+
+	db.m.Lock()
+	cf.immutableMem = cf.immutableMem[1:]
+	if table != nil {
+		cf.levels[0] = append([]*Table{table}, cf.levels[0]...)
+	}
+	cf.flushedSeq = max(cf.flushedSeq, mem.maxSeq)
+	db.m.Unlock()
+
+	if table != nil {
+		db.triggerCompaction()
+	}
+	return mem.tinyWal.remove()
+}
+
+func (db *DB) newTableId() uint32 {
+	db.m.Lock()
+	defer db.m.Unlock()
+	id := db.nextTableId
+	db.nextTableId++
+	return id
+}
+
+// getTables returns the tables that may contain the user key in lookup order: level 0
+// from the newest table to the oldest, then every deeper level. A level only holds
+// overlapping tables if a compaction was interrupted before the MANIFEST recorded them,
+// the newer one wins.
+func (cf *ColumnFamily) getTables(key []byte) []*Table {
+	var tables []*Table
+	for level, levelTables := range cf.levels {
+		start := len(tables)
+		for _, table := range levelTables {
+			if table.containsKey(key) {
+				tables = append(tables, table)
+			}
+		}
+		if level > 0 && len(tables)-start > 1 {
+			candidates := tables[start:]
+			sort.Slice(candidates, func(i, j int) bool { return candidates[i].id > candidates[j].id })
+		}
+	}
+	return tables
+}
+
+// levelTables returns a copy of the tables of the level, the newer table first.
+func (cf *ColumnFamily) levelTables(level int) []*Table {
+	tables := append([]*Table(nil), cf.levels[level]...)
+	if level > 0 {
+		sort.Slice(tables, func(i, j int) bool { return tables[i].id > tables[j].id })
+	}
+	return tables
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForFlush waits until every immutable memtable of the database has been flushed.
+func waitForFlush(t *testing.T, db *DB) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		db.m.RLock()
+		pending := 0
+		for _, cf := range db.families {
+			pending += len(cf.immutableMem)
+		}
+		db.m.RUnlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d memtables are still waiting for a flush", pending)
+		}
+		db.triggerFlush()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countFiles(t *testing.T, dir, ext string) int {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(paths)
+}
+
+// fillMemTables writes n keys with the prefix, 3000 keys rotate a 64KB memtable several times.
+func fillMemTables(t *testing.T, db *DB, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := db.Put(fmt.Sprintf("%s-%05d", prefix, i), strings.Repeat("v", 100)+fmt.Sprint(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFlushWritesTables(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	db := openTestDB(t, options)
+
+	fillMemTables(t, db, "key", 3000)
+	if err := db.Delete([]byte("key-00010"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The deletion is flushed as well.
+	fillMemTables(t, db, "other", 3000)
+	waitForFlush(t, db)
+
+	if countFiles(t, options.DirPath, tableFileExt) == 0 {
+		t.Fatal("no table file was written")
+	}
+	// The tables hold the flushed keys, the deletion hides the older value.
+	for _, i := range []int{0, 11, 1500, 2999} {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+	}
+	mustNotFind(t, db, "key-00010")
+	mustNotFind(t, db, "missing")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if countFiles(t, options.DirPath, tableFileExt+tmpFileExt) != 0 {
+		t.Fatal("a temporary table file was left behind")
+	}
+}
+
+func TestFlushRemovesWalSegments(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	db := openTestDB(t, options)
+
+	fillMemTables(t, db, "key", 3000)
+	waitForFlush(t, db)
+
+	// Only the WAL of the active memtable is left.
+	paths, err := filepath.Glob(filepath.Join(options.DirPath, "*.MEM.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := fmt.Sprintf(walFileExt, db.defaultFamily.activeMem.option.id)
+	for _, path := range paths {
+		if !strings.HasSuffix(path, active) {
+			t.Fatalf("the WAL segment %s of a flushed memtable is still there", path)
+		}
+	}
+}
+
+func TestTablesAreReadAfterReopen(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillMemTables(t, db, "key", 3000)
+	waitForFlush(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	for _, i := range []int{0, 1234, 2999} {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+	}
+}
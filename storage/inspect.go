@@ -0,0 +1,141 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// ChunkInfo describes a chunk of a segment file as it is stored.
+type ChunkInfo struct {
+	BlockIndex  uint32
+	ChunkOffset uint32
+	// Type is the type of the chunk without the compressed flag.
+	Type       ChunkType
+	Compressed bool
+	// Length is the length of the data of the chunk, without its header.
+	Length uint32
+	// Valid reports whether the checksum of the chunk matches.
+	Valid bool
+}
+
+// OpenSegmentFileForRead opens an existing segment file for inspection, it is never
+// written. The id of the segment is the number its name starts with.
+func OpenSegmentFileForRead(path string) (*SegmentFile, error) {
+	dir, name := filepath.Split(path)
+	i := strings.IndexByte(name, '.')
+	if i <= 0 {
+		return nil, _const.ErrorFileExtError
+	}
+	id, err := strconv.ParseUint(name[:i], 10, 32)
+	if err != nil {
+		return nil, _const.ErrorFileExtError
+	}
+	segment, err := openReadOnlySegmentFile(dir, name[i:], uint32(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The name is built from the id, a name that is not zero padded is opened as it is.
+	if segment.fd.Name() != filepath.Join(dir, name) {
+		_ = segment.Close()
+		return nil, _const.ErrorFileExtError
+	}
+	return segment, nil
+}
+
+// NextChunk returns the next chunk of the segment, the padding at the end of the blocks
+// is skipped. A chunk whose checksum does not match is returned as invalid and the walk
+// continues after it, or in the next block if its length does not fit. io.EOF means the
+// segment ends and ErrorTornChunk that it ends in the middle of a chunk. NextChunk and
+// Next move the same position.
+func (s *SegmentReader) NextChunk() (*ChunkInfo, error) {
+	if s.seg.closed {
+		return nil, io.EOF
+	}
+	size := s.seg.Size()
+	if s.chunkoffset+_const.ChunkHeadSize >= _const.BlockSize {
+		s.blockidx++
+		s.chunkoffset = 0
+	}
+	if s.offset() >= size {
+		return nil, io.EOF
+	}
+	block, err := s.seg.readBlock(s.blockidx, size)
+	if err != nil {
+		return nil, err
+	}
+	if s.chunkoffset+_const.ChunkHeadSize > uint32(len(block)) {
+		return nil, _const.ErrorTornChunk
+	}
+
+	header := block[s.chunkoffset : s.chunkoffset+_const.ChunkHeadSize]
+	length := uint32(binary.LittleEndian.Uint16(header[4:6]))
+	chunk := &ChunkInfo{
+		BlockIndex:  s.blockidx,
+		ChunkOffset: s.chunkoffset,
+		Type:        header[6] &^ chunkCompressedFlag,
+		Compressed:  header[6]&chunkCompressedFlag != 0,
+		Length:      length,
+	}
+	start := s.chunkoffset + _const.ChunkHeadSize
+	end := start + length
+	if end > uint32(len(block)) {
+		if int64(s.blockidx+1)*_const.BlockSize >= size {
+			return nil, _const.ErrorTornChunk
+		}
+		// The length is garbage, the rest of the block can not be walked.
+		s.blockidx++
+		s.chunkoffset = 0
+		return chunk, nil
+	}
+	sum := crc32.ChecksumIEEE(header[4:])
+	sum = crc32.Update(sum, crc32.IEEETable, block[start:end])
+	chunk.Valid = sum == binary.LittleEndian.Uint32(header[:4])
+	s.chunkoffset = end
+	return chunk, nil
+}
+
+// Offset returns the position of the next chunk in the segment file.
+func (s *SegmentReader) Offset() int64 {
+	return s.offset()
+}
+
+// Skip moves the reader past a record that Next could not read to the first readable
+// record of the following blocks, as the WAL recovery does. It returns the number of bytes
+// skipped, false means that no readable record is left.
+func (s *SegmentReader) Skip() (int64, bool) {
+	from := s.offset()
+	next, found := s.seg.resync(s.blockidx)
+	if !found {
+		s.seek(s.seg.Size())
+		return s.seg.Size() - from, false
+	}
+	s.seek(next)
+	return next - from, true
+}
+
+// DecodeBatchEnd returns the id of the batch a LogRecordBatchEnd record ends and the ids of
+// the column families the batch wrote, nil if it only wrote the family of the WAL.
+func DecodeBatchEnd(record *LogRecord) (uint64, []uint32, error) {
+	if record.Type != LogRecordBatchEnd {
+		return 0, nil, _const.ErrorLogRecordCorrupted
+	}
+	batchId, err := snowflake.ParseBytes(record.Key)
+	if err != nil {
+		return 0, nil, _const.ErrorLogRecordCorrupted
+	}
+	if len(record.Value) == 0 {
+		return uint64(batchId), nil, nil
+	}
+	families, err := decodeFamilyIds(record.Value)
+	if err != nil {
+		return 0, nil, err
+	}
+	return uint64(batchId), families, nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// readChunks walks the chunks of the segment file until the walk ends, err is io.EOF if
+// the segment ends cleanly.
+func readChunks(t *testing.T, path string) ([]*ChunkInfo, error) {
+	t.Helper()
+	segment, err := OpenSegmentFileForRead(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = segment.Close()
+	}()
+	var chunks []*ChunkInfo
+	reader := segment.NewSegmentReader()
+	for {
+		chunk, err := reader.NextChunk()
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestNextChunkWalksTheBlocks(t *testing.T) {
+	records := testRecords()
+	path := writeTestSegment(t, records)
+	chunks, err := readChunks(t, path)
+	if err != io.EOF {
+		t.Fatalf("walk of the chunks: %v", err)
+	}
+
+	// Every record is a full chunk or starts a chunk and ends one, the data adds up.
+	var (
+		sizes []int
+		size  int
+	)
+	for i, chunk := range chunks {
+		if !chunk.Valid || chunk.Compressed {
+			t.Fatalf("chunk %d: %+v", i, chunk)
+		}
+		if chunk.ChunkOffset+_const.ChunkHeadSize+chunk.Length > _const.BlockSize {
+			t.Fatalf("chunk %d ends past its block: %+v", i, chunk)
+		}
+		size += int(chunk.Length)
+		if chunk.Type == ChunkTypeFull || chunk.Type == ChunkTypeEnd {
+			sizes = append(sizes, size)
+			size = 0
+		}
+	}
+	var want []int
+	for _, record := range records {
+		want = append(want, len(record))
+	}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("the chunks add up to records of %v bytes, want %v", sizes, want)
+	}
+	if first := chunks[0]; first.Type != ChunkTypeFull || first.BlockIndex != 0 || first.ChunkOffset != 0 || first.Length != 1 {
+		t.Fatalf("first chunk %+v", first)
+	}
+}
+
+func TestNextChunkReportsDamage(t *testing.T) {
+	records := [][]byte{[]byte("first"), bytes.Repeat([]byte{'x'}, 2*_const.BlockSize), []byte("last")}
+	path := writeTestSegment(t, records)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A byte in the data of the chunk that continues the big record in the second block.
+	data[_const.BlockSize+100] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := readChunks(t, path)
+	if err != io.EOF {
+		t.Fatalf("walk of the chunks: %v", err)
+	}
+	var bad []uint32
+	for _, chunk := range chunks {
+		if !chunk.Valid {
+			bad = append(bad, chunk.BlockIndex)
+		}
+	}
+	if !reflect.DeepEqual(bad, []uint32{1}) || !chunks[len(chunks)-1].Valid {
+		t.Fatalf("invalid chunks in the blocks %v, want only in block 1", bad)
+	}
+
+	// The file ends in the middle of the last chunk.
+	if err := os.Truncate(path, int64(len(data))-2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChunks(t, path); !errors.Is(err, _const.ErrorTornChunk) {
+		t.Fatalf("walk of a torn segment: %v", err)
+	}
+}
+
+func TestSkipResumesAfterTheDamage(t *testing.T) {
+	records := [][]byte{[]byte("first"), []byte("second"), bytes.Repeat([]byte{'x'}, _const.BlockSize), []byte("last")}
+	path := writeTestSegment(t, records)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A byte of the second record.
+	data[2*_const.ChunkHeadSize+len("first")+1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := OpenSegmentFileForRead(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = segment.Close()
+	}()
+	reader := segment.NewSegmentReader()
+	if record, _, err := reader.Next(); err != nil || string(record) != "first" {
+		t.Fatalf("first record %q: %v", record, err)
+	}
+	if _, _, err := reader.Next(); err == nil {
+		t.Fatal("the damaged record is read")
+	}
+	from := reader.Offset()
+	skipped, more := reader.Skip()
+	if !more || skipped <= 0 || reader.Offset() != from+skipped {
+		t.Fatalf("skipped %d bytes from %d to %d, more %v", skipped, from, reader.Offset(), more)
+	}
+	// The big record starts in the first block, the next one that starts in a block is
+	// the last.
+	if record, _, err := reader.Next(); err != nil || string(record) != "last" {
+		t.Fatalf("record after the damage %q: %v", record, err)
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("read after the last record: %v", err)
+	}
+	if skipped, more := reader.Skip(); more || skipped != 0 {
+		t.Fatalf("skip at the end: %d %v", skipped, more)
+	}
+}
+
+func TestOpenSegmentFileForReadChecksTheName(t *testing.T) {
+	path := writeTestSegment(t, [][]byte{[]byte("record")})
+	dir := filepath.Dir(path)
+	for _, name := range []string{"SEG", ".SEG", "x1.SEG", "1.SEG", "99999999999.SEG"} {
+		other := filepath.Join(dir, name)
+		if err := os.Link(path, other); err != nil {
+			t.Fatal(err)
+		}
+		if segment, err := OpenSegmentFileForRead(other); !errors.Is(err, _const.ErrorFileExtError) {
+			if err == nil {
+				_ = segment.Close()
+			}
+			t.Fatalf("open %s: %v", name, err)
+		}
+	}
+	if _, err := OpenSegmentFileForRead(filepath.Join(dir, "0000000002.SEG")); err == nil {
+		t.Fatal("a missing segment is opened")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0000000002.SEG")); !os.IsNotExist(err) {
+		t.Fatalf("the missing segment was created: %v", err)
+	}
+}
+
+func TestDecodeBatchEnd(t *testing.T) {
+	node, err := snowflake.NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := node.Generate()
+	record := &LogRecord{Key: id.Bytes(), Type: LogRecordBatchEnd}
+	if batchId, families, err := DecodeBatchEnd(record); err != nil || batchId != uint64(id) || families != nil {
+		t.Fatalf("decoded %d %v %v, want %d", batchId, families, err, id)
+	}
+	record.Value = encodeFamilyIds([]uint32{0, 3, 300})
+	if _, families, err := DecodeBatchEnd(record); err != nil || !reflect.DeepEqual(families, []uint32{0, 3, 300}) {
+		t.Fatalf("decoded the families %v: %v", families, err)
+	}
+
+	broken := []*LogRecord{
+		{Key: id.Bytes(), Type: LogRecordNormal},
+		{Key: []byte("not a number"), Type: LogRecordBatchEnd},
+		{Key: id.Bytes(), Value: []byte{0x80}, Type: LogRecordBatchEnd},
+	}
+	for _, record := range broken {
+		if _, _, err := DecodeBatchEnd(record); err == nil {
+			t.Fatalf("%+v is decoded", record)
+		}
+	}
+}
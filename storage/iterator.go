@@ -0,0 +1,368 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// Iterator walks the keys of the database in order. It merges the active memtable, the
+// immutable memtables and the table files as of the sequence number it was created at,
+// so later writes stay invisible, and hides deleted keys, the keys of the deleted ranges
+// and the keys that had expired when it was created. An Iterator must be closed and
+// is not safe for concurrent use.
+//
+// Seek and SeekForPrev always position by key order, Next moves in the direction given by
+// IteratorOptions.Reverse and Prev moves the other way.
+type Iterator struct {
+	family  *ColumnFamily
+	options IteratorOptions
+	readTs  uint64
+	now     uint64
+	// rangeDels are the range tombstones visible to the iterator.
+	rangeDels rangeTombstones
+	// versions collects the versions of a key while merge operands are resolved.
+	versions []version
+	// err is the error of the merge operator, it stops the iterator and is returned by Close.
+	err    error
+	tables []*Table
+	// vlogGeneration pins the value log segments the versions of the iterator may point to.
+	vlogGeneration uint64
+	vlogPinned     bool
+
+	forward  *y.MergeIterator
+	backward *y.MergeIterator
+
+	// reversed reports whether the last move went towards the smaller keys.
+	reversed bool
+	valid    bool
+	key      []byte
+	value    []byte
+}
+
+// NewIterator returns an iterator over a consistent view of a column family, the view of
+// IteratorOptions.Snapshot if one is given.
+func (db *DB) NewIterator(options IteratorOptions) (*Iterator, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return nil, _const.ErrorDBClosed
+	}
+
+	cf, err := db.family(options.ColumnFamily)
+	if err != nil {
+		return nil, err
+	}
+	memTables := cf.getMemTables()
+	var tables []*Table
+	for level := range cf.levels {
+		tables = append(tables, cf.levelTables(level)...)
+	}
+	for _, table := range tables {
+		table.incrRef()
+	}
+
+	newIterators := func(reversed bool) []y.Iterator {
+		iterators := make([]y.Iterator, 0, len(memTables)+len(tables))
+		for _, mem := range memTables {
+			iterators = append(iterators, mem.skl.NewUniIterator(reversed))
+		}
+		for _, table := range tables {
+			iterators = append(iterators, table.newIterator(reversed))
+		}
+		return iterators
+	}
+
+	readTs := db.seq
+	if options.Snapshot != nil {
+		readTs = options.Snapshot.seq
+	}
+
+	return &Iterator{
+		family:    cf,
+		options:   options,
+		readTs:    readTs,
+		now:       uint64(time.Now().UnixNano()),
+		rangeDels: cf.rangeTombstones(readTs),
+		tables:    tables,
+		forward:   y.NewMergeIterator(newIterators(false), false),
+		backward:  y.NewMergeIterator(newIterators(true), true),
+
+		vlogGeneration: db.vlog.acquire(),
+		vlogPinned:     true,
+	}, nil
+}
+
+// Rewind moves to the first key, or to the last key of a reverse iterator.
+func (it *Iterator) Rewind() {
+	if it.options.Reverse {
+		it.seekToLast()
+	} else {
+		it.seekToFirst()
+	}
+}
+
+// Seek moves to the first key that is >= key.
+func (it *Iterator) Seek(key []byte) {
+	if it.options.LowerBound != nil && bytes.Compare(key, it.options.LowerBound) < 0 {
+		key = it.options.LowerBound
+	}
+	it.forward.Seek(y.KeyWithTs(key, math.MaxUint64))
+	it.findNext()
+}
+
+// SeekForPrev moves to the last key that is <= key.
+func (it *Iterator) SeekForPrev(key []byte) {
+	if it.options.UpperBound != nil && bytes.Compare(key, it.options.UpperBound) >= 0 {
+		it.seekToLast()
+		return
+	}
+	it.backward.Seek(y.KeyWithTs(key, 0))
+	it.findPrev()
+}
+
+// Next moves to the next key in the direction of the iterator.
+func (it *Iterator) Next() {
+	if it.options.Reverse {
+		it.prev()
+	} else {
+		it.next()
+	}
+}
+
+// Prev moves to the previous key in the direction of the iterator.
+func (it *Iterator) Prev() {
+	if it.options.Reverse {
+		it.next()
+	} else {
+		it.prev()
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position, it is only valid until the next move.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value at the current position, it is nil in keys-only mode.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Close releases the memtables and table files held by the iterator.
+func (it *Iterator) Close() error {
+	err := it.err
+	if forwardErr := it.forward.Close(); err == nil {
+		err = forwardErr
+	}
+	if backwardErr := it.backward.Close(); err == nil {
+		err = backwardErr
+	}
+	for _, table := range it.tables {
+		if tableErr := table.decrRef(); err == nil {
+			err = tableErr
+		}
+	}
+	it.tables = nil
+	if it.vlogPinned {
+		it.family.db.vlog.release(it.vlogGeneration)
+		it.vlogPinned = false
+	}
+	it.valid = false
+	return err
+}
+
+func (it *Iterator) seekToFirst() {
+	if it.options.LowerBound != nil {
+		it.Seek(it.options.LowerBound)
+		return
+	}
+	it.forward.Rewind()
+	it.findNext()
+}
+
+func (it *Iterator) seekToLast() {
+	if it.options.UpperBound != nil {
+		it.backward.Seek(y.KeyWithTs(it.options.UpperBound, 0))
+		it.skipBackward(it.options.UpperBound)
+		it.findPrev()
+		return
+	}
+	it.backward.Rewind()
+	it.findPrev()
+}
+
+func (it *Iterator) next() {
+	if !it.valid {
+		return
+	}
+	if it.reversed {
+		// Change direction: the forward iterator is repositioned after the current key.
+		key := it.key
+		it.forward.Seek(y.KeyWithTs(key, math.MaxUint64))
+		it.skipForward(key)
+	}
+	it.findNext()
+}
+
+func (it *Iterator) prev() {
+	if !it.valid {
+		return
+	}
+	if !it.reversed {
+		// Change direction: the backward iterator is repositioned before the current key.
+		key := it.key
+		it.backward.Seek(y.KeyWithTs(key, 0))
+		it.skipBackward(key)
+	}
+	it.findPrev()
+}
+
+func (it *Iterator) skipForward(key []byte) {
+	for it.forward.Valid() && bytes.Equal(y.ParseKey(it.forward.Key()), key) {
+		it.forward.Next()
+	}
+}
+
+func (it *Iterator) skipBackward(key []byte) {
+	for it.backward.Valid() && bytes.Equal(y.ParseKey(it.backward.Key()), key) {
+		it.backward.Next()
+	}
+}
+
+// findNext moves the forward iterator to the next visible key, the versions of a key
+// come from the newest to the oldest.
+func (it *Iterator) findNext() {
+	it.reversed = false
+	it.valid = false
+	for it.forward.Valid() {
+		internalKey := it.forward.Key()
+		seq := y.ParseTs(internalKey)
+		if seq > it.readTs {
+			it.forward.Next()
+			continue
+		}
+		key := y.Copy(y.ParseKey(internalKey))
+		if it.options.UpperBound != nil && bytes.Compare(key, it.options.UpperBound) >= 0 {
+			return
+		}
+		value := it.forward.Value()
+		if value.Meta == LogRecordMerge {
+			// The versions come from the newest one, collect them down to the base value.
+			it.versions = append(it.versions[:0], version{seq: seq, value: value})
+			for it.forward.Next(); it.forward.Valid() && bytes.Equal(y.ParseKey(it.forward.Key()), key); it.forward.Next() {
+				older := it.forward.Value()
+				it.versions = append(it.versions, version{seq: y.ParseTs(it.forward.Key()), value: older})
+				if older.Meta != LogRecordMerge {
+					break
+				}
+			}
+			visible := it.setMerged(key)
+			it.skipForward(key)
+			if visible || it.err != nil {
+				return
+			}
+			continue
+		}
+		visible := it.visible(key, seq, value)
+		if visible {
+			it.setItem(key, value)
+		}
+		it.skipForward(key)
+		if visible {
+			return
+		}
+	}
+}
+
+// findPrev moves the backward iterator to the previous visible key, the versions of a
+// key come from the oldest to the newest so the last readable one wins.
+func (it *Iterator) findPrev() {
+	it.reversed = true
+	it.valid = false
+	for it.backward.Valid() {
+		key := y.Copy(y.ParseKey(it.backward.Key()))
+		if it.options.LowerBound != nil && bytes.Compare(key, it.options.LowerBound) < 0 {
+			return
+		}
+		// The versions come from the oldest one, the newest readable one is collected last.
+		it.versions = it.versions[:0]
+		for it.backward.Valid() && bytes.Equal(y.ParseKey(it.backward.Key()), key) {
+			if ts := y.ParseTs(it.backward.Key()); ts <= it.readTs {
+				it.versions = append(it.versions, version{seq: ts, value: it.backward.Value()})
+			}
+			it.backward.Next()
+		}
+		if len(it.versions) == 0 {
+			continue
+		}
+		newest := it.versions[len(it.versions)-1]
+		if newest.value.Meta == LogRecordMerge {
+			for i, j := 0, len(it.versions)-1; i < j; i, j = i+1, j-1 {
+				it.versions[i], it.versions[j] = it.versions[j], it.versions[i]
+			}
+			if it.setMerged(key) || it.err != nil {
+				return
+			}
+			continue
+		}
+		if it.visible(key, newest.seq, newest.value) {
+			it.setItem(key, newest.value)
+			return
+		}
+	}
+}
+
+// visible reports whether the version seq of the key is neither deleted nor expired.
+func (it *Iterator) visible(key []byte, seq uint64, value y.ValueStruct) bool {
+	return value.Meta != LogRecordDeleted && !isExpired(value, it.now) &&
+		!it.rangeDels.covers(key, seq, it.readTs)
+}
+
+// setMerged resolves the collected versions of the key, the newest one first, and reports
+// whether the key has a value.
+func (it *Iterator) setMerged(key []byte) bool {
+	value, ok, err := it.family.resolve(key, it.versions, it.rangeDels.coveringSeq(key, it.readTs), it.now)
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return false
+	}
+	if ok {
+		it.valid = true
+		it.key = key
+		it.value = nil
+		if !it.options.KeysOnly {
+			it.value = y.Copy(value)
+		}
+	}
+	return ok
+}
+
+func (it *Iterator) setItem(key []byte, value y.ValueStruct) {
+	it.valid = true
+	it.key = key
+	it.value = nil
+	if it.options.KeysOnly {
+		return
+	}
+	data, err := it.family.db.valueOf(value)
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return
+	}
+	if value.UserMeta == valuePointerMeta {
+		// The value log returns a buffer of its own.
+		it.value = data
+		return
+	}
+	it.value = y.Copy(data)
+}
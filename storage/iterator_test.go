@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// fillIteratorTestDB spreads the keys over the tables and the memtables, overwrites some
+// of them and deletes others, and returns what the database must contain.
+func fillIteratorTestDB(t *testing.T) (*DB, map[string]string) {
+	t.Helper()
+	options := compactionTestOptions(t)
+	db := openTestDB(t, options)
+	want := make(map[string]string)
+	put := func(key, value string) {
+		if err := db.Put(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	for i := 0; i < 3000; i++ {
+		put(fmt.Sprintf("key-%05d", i), fmt.Sprintf("first-%d", i))
+	}
+	waitForCompaction(t, db)
+	for i := 0; i < 3000; i += 3 {
+		put(fmt.Sprintf("key-%05d", i), fmt.Sprintf("second-%d", i))
+	}
+	for i := 1; i < 3000; i += 5 {
+		if err := db.Delete([]byte(fmt.Sprintf("key-%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, fmt.Sprintf("key-%05d", i))
+	}
+	return db, want
+}
+
+func sortedKeys(want map[string]string) []string {
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestIterator(t *testing.T, db *DB, options IteratorOptions) *Iterator {
+	t.Helper()
+	it, err := db.NewIterator(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = it.Close()
+	})
+	return it
+}
+
+// collect reads the keys and values from the current position in the direction of Next.
+func collect(it *Iterator) ([]string, []string) {
+	var keys, values []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+		values = append(values, string(it.Value()))
+	}
+	return keys, values
+}
+
+func checkIteration(t *testing.T, keys, values []string, wantKeys []string, want map[string]string) {
+	t.Helper()
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("%d keys, want %d", len(keys), len(wantKeys))
+	}
+	for i := range keys {
+		if keys[i] != wantKeys[i] {
+			t.Fatalf("key %d: %s, want %s", i, keys[i], wantKeys[i])
+		}
+		if values != nil && values[i] != want[keys[i]] {
+			t.Fatalf("%s: %q, want %q", keys[i], values[i], want[keys[i]])
+		}
+	}
+}
+
+func TestIteratorMergesMemTablesAndTables(t *testing.T) {
+	db, want := fillIteratorTestDB(t)
+	wantKeys := sortedKeys(want)
+
+	it := newTestIterator(t, db, IteratorOptions{})
+	it.Rewind()
+	keys, values := collect(it)
+	checkIteration(t, keys, values, wantKeys, want)
+
+	reversed := make([]string, len(wantKeys))
+	for i, key := range wantKeys {
+		reversed[len(wantKeys)-1-i] = key
+	}
+	it = newTestIterator(t, db, IteratorOptions{Reverse: true})
+	it.Rewind()
+	keys, values = collect(it)
+	checkIteration(t, keys, values, reversed, want)
+}
+
+func TestIteratorBounds(t *testing.T) {
+	db, want := fillIteratorTestDB(t)
+
+	var wantKeys []string
+	for _, key := range sortedKeys(want) {
+		if key >= "key-00100" && key < "key-00200" {
+			wantKeys = append(wantKeys, key)
+		}
+	}
+	it := newTestIterator(t, db, IteratorOptions{LowerBound: []byte("key-00100"), UpperBound: []byte("key-00200")})
+	it.Rewind()
+	keys, values := collect(it)
+	checkIteration(t, keys, values, wantKeys, want)
+
+	// A seek outside the bounds stops at the bound.
+	it.Seek([]byte("key-00000"))
+	if !it.Valid() || string(it.Key()) != wantKeys[0] {
+		t.Fatalf("seek below the lower bound is not at %s", wantKeys[0])
+	}
+	it.Seek([]byte("key-00200"))
+	if it.Valid() {
+		t.Fatalf("seek to the upper bound found %s", it.Key())
+	}
+
+	it = newTestIterator(t, db, IteratorOptions{Reverse: true, LowerBound: []byte("key-00100"), UpperBound: []byte("key-00200")})
+	it.Rewind()
+	if !it.Valid() || string(it.Key()) != wantKeys[len(wantKeys)-1] {
+		t.Fatalf("a reverse iterator does not start at %s", wantKeys[len(wantKeys)-1])
+	}
+}
+
+func TestIteratorSeekAndChangeDirection(t *testing.T) {
+	db, want := fillIteratorTestDB(t)
+
+	it := newTestIterator(t, db, IteratorOptions{})
+	// key-00001 is deleted, the seek lands on the next key.
+	it.Seek([]byte("key-00001"))
+	if !it.Valid() || string(it.Key()) != "key-00002" {
+		t.Fatal("seek does not skip the deleted key")
+	}
+	it.Prev()
+	if !it.Valid() || string(it.Key()) != "key-00000" || string(it.Value()) != want["key-00000"] {
+		t.Fatal("prev does not skip the deleted key")
+	}
+	it.Next()
+	it.Next()
+	if !it.Valid() || string(it.Key()) != "key-00003" || string(it.Value()) != want["key-00003"] {
+		t.Fatal("next after prev is not at key-00003")
+	}
+
+	it.SeekForPrev([]byte("key-00006"))
+	if !it.Valid() || string(it.Key()) != "key-00005" {
+		t.Fatal("seek for prev does not skip the deleted key")
+	}
+	it.SeekForPrev([]byte("key-00005x"))
+	if !it.Valid() || string(it.Key()) != "key-00005" {
+		t.Fatal("seek for prev is not at the largest smaller key")
+	}
+	it.Seek([]byte("zzz"))
+	if it.Valid() {
+		t.Fatalf("seek after the last key found %s", it.Key())
+	}
+}
+
+func TestIteratorKeysOnly(t *testing.T) {
+	db, want := fillIteratorTestDB(t)
+
+	it := newTestIterator(t, db, IteratorOptions{KeysOnly: true})
+	it.Rewind()
+	keys, values := collect(it)
+	checkIteration(t, keys, nil, sortedKeys(want), want)
+	for i, value := range values {
+		if value != "" {
+			t.Fatalf("%s has the value %q in keys-only mode", keys[i], value)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	_const "SmartStashDB/const"
 	"encoding/binary"
+	"time"
 )
 
 type LogRecordType = byte
@@ -10,7 +12,14 @@ const (
 	LogRecordNormal = iota
 	LogRecordDeleted
 	LogRecordBatchEnd
-	MaxLogRecordLength = 1 + binary.MaxVarintLen64*2
+	// LogRecordRangeDeleted deletes the keys from Key up to Value, Value is exclusive.
+	LogRecordRangeDeleted
+	// LogRecordMerge holds merge operands that are applied to the value by the MergeOperator.
+	LogRecordMerge
+	// LogRecordValuePointer is a LogRecordNormal whose value was moved into the value log,
+	// Value is the encoded ChunkPosition of the value.
+	LogRecordValuePointer
+	MaxLogRecordLength = 1 + binary.MaxVarintLen64*5
 )
 
 type LogRecord struct {
@@ -18,13 +27,19 @@ type LogRecord struct {
 	Value   []byte
 	Type    LogRecordType
 	BatchId uint64
+	Seq     uint64 // sequence number of the batch, it is the version of the key.
+	Expire  uint64 // expiry time in unix nanoseconds, zero means the key never expires.
 }
 
 func NewLogRecord() *LogRecord {
 	return &LogRecord{}
 }
 
-// Encode Serialize LogRecord, header + batchId + keySize + valueSize + key + value /*
+func (logRecord *LogRecord) expired() bool {
+	return logRecord.Expire != 0 && logRecord.Expire <= uint64(time.Now().UnixNano())
+}
+
+// Encode Serialize LogRecord, header + batchId + seq + expire + keySize + valueSize + key + value /*
 func (logRecord *LogRecord) Encode() []byte {
 	header := make([]byte, MaxLogRecordLength)
 	header[0] = logRecord.Type
@@ -32,6 +47,8 @@ func (logRecord *LogRecord) Encode() []byte {
 	index := 1
 
 	index += binary.PutUvarint(header[index:], logRecord.BatchId)
+	index += binary.PutUvarint(header[index:], logRecord.Seq)
+	index += binary.PutUvarint(header[index:], logRecord.Expire)
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
 
@@ -54,10 +71,14 @@ func (logRecord *LogRecord) Decode(b []byte) {
 	n := 0
 	logRecord.BatchId, n = binary.Uvarint(b[index:])
 	index += n
-	keyLength, n := binary.Uvarint(b[index:])
+	logRecord.Seq, n = binary.Uvarint(b[index:])
+	index += n
+	logRecord.Expire, n = binary.Uvarint(b[index:])
+	index += n
+	keyLength, n := binary.Varint(b[index:])
 	index += n
 
-	valueLength, n := binary.Uvarint(b[index:])
+	valueLength, n := binary.Varint(b[index:])
 	index += n
 
 	key := make([]byte, keyLength)
@@ -73,3 +94,37 @@ func (logRecord *LogRecord) Decode(b []byte) {
 	logRecord.Value = value
 
 }
+
+// DecodeChecked decodes like Decode, but it reports a truncated or malformed record with
+// ErrorLogRecordCorrupted instead of panicking, for records that are not protected by a CRC.
+func (logRecord *LogRecord) DecodeChecked(b []byte) error {
+	if len(b) == 0 {
+		return _const.ErrorLogRecordCorrupted
+	}
+	index := 1
+	// batchId, seq and expire.
+	for i := 0; i < 3; i++ {
+		_, n := binary.Uvarint(b[index:])
+		if n <= 0 {
+			return _const.ErrorLogRecordCorrupted
+		}
+		index += n
+	}
+	keyLength, n := binary.Varint(b[index:])
+	if n <= 0 {
+		return _const.ErrorLogRecordCorrupted
+	}
+	index += n
+	valueLength, n := binary.Varint(b[index:])
+	if n <= 0 {
+		return _const.ErrorLogRecordCorrupted
+	}
+	index += n
+
+	rest := int64(len(b) - index)
+	if keyLength < 0 || valueLength < 0 || keyLength > rest || valueLength != rest-keyLength {
+		return _const.ErrorLogRecordCorrupted
+	}
+	logRecord.Decode(b)
+	return nil
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func TestLogRecordRoundTrip(t *testing.T) {
+	records := []*LogRecord{
+		{Key: []byte("key"), Value: []byte("value"), Type: LogRecordNormal, BatchId: 42, Seq: 7, Expire: 1 << 60},
+		{Key: []byte("deleted"), Type: LogRecordDeleted, BatchId: 1 << 62},
+		{Key: bytes.Repeat([]byte{'k'}, 300), Value: bytes.Repeat([]byte{'v'}, 70000), Type: LogRecordNormal},
+		{Key: []byte("end"), Type: LogRecordBatchEnd},
+	}
+	for _, record := range records {
+		decoded := NewLogRecord()
+		decoded.Decode(record.Encode())
+		if decoded.Type != record.Type || decoded.BatchId != record.BatchId ||
+			decoded.Seq != record.Seq || decoded.Expire != record.Expire ||
+			!bytes.Equal(decoded.Key, record.Key) || !bytes.Equal(decoded.Value, record.Value) {
+			t.Fatalf("decoded %+v, want %+v", decoded, record)
+		}
+	}
+}
+
+func TestDecodeCheckedRefusesBrokenRecords(t *testing.T) {
+	record := &LogRecord{Key: []byte("key"), Value: []byte("value"), Type: LogRecordNormal, Expire: 1 << 40}
+	encoded := record.Encode()
+	decoded := NewLogRecord()
+	if err := decoded.DecodeChecked(encoded); err != nil || string(decoded.Key) != "key" || string(decoded.Value) != "value" {
+		t.Fatalf("decoded %+v %v", decoded, err)
+	}
+	broken := [][]byte{
+		nil,
+		encoded[:1],
+		encoded[:len(encoded)-1],
+		append(append([]byte(nil), encoded...), 'x'),
+		{LogRecordNormal, 0, 0, 0, 0x7f, 0},
+	}
+	for _, b := range broken {
+		if err := NewLogRecord().DecodeChecked(b); !errors.Is(err, _const.ErrorLogRecordCorrupted) {
+			t.Fatalf("decoded %x: %v", b, err)
+		}
+	}
+}
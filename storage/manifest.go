@@ -0,0 +1,552 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// CurrentFileName holds the name of the MANIFEST that describes the database.
+	CurrentFileName = "CURRENT"
+
+	manifestFileExt = ".MANIFEST"
+
+	// manifestRotateSize is the size after which the next edit starts a new MANIFEST with
+	// a snapshot of the recorded state.
+	manifestRotateSize = 4 * _const.MB
+)
+
+// The tags of the fields of a version edit.
+const (
+	editNextTableId = iota + 1
+	editNextFamilyId
+	editLastSeq
+	editAddFamily
+	editDropFamily
+	editFlushedSeq
+	editAddWal
+	editDeleteWal
+	editAddTable
+	editDeleteTable
+)
+
+// versionSet records the files that make up the database in the MANIFEST, a log of version
+// edits: the column families, the WAL of every memtable, the table files with their level
+// and key range, the next table id and the last sequence number. The database is opened
+// from exactly the recorded files, the others are leftovers of an interrupted flush or
+// compaction and are deleted.
+type versionSet struct {
+	dir string
+
+	// mu serializes the edits, it is never held while waiting for another lock.
+	mu         sync.Mutex
+	manifest   *SegmentFile
+	manifestId uint32
+	// rotate starts a new MANIFEST on the next edit, the tail of the current one may be
+	// torn by a failed write.
+	rotate bool
+
+	nextTableId  uint32
+	nextFamilyId uint32
+	lastSeq      uint64
+	families     map[uint32]*familyVersion
+}
+
+// familyVersion is the recorded state of a column family.
+type familyVersion struct {
+	id   uint32
+	name string
+	// flushedSeq is the biggest sequence number of the flushed memtables.
+	flushedSeq uint64
+	// wals are the ids of the memtables whose WAL is live.
+	wals   map[int]bool
+	tables map[uint32]tableMeta
+}
+
+// tableMeta describes a table file of a family, smallest and biggest are internal keys.
+type tableMeta struct {
+	family   uint32
+	id       uint32
+	level    int
+	size     int64
+	smallest []byte
+	biggest  []byte
+}
+
+type walRef struct {
+	family uint32
+	id     int
+}
+
+type familySeq struct {
+	family uint32
+	seq    uint64
+}
+
+// versionEdit is a change of the recorded state, zero fields are left unchanged.
+type versionEdit struct {
+	nextTableId     uint32
+	nextFamilyId    uint32
+	lastSeq         uint64
+	addedFamilies   []*familyVersion
+	droppedFamilies []uint32
+	flushedSeqs     []familySeq
+	addedWals       []walRef
+	deletedWals     []walRef
+	addedTables     []tableMeta
+	deletedTables   []tableMeta
+}
+
+func newFamilyVersion(id uint32, name string) *familyVersion {
+	return &familyVersion{
+		id:     id,
+		name:   name,
+		wals:   make(map[int]bool),
+		tables: make(map[uint32]tableMeta),
+	}
+}
+
+// walIds returns the ids of the live WALs, the oldest first.
+func (fv *familyVersion) walIds() []int {
+	ids := make([]int, 0, len(fv.wals))
+	for id := range fv.wals {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func tableMetaOf(family uint32, level int, table *Table) tableMeta {
+	return tableMeta{
+		family:   family,
+		id:       table.id,
+		level:    level,
+		size:     table.size,
+		smallest: table.smallest,
+		biggest:  table.biggest,
+	}
+}
+
+func (e *versionEdit) encode() []byte {
+	var buf []byte
+	putUvarint := func(tag int, values ...uint64) {
+		buf = binary.AppendUvarint(buf, uint64(tag))
+		for _, value := range values {
+			buf = binary.AppendUvarint(buf, value)
+		}
+	}
+	putBytes := func(b []byte) {
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	if e.nextTableId != 0 {
+		putUvarint(editNextTableId, uint64(e.nextTableId))
+	}
+	if e.nextFamilyId != 0 {
+		putUvarint(editNextFamilyId, uint64(e.nextFamilyId))
+	}
+	if e.lastSeq != 0 {
+		putUvarint(editLastSeq, e.lastSeq)
+	}
+	for _, fv := range e.addedFamilies {
+		putUvarint(editAddFamily, uint64(fv.id))
+		putBytes([]byte(fv.name))
+	}
+	for _, id := range e.droppedFamilies {
+		putUvarint(editDropFamily, uint64(id))
+	}
+	for _, f := range e.flushedSeqs {
+		putUvarint(editFlushedSeq, uint64(f.family), f.seq)
+	}
+	for _, w := range e.addedWals {
+		putUvarint(editAddWal, uint64(w.family), uint64(w.id))
+	}
+	for _, w := range e.deletedWals {
+		putUvarint(editDeleteWal, uint64(w.family), uint64(w.id))
+	}
+	for _, t := range e.addedTables {
+		putUvarint(editAddTable, uint64(t.family), uint64(t.id), uint64(t.level), uint64(t.size))
+		putBytes(t.smallest)
+		putBytes(t.biggest)
+	}
+	for _, t := range e.deletedTables {
+		putUvarint(editDeleteTable, uint64(t.family), uint64(t.id))
+	}
+	return buf
+}
+
+func decodeVersionEdit(data []byte) (*versionEdit, error) {
+	var (
+		edit    = &versionEdit{}
+		corrupt bool
+	)
+	uvarint := func() uint64 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			corrupt = true
+			return 0
+		}
+		data = data[n:]
+		return value
+	}
+	readBytes := func() []byte {
+		length := uvarint()
+		if corrupt || uint64(len(data)) < length {
+			corrupt = true
+			return nil
+		}
+		b := append([]byte(nil), data[:length]...)
+		data = data[length:]
+		return b
+	}
+	for len(data) > 0 && !corrupt {
+		switch uvarint() {
+		case editNextTableId:
+			edit.nextTableId = uint32(uvarint())
+		case editNextFamilyId:
+			edit.nextFamilyId = uint32(uvarint())
+		case editLastSeq:
+			edit.lastSeq = uvarint()
+		case editAddFamily:
+			id := uint32(uvarint())
+			edit.addedFamilies = append(edit.addedFamilies, newFamilyVersion(id, string(readBytes())))
+		case editDropFamily:
+			edit.droppedFamilies = append(edit.droppedFamilies, uint32(uvarint()))
+		case editFlushedSeq:
+			edit.flushedSeqs = append(edit.flushedSeqs, familySeq{family: uint32(uvarint()), seq: uvarint()})
+		case editAddWal:
+			edit.addedWals = append(edit.addedWals, walRef{family: uint32(uvarint()), id: int(uvarint())})
+		case editDeleteWal:
+			edit.deletedWals = append(edit.deletedWals, walRef{family: uint32(uvarint()), id: int(uvarint())})
+		case editAddTable:
+			t := tableMeta{family: uint32(uvarint()), id: uint32(uvarint()), level: int(uvarint()), size: int64(uvarint())}
+			t.smallest = readBytes()
+			t.biggest = readBytes()
+			edit.addedTables = append(edit.addedTables, t)
+		case editDeleteTable:
+			edit.deletedTables = append(edit.deletedTables, tableMeta{family: uint32(uvarint()), id: uint32(uvarint())})
+		default:
+			corrupt = true
+		}
+	}
+	if corrupt {
+		return nil, _const.ErrorManifestCorrupted
+	}
+	return edit, nil
+}
+
+// apply changes the recorded state, the edits of dropped families are ignored.
+func (vs *versionSet) apply(edit *versionEdit) {
+	vs.nextTableId = max(vs.nextTableId, edit.nextTableId)
+	vs.nextFamilyId = max(vs.nextFamilyId, edit.nextFamilyId)
+	vs.lastSeq = max(vs.lastSeq, edit.lastSeq)
+	for _, fv := range edit.addedFamilies {
+		vs.families[fv.id] = newFamilyVersion(fv.id, fv.name)
+	}
+	for _, f := range edit.flushedSeqs {
+		if fv := vs.families[f.family]; fv != nil {
+			fv.flushedSeq = max(fv.flushedSeq, f.seq)
+		}
+	}
+	for _, w := range edit.addedWals {
+		if fv := vs.families[w.family]; fv != nil {
+			fv.wals[w.id] = true
+		}
+	}
+	for _, w := range edit.deletedWals {
+		if fv := vs.families[w.family]; fv != nil {
+			delete(fv.wals, w.id)
+		}
+	}
+	for _, t := range edit.deletedTables {
+		if fv := vs.families[t.family]; fv != nil {
+			delete(fv.tables, t.id)
+		}
+	}
+	for _, t := range edit.addedTables {
+		if fv := vs.families[t.family]; fv != nil {
+			fv.tables[t.id] = t
+		}
+	}
+	for _, id := range edit.droppedFamilies {
+		delete(vs.families, id)
+	}
+}
+
+// snapshot returns the edit that creates the recorded state from nothing.
+func (vs *versionSet) snapshot() *versionEdit {
+	edit := &versionEdit{
+		nextTableId:  vs.nextTableId,
+		nextFamilyId: vs.nextFamilyId,
+		lastSeq:      vs.lastSeq,
+	}
+	for _, fv := range vs.sortedFamilies() {
+		edit.addedFamilies = append(edit.addedFamilies, fv)
+		if fv.flushedSeq != 0 {
+			edit.flushedSeqs = append(edit.flushedSeqs, familySeq{family: fv.id, seq: fv.flushedSeq})
+		}
+		for _, id := range fv.walIds() {
+			edit.addedWals = append(edit.addedWals, walRef{family: fv.id, id: id})
+		}
+		ids := make([]uint32, 0, len(fv.tables))
+		for id := range fv.tables {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			edit.addedTables = append(edit.addedTables, fv.tables[id])
+		}
+	}
+	return edit
+}
+
+func (vs *versionSet) sortedFamilies() []*familyVersion {
+	families := make([]*familyVersion, 0, len(vs.families))
+	for _, fv := range vs.families {
+		families = append(families, fv)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+// logAndApply appends the edit to the MANIFEST, syncs it and applies it.
+func (vs *versionSet) logAndApply(edit *versionEdit) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.manifest == nil || vs.rotate || vs.manifest.Size() >= manifestRotateSize {
+		if err := vs.createManifest(); err != nil {
+			return err
+		}
+	}
+	if _, err := vs.manifest.Write(edit.encode()); err != nil {
+		vs.rotate = true
+		return err
+	}
+	if err := vs.manifest.Sync(); err != nil {
+		vs.rotate = true
+		return err
+	}
+	vs.apply(edit)
+	return nil
+}
+
+// createManifest writes the recorded state into a new MANIFEST, points CURRENT to it and
+// deletes the old ones. It must be called with vs.mu held or before the set is shared.
+func (vs *versionSet) createManifest() error {
+	id := vs.manifestId + 1
+	// A MANIFEST left by a crash before CURRENT was switched is not used.
+	if err := os.Remove(segmentFileName(vs.dir, manifestFileExt, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	manifest, err := openSegmentFile(vs.dir, manifestFileExt, id, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := manifest.Write(vs.snapshot().encode()); err != nil {
+		_ = manifest.Close()
+		return err
+	}
+	if err := manifest.Sync(); err != nil {
+		_ = manifest.Close()
+		return err
+	}
+	if err := setCurrentFile(vs.dir, filepath.Base(manifest.fd.Name())); err != nil {
+		_ = manifest.Close()
+		return err
+	}
+
+	if vs.manifest != nil {
+		_ = vs.manifest.Close()
+	}
+	vs.manifest = manifest
+	vs.manifestId = id
+	vs.rotate = false
+	return removeObsoleteManifests(vs.dir, id)
+}
+
+func (vs *versionSet) close() error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.manifest == nil {
+		return nil
+	}
+	return vs.manifest.Close()
+}
+
+// setCurrentFile switches CURRENT to the MANIFEST with the name, the old content stays in
+// place until the new one is complete.
+func setCurrentFile(dir string, name string) error {
+	path := filepath.Join(dir, CurrentFileName)
+	fd, err := os.OpenFile(path+tmpFileExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.WriteString(name + "\n"); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpFileExt, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+func removeObsoleteManifests(dir string, current uint32) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var id uint32
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), manifestFileExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+manifestFileExt, &id); err != nil || id == current {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverVersionSet reads the state recorded in the directory, the MANIFEST is only
+// written again by createManifest. A directory without CURRENT is new and only has the
+// default family, unless a MANIFEST is left: then CURRENT was lost and RepairDB has to
+// rebuild it.
+func recoverVersionSet(dir string) (*versionSet, error) {
+	vs := &versionSet{
+		dir:         dir,
+		nextTableId: 1,
+		families:    make(map[uint32]*familyVersion),
+	}
+	current, err := os.ReadFile(filepath.Join(dir, CurrentFileName))
+	if os.IsNotExist(err) {
+		manifests, err := filepath.Glob(filepath.Join(dir, "*"+manifestFileExt))
+		if err != nil {
+			return nil, err
+		}
+		if len(manifests) > 0 {
+			return nil, _const.ErrorManifestCorrupted
+		}
+		fv := newFamilyVersion(defaultColumnFamilyId, DefaultColumnFamilyName)
+		fv.wals[initTableId] = true
+		vs.families[fv.id] = fv
+		vs.nextFamilyId = 1
+		return vs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(string(current), "\n")
+	if _, err := fmt.Sscanf(name, "%d"+manifestFileExt, &vs.manifestId); err != nil {
+		return nil, _const.ErrorManifestCorrupted
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, _const.ErrorManifestCorrupted
+		}
+		return nil, err
+	}
+	manifest, err := openReadOnlySegmentFile(dir, manifestFileExt, vs.manifestId, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = manifest.Close()
+	}()
+
+	reader := manifest.NewSegmentReader()
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, _const.ErrorTornChunk) || errors.Is(err, _const.ErrorInvalidCRC) {
+			// The edit torn by a crash was never applied, a damaged edit before the
+			// tail is not recoverable.
+			if _, ok := manifest.resync(reader.blockidx); ok {
+				return nil, _const.ErrorManifestCorrupted
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		edit, err := decodeVersionEdit(data)
+		if err != nil {
+			return nil, err
+		}
+		vs.apply(edit)
+	}
+	if vs.families[defaultColumnFamilyId] == nil {
+		return nil, _const.ErrorManifestCorrupted
+	}
+	return vs, nil
+}
+
+// removeObsoleteFiles deletes the WAL and table files of the family that are not recorded
+// and the unfinished table files.
+func removeObsoleteFiles(dir string, fv *familyVersion) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		obsolete := strings.HasSuffix(entry.Name(), tableFileExt+tmpFileExt)
+		if walId, ok := parseWalFileName(entry.Name()); ok {
+			obsolete = !fv.wals[walId]
+		}
+		if tableId, ok := parseTableFileName(entry.Name()); ok {
+			_, recorded := fv.tables[tableId]
+			obsolete = !recorded
+		}
+		if !obsolete {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseWalFileName returns the memtable id of a WAL segment file name.
+func parseWalFileName(name string) (int, bool) {
+	var segmentId, id int
+	if _, err := fmt.Sscanf(name, "%d"+walFileExt, &segmentId, &id); err != nil {
+		return 0, false
+	}
+	return id, name == fmt.Sprintf("%010d"+walFileExt, segmentId, id)
+}
+
+// parseTableFileName returns the id of a table file name.
+func parseTableFileName(name string) (uint32, bool) {
+	var id uint32
+	if _, err := fmt.Sscanf(name, "%d"+tableFileExt, &id); err != nil {
+		return 0, false
+	}
+	return id, name == tableFileName("", id)
+}
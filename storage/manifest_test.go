@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+// currentManifest returns the path of the MANIFEST named by CURRENT.
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+	current, err := os.ReadFile(filepath.Join(dir, CurrentFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimSuffix(string(current), "\n")
+	if !strings.HasSuffix(name, manifestFileExt) {
+		t.Fatalf("CURRENT names %q", name)
+	}
+	return filepath.Join(dir, name)
+}
+
+func TestManifestRecordsTheLiveFiles(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillMemTables(t, db, "key", 3000)
+	waitForCompaction(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every open starts a new MANIFEST and removes the old ones.
+	if _, err := os.Stat(currentManifest(t, options.DirPath)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, options.DirPath, manifestFileExt); n != 1 {
+		t.Fatalf("%d MANIFEST files", n)
+	}
+
+	// The files a crashed flush or compaction leaves behind are not recorded.
+	strayTable := tableFileName(options.DirPath, 9999)
+	strayWal := filepath.Join(options.DirPath, fmt.Sprintf("%010d"+walFileExt, 1, 9999))
+	for _, path := range []string{strayTable, strayWal} {
+		if err := os.WriteFile(path, []byte("stray"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db = openTestDB(t, options)
+	for _, path := range []string{strayTable, strayWal} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("the unrecorded file %s is left: %v", path, err)
+		}
+	}
+	db.m.RLock()
+	fv := db.versions.families[defaultColumnFamilyId]
+	tables := 0
+	for _, level := range db.defaultFamily.levels {
+		for _, table := range level {
+			if _, ok := fv.tables[table.id]; !ok {
+				t.Errorf("the table %d is not recorded", table.id)
+			}
+			tables++
+		}
+	}
+	memTables := db.defaultFamily.getMemTables()
+	db.m.RUnlock()
+	if tables == 0 || tables != len(fv.tables) {
+		t.Fatalf("%d tables opened, %d recorded", tables, len(fv.tables))
+	}
+	for _, table := range memTables {
+		if !fv.wals[table.option.id] {
+			t.Fatalf("the WAL of the memtable %d is not recorded", table.option.id)
+		}
+	}
+	for _, i := range []int{0, 1500, 2999} {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), strings.Repeat("v", 100)+fmt.Sprint(i))
+	}
+}
+
+func TestManifestWithTornTail(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The edit torn by a crash was never applied.
+	fd, err := os.OpenFile(currentManifest(t, options.DirPath), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, options)
+	mustGet(t, db, "key", "value")
+}
+
+func TestCurrentNamesAMissingManifest(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(options.DirPath, CurrentFileName), []byte("999"+manifestFileExt+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDB(options); !errors.Is(err, _const.ErrorManifestCorrupted) {
+		t.Fatalf("open with a CURRENT naming a missing MANIFEST: %v", err)
+	}
+}
+
+func TestLostCurrentIsReported(t *testing.T) {
+	options := testOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A MANIFEST without CURRENT is not a new database, opening it as one would lose the
+	// recorded families and tables.
+	if err := os.Remove(filepath.Join(options.DirPath, CurrentFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDB(options); !errors.Is(err, _const.ErrorManifestCorrupted) {
+		t.Fatalf("open without CURRENT: %v", err)
+	}
+}
@@ -1,29 +1,48 @@
 package storage
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/bwmarrin/snowflake"
 	"github.com/dgraph-io/badger/skl"
 	"github.com/dgraph-io/badger/y"
-	"io"
 	"math"
-	"os"
-	"sort"
 	"sync"
+	"time"
 )
 
 const (
 	initTableId = 1
 
 	walFileExt = ".MEM.%d"
+
+	// memTableEntrySize is the average entry size assumed to size the bloom filter.
+	memTableEntrySize = 64
 )
 
 type MemTable struct {
 	option memTableOptions
 
+	// maxSeq is the biggest sequence number written into the memtable.
+	maxSeq uint64
+
 	mu sync.RWMutex
 
 	skl *skl.Skiplist
+	// arenaSize is the memory of the skip-list, a write that does not fit into the rest of
+	// it must go to a new memtable.
+	arenaSize int64
+
+	// filter holds the user keys of the skip-list, it is nil if the filters are disabled.
+	filter bloomFilter
+
+	// rangeDels are the range tombstones written into the memtable, sorted by start key.
+	rangeDels rangeTombstones
+
+	// pending are the replayed parts of the batches that wrote several column families,
+	// they are applied once the other parts are known to be durable. A point-in-time
+	// recovery keeps every replayed batch pending until it knows where to stop.
+	pending []*familyBatchPart
 
 	tinyWal *TinyWAL
 }
@@ -35,164 +54,328 @@ type memTableOptions struct {
 	walCacheSize    uint32 // wal cache size.
 	walIsSync       bool   // whether to flush the disk immediately.
 	walBytesPerSync uint32 // how bytes to flush the disk.
-}
+	bloomBitsPerKey int    // bloom filter bits per key, zero disables the filter.
 
-func openAllMemTables(options WalOptions) ([]*MemTable, error) {
-	dir, err := os.ReadDir(options.DirPath)
-	if err != nil {
-		return nil, err
-	}
-	var tableIds []int
+	walRecoveryMode WALRecoveryMode // how corrupted chunks are handled on replay.
+	walCompression  *compression    // compresses the WAL records.
+	walReadOnly     bool            // replays the WAL without writing it.
+}
 
-	for _, file := range dir {
-		if file.IsDir() {
-			continue
-		}
-		var id int
-		var prefix int
+// batchKey identifies a batch in the WALs, the sequence number tells apart the batches of
+// different runs whose ids collide.
+type batchKey struct {
+	id  uint64
+	seq uint64
+}
 
-		_, err = fmt.Sscanf(file.Name(), "memtable_%d"+walFileExt, &prefix, &id)
-		if err != nil {
-			continue
-		}
-		tableIds = append(tableIds, id)
-	}
+// familyBatchPart is the part of a batch that wrote several column families.
+type familyBatchPart struct {
+	batchId uint64
+	seq     uint64
+	records []*LogRecord
+	// families are the ids of all families written by the batch.
+	families []uint32
+	// position is where the batch starts in the WAL.
+	position *ChunkPosition
+}
 
+// openAllMemTables replays the WALs of the memtables with the ids in the directory of the
+// option, the ids are sorted and the oldest memtable comes first. The id of the option is
+// ignored. flushedSeq is the sequence number the family flushed its tables up to.
+func openAllMemTables(option memTableOptions, tableIds []int, flushedSeq uint64, report *WALRecoveryReport) ([]*MemTable, error) {
+	// A point-in-time recovery drops the newer WALs of the family here, the batches the
+	// other families wrote after the same point are dropped once all of them are replayed.
+	report.stopped = false
+	lastSeq := flushedSeq
 	if len(tableIds) == 0 {
-		tableIds = append(tableIds, initTableId)
+		tableIds = []int{initTableId}
 	}
 
-	sort.Ints(tableIds)
-
-	tables := make([]*MemTable, len(tableIds))
+	tables := make([]*MemTable, 0, len(tableIds))
+	closeAll := func() {
+		for _, table := range tables {
+			_ = table.close()
+		}
+	}
 
-	for i, id := range tableIds {
-		table, err := openMemTable(memTableOptions{
-			sklMemSize:      options.MemTableSize,
-			id:              id,
-			walDir:          options.DirPath,
-			walIsSync:       options.Sync,
-			walBytesPerSync: options.BytesPerSync,
-		})
+	for _, id := range tableIds {
+		option.id = id
+		// Everything after the point where a point-in-time recovery stopped is dropped, a
+		// read-only database only leaves it out.
+		if report.stopped && option.walReadOnly {
+			continue
+		}
+		if report.stopped {
+			if err := removeMemTableWal(option, report); err != nil {
+				closeAll()
+				return nil, err
+			}
+			continue
+		}
 
+		table, err := openMemTable(option, report)
 		if err != nil {
+			closeAll()
 			return nil, err
 		}
-		tables[i] = table
+		tables = append(tables, table)
+		lastSeq = max(lastSeq, table.replayedSeq())
+		// The batch after the last one replayed may be lost.
+		if report.stopped {
+			report.stopAt(lastSeq + 1)
+		}
 	}
 
 	return tables, nil
 }
 
-func openMemTable(option memTableOptions) (*MemTable, error) {
-	skipList := skl.NewSkiplist(int64(option.sklMemSize * 2))
-
-	table := &MemTable{
-		option: option,
-		skl:    skipList,
-	}
-	wal, err := OpenTinyWAL(WalOptions{
+func openMemTableWal(option memTableOptions) (*TinyWAL, error) {
+	return OpenTinyWAL(WalOptions{
 		DirPath:        option.walDir,
 		MemTableSize:   math.MaxInt32,
 		segmentFileExt: fmt.Sprintf(walFileExt, option.id),
 		Sync:           option.walIsSync,
-		BytesPerSync:   option.walBytesPerSync,
+		BytesPerSync:   uint64(option.walBytesPerSync),
 		BlockCache:     option.walCacheSize,
+		compression:    option.walCompression,
+		readOnly:       option.walReadOnly,
 	})
+}
+
+// openMemTable opens the memtable and replays its WAL, the dropped data is added to the report.
+func openMemTable(option memTableOptions, report *WALRecoveryReport) (*MemTable, error) {
+	wal, err := openMemTableWal(option)
 	if err != nil {
 		return nil, err
 	}
-	table.tinyWal = wal
-
-	indexRecords := make(map[uint64][]*LogRecord)
 
-	reader := wal.NewReader()
+	table := &MemTable{
+		option:  option,
+		tinyWal: wal,
+	}
+	if option.bloomBitsPerKey > 0 {
+		table.filter = newBloomFilter(int(option.sklMemSize/memTableEntrySize), option.bloomBitsPerKey)
+	}
 
-	for {
-		data, _, err := reader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+	indexRecords := make(map[batchKey][]*LogRecord)
+	starts := make(map[batchKey]*ChunkPosition)
+	// The batches are applied once the WAL is read, the skip-list is sized by the replayed
+	// records.
+	var (
+		batches      []*familyBatchPart
+		replayedSize int64
+	)
 
+	err = wal.replay(option.walRecoveryMode, report, func(data []byte, position *ChunkPosition) error {
 		record := NewLogRecord()
 		record.Decode(data)
 		if record.Type == LogRecordBatchEnd {
 			batchId, err := snowflake.ParseBytes(record.Key)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
-			for _, idxRecord := range indexRecords[uint64(batchId)] {
-				table.skl.Put(y.KeyWithTs(idxRecord.Key, 0),
-					y.ValueStruct{
-						Meta:  idxRecord.Type,
-						Value: idxRecord.Value,
-					})
+			key := batchKey{id: uint64(batchId), seq: record.Seq}
+			part := &familyBatchPart{
+				batchId:  key.id,
+				seq:      key.seq,
+				records:  indexRecords[key],
+				position: starts[key],
 			}
-			delete(indexRecords, uint64(batchId))
-
+			if part.position == nil {
+				part.position = position
+			}
+			delete(indexRecords, key)
+			delete(starts, key)
+			if len(record.Value) > 0 {
+				if part.families, err = decodeFamilyIds(record.Value); err != nil {
+					return err
+				}
+			}
+			batches = append(batches, part)
 		} else {
-			indexRecords[record.BatchId] = append(indexRecords[record.BatchId], record)
+			replayedSize += sklEntrySize(len(record.Key), len(record.Value))
+			key := batchKey{id: record.BatchId, seq: record.Seq}
+			indexRecords[key] = append(indexRecords[key], record)
+			if starts[key] == nil {
+				starts[key] = position
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		_ = wal.close()
+		return nil, err
+	}
+	report.DroppedBatches += len(indexRecords)
+
+	// The WAL may have been written with a bigger memtable size, the skip-list must hold
+	// all of it. A recovered memtable that is too big is simply full.
+	table.arenaSize = max(int64(option.sklMemSize)*2, replayedSize)
+	table.skl = skl.NewSkiplist(table.arenaSize)
+	for _, part := range batches {
+		// The parts of the batches that wrote several families wait for the other parts.
+		if part.families != nil || option.walRecoveryMode == WALRecoveryPointInTime {
+			table.pending = append(table.pending, part)
+			continue
+		}
+		for _, record := range part.records {
+			table.put(record, part.seq)
+		}
+		table.maxSeq = max(table.maxSeq, part.seq)
 	}
 
 	return table, nil
 }
 
-func (mt *MemTable) get(key []byte) (bool, []byte) {
+// replayedSeq returns the newest sequence number replayed from the WAL.
+func (mt *MemTable) replayedSeq() uint64 {
+	seq := mt.maxSeq
+	for _, part := range mt.pending {
+		seq = max(seq, part.seq)
+	}
+	return seq
+}
+
+// get returns the newest version of the key that is visible at readTs. Sequence numbers
+// start from 1, so a zero version means that the key is missing.
+func (mt *MemTable) get(key []byte, readTs uint64) (y.ValueStruct, bool) {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
 
-	valueStruct := mt.skl.Get(y.KeyWithTs(key, 0))
-	deleted := valueStruct.Meta == LogRecordDeleted
+	if mt.filter != nil && !mt.filter.mayContain(key) {
+		return y.ValueStruct{}, false
+	}
+	valueStruct := mt.skl.Get(y.KeyWithTs(key, readTs))
+	return valueStruct, valueStruct.Version != 0
+}
 
-	return deleted, valueStruct.Value
+// addFilter adds the user key to the bloom filter, it must be called with mt.mu held or
+// before the memtable is shared.
+func (mt *MemTable) addFilter(key []byte) {
+	if mt.filter != nil {
+		mt.filter.add(key)
+	}
 }
 
 func (mt *MemTable) isFull() bool {
 	return mt.skl.MemSize() >= int64(mt.option.sklMemSize)
 }
 
-func (mt *MemTable) putBatch(records map[string]*LogRecord, batchId snowflake.ID, options *WriteOptions) error {
-	if options == nil || options.DisableWal {
-		for _, record := range records {
-			record.BatchId = uint64(batchId)
+// hasRoom reports whether the skip-list can take size more bytes.
+func (mt *MemTable) hasRoom(size int64) bool {
+	return mt.skl.MemSize()+size <= mt.arenaSize
+}
+
+// sklEntrySize bounds the skip-list memory taken by an entry: a node of the maximum height
+// with its alignment, the key with its version and the encoded value.
+func sklEntrySize(keySize, valueSize int) int64 {
+	return int64(skl.MaxNodeSize + 7 + keySize + 8 + valueSize + 2 + binary.MaxVarintLen64)
+}
+
+// logBatches writes the parts of the batches that belong to the family into the WAL with
+// one append and at most one sync. Every part ends with its own BatchEnd record, the one of a
+// batch that wrote several families lists all of them.
+func (mt *MemTable) logBatches(cf *ColumnFamily, batches []*commitRequest) error {
+	walWrites, sync := false, mt.option.walIsSync
+	// The records of a failed commit must not be written with the next one.
+	fail := func(err error) error {
+		mt.tinyWal.ClearPendingWrites()
+		return err
+	}
+	for _, batch := range batches {
+		writes := batch.writes[cf]
+		if writes == nil || batch.disableWal {
+			continue
+		}
+		walWrites = true
+		sync = sync || batch.sync
+		for _, record := range writes.rangeDeletes {
+			record.BatchId = uint64(batch.batchId)
+			record.Seq = batch.seq
 			if err := mt.tinyWal.PendingWrites(record.Encode()); err != nil {
-				return err
+				return fail(err)
+			}
+		}
+		for _, record := range writes.records {
+			record.BatchId = uint64(batch.batchId)
+			record.Seq = batch.seq
+			if err := mt.tinyWal.PendingWrites(record.Encode()); err != nil {
+				return fail(err)
 			}
 		}
 		record := NewLogRecord()
-		record.Key = batchId.Bytes()
+		record.Key = batch.batchId.Bytes()
 		record.Type = LogRecordBatchEnd
+		record.Seq = batch.seq
+		if len(batch.writes) > 1 {
+			record.Value = encodeFamilyIds(batch.familyIds())
+		}
 
 		if err := mt.tinyWal.PendingWrites(record.Encode()); err != nil {
-			return err
+			return fail(err)
 		}
+	}
 
-		if err := mt.tinyWal.WriteAll(); err != nil {
+	if walWrites {
+		if _, err := mt.tinyWal.WriteAll(); err != nil {
 			return err
 		}
-
-		if options != nil && options.Sync && mt.option.walIsSync {
+		if sync {
 			if err := mt.tinyWal.Sync(); err != nil {
 				return err
 			}
 		}
 	}
+	return nil
+}
 
+// applyBatches writes the parts of the logged batches that belong to the family into the skip-list.
+func (mt *MemTable) applyBatches(cf *ColumnFamily, batches []*commitRequest) {
 	mt.mu.Lock()
-	for key, record := range records {
-		mt.skl.Put(y.KeyWithTs([]byte(key), 0),
-			y.ValueStruct{
-				Meta:  record.Type,
-				Value: record.Value,
-			})
-	}
-	mt.mu.Unlock()
-	return nil
+	defer mt.mu.Unlock()
+	for _, batch := range batches {
+		writes := batch.writes[cf]
+		if writes == nil {
+			continue
+		}
+		for _, record := range writes.rangeDeletes {
+			mt.put(record, batch.seq)
+		}
+		for _, record := range writes.records {
+			mt.put(record, batch.seq)
+		}
+		mt.maxSeq = max(mt.maxSeq, batch.seq)
+	}
+}
+
+// put adds the record with the sequence number, it must be called with mt.mu held or
+// before the memtable is shared.
+func (mt *MemTable) put(record *LogRecord, seq uint64) {
+	if record.Type == LogRecordRangeDeleted {
+		mt.rangeDels = append(mt.rangeDels, rangeTombstone{start: record.Key, end: record.Value, seq: seq})
+		mt.rangeDels.sort()
+		return
+	}
+	mt.addFilter(record.Key)
+	value := y.ValueStruct{
+		Meta:      record.Type,
+		Value:     record.Value,
+		ExpiresAt: record.Expire,
+	}
+	if record.Type == LogRecordValuePointer {
+		value.Meta = LogRecordNormal
+		value.UserMeta = valuePointerMeta
+	}
+	mt.skl.Put(y.KeyWithTs(record.Key, seq), value)
+}
+
+// rangeDeleteSeq returns the newest sequence number <= readTs of the range tombstones
+// that contain the key.
+func (mt *MemTable) rangeDeleteSeq(key []byte, readTs uint64) uint64 {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.rangeDels.coveringSeq(key, readTs)
 }
 
 func (mt *MemTable) close() error {
@@ -201,3 +384,49 @@ func (mt *MemTable) close() error {
 	}
 	return nil
 }
+
+// flush writes the skip-list and the range tombstones into a table file, nil is returned if
+// the memtable is empty. Expired values are written as tombstones, so that they still hide
+// the older versions of the key in the deeper levels, compaction drops them later. The
+// versions deleted by a range tombstone that every snapshot sees are left out.
+func (mt *MemTable) flush(cf *ColumnFamily, tableId uint32, smallestSnapshot uint64) (*Table, error) {
+	builder, err := newTableBuilder(cf.dir, tableId, 0, mt.option.bloomBitsPerKey, cf.tableCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	now := uint64(time.Now().UnixNano())
+	// The merge operands that every snapshot sees are combined while the memtable is written.
+	iterator := cf.newCollapsingIterator(mt.skl.NewUniIterator(false), smallestSnapshot, mt.rangeDels, nil, now)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		if mt.rangeDels.covers(y.ParseKey(key), y.ParseTs(key), smallestSnapshot) {
+			continue
+		}
+		value := iterator.Value()
+		if isExpired(value, now) {
+			value = expiredTombstone
+		}
+		if err := builder.add(key, value); err != nil {
+			_ = iterator.Close()
+			builder.abandon()
+			return nil, err
+		}
+	}
+	if err := iterator.Close(); err != nil {
+		builder.abandon()
+		return nil, err
+	}
+	for _, r := range mt.rangeDels {
+		builder.addRangeTombstone(r)
+	}
+	if builder.empty() {
+		builder.abandon()
+		return nil, nil
+	}
+	if err := builder.finish(); err != nil {
+		builder.abandon()
+		return nil, err
+	}
+	return openTable(cf.dir, tableId)
+}
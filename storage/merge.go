@@ -0,0 +1,265 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// MergeOperator combines the operands written by DB.Merge with the value of the key, it
+// must be deterministic since the operands are combined lazily on reads, flush and
+// compaction.
+type MergeOperator interface {
+	// Merge applies the operands, the oldest one first, to the existing value of the key.
+	// existing is nil if the key has no value.
+	Merge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// A merge value is a list of operands, the oldest one first, every operand is prefixed
+// with its length, so two lists are combined by appending them.
+func appendMergeOperand(list []byte, operand []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(operand)))
+	list = append(list, buf[:n]...)
+	return append(list, operand...)
+}
+
+func decodeMergeOperands(list []byte) ([][]byte, error) {
+	var operands [][]byte
+	for len(list) > 0 {
+		length, n := binary.Uvarint(list)
+		if n <= 0 || uint64(len(list)-n) < length {
+			return nil, _const.ErrorTableCorrupted
+		}
+		operands = append(operands, list[n:n+int(length)])
+		list = list[n+int(length):]
+	}
+	return operands, nil
+}
+
+// fullMerge applies the merge values, the newest one first, to the base value.
+func (cf *ColumnFamily) fullMerge(key, base []byte, lists [][]byte) ([]byte, error) {
+	if cf.options.MergeOperator == nil {
+		return nil, _const.ErrorNoMergeOperator
+	}
+	var operands [][]byte
+	for i := len(lists) - 1; i >= 0; i-- {
+		ops, err := decodeMergeOperands(lists[i])
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, ops...)
+	}
+	return cf.options.MergeOperator.Merge(key, base, operands)
+}
+
+// version is a version of a key, seq is the sequence number of the batch that wrote it.
+type version struct {
+	seq   uint64
+	value y.ValueStruct
+}
+
+// resolve returns the value of the key from its visible versions, the newest one first.
+// The merge operands on top of the newest value are applied to it, a version older than
+// rangeSeq is deleted by a range tombstone. ok is false if the key is deleted.
+func (cf *ColumnFamily) resolve(key []byte, versions []version, rangeSeq uint64, now uint64) ([]byte, bool, error) {
+	var (
+		lists [][]byte
+		base  []byte
+	)
+	for _, v := range versions {
+		if v.seq < rangeSeq {
+			break
+		}
+		if v.value.Meta == LogRecordMerge {
+			lists = append(lists, v.value.Value)
+			continue
+		}
+		if v.value.Meta != LogRecordDeleted && !isExpired(v.value, now) {
+			value, err := cf.db.valueOf(v.value)
+			if err != nil {
+				return nil, false, err
+			}
+			base = value
+		}
+		break
+	}
+	if len(lists) == 0 {
+		return base, base != nil, nil
+	}
+	value, err := cf.fullMerge(key, base, lists)
+	return value, err == nil, err
+}
+
+// versions returns the versions of the key visible at readTs, the newest one first. It
+// stops after the first version that is not a merge operand and must be called with db.m held.
+func (cf *ColumnFamily) versions(key []byte, readTs uint64) ([]version, error) {
+	var versions []version
+	internalKey := y.KeyWithTs(key, readTs)
+	// collect reads the versions of the iterator, it returns false once the base is found.
+	collect := func(it y.Iterator) bool {
+		for it.Seek(internalKey); it.Valid() && y.SameKey(it.Key(), internalKey); it.Next() {
+			value := it.Value()
+			versions = append(versions, version{seq: y.ParseTs(it.Key()), value: value})
+			if value.Meta != LogRecordMerge {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, mem := range cf.getMemTables() {
+		it := mem.skl.NewUniIterator(false)
+		more := collect(it)
+		_ = it.Close()
+		if !more {
+			return versions, nil
+		}
+	}
+	for _, table := range cf.getTables(internalKey) {
+		if table.filter != nil && !table.filter.mayContain(key) {
+			continue
+		}
+		it := table.newIterator(false)
+		more := collect(it)
+		if err := it.Close(); err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return versions, nil
+}
+
+// collapsingIterator walks the entries of a flush or a compaction. Once every snapshot
+// sees the newest merge operand of a key, the operands below it are combined into it and
+// applied to the base value if the base is known. Without a base the operands stay a
+// merge value, unless bottommost reports that no deeper level holds the key.
+type collapsingIterator struct {
+	family           *ColumnFamily
+	it               y.Iterator
+	smallestSnapshot uint64
+	rangeDels        rangeTombstones
+	bottommost       func(internalKey []byte) bool
+	now              uint64
+
+	key   []byte
+	value y.ValueStruct
+	// ahead is set when the wrapped iterator already points after the current entry.
+	ahead   bool
+	lastKey []byte
+	lastSeq uint64
+	err     error
+}
+
+func (cf *ColumnFamily) newCollapsingIterator(it y.Iterator, smallestSnapshot uint64, rangeDels rangeTombstones,
+	bottommost func(internalKey []byte) bool, now uint64) *collapsingIterator {
+	return &collapsingIterator{
+		family:           cf,
+		it:               it,
+		smallestSnapshot: smallestSnapshot,
+		rangeDels:        rangeDels,
+		bottommost:       bottommost,
+		now:              now,
+	}
+}
+
+func (c *collapsingIterator) Rewind() {
+	c.it.Rewind()
+	c.lastKey = nil
+	c.settle()
+}
+
+func (c *collapsingIterator) Next() {
+	if !c.ahead {
+		c.it.Next()
+	}
+	c.settle()
+}
+
+func (c *collapsingIterator) Valid() bool {
+	return c.err == nil && c.key != nil
+}
+
+func (c *collapsingIterator) Key() []byte {
+	return c.key
+}
+
+func (c *collapsingIterator) Value() y.ValueStruct {
+	return c.value
+}
+
+func (c *collapsingIterator) Close() error {
+	err := c.it.Close()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+// settle loads the entry the wrapped iterator points to, collapsing a merge chain.
+func (c *collapsingIterator) settle() {
+	c.ahead = false
+	c.key = nil
+	if c.err != nil || !c.it.Valid() {
+		return
+	}
+	key, value := c.it.Key(), c.it.Value()
+	userKey, seq := y.ParseKey(key), y.ParseTs(key)
+	first := c.lastKey == nil || !y.SameKey(key, c.lastKey) || c.lastSeq > c.smallestSnapshot
+	c.lastKey = append(c.lastKey[:0], key...)
+	c.lastSeq = seq
+	c.key, c.value = key, value
+	if value.Meta != LogRecordMerge || seq > c.smallestSnapshot || !first {
+		return
+	}
+
+	c.key = y.Copy(key)
+	lists := [][]byte{y.Copy(value.Value)}
+	full := false
+	var base []byte
+	for c.it.Next(); c.it.Valid() && y.SameKey(c.it.Key(), key); c.it.Next() {
+		older := c.it.Value()
+		if c.rangeDels.covers(userKey, y.ParseTs(c.it.Key()), c.smallestSnapshot) {
+			full = true
+			break
+		}
+		if older.Meta == LogRecordMerge {
+			lists = append(lists, y.Copy(older.Value))
+			continue
+		}
+		full = true
+		if older.Meta != LogRecordDeleted && !isExpired(older, c.now) {
+			value, err := c.family.db.valueOf(older)
+			if err != nil {
+				c.err = err
+				c.key = nil
+				return
+			}
+			base = value
+		}
+		break
+	}
+	c.ahead = true
+	if !full && c.bottommost != nil && c.bottommost(key) {
+		full = true
+	}
+
+	if !full {
+		var combined []byte
+		for i := len(lists) - 1; i >= 0; i-- {
+			combined = append(combined, lists[i]...)
+		}
+		c.value = y.ValueStruct{Meta: LogRecordMerge, Value: combined}
+		return
+	}
+	merged, err := c.family.fullMerge(userKey, base, lists)
+	if err != nil {
+		c.err = err
+		c.key = nil
+		return
+	}
+	c.value = y.ValueStruct{Meta: LogRecordNormal, Value: merged}
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+type concatOperator struct{}
+
+func (concatOperator) Merge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	return bytes.Join(append([][]byte{existing}, operands...), nil), nil
+}
+
+func mergeTestOptions(t *testing.T) Options {
+	options := compactionTestOptions(t)
+	options.MergeOperator = concatOperator{}
+	return options
+}
+
+func mustMerge(t *testing.T, db *DB, key, operand string) {
+	t.Helper()
+	if err := db.Merge([]byte(key), []byte(operand), nil); err != nil {
+		t.Fatalf("merge %s: %v", key, err)
+	}
+}
+
+func TestMergeAppliesOperandsInOrder(t *testing.T) {
+	db := openTestDB(t, mergeTestOptions(t))
+
+	if err := db.Put("base", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustMerge(t, db, "base", "b")
+	mustMerge(t, db, "base", "c")
+	mustGet(t, db, "base", "abc")
+
+	mustMerge(t, db, "missing", "x")
+	mustMerge(t, db, "missing", "y")
+	mustGet(t, db, "missing", "xy")
+
+	if err := db.Put("deleted", "old", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("deleted"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustMerge(t, db, "deleted", "new")
+	mustGet(t, db, "deleted", "new")
+
+	if err := db.DeleteRange([]byte("a"), []byte("z"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "base")
+	mustMerge(t, db, "base", "d")
+	mustGet(t, db, "base", "d")
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Merge([]byte("key"), []byte("x"), nil); !errors.Is(err, _const.ErrorNoMergeOperator) {
+		t.Fatalf("merge without an operator: %v", err)
+	}
+}
+
+func TestMergeInBatchAndTxn(t *testing.T) {
+	db := openTestDB(t, mergeTestOptions(t))
+	if err := db.Put("key", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	for _, operand := range []string{"b", "c"} {
+		if err := batch.Merge([]byte("key"), []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := batch.Get([]byte("key")); err != nil || string(value) != "abc" {
+		t.Fatalf("batch get: %q %v", value, err)
+	}
+	if err := batch.Put([]byte("put"), []byte("p")); err != nil {
+		t.Fatal(err)
+	}
+	// A merge on a value written by the batch is applied right away.
+	if err := batch.Merge([]byte("put"), []byte("q")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key", "a")
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "key", "abc")
+	mustGet(t, db, "put", "pq")
+
+	txn := db.BeginTxn()
+	if err := txn.Merge([]byte("key"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := txn.Get([]byte("key")); err != nil || string(value) != "abcd" {
+		t.Fatalf("txn get: %q %v", value, err)
+	}
+	mustMerge(t, db, "key", "e")
+	if err := txn.Commit(nil); !errors.Is(err, _const.ErrTxnConflict) {
+		t.Fatalf("commit after a concurrent merge of a read key: %v", err)
+	}
+	mustGet(t, db, "key", "abce")
+}
+
+func TestMergeSurvivesFlushCompactionAndReopen(t *testing.T) {
+	options := mergeTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("counter", "0", nil); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot *Snapshot
+	want := "0"
+	for i := 1; i <= 6; i++ {
+		operand := fmt.Sprint(i)
+		mustMerge(t, db, "counter", operand)
+		want += operand
+		if i == 3 {
+			snapshot = db.NewSnapshot()
+		}
+		fillMemTables(t, db, fmt.Sprintf("fill%d", i), 1000)
+	}
+	waitForCompaction(t, db)
+	mustGet(t, db, "counter", want)
+	// The operands that a snapshot still sees are not combined into newer ones.
+	mustGetAt(t, db, snapshot, "counter", "0123")
+	db.ReleaseSnapshot(snapshot)
+
+	kvs, _, err := db.Scan([]byte("counter"), []byte("counter\x00"), 0)
+	if err != nil || len(kvs) != 1 || string(kvs[0].Value) != want {
+		t.Fatalf("scan of the merged key: %q %v", kvs, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	mustGet(t, db, "counter", want)
+	mustMerge(t, db, "counter", "7")
+	mustGet(t, db, "counter", want+"7")
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	_const "SmartStashDB/const"
 	"os"
+	"time"
 )
 
 type WalOptions struct {
@@ -12,21 +13,160 @@ type WalOptions struct {
 	Sync           bool
 	BytesPerSync   uint64
 	BlockCache     uint32
+
+	// compression compresses the records of the segment files, nil stores them as they are.
+	compression *compression
+	// readOnly opens the existing segment files for reading and never creates, truncates
+	// or removes one.
+	readOnly bool
+}
+
+type Options struct {
+	DirPath      string
+	MemTableSize uint32
+	BlockCache   uint32
+	Sync         bool
+	BytesPerSync uint32
+
+	// L0CompactionTrigger is the number of level 0 tables that starts a compaction.
+	L0CompactionTrigger int
+	// BaseLevelSize is the size limit of level 1, every deeper level is LevelSizeMultiplier times bigger.
+	BaseLevelSize       uint64
+	LevelSizeMultiplier int
+	// TableFileSize is the target size of the tables written by a compaction.
+	TableFileSize uint64
+
+	// BloomBitsPerKey is the size of the bloom filters of the memtables and the tables,
+	// 10 bits give about 1% false positives, zero disables the filters.
+	BloomBitsPerKey int
+
+	// WALRecoveryMode decides how the corrupted chunks of the WAL are handled on open.
+	WALRecoveryMode WALRecoveryMode
+
+	// MergeOperator combines the operands of DB.Merge, Merge fails if it is nil.
+	MergeOperator MergeOperator
+
+	// Compressor compresses the WAL records and the data blocks of the tables, nil stores
+	// them as they are. The codec is recorded with the data, the files written with another
+	// codec stay readable as long as it is registered.
+	Compressor Compressor
+
+	// ValueThreshold is the size above which a value is written into the value log, the
+	// memtables and the tables only keep its position. It must not be above 65535, the
+	// skip-lists can not hold a bigger value, so those always go to the value log. Zero uses
+	// the threshold of DefaultOptions.
+	ValueThreshold int
+	// ValueLogFileSize is the size of a value log segment, DB.RunValueLogGC rewrites whole segments.
+	ValueLogFileSize uint64
+
+	// ColumnFamilies are the options of the column families opened by OpenDB, they are not
+	// stored with the database. A family without options uses the settings of the default one.
+	ColumnFamilies map[string]ColumnFamilyOptions
+
+	// ReadOnly opens an existing database without writing or creating any file: the WAL is
+	// replayed without being repaired, nothing is flushed or compacted and every write fails
+	// with ErrorReadOnlyDB. The database may be opened read-only by several processes, but
+	// not while it is opened for writing.
+	ReadOnly bool
+}
+
+// ColumnFamilyOptions are the settings of one column family, the settings of the default
+// family are the ones of the Options. The zero sizes and triggers are taken from
+// DefaultColumnFamilyOptions.
+type ColumnFamilyOptions struct {
+	MemTableSize uint32
+
+	L0CompactionTrigger int
+	BaseLevelSize       uint64
+	LevelSizeMultiplier int
+	TableFileSize       uint64
+
+	BloomBitsPerKey int
+	MergeOperator   MergeOperator
+	Compressor      Compressor
 }
 
+// columnFamilyOptions returns the settings of the default column family.
+func (options Options) columnFamilyOptions() ColumnFamilyOptions {
+	return ColumnFamilyOptions{
+		MemTableSize:        options.MemTableSize,
+		L0CompactionTrigger: options.L0CompactionTrigger,
+		BaseLevelSize:       options.BaseLevelSize,
+		LevelSizeMultiplier: options.LevelSizeMultiplier,
+		TableFileSize:       options.TableFileSize,
+		BloomBitsPerKey:     options.BloomBitsPerKey,
+		MergeOperator:       options.MergeOperator,
+		Compressor:          options.Compressor,
+	}
+}
+
+// withDefaults returns the options with the unset sizes and triggers taken from
+// DefaultColumnFamilyOptions, a zero BloomBitsPerKey still disables the filters.
+func (options ColumnFamilyOptions) withDefaults() ColumnFamilyOptions {
+	if options.MemTableSize == 0 {
+		options.MemTableSize = DefaultColumnFamilyOptions.MemTableSize
+	}
+	if options.L0CompactionTrigger <= 0 {
+		options.L0CompactionTrigger = DefaultColumnFamilyOptions.L0CompactionTrigger
+	}
+	if options.BaseLevelSize == 0 {
+		options.BaseLevelSize = DefaultColumnFamilyOptions.BaseLevelSize
+	}
+	if options.LevelSizeMultiplier <= 0 {
+		options.LevelSizeMultiplier = DefaultColumnFamilyOptions.LevelSizeMultiplier
+	}
+	if options.TableFileSize == 0 {
+		options.TableFileSize = DefaultColumnFamilyOptions.TableFileSize
+	}
+	return options
+}
+
+// WALRecoveryMode decides how OpenDB handles corrupted chunks while replaying the WAL.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTolerateCorruptedTail drops a torn or corrupted tail of the WAL, as left by
+	// a crash during a write, and fails on corruption anywhere else.
+	WALRecoveryTolerateCorruptedTail WALRecoveryMode = iota
+	// WALRecoveryAbsoluteConsistency fails on any corrupted chunk.
+	WALRecoveryAbsoluteConsistency
+	// WALRecoveryPointInTime stops at the first corrupted chunk and drops everything written
+	// after it in every column family, the database is recovered to a consistent point in
+	// time. The data the families already flushed into tables is kept.
+	WALRecoveryPointInTime
+	// WALRecoverySkipCorrupted skips the corrupted chunks and replays the rest, a batch that
+	// lost some of its records may be applied partially.
+	WALRecoverySkipCorrupted
+)
+
 type BatchOptions struct {
+	// ReadOnly batches only serve Get.
 	ReadOnly bool
-	Sync     bool
+	// Sync syncs the WAL on Commit when no WriteOptions are given.
+	Sync bool
 }
 
-var DefaultOptions = WalOptions{
+var DefaultOptions = Options{
 	DirPath:      tempDBDir(),
 	MemTableSize: 64 * _const.MB,
 	BlockCache:   0,
 	Sync:         false,
 	BytesPerSync: 0,
+
+	L0CompactionTrigger: 4,
+	BaseLevelSize:       256 * _const.MB,
+	LevelSizeMultiplier: 10,
+	TableFileSize:       64 * _const.MB,
+
+	BloomBitsPerKey: 10,
+	WALRecoveryMode: WALRecoveryTolerateCorruptedTail,
+
+	ValueThreshold:   4 * _const.KB,
+	ValueLogFileSize: 256 * _const.MB,
 }
 
+var DefaultColumnFamilyOptions = DefaultOptions.columnFamilyOptions()
+
 var DefaultBatchOptions = BatchOptions{
 	ReadOnly: false,
 	Sync:     true,
@@ -40,4 +180,28 @@ func tempDBDir() string {
 type WriteOptions struct {
 	Sync       bool
 	DisableWal bool
+	// TTL makes the values written without their own ttl expire after it, zero means never.
+	TTL time.Duration
+}
+
+type ReadOptions struct {
+	// Snapshot makes the read see the database as of the snapshot, nil reads the latest data.
+	Snapshot *Snapshot
+	// ColumnFamily is the family that is read, nil reads the default one.
+	ColumnFamily *ColumnFamily
+}
+
+type IteratorOptions struct {
+	// Reverse makes Rewind start from the last key and Next move towards the smaller keys.
+	Reverse bool
+	// LowerBound is the inclusive lower bound, nil means no bound.
+	LowerBound []byte
+	// UpperBound is the exclusive upper bound, nil means no bound.
+	UpperBound []byte
+	// KeysOnly skips copying the values.
+	KeysOnly bool
+	// Snapshot makes the iterator see the database as of the snapshot, nil uses the latest data.
+	Snapshot *Snapshot
+	// ColumnFamily is the family that is iterated, nil iterates the default one.
+	ColumnFamily *ColumnFamily
 }
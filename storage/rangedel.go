@@ -0,0 +1,184 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// keysEnd is bigger than every key, the keys are at most maxKeySize long.
+var keysEnd = bytes.Repeat([]byte{0xff}, maxKeySize+1)
+
+// rangeTombstone deletes the keys start <= key < end that were written before seq, an
+// empty end deletes up to the last key.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seq   uint64
+}
+
+func (r rangeTombstone) contains(key []byte) bool {
+	return bytes.Compare(r.start, key) <= 0 && (len(r.end) == 0 || bytes.Compare(key, r.end) < 0)
+}
+
+// clip returns the part of the tombstone within lower <= key < upper, a nil bound is open.
+func (r rangeTombstone) clip(lower, upper []byte) (rangeTombstone, bool) {
+	if lower != nil && bytes.Compare(r.start, lower) < 0 {
+		r.start = lower
+	}
+	if upper != nil && (len(r.end) == 0 || bytes.Compare(upper, r.end) < 0) {
+		r.end = upper
+	}
+	return r, len(r.end) == 0 || bytes.Compare(r.start, r.end) < 0
+}
+
+// endKey returns the internal key of the exclusive end, the end of a tombstone without one
+// is bigger than every key.
+func (r rangeTombstone) endKey() []byte {
+	if len(r.end) == 0 {
+		return y.KeyWithTs(keysEnd, 0)
+	}
+	return y.KeyWithTs(r.end, 0)
+}
+
+// rangeTombstones is a list of tombstones sorted by their start key.
+type rangeTombstones []rangeTombstone
+
+func (ts rangeTombstones) sort() {
+	sort.Slice(ts, func(i, j int) bool { return bytes.Compare(ts[i].start, ts[j].start) < 0 })
+}
+
+// coveringSeq returns the newest sequence number <= readTs of the tombstones that contain
+// the key, zero if none does. The version of the key is deleted if it is older.
+func (ts rangeTombstones) coveringSeq(key []byte, readTs uint64) uint64 {
+	var seq uint64
+	n := sort.Search(len(ts), func(i int) bool { return bytes.Compare(ts[i].start, key) > 0 })
+	for _, r := range ts[:n] {
+		if r.seq <= readTs && r.seq > seq && r.contains(key) {
+			seq = r.seq
+		}
+	}
+	return seq
+}
+
+// covers reports whether a tombstone visible at readTs deletes the version seq of the key.
+func (ts rangeTombstones) covers(key []byte, seq uint64, readTs uint64) bool {
+	return ts.coveringSeq(key, readTs) > seq
+}
+
+// smallestKey and biggestKey return the internal keys that bound the non-empty list, the
+// end bound is exclusive so the biggest key is a little too big.
+func (ts rangeTombstones) smallestKey() []byte {
+	smallest := ts[0].start
+	for _, r := range ts[1:] {
+		if bytes.Compare(r.start, smallest) < 0 {
+			smallest = r.start
+		}
+	}
+	return y.KeyWithTs(smallest, math.MaxUint64)
+}
+
+func (ts rangeTombstones) biggestKey() []byte {
+	biggest := ts[0].endKey()
+	for _, r := range ts[1:] {
+		if end := r.endKey(); y.CompareKeys(end, biggest) > 0 {
+			biggest = end
+		}
+	}
+	return biggest
+}
+
+func (ts rangeTombstones) encode() []byte {
+	var (
+		buf    bytes.Buffer
+		varint [binary.MaxVarintLen64]byte
+	)
+	for _, r := range ts {
+		n := binary.PutUvarint(varint[:], uint64(len(r.start)))
+		buf.Write(varint[:n])
+		buf.Write(r.start)
+		n = binary.PutUvarint(varint[:], uint64(len(r.end)))
+		buf.Write(varint[:n])
+		buf.Write(r.end)
+		n = binary.PutUvarint(varint[:], r.seq)
+		buf.Write(varint[:n])
+	}
+	return buf.Bytes()
+}
+
+func decodeRangeTombstones(b []byte) (rangeTombstones, error) {
+	var ts rangeTombstones
+	readBytes := func() ([]byte, bool) {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return nil, false
+		}
+		value := b[n : n+int(length)]
+		b = b[n+int(length):]
+		return value, true
+	}
+	for len(b) > 0 {
+		var (
+			r  rangeTombstone
+			ok bool
+			n  int
+		)
+		if r.start, ok = readBytes(); !ok {
+			return nil, _const.ErrorTableCorrupted
+		}
+		if r.end, ok = readBytes(); !ok {
+			return nil, _const.ErrorTableCorrupted
+		}
+		if r.seq, n = binary.Uvarint(b); n <= 0 {
+			return nil, _const.ErrorTableCorrupted
+		}
+		b = b[n:]
+		ts = append(ts, r)
+	}
+	ts.sort()
+	return ts, nil
+}
+
+// rangeDeleteSeq returns the newest sequence number <= readTs of the range tombstones of
+// the family that contain the key, it must be called with db.m held.
+func (cf *ColumnFamily) rangeDeleteSeq(key []byte, readTs uint64) uint64 {
+	var seq uint64
+	for _, mem := range cf.getMemTables() {
+		seq = max(seq, mem.rangeDeleteSeq(key, readTs))
+	}
+	for _, tables := range cf.levels {
+		for _, table := range tables {
+			seq = max(seq, table.rangeDels.coveringSeq(key, readTs))
+		}
+	}
+	return seq
+}
+
+// rangeTombstones returns the range tombstones of the family visible at readTs, it must be
+// called with db.m held.
+func (cf *ColumnFamily) rangeTombstones(readTs uint64) rangeTombstones {
+	var ts rangeTombstones
+	add := func(tombstones rangeTombstones) {
+		for _, r := range tombstones {
+			if r.seq <= readTs {
+				ts = append(ts, r)
+			}
+		}
+	}
+	for _, mem := range cf.getMemTables() {
+		mem.mu.RLock()
+		add(mem.rangeDels)
+		mem.mu.RUnlock()
+	}
+	for _, tables := range cf.levels {
+		for _, table := range tables {
+			add(table.rangeDels)
+		}
+	}
+	ts.sort()
+	return ts
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func TestDeleteRange(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	for _, key := range []string{"a", "b", "b1", "c", "d"} {
+		if err := db.Put(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := db.NewSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+
+	if err := db.DeleteRange([]byte("b"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "b1", "c"} {
+		mustNotFind(t, db, key)
+		mustGetAt(t, db, snapshot, key, key)
+	}
+	mustGet(t, db, "a", "a")
+	mustGet(t, db, "d", "d")
+
+	// A write after the tombstone is visible again.
+	if err := db.Put("b1", "again", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "b1", "again")
+
+	it := newTestIterator(t, db, IteratorOptions{})
+	it.Rewind()
+	keys, _ := collect(it)
+	if fmt.Sprint(keys) != "[a b1 d]" {
+		t.Fatalf("the iterator found %v", keys)
+	}
+	it = newTestIterator(t, db, IteratorOptions{Reverse: true})
+	it.Rewind()
+	keys, _ = collect(it)
+	if fmt.Sprint(keys) != "[d b1 a]" {
+		t.Fatalf("the reverse iterator found %v", keys)
+	}
+}
+
+func TestDeleteRangeInBatch(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("k2", "old", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	for _, key := range []string{"k1", "k3", "z"} {
+		if err := batch.Put([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The range deletion drops the pending writes before it, the writes after it stay.
+	if err := batch.DeleteRange([]byte("k"), []byte("l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put([]byte("k4"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Get([]byte("k1")); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("a pending write in the deleted range: %v", err)
+	}
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		mustNotFind(t, db, key)
+	}
+	mustGet(t, db, "k4", "new")
+	mustGet(t, db, "z", "new")
+
+	for _, r := range [][2]string{{"b", "a"}, {"a", "a"}} {
+		if err := db.DeleteRange([]byte(r[0]), []byte(r[1]), nil); !errors.Is(err, _const.ErrorInvalidRange) {
+			t.Fatalf("delete range %q %q: %v", r[0], r[1], err)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	for _, key := range []string{"user:1", "user:2", "user;", "users", "video:1"} {
+		if err := db.Put(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeletePrefix([]byte("user:"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "user:1")
+	mustNotFind(t, db, "user:2")
+	for _, key := range []string{"user;", "users", "video:1"} {
+		mustGet(t, db, key, key)
+	}
+}
+
+func TestDeleteRangeWithoutAnEnd(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "\xff", "\xff\xff", "\xff\xff\x01"} {
+		if err := db.Put(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeletePrefix([]byte("\xff\xff"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "a", "a")
+	mustGet(t, db, "\xff", "\xff")
+	mustNotFind(t, db, "\xff\xff")
+	mustNotFind(t, db, "\xff\xff\x01")
+
+	fillMemTables(t, db, "key", 3000)
+	if err := db.DeleteRange([]byte("key-02000"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fillMemTables(t, db, "other", 3000)
+	waitForCompaction(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	mustGet(t, db, "a", "a")
+	mustGet(t, db, "key-01999", strings.Repeat("v", 100)+"1999")
+	mustNotFind(t, db, "key-02000")
+	mustNotFind(t, db, "\xff")
+	mustGet(t, db, "other-00000", strings.Repeat("v", 100)+"0")
+
+	// An empty prefix deletes every key.
+	if err := db.DeletePrefix(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	kvs, _, err := db.Scan(nil, nil, 0)
+	if err != nil || len(kvs) != 0 {
+		t.Fatalf("%d keys left after deleting every key: %v", len(kvs), err)
+	}
+}
+
+func TestRangeTombstonesSurviveFlushCompactionAndReopen(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillMemTables(t, db, "key", 3000)
+	waitForCompaction(t, db)
+	if err := db.DeleteRange([]byte("key-01000"), []byte("key-02000"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The tombstone is replayed from the WAL.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "key-01500")
+
+	// The tombstone is flushed and compacted with the keys it deletes.
+	fillMemTables(t, db, "other", 3000)
+	fillMemTables(t, db, "more", 3000)
+	waitForCompaction(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	for i := 0; i < 3000; i += 250 {
+		key := fmt.Sprintf("key-%05d", i)
+		if i >= 1000 && i < 2000 {
+			mustNotFind(t, db, key)
+		} else {
+			mustGet(t, db, key, strings.Repeat("v", 100)+fmt.Sprint(i))
+		}
+	}
+	kvs, _, err := db.Scan([]byte("key-"), []byte("key-~"), 0)
+	if err != nil || len(kvs) != 2000 {
+		t.Fatalf("%d keys left after the range deletion: %v", len(kvs), err)
+	}
+}
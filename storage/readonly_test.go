@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_const "SmartStashDB/const"
+)
+
+// fileState is the size and modification time of every file under dir.
+func fileState(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		state[rel] = fmt.Sprintf("%d %v", info.Size(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func openReadOnlyTestDB(t *testing.T, options Options) *DB {
+	t.Helper()
+	options.ReadOnly = true
+	return openTestDB(t, options)
+}
+
+func TestReadOnlyOpenWritesNothing(t *testing.T) {
+	options := vlogTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCheckpointData(t, db, cf, "key")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := fileState(t, options.DirPath)
+	// The modification times must be able to change.
+	time.Sleep(10 * time.Millisecond)
+
+	readOnly := openReadOnlyTestDB(t, options)
+	// Several read-only opens share the directory.
+	second := openReadOnlyTestDB(t, options)
+	checkCheckpointData(t, readOnly, "key")
+	checkCheckpointData(t, second, "key")
+	mustNotFind(t, readOnly, "missing")
+
+	other, err := readOnly.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string]error{
+		"put":           readOnly.Put("key", "value", nil),
+		"delete":        readOnly.Delete([]byte("key-00000"), nil),
+		"put cf":        readOnly.PutCF(other, "key", "value", nil),
+		"create family": func() error { _, err := readOnly.CreateColumnFamily("new", DefaultColumnFamilyOptions); return err }(),
+		"drop family":   readOnly.DropColumnFamily(other),
+		"checkpoint":    readOnly.Checkpoint(filepath.Join(t.TempDir(), "checkpoint")),
+	}
+	for name, err := range writes {
+		if !errors.Is(err, _const.ErrorReadOnlyDB) {
+			t.Fatalf("%s on a read-only database: %v", name, err)
+		}
+	}
+	mustGet(t, readOnly, "key-00000", "vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv0")
+
+	// A read-only open keeps the writers out, and the other way round.
+	if db, err := OpenDB(options); !errors.Is(err, _const.ErrDatabaseIsUsing) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("open for writing while opened read-only: %v", err)
+	}
+	if err := readOnly.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileState(t, options.DirPath); !reflect.DeepEqual(after, before) {
+		t.Fatalf("the read-only open changed the files:\nbefore %v\nafter  %v", before, after)
+	}
+
+	db = openTestDB(t, options)
+	readOnlyOptions := options
+	readOnlyOptions.ReadOnly = true
+	if db, err := OpenDB(readOnlyOptions); !errors.Is(err, _const.ErrDatabaseIsUsing) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("read-only open while opened for writing: %v", err)
+	}
+}
+
+func TestReadOnlyOpenOfAMissingDirectory(t *testing.T) {
+	options := testOptions(t)
+	options.DirPath = filepath.Join(options.DirPath, "missing")
+	options.ReadOnly = true
+	if db, err := OpenDB(options); err == nil {
+		_ = db.Close()
+		t.Fatal("a missing directory is opened read-only")
+	}
+	if _, err := os.Stat(options.DirPath); !os.IsNotExist(err) {
+		t.Fatalf("the missing directory was created: %v", err)
+	}
+}
+
+func TestReadOnlyOpenKeepsATornWAL(t *testing.T) {
+	options, path := crashedWal(t)
+	tearTail(t, path)
+	before := fileState(t, options.DirPath)
+	time.Sleep(10 * time.Millisecond)
+
+	db := openReadOnlyTestDB(t, options)
+	n := recoveredBatches(t, db)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the torn ones must be left out", n, crashBatches)
+	}
+	report := db.RecoveryReport()
+	if report.DroppedBytes == 0 || len(report.TruncatedSegments) != 0 || len(report.RemovedSegments) != 0 {
+		t.Fatalf("the read-only open reports a repair: %+v", report)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileState(t, options.DirPath); !reflect.DeepEqual(after, before) {
+		t.Fatalf("the read-only open changed the files:\nbefore %v\nafter  %v", before, after)
+	}
+
+	// The writable open repairs the WAL as before.
+	repaired := openTestDB(t, options)
+	if again := recoveredBatches(t, repaired); again != n {
+		t.Fatalf("%d batches after the repair, %d read-only", again, n)
+	}
+	if report := repaired.RecoveryReport(); len(report.TruncatedSegments) != 1 {
+		t.Fatalf("the torn tail is not repaired: %+v", report)
+	}
+}
+
+func TestReadOnlyPointInTimeRecovery(t *testing.T) {
+	options, path := crashedWal(t)
+	corruptBlock(t, path)
+	options.WALRecoveryMode = WALRecoveryPointInTime
+	before := fileState(t, options.DirPath)
+	time.Sleep(10 * time.Millisecond)
+
+	db := openReadOnlyTestDB(t, options)
+	n := recoveredBatches(t, db)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the recovery must stop at the corruption", n, crashBatches)
+	}
+	if report := db.RecoveryReport(); report.CorruptedChunks != 1 || len(report.TruncatedSegments) != 0 {
+		t.Fatalf("the corruption is not reported as it is: %+v", report)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileState(t, options.DirPath); !reflect.DeepEqual(after, before) {
+		t.Fatalf("the read-only recovery changed the files:\nbefore %v\nafter  %v", before, after)
+	}
+}
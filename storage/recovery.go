@@ -0,0 +1,248 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// WALRecoveryReport describes what OpenDB dropped while replaying the WAL.
+type WALRecoveryReport struct {
+	// DroppedBytes is the size of the corrupted or torn data that was skipped or removed.
+	DroppedBytes int64
+	// CorruptedChunks counts the places where a chunk failed verification or was torn.
+	CorruptedChunks int
+	// DroppedBatches counts the batches whose BatchEnd record was never written, and the
+	// batches that wrote several column families and lost the part of one of them.
+	DroppedBatches int
+	// TruncatedSegments are the segment files that were cut after their last good record.
+	TruncatedSegments []string
+	// RemovedSegments are the segment files that were deleted by a point-in-time recovery.
+	RemovedSegments []string
+
+	// stopped is set once a point-in-time recovery stopped in the family being opened, its
+	// newer WALs are dropped.
+	stopped bool
+	// stopSeq is the lowest sequence number a point-in-time recovery may have lost, zero if
+	// none stopped. Every column family drops the batches from there on.
+	stopSeq uint64
+}
+
+// stopAt records that a point-in-time recovery lost the batches from seq on.
+func (report *WALRecoveryReport) stopAt(seq uint64) {
+	if report.stopSeq == 0 || seq < report.stopSeq {
+		report.stopSeq = seq
+	}
+}
+
+// RecoveryReport returns what the WAL replay dropped when the database was opened.
+func (db *DB) RecoveryReport() WALRecoveryReport {
+	return db.recovery
+}
+
+// sortedSegments returns the segments of the WAL, the oldest first. It must be called with
+// w.mutex held.
+func (w *TinyWAL) sortedSegments() []*SegmentFile {
+	segments := make([]*SegmentFile, 0, len(w.immutableSegment)+1)
+	if w.activeSegment != nil {
+		segments = append(segments, w.activeSegment)
+	}
+	for _, segment := range w.immutableSegment {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].segmentFileId < segments[j].segmentFileId })
+	return segments
+}
+
+// replay passes the records of the WAL and their positions to fn in order, the corrupted
+// chunks are handled by the mode. A torn tail of the last segment is truncated in every
+// mode but the absolute consistency, so that new records are not appended after garbage.
+func (w *TinyWAL) replay(mode WALRecoveryMode, report *WALRecoveryReport, fn func(data []byte, position *ChunkPosition) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	segments := w.sortedSegments()
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		reader := segment.NewSegmentReader()
+		for {
+			data, position, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				if err := fn(data, position); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != _const.ErrorTornChunk && err != _const.ErrorInvalidCRC {
+				return err
+			}
+
+			badOffset := reader.offset()
+			if mode == WALRecoveryAbsoluteConsistency {
+				return corruptionError(err, segment, badOffset)
+			}
+			report.CorruptedChunks++
+			next, found := segment.resync(reader.blockidx)
+			if !found && last {
+				if err := w.truncateSegment(segment, badOffset, report); err != nil {
+					return err
+				}
+				break
+			}
+
+			switch mode {
+			case WALRecoveryPointInTime:
+				report.stopped = true
+				return w.cutSegments(segments, i, badOffset, report)
+			case WALRecoverySkipCorrupted:
+				if found {
+					report.DroppedBytes += next - badOffset
+					reader.seek(next)
+					continue
+				}
+				report.DroppedBytes += segment.Size() - badOffset
+			default:
+				return corruptionError(err, segment, badOffset)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func corruptionError(err error, segment *SegmentFile, offset int64) error {
+	return fmt.Errorf("%w: %s at offset %d", err, segment.fd.Name(), offset)
+}
+
+// cut drops the records of the WAL from the position on.
+func (w *TinyWAL) cut(position *ChunkPosition, report *WALRecoveryReport) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	segments := w.sortedSegments()
+	for i, segment := range segments {
+		if segment.segmentFileId == position.SegmentFileId {
+			offset := int64(position.BlockIndex)*_const.BlockSize + int64(position.ChunkOffset)
+			return w.cutSegments(segments, i, offset, report)
+		}
+	}
+	return nil
+}
+
+// cutSegments truncates the i-th of the sorted segments at the offset and removes the
+// segments after it, the truncated one becomes the active segment. It must be called with
+// w.mutex held.
+func (w *TinyWAL) cutSegments(segments []*SegmentFile, i int, offset int64, report *WALRecoveryReport) error {
+	segment := segments[i]
+	if err := w.truncateSegment(segment, offset, report); err != nil {
+		return err
+	}
+	if err := w.removeSegments(segments[i+1:], report); err != nil {
+		return err
+	}
+	delete(w.immutableSegment, segment.segmentFileId)
+	w.activeSegment = segment
+	return nil
+}
+
+// truncateSegment cuts the segment after its last good record, a read-only WAL only
+// counts the dropped bytes.
+func (w *TinyWAL) truncateSegment(segment *SegmentFile, size int64, report *WALRecoveryReport) error {
+	report.DroppedBytes += segment.Size() - size
+	if w.option.readOnly {
+		return nil
+	}
+	report.TruncatedSegments = append(report.TruncatedSegments, segment.fd.Name())
+	return segment.truncate(size)
+}
+
+// removeSegments deletes the segments that come after a point-in-time recovery stopped.
+func (w *TinyWAL) removeSegments(segments []*SegmentFile, report *WALRecoveryReport) error {
+	for _, segment := range segments {
+		report.DroppedBytes += segment.Size()
+		if w.option.readOnly {
+			continue
+		}
+		report.RemovedSegments = append(report.RemovedSegments, segment.fd.Name())
+		delete(w.immutableSegment, segment.segmentFileId)
+		if err := segment.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(segment.fd.Name()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeMemTableWal deletes the WAL of a memtable that is newer than the point where a
+// point-in-time recovery stopped.
+func removeMemTableWal(option memTableOptions, report *WALRecoveryReport) error {
+	wal, err := openMemTableWal(option)
+	if err != nil {
+		return err
+	}
+	return dropWal(wal, report)
+}
+
+// dropWal deletes the WAL of a memtable that comes after the point where a point-in-time
+// recovery stopped, a read-only WAL is only closed.
+func dropWal(wal *TinyWAL, report *WALRecoveryReport) error {
+	wal.mutex.RLock()
+	segments := wal.sortedSegments()
+	wal.mutex.RUnlock()
+	for _, segment := range segments {
+		report.DroppedBytes += segment.Size()
+		if !wal.option.readOnly {
+			report.RemovedSegments = append(report.RemovedSegments, segment.fd.Name())
+		}
+	}
+	if wal.option.readOnly {
+		return wal.close()
+	}
+	return wal.remove()
+}
+
+// resync returns the offset of the first readable record in the blocks after the given
+// one, the chunks of a block are walked by their lengths.
+func (f *SegmentFile) resync(index uint32) (int64, bool) {
+	size := f.Size()
+	for b := index + 1; int64(b)*_const.BlockSize < size; b++ {
+		block, err := f.readBlock(b, size)
+		if err != nil {
+			return 0, false
+		}
+		for offset := uint32(0); offset+_const.ChunkHeadSize < uint32(len(block)); {
+			if _, _, err := f.readInternal(b, offset); err == nil {
+				return int64(b)*_const.BlockSize + int64(offset), true
+			}
+			offset += _const.ChunkHeadSize + uint32(binary.LittleEndian.Uint16(block[offset+4:offset+6]))
+		}
+	}
+	return 0, false
+}
+
+// truncate cuts the file at size and drops the cached blocks past it.
+func (f *SegmentFile) truncate(size int64) error {
+	if err := f.fd.Truncate(size); err != nil {
+		return err
+	}
+	if err := f.fd.Sync(); err != nil {
+		return err
+	}
+	lastBlockIndex := f.lastBlockIndex
+	f.lastBlockIndex = uint32(size / _const.BlockSize)
+	f.lastBlockSize = uint32(size % _const.BlockSize)
+	if f.localCache != nil {
+		for index := f.lastBlockIndex; index <= lastBlockIndex; index++ {
+			f.localCache.Remove(f.blockCacheKey(index))
+		}
+	}
+	return nil
+}
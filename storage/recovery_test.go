@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+	"github.com/bwmarrin/snowflake"
+)
+
+// walBatches returns the ids of the BatchEnd records of the WAL segments in the directory.
+func walBatches(t *testing.T, dir string) []uint64 {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.MEM.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, path := range paths {
+		var segmentId uint32
+		name := filepath.Base(path)
+		if _, err := fmt.Sscanf(name, "%d", &segmentId); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		segment, err := openSegmentFile(dir, strings.TrimLeft(name, "0123456789"), segmentId, nil, nil)
+		if err != nil {
+			t.Fatalf("open %s: %v", path, err)
+		}
+		reader := segment.NewSegmentReader()
+		for {
+			data, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("read %s: %v", path, err)
+			}
+			record := NewLogRecord()
+			record.Decode(data)
+			if record.Type != LogRecordBatchEnd {
+				continue
+			}
+			id, err := snowflake.ParseBytes(record.Key)
+			if err != nil {
+				t.Fatalf("decode %s: %v", path, err)
+			}
+			ids = append(ids, uint64(id))
+		}
+		_ = segment.Close()
+	}
+	return ids
+}
+
+const (
+	crashBatches   = 50
+	crashBatchKeys = 10
+)
+
+func crashValue(key string) string {
+	return key + strings.Repeat("v", 200)
+}
+
+// writeCrashBatches commits batches that write crashBatchKeys keys into the default family
+// and into cf each, they fill several WAL blocks.
+func writeCrashBatches(t *testing.T, db *DB, cf *ColumnFamily) {
+	t.Helper()
+	for i := 0; i < crashBatches; i++ {
+		batch := db.NewBatch(DefaultBatchOptions)
+		for j := 0; j < crashBatchKeys; j++ {
+			key := []byte(fmt.Sprintf("b%03d-k%02d", i, j))
+			value := []byte(crashValue(string(key)))
+			if err := batch.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			if err := batch.PutCF(cf, key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Commit(&WriteOptions{Sync: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// batchKeysFound returns how many keys of the batch are in the family.
+func batchKeysFound(t *testing.T, db *DB, cf *ColumnFamily, i int) int {
+	t.Helper()
+	found := 0
+	for j := 0; j < crashBatchKeys; j++ {
+		key := fmt.Sprintf("b%03d-k%02d", i, j)
+		value, err := db.GetCF(cf, key)
+		switch {
+		case err == nil && string(value) == crashValue(key):
+			found++
+		case err == nil:
+			t.Fatalf("batch %d: %s has the value %q", i, key, value)
+		case !errors.Is(err, _const.ErrorKeyNotFound):
+			t.Fatalf("batch %d: get %s: %v", i, key, err)
+		}
+	}
+	return found
+}
+
+// recoveredBatches returns the number of batches found in the database, it fails if a batch
+// is found partially or after a missing one.
+func recoveredBatches(t *testing.T, db *DB) int {
+	t.Helper()
+	other, err := db.ColumnFamily("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered := 0
+	for i := 0; i < crashBatches; i++ {
+		switch found := batchKeysFound(t, db, nil, i) + batchKeysFound(t, db, other, i); {
+		case found == 0:
+		case found != 2*crashBatchKeys:
+			t.Fatalf("batch %d was recovered partially, %d of %d keys", i, found, 2*crashBatchKeys)
+		case recovered != i:
+			t.Fatalf("batch %d was recovered after the lost batch %d", i, recovered)
+		default:
+			recovered++
+		}
+	}
+	return recovered
+}
+
+// crashedWal writes the crash batches, copies the files as a crash leaves them and returns
+// the options to open the copy and the path of the only WAL segment of the default family.
+func crashedWal(t *testing.T) (Options, string) {
+	t.Helper()
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCrashBatches(t, db, cf)
+
+	options.DirPath = crashCopy(t, options.DirPath)
+	paths, err := filepath.Glob(filepath.Join(options.DirPath, "*.MEM.*"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("want one WAL segment, got %v %v", paths, err)
+	}
+	return options, paths[0]
+}
+
+func tearTail(t *testing.T, path string) {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, stat.Size()-1000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptBlock flips a byte in the second block of the WAL segment.
+func corruptBlock(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 3*_const.BlockSize {
+		t.Fatalf("the WAL segment has only %d bytes", len(data))
+	}
+	data[_const.BlockSize+100] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	options, _ := crashedWal(t)
+	recovered := openTestDB(t, options)
+	if n := recoveredBatches(t, recovered); n != crashBatches {
+		t.Fatalf("%d of %d batches recovered", n, crashBatches)
+	}
+	if report := recovered.RecoveryReport(); report.DroppedBatches != 0 || report.CorruptedChunks != 0 {
+		t.Fatalf("nothing should be dropped: %+v", report)
+	}
+}
+
+func TestWALReplayAfterCrashWithTornTail(t *testing.T) {
+	options, path := crashedWal(t)
+	tearTail(t, path)
+
+	recovered, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := recoveredBatches(t, recovered)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the torn ones must be dropped", n, crashBatches)
+	}
+	report := recovered.RecoveryReport()
+	if report.DroppedBatches == 0 || report.CorruptedChunks != 1 || len(report.TruncatedSegments) != 1 {
+		t.Fatalf("the torn tail is not reported: %+v", report)
+	}
+	// New writes go after the truncated tail.
+	if err := recovered.Put("after", "crash", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dropped batches do not come back on the next open and nothing is torn any more.
+	reopened := openTestDB(t, options)
+	if again := recoveredBatches(t, reopened); again != n {
+		t.Fatalf("%d batches after reopening, %d before", again, n)
+	}
+	mustGet(t, reopened, "after", "crash")
+	if report := reopened.RecoveryReport(); report.CorruptedChunks != 0 || len(report.TruncatedSegments) != 0 {
+		t.Fatalf("the truncated WAL is still torn: %+v", report)
+	}
+}
+
+func TestAbsoluteConsistencyFailsOnTornTail(t *testing.T) {
+	options, path := crashedWal(t)
+	tearTail(t, path)
+	options.WALRecoveryMode = WALRecoveryAbsoluteConsistency
+	if db, err := OpenDB(options); !errors.Is(err, _const.ErrorTornChunk) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("open with a torn tail: %v", err)
+	}
+}
+
+func TestCorruptionInTheMiddleOfTheWAL(t *testing.T) {
+	options, path := crashedWal(t)
+	corruptBlock(t, path)
+
+	for _, mode := range []WALRecoveryMode{WALRecoveryTolerateCorruptedTail, WALRecoveryAbsoluteConsistency} {
+		options.WALRecoveryMode = mode
+		if db, err := OpenDB(options); !errors.Is(err, _const.ErrorInvalidCRC) {
+			if err == nil {
+				_ = db.Close()
+			}
+			t.Fatalf("mode %d: open with a corrupted block: %v", mode, err)
+		}
+	}
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	options, path := crashedWal(t)
+	corruptBlock(t, path)
+	options.WALRecoveryMode = WALRecoveryPointInTime
+
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := recoveredBatches(t, db)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the recovery must stop at the corruption", n, crashBatches)
+	}
+	// The other family is cut at the same batch.
+	if report := db.RecoveryReport(); report.CorruptedChunks != 1 || len(report.TruncatedSegments) != 2 {
+		t.Fatalf("the corruption is not reported: %+v", report)
+	}
+	if err := db.Put("after", "recovery", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The WAL was cut at the corruption, the batches after it stay lost.
+	options.WALRecoveryMode = WALRecoveryTolerateCorruptedTail
+	reopened := openTestDB(t, options)
+	if again := recoveredBatches(t, reopened); again != n {
+		t.Fatalf("%d batches after reopening, %d before", again, n)
+	}
+	mustGet(t, reopened, "after", "recovery")
+}
+
+func TestSkipCorruptedRecovery(t *testing.T) {
+	options, path := crashedWal(t)
+	corruptBlock(t, path)
+	options.WALRecoveryMode = WALRecoverySkipCorrupted
+
+	db := openTestDB(t, options)
+	report := db.RecoveryReport()
+	if report.CorruptedChunks != 1 || report.DroppedBytes == 0 {
+		t.Fatalf("the skipped chunks are not reported: %+v", report)
+	}
+	// The batches before and after the corrupted block are replayed.
+	if batchKeysFound(t, db, nil, 0) != crashBatchKeys || batchKeysFound(t, db, nil, crashBatches-1) != crashBatchKeys {
+		t.Fatal("the intact batches were not replayed")
+	}
+	lost := 0
+	for i := 0; i < crashBatches; i++ {
+		lost += crashBatchKeys - batchKeysFound(t, db, nil, i)
+	}
+	if lost == 0 {
+		t.Fatal("no key was lost with the corrupted block")
+	}
+}
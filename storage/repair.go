@@ -0,0 +1,626 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// LostDirName is the directory of the database where RepairDB moves the files it could
+	// not keep as they are.
+	LostDirName = "lost"
+
+	// lostFamilyNameFmt names a column family whose name was lost with the MANIFEST.
+	lostFamilyNameFmt = "lost-%d"
+)
+
+// RepairReport describes what RepairDB kept and what it dropped. A batch that wrote several
+// column families is counted once for every family.
+type RepairReport struct {
+	// RecoveredBatches and RecoveredRecords count the complete batches kept in the WALs and
+	// their records, the batches that were already flushed into the tables are not counted.
+	RecoveredBatches int
+	RecoveredRecords int
+	// DroppedBatches and DroppedRecords count the batches that could not be verified: the
+	// batches without their BatchEnd record, the ones that lost records to a damaged chunk,
+	// whose values are missing from the value log or whose part of another family is lost.
+	DroppedBatches int
+	DroppedRecords int
+	// DroppedBytes is the size of the WAL data that could not be read.
+	DroppedBytes int64
+	// CorruptedChunks counts the places where the WAL could not be read or decoded.
+	CorruptedChunks int
+	// DroppedTables counts the recorded table files that are missing or damaged.
+	DroppedTables int
+	// ManifestRebuilt is set if the MANIFEST could not be read, the database is rebuilt from
+	// the files found in its directories.
+	ManifestRebuilt bool
+	// LostFiles are the files moved into the lost directory, relative to the database
+	// directory.
+	LostFiles []string
+}
+
+// repairBatch is the part of a batch that a family logged, records are the encoded records
+// as they were read, the BatchEnd record included.
+type repairBatch struct {
+	id       uint64
+	seq      uint64
+	families []uint32
+	records  [][]byte
+	// ended is set once the BatchEnd record is read, broken if the batch may have lost a
+	// record.
+	ended  bool
+	broken bool
+}
+
+// repairWal is the result of reading the WAL of a memtable.
+type repairWal struct {
+	family   *familyVersion
+	id       int
+	segments []uint32
+	batches  []*repairBatch
+	// rewrite is set if the WAL is not kept as it is.
+	rewrite bool
+}
+
+// RepairDB makes the database in options.DirPath openable again after its files were
+// damaged, the database must not be open. Every WAL segment is read and only the complete
+// batches that can be verified are kept: a WAL that lost anything is moved into the lost
+// directory and written again with the kept batches. The recorded table files are read
+// block by block and the damaged ones are moved into the lost directory as well. A MANIFEST
+// that can not be read is rebuilt from the files, the column families whose name is lost
+// are named after their id. The repair ends with a new MANIFEST, the data dropped by it
+// is described by the report.
+func RepairDB(options Options) (*RepairReport, error) {
+	if options.ReadOnly {
+		return nil, _const.ErrorReadOnlyDB
+	}
+	if _, err := os.Stat(options.DirPath); err != nil {
+		return nil, err
+	}
+	fileLock, err := lockDir(options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	compressors := []Compressor{options.Compressor}
+	for _, familyOptions := range options.ColumnFamilies {
+		compressors = append(compressors, familyOptions.Compressor)
+	}
+	for _, c := range compressors {
+		if c == nil {
+			continue
+		}
+		if err := registerCompressor(c); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &repairer{dir: options.DirPath, report: &RepairReport{}}
+	if r.versions, err = recoverVersionSet(r.dir); err != nil {
+		if r.versions, err = r.rebuildVersionSet(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fv := range r.versions.sortedFamilies() {
+		if err := r.repairTables(fv); err != nil {
+			return nil, err
+		}
+	}
+
+	vlog, err := OpenTinyWAL(WalOptions{
+		DirPath:        r.dir,
+		MemTableSize:   math.MaxInt32,
+		segmentFileExt: valueLogFileExt,
+		readOnly:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.vlog = vlog
+	defer func() {
+		_ = vlog.close()
+	}()
+
+	var wals []*repairWal
+	for _, fv := range r.versions.sortedFamilies() {
+		for _, id := range fv.walIds() {
+			wal, err := r.readWal(fv, id)
+			if err != nil {
+				return nil, err
+			}
+			wals = append(wals, wal)
+		}
+	}
+	r.checkFamilyBatches(wals)
+	for _, wal := range wals {
+		if err := r.writeWal(wal); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.versions.createManifest(); err != nil {
+		return nil, err
+	}
+	if err := r.versions.close(); err != nil {
+		return nil, err
+	}
+	return r.report, nil
+}
+
+type repairer struct {
+	dir      string
+	versions *versionSet
+	vlog     *TinyWAL
+	report   *RepairReport
+}
+
+// rebuildVersionSet builds the state of a database whose MANIFEST can not be read. The
+// names and the flushed sequence numbers of the families are taken from the edits that
+// can still be read, the WAL and table files are found by their names. The MANIFEST files
+// and CURRENT are moved into the lost directory.
+func (r *repairer) rebuildVersionSet() (*versionSet, error) {
+	r.report.ManifestRebuilt = true
+	vs := &versionSet{
+		dir:         r.dir,
+		nextTableId: 1,
+		families:    make(map[uint32]*familyVersion),
+	}
+	salvaged := r.salvageManifest()
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{defaultColumnFamilyId}
+	for _, entry := range entries {
+		var id uint32
+		switch {
+		case entry.IsDir():
+			if _, err := fmt.Sscanf(entry.Name(), columnFamilyDirFmt, &id); err == nil &&
+				entry.Name() == fmt.Sprintf(columnFamilyDirFmt, id) && id != defaultColumnFamilyId {
+				ids = append(ids, id)
+			}
+		case entry.Name() == CurrentFileName || strings.HasSuffix(entry.Name(), manifestFileExt):
+			if _, err := fmt.Sscanf(entry.Name(), "%d"+manifestFileExt, &id); err == nil {
+				vs.manifestId = max(vs.manifestId, id)
+			}
+			if err := r.moveToLost(entry.Name()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, id := range ids {
+		name := fmt.Sprintf(lostFamilyNameFmt, id)
+		if id == defaultColumnFamilyId {
+			name = DefaultColumnFamilyName
+		}
+		fv := newFamilyVersion(id, name)
+		if old := salvaged[id]; old != nil {
+			fv.name = old.name
+			fv.flushedSeq = old.flushedSeq
+		}
+		walIds, tableIds, err := scanFamilyFiles(columnFamilyDir(r.dir, id))
+		if err != nil {
+			return nil, err
+		}
+		for _, walId := range walIds {
+			fv.wals[walId] = true
+		}
+		if len(fv.wals) == 0 {
+			fv.wals[initTableId] = true
+		}
+		for _, tableId := range tableIds {
+			// The level and the key range are read when the table is verified.
+			fv.tables[tableId] = tableMeta{family: id, id: tableId}
+			vs.nextTableId = max(vs.nextTableId, tableId+1)
+		}
+		vs.families[id] = fv
+		vs.nextFamilyId = max(vs.nextFamilyId, id+1)
+	}
+	return vs, nil
+}
+
+// scanFamilyFiles returns the ids of the memtable WALs and of the table files in the
+// directory of a family, a missing directory is empty.
+func scanFamilyFiles(dir string) ([]int, []uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		walIds   []int
+		tableIds []uint32
+		seen     = make(map[int]bool)
+	)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if walId, ok := parseWalFileName(entry.Name()); ok {
+			if !seen[walId] {
+				seen[walId] = true
+				walIds = append(walIds, walId)
+			}
+			continue
+		}
+		if tableId, ok := parseTableFileName(entry.Name()); ok {
+			tableIds = append(tableIds, tableId)
+		}
+	}
+	sort.Ints(walIds)
+	return walIds, tableIds, nil
+}
+
+// salvageManifest returns the families recorded by the edits of the newest MANIFEST up to
+// the first one that can not be read.
+func (r *repairer) salvageManifest() map[uint32]*familyVersion {
+	vs := &versionSet{dir: r.dir, families: make(map[uint32]*familyVersion)}
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return vs.families
+	}
+	var id uint32
+	for _, entry := range entries {
+		var manifestId uint32
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+manifestFileExt, &manifestId); err == nil && !entry.IsDir() {
+			id = max(id, manifestId)
+		}
+	}
+	if id == 0 {
+		return vs.families
+	}
+	manifest, err := openReadOnlySegmentFile(r.dir, manifestFileExt, id, nil, nil)
+	if err != nil {
+		return vs.families
+	}
+	defer func() {
+		_ = manifest.Close()
+	}()
+	reader := manifest.NewSegmentReader()
+	for {
+		data, _, err := reader.Next()
+		if err != nil {
+			break
+		}
+		edit, err := decodeVersionEdit(data)
+		if err != nil {
+			break
+		}
+		vs.apply(edit)
+	}
+	return vs.families
+}
+
+// repairTables reads every block of the recorded tables of the family, the missing and the
+// damaged tables are dropped. A rebuilt family takes the level and the key range of its
+// tables from the files, and counts the sequence numbers they hold as flushed.
+func (r *repairer) repairTables(fv *familyVersion) error {
+	dir := columnFamilyDir(r.dir, fv.id)
+	for id := range fv.tables {
+		table, err := openTable(dir, id)
+		if err == nil {
+			for i := range table.index {
+				if _, err = table.readBlock(i); err != nil {
+					break
+				}
+			}
+			if err == nil && table.level >= maxLevels {
+				err = _const.ErrorTableCorrupted
+			}
+			if err == nil && r.report.ManifestRebuilt {
+				fv.tables[id] = tableMetaOf(fv.id, table.level, table)
+				fv.flushedSeq = max(fv.flushedSeq, table.maxSeq)
+			}
+			if err == nil {
+				r.versions.lastSeq = max(r.versions.lastSeq, table.maxSeq)
+			}
+			if closeErr := table.close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err == nil {
+			continue
+		}
+		// A table that can not be read from the disk is not damaged, the repair stops.
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		delete(fv.tables, id)
+		r.report.DroppedTables++
+		if err := r.moveToLost(r.relative(tableFileName(dir, id))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readWal reads the segments of the WAL of a memtable and keeps the batches that can be
+// verified. After a damaged chunk the batches that were open are dropped, and so is the
+// first batch that starts after it since its first records may be lost as well.
+func (r *repairer) readWal(fv *familyVersion, id int) (*repairWal, error) {
+	dir := columnFamilyDir(r.dir, fv.id)
+	wal := &repairWal{family: fv, id: id}
+	segments, err := walSegmentIds(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	wal.segments = segments
+
+	var (
+		open      = make(map[batchKey]*repairBatch)
+		order     []*repairBatch
+		afterLoss bool
+	)
+	damage := func() {
+		r.report.CorruptedChunks++
+		wal.rewrite = true
+		afterLoss = true
+		for _, batch := range open {
+			batch.broken = true
+		}
+	}
+
+	ext := fmt.Sprintf(walFileExt, id)
+	for _, segmentId := range segments {
+		segment, err := openReadOnlySegmentFile(dir, ext, segmentId, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		reader := segment.NewSegmentReader()
+		for {
+			data, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				damage()
+				skipped, more := reader.Skip()
+				r.report.DroppedBytes += skipped
+				if !more {
+					break
+				}
+				continue
+			}
+
+			record := NewLogRecord()
+			if err := record.DecodeChecked(data); err != nil {
+				damage()
+				r.report.DroppedBytes += int64(len(data))
+				continue
+			}
+			if record.Type != LogRecordBatchEnd {
+				key := batchKey{id: record.BatchId, seq: record.Seq}
+				batch := open[key]
+				if batch == nil {
+					batch = &repairBatch{id: record.BatchId, seq: record.Seq, broken: afterLoss}
+					afterLoss = false
+					open[key] = batch
+					order = append(order, batch)
+				}
+				batch.records = append(batch.records, data)
+				batch.broken = batch.broken || !r.verifyValue(fv.id, record)
+				continue
+			}
+
+			batchId, families, err := DecodeBatchEnd(record)
+			if err != nil {
+				damage()
+				continue
+			}
+			key := batchKey{id: batchId, seq: record.Seq}
+			batch := open[key]
+			delete(open, key)
+			if batch == nil {
+				// Every record of the batch is lost.
+				batch = &repairBatch{id: batchId, seq: record.Seq, broken: true}
+				afterLoss = false
+				order = append(order, batch)
+			}
+			batch.records = append(batch.records, data)
+			batch.ended = true
+			batch.families = families
+			if batch.broken {
+				wal.rewrite = true
+				r.dropBatch(batch)
+				continue
+			}
+			// The batches up to the flushed sequence number are stored in the tables.
+			if batch.seq <= fv.flushedSeq {
+				wal.rewrite = true
+				continue
+			}
+			wal.batches = append(wal.batches, batch)
+		}
+		if err := segment.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The batches without their BatchEnd record were never committed.
+	for _, batch := range order {
+		if open[batchKey{id: batch.id, seq: batch.seq}] == batch {
+			wal.rewrite = true
+			r.dropBatch(batch)
+		}
+	}
+	return wal, nil
+}
+
+// verifyValue reports whether the value a value pointer record points to is in the value
+// log and belongs to the record.
+func (r *repairer) verifyValue(family uint32, record *LogRecord) bool {
+	if record.Type != LogRecordValuePointer {
+		return true
+	}
+	position, err := DecodeChunkPosition(record.Value)
+	if err != nil {
+		return false
+	}
+	data, err := r.vlog.Read(position)
+	if err != nil {
+		return false
+	}
+	entry, err := decodeValueLogEntry(data)
+	return err == nil && entry.family == family && entry.seq == record.Seq && bytes.Equal(entry.key, record.Key)
+}
+
+// checkFamilyBatches drops the parts of the batches that wrote several column families if
+// the part of another family is lost and was not flushed, as OpenDB would.
+func (r *repairer) checkFamilyBatches(wals []*repairWal) {
+	logged := make(map[batchKey]map[uint32]bool)
+	for _, wal := range wals {
+		for _, batch := range wal.batches {
+			key := batchKey{id: batch.id, seq: batch.seq}
+			if logged[key] == nil {
+				logged[key] = make(map[uint32]bool)
+			}
+			logged[key][wal.family.id] = true
+		}
+	}
+	for _, wal := range wals {
+		kept := wal.batches[:0]
+		for _, batch := range wal.batches {
+			complete := true
+			for _, id := range batch.families {
+				fv, ok := r.versions.families[id]
+				if ok && !logged[batchKey{id: batch.id, seq: batch.seq}][id] && fv.flushedSeq < batch.seq {
+					complete = false
+					break
+				}
+			}
+			if !complete {
+				wal.rewrite = true
+				r.dropBatch(batch)
+				continue
+			}
+			kept = append(kept, batch)
+		}
+		wal.batches = kept
+	}
+}
+
+func (r *repairer) dropBatch(batch *repairBatch) {
+	r.report.DroppedBatches++
+	r.report.DroppedRecords += batch.dataRecords()
+}
+
+// dataRecords counts the records of the batch without the BatchEnd record.
+func (batch *repairBatch) dataRecords() int {
+	if batch.ended {
+		return len(batch.records) - 1
+	}
+	return len(batch.records)
+}
+
+// writeWal counts the kept batches of the WAL, a WAL that is not kept as it is is moved
+// into the lost directory and written again with the kept batches.
+func (r *repairer) writeWal(wal *repairWal) error {
+	for _, batch := range wal.batches {
+		r.report.RecoveredBatches++
+		r.report.RecoveredRecords += batch.dataRecords()
+		r.versions.lastSeq = max(r.versions.lastSeq, batch.seq)
+	}
+	if !wal.rewrite {
+		return nil
+	}
+
+	dir := columnFamilyDir(r.dir, wal.family.id)
+	ext := fmt.Sprintf(walFileExt, wal.id)
+	for _, id := range wal.segments {
+		if err := r.moveToLost(r.relative(segmentFileName(dir, ext, id))); err != nil {
+			return err
+		}
+	}
+	if len(wal.batches) == 0 {
+		// OpenDB creates the WAL of a recorded memtable that has no segment file.
+		return nil
+	}
+	segment, err := openSegmentFile(dir, ext, _const.FirstSegmentFileId, nil, nil)
+	if err != nil {
+		return err
+	}
+	for _, batch := range wal.batches {
+		if _, err := segment.WriteAll(batch.records); err != nil {
+			_ = segment.Close()
+			return err
+		}
+	}
+	if err := segment.Sync(); err != nil {
+		_ = segment.Close()
+		return err
+	}
+	return segment.Close()
+}
+
+// walSegmentIds returns the ids of the segment files of the WAL of a memtable, sorted.
+func walSegmentIds(dir string, id int) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, entry := range entries {
+		var segmentId uint32
+		if entry.IsDir() {
+			continue
+		}
+		if walId, ok := parseWalFileName(entry.Name()); !ok || walId != id {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "%d", &segmentId); err == nil {
+			ids = append(ids, segmentId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (r *repairer) relative(path string) string {
+	rel, err := filepath.Rel(r.dir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// moveToLost moves the file, given relative to the database directory, into the same place
+// under the lost directory. A file that is already there from an earlier repair is kept and
+// the new one gets a numbered name.
+func (r *repairer) moveToLost(rel string) error {
+	dst := filepath.Join(r.dir, LostDirName, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	for n := 1; ; n++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(r.dir, LostDirName, fmt.Sprintf("%s.%d", rel, n))
+	}
+	if err := os.Rename(filepath.Join(r.dir, rel), dst); err != nil {
+		return err
+	}
+	r.report.LostFiles = append(r.report.LostFiles, r.relative(dst))
+	return syncDir(dst)
+}
@@ -0,0 +1,291 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// repairTestDB repairs the database in options.DirPath and opens it with the default WAL
+// recovery mode.
+func repairTestDB(t *testing.T, options Options) (*RepairReport, *DB) {
+	t.Helper()
+	report, err := RepairDB(options)
+	if err != nil {
+		t.Fatalf("repair %s: %v", options.DirPath, err)
+	}
+	options.WALRecoveryMode = DefaultOptions.WALRecoveryMode
+	return report, openTestDB(t, options)
+}
+
+// familyBatches returns the batches of the crash test found in both families, it fails if
+// a batch is found partially.
+func familyBatches(t *testing.T, db *DB, family string) []int {
+	t.Helper()
+	other, err := db.ColumnFamily(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches []int
+	for i := 0; i < crashBatches; i++ {
+		switch found := batchKeysFound(t, db, nil, i) + batchKeysFound(t, db, other, i); found {
+		case 0:
+		case 2 * crashBatchKeys:
+			batches = append(batches, i)
+		default:
+			t.Fatalf("batch %d was recovered partially, %d of %d keys", i, found, 2*crashBatchKeys)
+		}
+	}
+	return batches
+}
+
+// lostFiles lists the files under the lost directory, relative to the database directory.
+func lostFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(filepath.Join(dir, LostDirName), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRepairKeepsAnIntactDatabase(t *testing.T) {
+	options, _ := crashedWal(t)
+	report, db := repairTestDB(t, options)
+	// A batch is counted once for every family it wrote.
+	want := RepairReport{RecoveredBatches: 2 * crashBatches, RecoveredRecords: 2 * crashBatches * crashBatchKeys}
+	if !reflect.DeepEqual(*report, want) {
+		t.Fatalf("report %+v, want %+v", report, want)
+	}
+	if n := recoveredBatches(t, db); n != crashBatches {
+		t.Fatalf("%d of %d batches after the repair", n, crashBatches)
+	}
+	if files := lostFiles(t, options.DirPath); files != nil {
+		t.Fatalf("the repair moved %v", files)
+	}
+}
+
+func TestRepairOfACorruptedWAL(t *testing.T) {
+	options, path := crashedWal(t)
+	corruptBlock(t, path)
+	if db, err := OpenDB(options); err == nil {
+		_ = db.Close()
+		t.Fatal("a corrupted WAL is opened")
+	}
+
+	report, db := repairTestDB(t, options)
+	batches := familyBatches(t, db, "other")
+	if len(batches) == 0 || len(batches) == crashBatches || batches[len(batches)-1] != crashBatches-1 {
+		t.Fatalf("batches %v after the repair, the ones around the damage must be dropped", batches)
+	}
+	if report.CorruptedChunks != 1 || report.DroppedBytes == 0 || report.DroppedTables != 0 {
+		t.Fatalf("the damage is not reported: %+v", report)
+	}
+	// The other family logged every batch, its parts of the lost batches are dropped too.
+	lost := crashBatches - len(batches)
+	if report.RecoveredBatches != 2*len(batches) || report.DroppedBatches < lost ||
+		report.RecoveredRecords != report.RecoveredBatches*crashBatchKeys {
+		t.Fatalf("report %+v with %d of %d batches kept", report, len(batches), crashBatches)
+	}
+	rel, _ := filepath.Rel(options.DirPath, path)
+	if files := lostFiles(t, options.DirPath); !reflect.DeepEqual(report.LostFiles, files) ||
+		!contains(files, filepath.Join(LostDirName, rel)) {
+		t.Fatalf("the repair moved %v, reported %v", files, report.LostFiles)
+	}
+
+	// The database is consistent again, new writes are kept.
+	if err := db.Put("after", "repair", &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestDB(t, options)
+	if again := familyBatches(t, reopened, "other"); !reflect.DeepEqual(again, batches) {
+		t.Fatalf("batches %v after reopening, %v before", again, batches)
+	}
+	mustGet(t, reopened, "after", "repair")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRepairOfATornTail(t *testing.T) {
+	options, path := crashedWal(t)
+	tearTail(t, path)
+
+	report, db := repairTestDB(t, options)
+	n := recoveredBatches(t, db)
+	if n == 0 || n == crashBatches {
+		t.Fatalf("%d of %d batches recovered, the torn ones must be dropped", n, crashBatches)
+	}
+	if report.RecoveredBatches != 2*n || report.DroppedBatches == 0 || report.CorruptedChunks != 1 {
+		t.Fatalf("report %+v with %d batches kept", report, n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second repair finds nothing left to drop.
+	report, err := RepairDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DroppedBatches != 0 || report.CorruptedChunks != 0 || report.LostFiles != nil {
+		t.Fatalf("second repair %+v", report)
+	}
+
+	// The WAL moved by the first repair is kept, the next one gets a numbered name.
+	tearTail(t, path)
+	if report, err = RepairDB(options); err != nil {
+		t.Fatal(err)
+	}
+	rel, _ := filepath.Rel(options.DirPath, path)
+	if !contains(report.LostFiles, filepath.Join(LostDirName, rel+".1")) {
+		t.Fatalf("third repair moved %v", report.LostFiles)
+	}
+	if files := lostFiles(t, options.DirPath); !contains(files, filepath.Join(LostDirName, rel)) {
+		t.Fatalf("the lost directory holds %v", files)
+	}
+}
+
+func TestRepairRebuildsTheManifest(t *testing.T) {
+	options, _ := crashedWal(t)
+	db := openTestDB(t, options)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := filepath.Glob(filepath.Join(options.DirPath, "*"+manifestFileExt))
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("no MANIFEST: %v", err)
+	}
+	for _, path := range manifests {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db, err := OpenDB(options); !errors.Is(err, _const.ErrorManifestCorrupted) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("open without the MANIFEST: %v", err)
+	}
+
+	report, db := repairTestDB(t, options)
+	if !report.ManifestRebuilt || report.DroppedBatches != 0 {
+		t.Fatalf("report %+v", report)
+	}
+	// The name of the family is lost with the MANIFEST.
+	if batches := familyBatches(t, db, "lost-1"); len(batches) != crashBatches {
+		t.Fatalf("%d of %d batches after rebuilding the MANIFEST", len(batches), crashBatches)
+	}
+}
+
+func TestRepairSalvagesTheFamilyNames(t *testing.T) {
+	options, _ := crashedWal(t)
+	// CURRENT no longer names the MANIFEST, the edits of the MANIFEST are still readable.
+	if err := os.WriteFile(filepath.Join(options.DirPath, CurrentFileName), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := OpenDB(options); !errors.Is(err, _const.ErrorManifestCorrupted) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("open with a broken CURRENT: %v", err)
+	}
+
+	report, db := repairTestDB(t, options)
+	if !report.ManifestRebuilt || report.DroppedBatches != 0 || !contains(report.LostFiles, filepath.Join(LostDirName, CurrentFileName)) {
+		t.Fatalf("report %+v", report)
+	}
+	if n := recoveredBatches(t, db); n != crashBatches {
+		t.Fatalf("%d of %d batches after rebuilding the MANIFEST", n, crashBatches)
+	}
+}
+
+func TestRepairDropsADamagedTable(t *testing.T) {
+	options := testOptions(t)
+	options.MemTableSize = 64 * 1024
+	db := openTestDB(t, options)
+	fillMemTables(t, db, "key", 3000)
+	waitForFlush(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := filepath.Glob(filepath.Join(options.DirPath, "*"+tableFileExt))
+	if err != nil || len(tables) == 0 {
+		t.Fatalf("no table files: %v", err)
+	}
+	data, err := os.ReadFile(tables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/3] ^= 0xff
+	if err := os.WriteFile(tables[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, db := repairTestDB(t, options)
+	rel, _ := filepath.Rel(options.DirPath, tables[0])
+	if report.DroppedTables != 1 || !reflect.DeepEqual(report.LostFiles, []string{filepath.Join(LostDirName, rel)}) {
+		t.Fatalf("report %+v", report)
+	}
+	if _, err := os.Stat(tables[0]); !os.IsNotExist(err) {
+		t.Fatalf("the damaged table is still in place: %v", err)
+	}
+	// The keys of the other tables and of the WAL are still there.
+	found := 0
+	for i := 0; i < 3000; i++ {
+		if _, err := db.Get(fmt.Sprintf("key-%05d", i)); err == nil {
+			found++
+		} else if !errors.Is(err, _const.ErrorKeyNotFound) {
+			t.Fatal(err)
+		}
+	}
+	if found == 0 || found == 3000 {
+		t.Fatalf("%d of 3000 keys after dropping a table", found)
+	}
+}
+
+func TestRepairRefusesAnOpenOrMissingDatabase(t *testing.T) {
+	options := testOptions(t)
+	db := openTestDB(t, options)
+	if _, err := RepairDB(options); !errors.Is(err, _const.ErrDatabaseIsUsing) {
+		t.Fatalf("repair of an open database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	readOnly := options
+	readOnly.ReadOnly = true
+	if _, err := RepairDB(readOnly); !errors.Is(err, _const.ErrorReadOnlyDB) {
+		t.Fatalf("read-only repair: %v", err)
+	}
+	options.DirPath = filepath.Join(options.DirPath, "missing")
+	if _, err := RepairDB(options); !os.IsNotExist(err) {
+		t.Fatalf("repair of a missing directory: %v", err)
+	}
+	if _, err := os.Stat(options.DirPath); !os.IsNotExist(err) {
+		t.Fatalf("the missing directory was created: %v", err)
+	}
+}
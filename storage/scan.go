@@ -0,0 +1,78 @@
+package storage
+
+// KV is a key and its value returned by the scans.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// Scan returns up to limit pairs with start <= key < end in key order, a nil bound is open
+// and a limit <= 0 returns all of them. next is the pagination token: pass it as start to
+// get the following page, it is nil after the last page. Every page is a consistent view
+// of the database, but the pages are read at different times.
+func (db *DB) Scan(start, end []byte, limit int) ([]KV, []byte, error) {
+	return db.scan(IteratorOptions{LowerBound: start, UpperBound: end}, limit)
+}
+
+// ReverseScan returns up to limit pairs with start <= key < end from the biggest key down.
+// Pass next as end to get the following page, it is nil after the last page.
+func (db *DB) ReverseScan(start, end []byte, limit int) ([]KV, []byte, error) {
+	kvs, next, err := db.scan(IteratorOptions{LowerBound: start, UpperBound: end, Reverse: true}, limit)
+	if next != nil {
+		// The end bound is exclusive, the following page ends before the last returned key.
+		next = kvs[len(kvs)-1].Key
+	}
+	return kvs, next, err
+}
+
+// PrefixScan calls fn for every key that starts with the prefix in key order, returning
+// false from fn stops the scan. The keys and values may be kept by fn.
+func (db *DB) PrefixScan(prefix []byte, fn func(key, value []byte) bool) error {
+	it, err := db.NewIterator(IteratorOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	if err != nil {
+		return err
+	}
+	for it.Rewind(); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Close()
+}
+
+// scan collects up to limit pairs and returns the key after the last one as the token.
+func (db *DB) scan(options IteratorOptions, limit int) ([]KV, []byte, error) {
+	it, err := db.NewIterator(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		kvs  []KV
+		next []byte
+	)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if limit > 0 && len(kvs) == limit {
+			next = it.Key()
+			break
+		}
+		kvs = append(kvs, KV{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Close(); err != nil {
+		return nil, nil, err
+	}
+	return kvs, next, nil
+}
+
+// PrefixEnd returns the smallest key that is bigger than every key with the prefix, nil
+// if there is none: a nil upper bound or range end is open.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func fillScanTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := openTestDB(t, testOptions(t))
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key-%03d", i), fmt.Sprint(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b-1", "b-2", "c"} {
+		if err := db.Put(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("key-050"), nil); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func scanKeys(kvs []KV) []string {
+	keys := make([]string, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = string(kv.Key)
+	}
+	return keys
+}
+
+func TestScanPages(t *testing.T) {
+	db := fillScanTestDB(t)
+
+	var (
+		keys  []string
+		start = []byte("key-")
+		pages int
+	)
+	for start != nil {
+		kvs, next, err := db.Scan(start, []byte("key-~"), 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range kvs {
+			var i int
+			if _, err := fmt.Sscanf(string(kv.Key), "key-%d", &i); err != nil || string(kv.Value) != fmt.Sprint(i) {
+				t.Fatalf("%s has the value %q", kv.Key, kv.Value)
+			}
+		}
+		keys = append(keys, scanKeys(kvs)...)
+		start = next
+		pages++
+	}
+	if len(keys) != 99 || pages != 4 {
+		t.Fatalf("%d keys in %d pages", len(keys), pages)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] || keys[i] == "key-050" {
+			t.Fatalf("the key %s follows %s", keys[i], keys[i-1])
+		}
+	}
+
+	// Without a limit everything is returned at once.
+	kvs, next, err := db.Scan(nil, nil, 0)
+	if err != nil || next != nil || len(kvs) != 103 {
+		t.Fatalf("a scan without a limit: %d keys, next %q, %v", len(kvs), next, err)
+	}
+}
+
+func TestReverseScanPages(t *testing.T) {
+	db := fillScanTestDB(t)
+
+	var (
+		keys  []string
+		end   = []byte("key-~")
+		pages int
+	)
+	for end != nil {
+		kvs, next, err := db.ReverseScan([]byte("key-"), end, 40)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, scanKeys(kvs)...)
+		end = next
+		pages++
+	}
+	if len(keys) != 99 || pages != 3 {
+		t.Fatalf("%d keys in %d pages", len(keys), pages)
+	}
+	if keys[0] != "key-099" || keys[len(keys)-1] != "key-000" {
+		t.Fatalf("the reverse scan goes from %s to %s", keys[0], keys[len(keys)-1])
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] <= keys[i] {
+			t.Fatalf("the key %s follows %s", keys[i], keys[i-1])
+		}
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	db := fillScanTestDB(t)
+	var keys []string
+	err := db.PrefixScan([]byte("b-"), func(key, value []byte) bool {
+		if !bytes.Equal(key, value) {
+			t.Fatalf("%s has the value %q", key, value)
+		}
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[b-1 b-2]" {
+		t.Fatalf("prefix b- found %v", keys)
+	}
+
+	// Returning false stops the scan.
+	count := 0
+	err = db.PrefixScan([]byte("key-"), func(key, value []byte) bool {
+		count++
+		return count < 5
+	})
+	if err != nil || count != 5 {
+		t.Fatalf("the scan went on for %d keys: %v", count, err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, end []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte{'a', 0xff}, []byte{'b'}},
+		{[]byte{'a', 0xfe, 0xff, 0xff}, []byte{'a', 0xff}},
+		{[]byte{0xff, 0xff}, nil},
+		{nil, nil},
+	} {
+		if end := PrefixEnd(tc.prefix); !bytes.Equal(end, tc.end) {
+			t.Fatalf("PrefixEnd(%q) = %q, want %q", tc.prefix, end, tc.end)
+		}
+	}
+
+	db := openTestDB(t, testOptions(t))
+	for _, key := range []string{"\xff\xff", "\xff\xff\x00", "\xff\xfe"} {
+		if err := db.Put(key, "v", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	if err := db.PrefixScan([]byte("\xff\xff"), func(key, value []byte) bool {
+		count++
+		return true
+	}); err != nil || count != 2 {
+		t.Fatalf("prefix 0xffff found %d keys: %v", count, err)
+	}
+}
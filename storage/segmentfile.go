@@ -7,6 +7,7 @@ import (
 	"fmt"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -26,12 +27,135 @@ type SegmentFile struct {
 
 	closed bool
 
-	localCache *lru.Cache[uint32, []byte]
+	localCache *lru.Cache[uint64, []byte]
+
+	// compression compresses the written records, nil writes them as they are.
+	compression *compression
 }
 
+// readInternal reads the record whose first chunk starts at the given block index and
+// chunk offset, and returns it together with the position of the next chunk.
+// io.EOF means there is nothing left to read, ErrorTornChunk means the file ends in
+// the middle of a record, and ErrorInvalidCRC means a chunk failed verification.
+// A compressed record is decompressed with the codec recorded in its first byte.
 func (f *SegmentFile) readInternal(index uint32, offset uint32) ([]byte, *ChunkPosition, error) {
+	if f.closed {
+		return nil, nil, _const.ErrClosed
+	}
+
+	var (
+		result     []byte
+		compressed bool
+		segSize    = f.Size()
+		nextChunk  = &ChunkPosition{SegmentFileId: f.segmentFileId}
+	)
+
+	// The writer pads the tail of a block that cannot hold another chunk header.
+	if offset+_const.ChunkHeadSize >= _const.BlockSize {
+		index++
+		offset = 0
+	}
+
+	for {
+		blockStart := int64(index) * _const.BlockSize
+		if blockStart+int64(offset) >= segSize {
+			if result == nil {
+				return nil, nil, io.EOF
+			}
+			return nil, nil, _const.ErrorTornChunk
+		}
+
+		block, err := f.readBlock(index, segSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if offset+_const.ChunkHeadSize > uint32(len(block)) {
+			return nil, nil, _const.ErrorTornChunk
+		}
+		header := block[offset : offset+_const.ChunkHeadSize]
+		length := uint32(binary.LittleEndian.Uint16(header[4:6]))
+		start := offset + _const.ChunkHeadSize
+		end := start + length
+		if end > uint32(len(block)) {
+			return nil, nil, _const.ErrorTornChunk
+		}
+
+		// 校验 len + type + data
+		sum := crc32.ChecksumIEEE(header[4:])
+		sum = crc32.Update(sum, crc32.IEEETable, block[start:end])
+		if sum != binary.LittleEndian.Uint32(header[:4]) {
+			return nil, nil, _const.ErrorInvalidCRC
+		}
+
+		chunkType := header[6] &^ chunkCompressedFlag
+		switch chunkType {
+		case ChunkTypeFull, ChunkTypeStart:
+			if result != nil {
+				return nil, nil, _const.ErrorInvalidCRC
+			}
+			compressed = header[6]&chunkCompressedFlag != 0
+		case ChunkTypeMiddle, ChunkTypeEnd:
+			if result == nil || compressed != (header[6]&chunkCompressedFlag != 0) {
+				return nil, nil, _const.ErrorInvalidCRC
+			}
+		default:
+			return nil, nil, _const.ErrorInvalidCRC
+		}
+		result = append(result, block[start:end]...)
+		if result == nil {
+			result = []byte{}
+		}
+
+		if chunkType == ChunkTypeFull || chunkType == ChunkTypeEnd {
+			nextChunk.BlockIndex = index
+			nextChunk.ChunkOffset = end
+			if end+_const.ChunkHeadSize >= _const.BlockSize {
+				nextChunk.BlockIndex++
+				nextChunk.ChunkOffset = 0
+			}
+			if compressed {
+				if len(result) == 0 {
+					return nil, nil, _const.ErrorInvalidCRC
+				}
+				if result, err = decompress(result[0], result[1:]); err != nil {
+					return nil, nil, err
+				}
+			}
+			return result, nextChunk, nil
+		}
+		index++
+		offset = 0
+	}
+}
+
+// readBlock returns the content of the block, it is at most BlockSize bytes long
+// and only full blocks are cached since the last block may still grow.
+func (f *SegmentFile) readBlock(index uint32, segSize int64) ([]byte, error) {
+	cacheKey := f.blockCacheKey(index)
+	if f.localCache != nil {
+		if block, ok := f.localCache.Get(cacheKey); ok {
+			return block, nil
+		}
+	}
 
-	return nil, nil, nil
+	blockStart := int64(index) * _const.BlockSize
+	size := int64(_const.BlockSize)
+	if blockStart+size > segSize {
+		size = segSize - blockStart
+	}
+	block := make([]byte, size)
+	if _, err := f.fd.ReadAt(block, blockStart); err != nil {
+		return nil, err
+	}
+	if f.localCache != nil && size == _const.BlockSize {
+		f.localCache.Add(cacheKey, block)
+	}
+	return block, nil
+}
+
+func (f *SegmentFile) blockCacheKey(index uint32) uint64 {
+	return uint64(f.segmentFileId)<<32 | uint64(index)
 }
 
 func (f *SegmentFile) NewSegmentReader() *SegmentReader {
@@ -118,11 +242,24 @@ func (f *SegmentFile) WriteAll(writes [][]byte) (position []*ChunkPosition, err
 	return positions, nil
 }
 
+// writeBuffer appends the chunks of the record to the buffer. A compressed record is
+// stored as the codec id followed by the compressed data, and all of its chunks are
+// flagged, so that the records written without compression still read back.
 func (f *SegmentFile) writeBuffer(bytes []byte, buffer *bytes.Buffer) (*ChunkPosition, error) {
 	if f.closed {
 		return nil, _const.ErrClosed
 	}
 
+	codec, stored, err := f.compression.compress(bytes)
+	if err != nil {
+		return nil, err
+	}
+	flag := byte(0)
+	if codec != NoCompressionId {
+		bytes = append([]byte{codec}, stored...)
+		flag = chunkCompressedFlag
+	}
+
 	padding := uint32(0)
 
 	// Pre-grow the buffer for better performance
@@ -148,12 +285,13 @@ func (f *SegmentFile) writeBuffer(bytes []byte, buffer *bytes.Buffer) (*ChunkPos
 
 	dataLen := uint32(len(bytes))
 
-	if f.lastBlockSize+_const.ChunkHeadSize <= _const.BlockSize {
-		err := f.appendChunk2Buffer(buffer, bytes, ChunkTypeFull)
+	if f.lastBlockSize+_const.ChunkHeadSize+dataLen <= _const.BlockSize {
+		err := f.appendChunk2Buffer(buffer, bytes, ChunkTypeFull|flag)
 		if err != nil {
 			return nil, err
 		}
 		position.ChunkSize = dataLen + _const.ChunkHeadSize
+		f.lastBlockSize += position.ChunkSize
 	} else {
 		// Split data into many chunks across blocks
 		var (
@@ -172,15 +310,20 @@ func (f *SegmentFile) writeBuffer(bytes []byte, buffer *bytes.Buffer) (*ChunkPos
 				freeSize = remainingDataSize
 				chunkType = ChunkTypeEnd
 			}
-			err := f.appendChunk2Buffer(buffer, bytes[dataLen-remainingDataSize:dataLen-remainingDataSize+freeSize], chunkType)
+			err := f.appendChunk2Buffer(buffer, bytes[dataLen-remainingDataSize:dataLen-remainingDataSize+freeSize], chunkType|flag)
 			if err != nil {
 				return nil, err
 			}
 			chunkNum++
 			remainingDataSize -= freeSize
-			curBlockSize = (curBlockSize + _const.ChunkHeadSize + freeSize) % _const.BlockSize
+			curBlockSize = curBlockSize + _const.ChunkHeadSize + freeSize
+			if curBlockSize == _const.BlockSize {
+				f.lastBlockIndex++
+				curBlockSize = 0
+			}
 		}
 		position.ChunkSize = chunkNum*_const.ChunkHeadSize + dataLen
+		f.lastBlockSize = curBlockSize
 	}
 
 	return position, nil
@@ -221,9 +364,18 @@ func segmentFileName(dir, ext string, id uint32) string {
 	return filepath.Join(dir, fmt.Sprintf("%010d"+ext, id))
 }
 
-func openSegmentFile(dir string, ext string, id uint32, localCache *lru.Cache[uint32, []byte]) (*SegmentFile, error) {
+func openSegmentFile(dir string, ext string, id uint32, localCache *lru.Cache[uint64, []byte], compression *compression) (*SegmentFile, error) {
+	return openSegmentFileWithFlag(dir, ext, id, localCache, compression, os.O_RDWR|os.O_CREATE|os.O_APPEND)
+}
+
+// openReadOnlySegmentFile opens an existing segment file that is only read.
+func openReadOnlySegmentFile(dir string, ext string, id uint32, localCache *lru.Cache[uint64, []byte], compression *compression) (*SegmentFile, error) {
+	return openSegmentFileWithFlag(dir, ext, id, localCache, compression, os.O_RDONLY)
+}
+
+func openSegmentFileWithFlag(dir string, ext string, id uint32, localCache *lru.Cache[uint64, []byte], compression *compression, flag int) (*SegmentFile, error) {
 	path := segmentFileName(dir, ext, id)
-	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	fd, err := os.OpenFile(path, flag, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -246,5 +398,6 @@ func openSegmentFile(dir string, ext string, id uint32, localCache *lru.Cache[ui
 		lastBlockSize:  uint32(size % _const.BlockSize),
 		header:         make([]byte, _const.ChunkHeadSize),
 		localCache:     localCache,
+		compression:    compression,
 	}, nil
 }
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+const testSegmentExt = ".SEG"
+
+func openTestWAL(t *testing.T, dir string, blockCache uint32) *TinyWAL {
+	t.Helper()
+	wal, err := OpenTinyWAL(WalOptions{
+		DirPath:        dir,
+		MemTableSize:   8 * _const.BlockSize,
+		segmentFileExt: testSegmentExt,
+		BytesPerSync:   _const.MB,
+		BlockCache:     blockCache,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = wal.close()
+	})
+	return wal
+}
+
+// testRecords returns records that fill a block exactly, span several blocks and leave too
+// little room for another chunk header at the end of a block.
+func testRecords() [][]byte {
+	sizes := []int{
+		1, 100,
+		// It ends at the end of the first block.
+		_const.BlockSize - 122,
+		// It ends 33 bytes into the fifth block.
+		3*_const.BlockSize + 5,
+		// It leaves 3 bytes at the end of the block, the next record starts in a new one.
+		_const.BlockSize - 43,
+		7, 0, 2 * _const.BlockSize, 4000, 4000, 4000,
+	}
+	records := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		records[i] = bytes.Repeat([]byte{byte('a' + i)}, size)
+	}
+	return records
+}
+
+// readAll reads the records of the WAL until the first error, io.EOF ends the WAL.
+func readAll(wal *TinyWAL) ([][]byte, []*ChunkPosition, error) {
+	var (
+		records   [][]byte
+		positions []*ChunkPosition
+	)
+	reader := wal.NewReader()
+	for {
+		data, position, err := reader.Next()
+		if err == io.EOF {
+			return records, positions, nil
+		}
+		if err != nil {
+			return records, positions, err
+		}
+		records = append(records, data)
+		positions = append(positions, position)
+	}
+}
+
+func TestSegmentFileReadsWhatWasWritten(t *testing.T) {
+	for _, blockCache := range []uint32{0, 4 * _const.BlockSize} {
+		dir := t.TempDir()
+		wal := openTestWAL(t, dir, blockCache)
+		records := testRecords()
+		var written []*ChunkPosition
+		for _, record := range records {
+			position, err := wal.Write(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, position)
+		}
+
+		// The records are read back from the files of another WAL as well.
+		for _, wal := range []*TinyWAL{wal, openTestWAL(t, dir, blockCache)} {
+			read, positions, err := readAll(wal)
+			if err != nil {
+				t.Fatalf("cache %d: %v", blockCache, err)
+			}
+			if len(read) != len(records) {
+				t.Fatalf("cache %d: %d records read, %d written", blockCache, len(read), len(records))
+			}
+			for i := range records {
+				if !bytes.Equal(read[i], records[i]) {
+					t.Fatalf("cache %d: record %d has %d bytes, want %d", blockCache, i, len(read[i]), len(records[i]))
+				}
+				if positions[i].SegmentFileId != written[i].SegmentFileId ||
+					positions[i].BlockIndex != written[i].BlockIndex ||
+					positions[i].ChunkOffset != written[i].ChunkOffset {
+					t.Fatalf("cache %d: record %d is read at %+v, written at %+v", blockCache, i, positions[i], written[i])
+				}
+			}
+		}
+	}
+}
+
+// writeTestSegment writes the records into one segment file and returns its path.
+func writeTestSegment(t *testing.T, records [][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	wal := openTestWAL(t, dir, 0)
+	for _, record := range records {
+		if _, err := wal.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.close(); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+testSegmentExt))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("want one segment file, got %v %v", paths, err)
+	}
+	return paths[0]
+}
+
+func TestSegmentFileDetectsCorruptedChunks(t *testing.T) {
+	records := [][]byte{[]byte("first"), bytes.Repeat([]byte{'x'}, 2*_const.BlockSize), []byte("last")}
+	path := writeTestSegment(t, records)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The byte is in the second chunk of the big record.
+	data[_const.BlockSize+100] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, _, err := readAll(openTestWAL(t, filepath.Dir(path), 0))
+	if !errors.Is(err, _const.ErrorInvalidCRC) {
+		t.Fatalf("reading a corrupted chunk: %v", err)
+	}
+	if len(read) != 1 || string(read[0]) != "first" {
+		t.Fatalf("%d records read before the corrupted one, want 1", len(read))
+	}
+}
+
+func TestSegmentFileDetectsTornTail(t *testing.T) {
+	records := [][]byte{[]byte("first"), bytes.Repeat([]byte{'x'}, 2*_const.BlockSize)}
+	path := writeTestSegment(t, records)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file ends in the middle of the last chunk of the big record.
+	if err := os.Truncate(path, stat.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	read, _, err := readAll(openTestWAL(t, filepath.Dir(path), 0))
+	if !errors.Is(err, _const.ErrorTornChunk) {
+		t.Fatalf("reading a torn record: %v", err)
+	}
+	if len(read) != 1 || string(read[0]) != "first" {
+		t.Fatalf("%d records read before the torn one, want 1", len(read))
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Snapshot is a stable view of the database, reads through it only see the batches
+// committed before it was taken. A snapshot keeps old versions from being compacted
+// away, so it must be released once it is no longer used.
+type Snapshot struct {
+	seq     uint64
+	element *list.Element
+}
+
+// Seq returns the sequence number of the last batch visible in the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// snapshotList keeps the live snapshots ordered by their sequence number.
+type snapshotList struct {
+	mu   sync.Mutex
+	list *list.List
+}
+
+func newSnapshotList() snapshotList {
+	return snapshotList{list: list.New()}
+}
+
+// NewSnapshot takes a snapshot of the current state of the database.
+func (db *DB) NewSnapshot() *Snapshot {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	db.snapshots.mu.Lock()
+	defer db.snapshots.mu.Unlock()
+	snapshot := &Snapshot{seq: db.seq}
+	snapshot.element = db.snapshots.list.PushBack(snapshot)
+	return snapshot
+}
+
+// ReleaseSnapshot releases the snapshot, it must not be used afterwards.
+func (db *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	db.snapshots.mu.Lock()
+	defer db.snapshots.mu.Unlock()
+	if snapshot.element != nil {
+		db.snapshots.list.Remove(snapshot.element)
+		snapshot.element = nil
+	}
+}
+
+// smallestSnapshot returns the oldest sequence number a reader may still ask for.
+func (db *DB) smallestSnapshot() uint64 {
+	db.m.RLock()
+	seq := db.seq
+	db.m.RUnlock()
+
+	db.snapshots.mu.Lock()
+	defer db.snapshots.mu.Unlock()
+	if front := db.snapshots.list.Front(); front != nil {
+		return front.Value.(*Snapshot).seq
+	}
+	return seq
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func mustGetAt(t *testing.T, db *DB, snapshot *Snapshot, key, want string) {
+	t.Helper()
+	value, err := db.GetWithOptions(key, &ReadOptions{Snapshot: snapshot})
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("get %s: %q, want %q", key, value, want)
+	}
+}
+
+func TestSnapshotSeesOldVersions(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "old-"+key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := db.NewSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+
+	if err := db.Put("a", "new-a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("d", "new-d", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mustGetAt(t, db, snapshot, "a", "old-a")
+	mustGetAt(t, db, snapshot, "b", "old-b")
+	if _, err := db.GetWithOptions("d", &ReadOptions{Snapshot: snapshot}); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("a key written after the snapshot is visible: %v", err)
+	}
+	mustGet(t, db, "a", "new-a")
+	mustNotFind(t, db, "b")
+
+	it := newTestIterator(t, db, IteratorOptions{Snapshot: snapshot})
+	it.Rewind()
+	keys, values := collect(it)
+	checkIteration(t, keys, values, []string{"a", "b", "c"}, map[string]string{"a": "old-a", "b": "old-b", "c": "old-c"})
+}
+
+func TestSnapshotSurvivesCompaction(t *testing.T) {
+	db := openTestDB(t, compactionTestOptions(t))
+	fillMemTables(t, db, "key", 3000)
+	snapshot := db.NewSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+
+	// The new versions and the deletions are compacted together with the old versions.
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 3000; i++ {
+			var err error
+			if i%2 == 0 {
+				err = db.Delete([]byte(fmt.Sprintf("key-%05d", i)), nil)
+			} else {
+				err = db.Put(fmt.Sprintf("key-%05d", i), fmt.Sprintf("round-%d", round), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForCompaction(t, db)
+
+	for _, i := range []int{0, 1, 1500, 2999} {
+		key := fmt.Sprintf("key-%05d", i)
+		mustGetAt(t, db, snapshot, key, strings.Repeat("v", 100)+fmt.Sprint(i))
+		if i%2 == 0 {
+			mustNotFind(t, db, key)
+		} else {
+			mustGet(t, db, key, "round-2")
+		}
+	}
+}
+
+func TestReleasedSnapshotIsForgotten(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("a", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	first := db.NewSnapshot()
+	if err := db.Put("a", "2", nil); err != nil {
+		t.Fatal(err)
+	}
+	second := db.NewSnapshot()
+	if second.Seq() <= first.Seq() {
+		t.Fatalf("the second snapshot has the sequence %d, the first %d", second.Seq(), first.Seq())
+	}
+
+	if db.smallestSnapshot() != first.Seq() {
+		t.Fatal("the oldest snapshot does not hold back the compaction")
+	}
+	db.ReleaseSnapshot(first)
+	// Releasing twice is harmless.
+	db.ReleaseSnapshot(first)
+	if db.smallestSnapshot() != second.Seq() {
+		t.Fatal("the released snapshot still holds back the compaction")
+	}
+	db.ReleaseSnapshot(second)
+	if err := db.Put("a", "3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.smallestSnapshot() <= second.Seq() {
+		t.Fatal("the compaction is held back without a snapshot")
+	}
+}
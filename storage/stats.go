@@ -0,0 +1,80 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+)
+
+// Stats describes the database at the time DB.Stats was called.
+type Stats struct {
+	// Seq is the sequence number of the last committed batch.
+	Seq uint64
+	// ColumnFamilies are sorted by id, the default family comes first.
+	ColumnFamilies []ColumnFamilyStats
+	// ValueLog describes the segments of the values bigger than Options.ValueThreshold.
+	ValueLog ValueLogStats
+}
+
+// ColumnFamilyStats describes the memtables, the table files and the compression of a
+// column family.
+type ColumnFamilyStats struct {
+	Name string
+	ID   uint32
+
+	// MemTables counts the active and the immutable memtables, MemTableBytes is the size
+	// of their skip-lists.
+	MemTables     int
+	MemTableBytes int64
+	// Levels describes the table files of every level.
+	Levels []LevelStats
+
+	// WALCompression and TableCompression count the bytes of the WAL records and of the
+	// table data blocks written since the database was opened, before and after compression.
+	WALCompression   CompressionStats
+	TableCompression CompressionStats
+}
+
+// ValueLogStats describes the value log, Compression counts the values written since the
+// database was opened.
+type ValueLogStats struct {
+	Segments    int
+	Bytes       int64
+	Compression CompressionStats
+}
+
+// LevelStats describes the table files of a level.
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+// Stats returns the statistics of the database and its column families.
+func (db *DB) Stats() (Stats, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.Closed {
+		return Stats{}, _const.ErrorDBClosed
+	}
+
+	stats := Stats{Seq: db.seq, ValueLog: db.vlog.stats()}
+	for _, cf := range db.sortedFamilies() {
+		family := ColumnFamilyStats{
+			Name:             cf.name,
+			ID:               cf.id,
+			Levels:           make([]LevelStats, len(cf.levels)),
+			WALCompression:   cf.walCompression.stats(),
+			TableCompression: cf.tableCompression.stats(),
+		}
+		for _, table := range cf.getMemTables() {
+			family.MemTables++
+			family.MemTableBytes += table.skl.MemSize()
+		}
+		for level, tables := range cf.levels {
+			for _, table := range tables {
+				family.Levels[level].Tables++
+				family.Levels[level].Bytes += table.size
+			}
+		}
+		stats.ColumnFamilies = append(stats.ColumnFamilies, family)
+	}
+	return stats, nil
+}
@@ -0,0 +1,520 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	tableFileExt = ".SST"
+
+	tmpFileExt = ".tmp"
+
+	// 单个 data block 的目标大小
+	tableBlockSize = 4 * _const.KB
+
+	tableMagic uint64 = 0x5353544153484443
+
+	// indexOffset + indexSize + filterOffset + filterSize + rangeDelOffset + rangeDelSize +
+	// level + maxSeq + magic
+	tableFooterSize = 8 + 4 + 8 + 4 + 8 + 4 + 4 + 8 + 8
+)
+
+// blockHandle locates a data block of a table file, lastKey is the biggest key of the block.
+type blockHandle struct {
+	lastKey []byte
+	offset  uint64
+	size    uint32
+}
+
+// Table is an immutable sorted table file, the layout is:
+//
+//	data block 1 | ... | data block n | filter block | range deletion block | index block | footer
+//
+// every block is its content, the id of the codec that compressed it and the crc32 of both,
+// only the data blocks are compressed. The filter block is the bloom filter
+// of the user keys and is left out if the filters are disabled, the range deletion block
+// holds the range tombstones and is left out if there are none, the index block records
+// the last key and the location of every data block, the footer points to the filter,
+// the range deletion and the index block and records the level and the biggest sequence
+// number of the table. The key range of a table covers its range tombstones too.
+type Table struct {
+	id     uint32
+	level  int
+	maxSeq uint64
+	fd     *os.File
+	path   string
+	size   int64
+	index  []blockHandle
+	filter bloomFilter
+	// rangeDels are the range tombstones of the table, sorted by start key.
+	rangeDels rangeTombstones
+	smallest  []byte
+	biggest   []byte
+	ref       atomic.Int32
+	removed   atomic.Bool
+}
+
+type tableBuilder struct {
+	id       uint32
+	level    int
+	maxSeq   uint64
+	fd       *os.File
+	path     string
+	tmpPath  string
+	block    bytes.Buffer
+	index    bytes.Buffer
+	offset   uint64
+	lastKey  []byte
+	keyCount int
+
+	bitsPerKey int
+	// keyHashes are the bloom hashes of the user keys, every version adds one.
+	keyHashes []uint32
+	rangeDels rangeTombstones
+
+	compression *compression
+}
+
+func tableFileName(dir string, id uint32) string {
+	return segmentFileName(dir, tableFileExt, id)
+}
+
+// newTableBuilder creates a builder that writes into a temporary file, the table only
+// becomes visible under its final name once finish succeeds.
+func newTableBuilder(dir string, id uint32, level int, bitsPerKey int, compression *compression) (*tableBuilder, error) {
+	path := tableFileName(dir, id)
+	fd, err := os.OpenFile(path+tmpFileExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &tableBuilder{
+		id:      id,
+		level:   level,
+		fd:      fd,
+		path:    path,
+		tmpPath: path + tmpFileExt,
+
+		bitsPerKey:  bitsPerKey,
+		compression: compression,
+	}, nil
+}
+
+// add appends an entry, keys must be added in increasing order.
+func (b *tableBuilder) add(key []byte, value y.ValueStruct) error {
+	var buf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	b.block.Write(buf[:n])
+	b.block.Write(key)
+
+	n = binary.PutUvarint(buf[:], uint64(encodedValueSize(value)))
+	b.block.Write(buf[:n])
+	value.EncodeTo(&b.block)
+
+	if b.bitsPerKey > 0 {
+		b.keyHashes = append(b.keyHashes, bloomHash(y.ParseKey(key)))
+	}
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.keyCount++
+	if seq := y.ParseTs(key); seq > b.maxSeq {
+		b.maxSeq = seq
+	}
+
+	if b.block.Len() >= tableBlockSize {
+		return b.finishBlock()
+	}
+	return nil
+}
+
+// addRangeTombstone adds a range tombstone, they may be added in any order.
+func (b *tableBuilder) addRangeTombstone(r rangeTombstone) {
+	b.rangeDels = append(b.rangeDels, r)
+	if r.seq > b.maxSeq {
+		b.maxSeq = r.seq
+	}
+}
+
+func (b *tableBuilder) empty() bool {
+	return b.keyCount == 0 && len(b.rangeDels) == 0
+}
+
+// estimateSize returns the bytes the table takes so far.
+func (b *tableBuilder) estimateSize() uint64 {
+	return b.offset + uint64(b.block.Len()+b.index.Len()+len(b.keyHashes)*b.bitsPerKey/8)
+}
+
+func (b *tableBuilder) finishBlock() error {
+	if b.block.Len() == 0 {
+		return nil
+	}
+	codec, data, err := b.compression.compress(b.block.Bytes())
+	if err != nil {
+		return err
+	}
+	block := &b.block
+	if codec != NoCompressionId {
+		block = bytes.NewBuffer(data)
+	}
+	size, err := b.writeBlock(block, codec)
+	if err != nil {
+		return err
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b.lastKey)))
+	b.index.Write(buf[:n])
+	b.index.Write(b.lastKey)
+	n = binary.PutUvarint(buf[:], b.offset)
+	b.index.Write(buf[:n])
+	n = binary.PutUvarint(buf[:], uint64(size))
+	b.index.Write(buf[:n])
+
+	b.offset += uint64(size)
+	b.block.Reset()
+	return nil
+}
+
+// writeBlock writes the block followed by its codec and checksum and returns the written size.
+func (b *tableBuilder) writeBlock(block *bytes.Buffer, codec byte) (uint32, error) {
+	block.WriteByte(codec)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(block.Bytes()))
+	block.Write(sum[:])
+	if _, err := b.fd.Write(block.Bytes()); err != nil {
+		return 0, err
+	}
+	return uint32(block.Len()), nil
+}
+
+// finish writes the index block and the footer, syncs the file and renames it
+// to its final name.
+func (b *tableBuilder) finish() error {
+	if err := b.finishBlock(); err != nil {
+		return err
+	}
+	filterOffset := b.offset
+	var filterSize uint32
+	if b.bitsPerKey > 0 {
+		var filter bytes.Buffer
+		filter.Write(buildBloomFilter(b.keyHashes, b.bitsPerKey))
+		size, err := b.writeBlock(&filter, NoCompressionId)
+		if err != nil {
+			return err
+		}
+		filterSize = size
+		b.offset += uint64(size)
+	}
+
+	rangeDelOffset := b.offset
+	var rangeDelSize uint32
+	if len(b.rangeDels) > 0 {
+		var rangeDels bytes.Buffer
+		rangeDels.Write(b.rangeDels.encode())
+		size, err := b.writeBlock(&rangeDels, NoCompressionId)
+		if err != nil {
+			return err
+		}
+		rangeDelSize = size
+		b.offset += uint64(size)
+	}
+
+	indexOffset := b.offset
+	indexSize, err := b.writeBlock(&b.index, NoCompressionId)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, tableFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:8], indexOffset)
+	binary.LittleEndian.PutUint32(footer[8:12], indexSize)
+	binary.LittleEndian.PutUint64(footer[12:20], filterOffset)
+	binary.LittleEndian.PutUint32(footer[20:24], filterSize)
+	binary.LittleEndian.PutUint64(footer[24:32], rangeDelOffset)
+	binary.LittleEndian.PutUint32(footer[32:36], rangeDelSize)
+	binary.LittleEndian.PutUint32(footer[36:40], uint32(b.level))
+	binary.LittleEndian.PutUint64(footer[40:48], b.maxSeq)
+	binary.LittleEndian.PutUint64(footer[48:56], tableMagic)
+	if _, err := b.fd.Write(footer); err != nil {
+		return err
+	}
+
+	if err := b.fd.Sync(); err != nil {
+		return err
+	}
+	if err := b.fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(b.tmpPath, b.path); err != nil {
+		return err
+	}
+	return syncDir(b.path)
+}
+
+// abandon drops the unfinished table file.
+func (b *tableBuilder) abandon() {
+	_ = b.fd.Close()
+	_ = os.Remove(b.tmpPath)
+}
+
+func openTable(dir string, id uint32) (*Table, error) {
+	path := tableFileName(dir, id)
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	table := &Table{
+		id:   id,
+		fd:   fd,
+		path: path,
+	}
+	table.ref.Store(1)
+	if err := table.loadIndex(); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return table, nil
+}
+
+func (t *Table) loadIndex() error {
+	stat, err := t.fd.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = stat.Size()
+	if t.size < tableFooterSize {
+		return _const.ErrorTableCorrupted
+	}
+
+	footer := make([]byte, tableFooterSize)
+	if _, err := t.fd.ReadAt(footer, t.size-tableFooterSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[48:56]) != tableMagic {
+		return _const.ErrorTableCorrupted
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	indexSize := binary.LittleEndian.Uint32(footer[8:12])
+	filterOffset := binary.LittleEndian.Uint64(footer[12:20])
+	filterSize := binary.LittleEndian.Uint32(footer[20:24])
+	rangeDelOffset := binary.LittleEndian.Uint64(footer[24:32])
+	rangeDelSize := binary.LittleEndian.Uint32(footer[32:36])
+	t.level = int(binary.LittleEndian.Uint32(footer[36:40]))
+	t.maxSeq = binary.LittleEndian.Uint64(footer[40:48])
+
+	if filterSize > 0 {
+		filter, err := t.readAt(filterOffset, filterSize)
+		if err != nil {
+			return err
+		}
+		t.filter = filter
+	}
+	if rangeDelSize > 0 {
+		block, err := t.readAt(rangeDelOffset, rangeDelSize)
+		if err != nil {
+			return err
+		}
+		if t.rangeDels, err = decodeRangeTombstones(block); err != nil {
+			return err
+		}
+	}
+
+	index, err := t.readAt(indexOffset, indexSize)
+	if err != nil {
+		return err
+	}
+	for len(index) > 0 {
+		var handle blockHandle
+		keyLen, n := binary.Uvarint(index)
+		if n <= 0 || uint64(len(index)-n) < keyLen {
+			return _const.ErrorTableCorrupted
+		}
+		index = index[n:]
+		handle.lastKey = index[:keyLen]
+		index = index[keyLen:]
+		handle.offset, n = binary.Uvarint(index)
+		if n <= 0 {
+			return _const.ErrorTableCorrupted
+		}
+		index = index[n:]
+		size, n := binary.Uvarint(index)
+		if n <= 0 {
+			return _const.ErrorTableCorrupted
+		}
+		index = index[n:]
+		handle.size = uint32(size)
+		t.index = append(t.index, handle)
+	}
+
+	if len(t.index) > 0 {
+		block, err := t.readBlock(0)
+		if err != nil {
+			return err
+		}
+		key, _, _, err := decodeTableEntry(block)
+		if err != nil {
+			return err
+		}
+		t.smallest = y.Copy(key)
+		t.biggest = t.index[len(t.index)-1].lastKey
+	}
+	if len(t.rangeDels) > 0 {
+		if smallest := t.rangeDels.smallestKey(); t.smallest == nil || y.CompareKeys(smallest, t.smallest) < 0 {
+			t.smallest = smallest
+		}
+		if biggest := t.rangeDels.biggestKey(); t.biggest == nil || y.CompareKeys(biggest, t.biggest) > 0 {
+			t.biggest = biggest
+		}
+	}
+	return nil
+}
+
+// readAt reads a block, verifies the trailing checksum and decompresses it.
+func (t *Table) readAt(offset uint64, size uint32) ([]byte, error) {
+	if size < 4 || int64(offset)+int64(size) > t.size {
+		return nil, _const.ErrorTableCorrupted
+	}
+	data := make([]byte, size)
+	if _, err := t.fd.ReadAt(data, int64(offset)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	content := data[:size-4]
+	if crc32.ChecksumIEEE(content) != binary.LittleEndian.Uint32(data[size-4:]) {
+		return nil, _const.ErrorInvalidCRC
+	}
+	if len(content) == 0 {
+		return nil, _const.ErrorTableCorrupted
+	}
+	codec := content[len(content)-1]
+	content = content[:len(content)-1]
+	if codec == NoCompressionId {
+		return content, nil
+	}
+	return decompress(codec, content)
+}
+
+func (t *Table) readBlock(i int) ([]byte, error) {
+	return t.readAt(t.index[i].offset, t.index[i].size)
+}
+
+// get returns the newest version of the key that is not newer than the given internal key.
+func (t *Table) get(key []byte) (y.ValueStruct, bool, error) {
+	if t.filter != nil && !t.filter.mayContain(y.ParseKey(key)) {
+		return y.ValueStruct{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool {
+		return y.CompareKeys(t.index[i].lastKey, key) >= 0
+	})
+	if i == len(t.index) {
+		return y.ValueStruct{}, false, nil
+	}
+	block, err := t.readBlock(i)
+	if err != nil {
+		return y.ValueStruct{}, false, err
+	}
+	for len(block) > 0 {
+		entryKey, value, n, err := decodeTableEntry(block)
+		if err != nil {
+			return y.ValueStruct{}, false, err
+		}
+		block = block[n:]
+		if y.CompareKeys(entryKey, key) < 0 {
+			continue
+		}
+		if !y.SameKey(entryKey, key) {
+			return y.ValueStruct{}, false, nil
+		}
+		value.Version = y.ParseTs(entryKey)
+		return value, true, nil
+	}
+	return y.ValueStruct{}, false, nil
+}
+
+// overlaps reports whether the user keys of the table intersect with [smallest, biggest].
+func (t *Table) overlaps(smallest, biggest []byte) bool {
+	if t.smallest == nil {
+		return false
+	}
+	return bytes.Compare(y.ParseKey(t.smallest), y.ParseKey(biggest)) <= 0 &&
+		bytes.Compare(y.ParseKey(smallest), y.ParseKey(t.biggest)) <= 0
+}
+
+// containsKey reports whether the user key may be stored in the table.
+func (t *Table) containsKey(key []byte) bool {
+	return t.overlaps(key, key)
+}
+
+func (t *Table) incrRef() {
+	t.ref.Add(1)
+}
+
+// decrRef releases a reference, the file is closed once nobody uses the table any more.
+func (t *Table) decrRef() error {
+	if t.ref.Add(-1) > 0 {
+		return nil
+	}
+	if err := t.fd.Close(); err != nil {
+		return err
+	}
+	if t.removed.Load() {
+		return os.Remove(t.path)
+	}
+	return nil
+}
+
+func (t *Table) close() error {
+	return t.decrRef()
+}
+
+// remove deletes the table file once the running iterators are done with it.
+func (t *Table) remove() error {
+	t.removed.Store(true)
+	return t.decrRef()
+}
+
+func encodedValueSize(value y.ValueStruct) int {
+	var buf [binary.MaxVarintLen64]byte
+	return 2 + binary.PutUvarint(buf[:], value.ExpiresAt) + len(value.Value)
+}
+
+// decodeTableEntry decodes the first entry of the block and returns the number of bytes it took.
+func decodeTableEntry(block []byte) ([]byte, y.ValueStruct, int, error) {
+	var value y.ValueStruct
+	keyLen, n := binary.Uvarint(block)
+	if n <= 0 || uint64(len(block)-n) < keyLen {
+		return nil, value, 0, _const.ErrorTableCorrupted
+	}
+	index := n
+	key := block[index : index+int(keyLen)]
+	index += int(keyLen)
+
+	valueLen, n := binary.Uvarint(block[index:])
+	if n <= 0 || uint64(len(block)-index-n) < valueLen || valueLen < 3 {
+		return nil, value, 0, _const.ErrorTableCorrupted
+	}
+	index += n
+	value.Decode(block[index : index+int(valueLen)])
+	index += int(valueLen)
+	return key, value, index, nil
+}
+
+// syncDir flushes the directory entry of the given file to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
+}
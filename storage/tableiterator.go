@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// tableIterator walks a table file block by block, it implements y.Iterator.
+type tableIterator struct {
+	table    *Table
+	reversed bool
+	blockIdx int
+	keys     [][]byte
+	values   []y.ValueStruct
+	pos      int
+	err      error
+}
+
+func (t *Table) newIterator(reversed bool) *tableIterator {
+	return &tableIterator{
+		table:    t,
+		reversed: reversed,
+		pos:      -1,
+	}
+}
+
+func (it *tableIterator) loadBlock(i int) bool {
+	it.keys = it.keys[:0]
+	it.values = it.values[:0]
+	it.blockIdx = i
+	it.pos = -1
+
+	block, err := it.table.readBlock(i)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	for len(block) > 0 {
+		key, value, n, err := decodeTableEntry(block)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.keys = append(it.keys, key)
+		it.values = append(it.values, value)
+		block = block[n:]
+	}
+	return true
+}
+
+func (it *tableIterator) seekToFirst() {
+	if len(it.table.index) == 0 || !it.loadBlock(0) {
+		return
+	}
+	it.pos = 0
+}
+
+func (it *tableIterator) seekToLast() {
+	if len(it.table.index) == 0 || !it.loadBlock(len(it.table.index)-1) {
+		return
+	}
+	it.pos = len(it.keys) - 1
+}
+
+// seek moves to the first entry whose key is >= key.
+func (it *tableIterator) seek(key []byte) {
+	i := sort.Search(len(it.table.index), func(i int) bool {
+		return y.CompareKeys(it.table.index[i].lastKey, key) >= 0
+	})
+	if i == len(it.table.index) {
+		it.keys = it.keys[:0]
+		it.pos = -1
+		return
+	}
+	if !it.loadBlock(i) {
+		return
+	}
+	it.pos = sort.Search(len(it.keys), func(i int) bool {
+		return y.CompareKeys(it.keys[i], key) >= 0
+	})
+}
+
+// seekForPrev moves to the last entry whose key is <= key.
+func (it *tableIterator) seekForPrev(key []byte) {
+	it.seek(key)
+	if !it.Valid() {
+		if it.err == nil {
+			it.seekToLast()
+		}
+		return
+	}
+	if y.CompareKeys(it.keys[it.pos], key) > 0 {
+		it.prev()
+	}
+}
+
+func (it *tableIterator) next() {
+	it.pos++
+	if it.pos < len(it.keys) {
+		return
+	}
+	if it.blockIdx+1 < len(it.table.index) && it.loadBlock(it.blockIdx+1) {
+		it.pos = 0
+	}
+}
+
+func (it *tableIterator) prev() {
+	it.pos--
+	if it.pos >= 0 {
+		return
+	}
+	if it.blockIdx > 0 && it.loadBlock(it.blockIdx-1) {
+		it.pos = len(it.keys) - 1
+	}
+}
+
+// Next implements y.Iterator.
+func (it *tableIterator) Next() {
+	if it.reversed {
+		it.prev()
+	} else {
+		it.next()
+	}
+}
+
+// Rewind implements y.Iterator.
+func (it *tableIterator) Rewind() {
+	if it.reversed {
+		it.seekToLast()
+	} else {
+		it.seekToFirst()
+	}
+}
+
+// Seek implements y.Iterator.
+func (it *tableIterator) Seek(key []byte) {
+	if it.reversed {
+		it.seekForPrev(key)
+	} else {
+		it.seek(key)
+	}
+}
+
+// Key implements y.Iterator.
+func (it *tableIterator) Key() []byte {
+	return it.keys[it.pos]
+}
+
+// Value implements y.Iterator.
+func (it *tableIterator) Value() y.ValueStruct {
+	return it.values[it.pos]
+}
+
+// Valid implements y.Iterator.
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.keys)
+}
+
+// Close implements y.Iterator.
+func (it *tableIterator) Close() error {
+	return it.err
+}
@@ -2,12 +2,11 @@ package storage
 
 import (
 	_const "SmartStashDB/const"
-	"errors"
-	"fmt"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"io/fs"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -17,7 +16,7 @@ type TinyWAL struct {
 	mutex            sync.RWMutex
 	activeSegment    *SegmentFile
 	immutableSegment map[SegmentFileId]*SegmentFile
-	localCache       *lru.Cache[uint32, []byte]
+	localCache       *lru.Cache[uint64, []byte]
 	byteWrite        uint64
 
 	pendingWritesLock sync.Mutex
@@ -41,17 +40,22 @@ func (w *TinyWAL) close() error {
 		}
 	}
 	w.immutableSegment = nil
+	if w.activeSegment == nil {
+		return nil
+	}
 	return w.activeSegment.Close()
 }
 
 func OpenTinyWAL(option WalOptions) (*TinyWAL, error) {
-	if strings.HasPrefix(option.segmentFileExt, ".") {
-		return nil, errors.New(option.segmentFileExt + " is not allowed")
+	if !strings.HasPrefix(option.segmentFileExt, ".") {
+		return nil, _const.ErrorFileExtError
 	}
 
-	err := os.MkdirAll(option.DirPath, fs.ModePerm)
-	if err != nil {
-		return nil, err
+	var err error
+	if !option.readOnly {
+		if err = os.MkdirAll(option.DirPath, fs.ModePerm); err != nil {
+			return nil, err
+		}
 	}
 
 	tinyWAL := &TinyWAL{
@@ -65,15 +69,14 @@ func OpenTinyWAL(option WalOptions) (*TinyWAL, error) {
 		if option.BlockCache%_const.BlockSize != 0 {
 			blockNum++
 		}
-		tinyWAL.localCache, err = lru.New[uint32, []byte](int(blockNum))
+		tinyWAL.localCache, err = lru.New[uint64, []byte](int(blockNum))
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	dir, err := os.ReadDir(option.DirPath)
-
-	if err != nil {
+	if err != nil && !(option.readOnly && os.IsNotExist(err)) {
 		return nil, err
 	}
 
@@ -82,8 +85,10 @@ func OpenTinyWAL(option WalOptions) (*TinyWAL, error) {
 		if file.IsDir() {
 			continue
 		}
-		segmentFileId := 0
-		_, err := fmt.Scanf(file.Name(), "%d"+option.segmentFileExt, &segmentFileId)
+		if !strings.HasSuffix(file.Name(), option.segmentFileExt) {
+			continue
+		}
+		segmentFileId, err := strconv.Atoi(strings.TrimSuffix(file.Name(), option.segmentFileExt))
 		if err != nil {
 			continue
 		}
@@ -91,7 +96,11 @@ func OpenTinyWAL(option WalOptions) (*TinyWAL, error) {
 	}
 
 	if len(segmentFileIds) == 0 {
-		segment, err := openSegmentFile(option.DirPath, option.segmentFileExt, _const.FirstSegmentFileId, tinyWAL.localCache)
+		// A read-only WAL without segment files is empty, it has no active segment.
+		if option.readOnly {
+			return tinyWAL, nil
+		}
+		segment, err := openSegmentFile(option.DirPath, option.segmentFileExt, _const.FirstSegmentFileId, tinyWAL.localCache, option.compression)
 
 		if err != nil {
 			return nil, err
@@ -99,8 +108,12 @@ func OpenTinyWAL(option WalOptions) (*TinyWAL, error) {
 		tinyWAL.activeSegment = segment
 	} else {
 		sort.Ints(segmentFileIds)
+		open := openSegmentFile
+		if option.readOnly {
+			open = openReadOnlySegmentFile
+		}
 		for i, fileId := range segmentFileIds {
-			segment, err := openSegmentFile(option.DirPath, option.segmentFileExt, uint32(fileId), tinyWAL.localCache)
+			segment, err := open(option.DirPath, option.segmentFileExt, uint32(fileId), tinyWAL.localCache, option.compression)
 			if err != nil {
 				return nil, err
 			}
@@ -119,7 +132,8 @@ func (w *TinyWAL) PendingWrites(data []byte) error {
 	w.pendingWritesLock.Lock()
 	defer w.pendingWritesLock.Unlock()
 
-	w.maxWriteSize(int64(len(data)))
+	w.pendingWritesSize += uint64(w.maxWriteSize(int64(len(data))))
+	w.pendingWrites = append(w.pendingWrites, data)
 	return nil
 }
 
@@ -164,7 +178,7 @@ func (w *TinyWAL) maxWriteSize(size int64) int64 {
 	return newHeadSize + total
 }
 
-func (w *TinyWAL) NewReader() *_const.Reader {
+func (w *TinyWAL) NewReader() *Reader {
 	w.mutex.RLock()
 	defer w.mutex.RUnlock()
 	var readers []*SegmentReader
@@ -175,7 +189,7 @@ func (w *TinyWAL) NewReader() *_const.Reader {
 
 	sort.Slice(readers, func(i, j int) bool { return readers[i].seg.segmentFileId < readers[j].seg.segmentFileId })
 
-	return &_const.Reader{
+	return &Reader{
 		AllSegmentReader: readers,
 		Progress:         0,
 	}
@@ -214,6 +228,21 @@ func (w *TinyWAL) Write(data []byte) (*ChunkPosition, error) {
 	return position, err
 }
 
+// Read returns the record at the position.
+func (w *TinyWAL) Read(position *ChunkPosition) ([]byte, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	segment := w.activeSegment
+	if segment == nil || position.SegmentFileId != segment.segmentFileId {
+		segment = w.immutableSegment[position.SegmentFileId]
+	}
+	if segment == nil {
+		return nil, os.ErrNotExist
+	}
+	data, _, err := segment.readInternal(position.BlockIndex, position.ChunkOffset)
+	return data, err
+}
+
 func (w *TinyWAL) isFull(delta int64) bool {
 	return w.activeSegment.Size()+w.maxWriteSize(delta) > int64(w.option.MemTableSize)
 }
@@ -224,7 +253,7 @@ func (w *TinyWAL) replaceActiveSegmentFile() error {
 		return err
 	}
 	w.byteWrite = 0
-	file, err := openSegmentFile(w.option.DirPath, w.option.segmentFileExt, w.activeSegment.segmentFileId+1, w.localCache)
+	file, err := openSegmentFile(w.option.DirPath, w.option.segmentFileExt, w.activeSegment.segmentFileId+1, w.localCache, w.option.compression)
 	if err != nil {
 		return err
 	}
@@ -234,5 +263,29 @@ func (w *TinyWAL) replaceActiveSegmentFile() error {
 }
 
 func (w *TinyWAL) ClearPendingWrites() {
+	w.pendingWritesLock.Lock()
+	defer w.pendingWritesLock.Unlock()
 
+	w.pendingWritesSize = 0
+	w.pendingWrites = w.pendingWrites[:0]
+}
+
+// remove closes the WAL and deletes all of its segment files.
+func (w *TinyWAL) remove() error {
+	w.mutex.RLock()
+	segments := []*SegmentFile{w.activeSegment}
+	for _, segment := range w.immutableSegment {
+		segments = append(segments, segment)
+	}
+	w.mutex.RUnlock()
+
+	if err := w.close(); err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := os.Remove(segment.fd.Name()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
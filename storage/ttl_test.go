@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	_const "SmartStashDB/const"
+)
+
+const testTTL = 50 * time.Millisecond
+
+func TestPutWithTTLExpires(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.PutWithTTL("short", "1", testTTL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "2", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("forever", "3", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "short", "1")
+
+	time.Sleep(2 * testTTL)
+	mustNotFind(t, db, "short")
+	mustGet(t, db, "long", "2")
+	mustGet(t, db, "forever", "3")
+
+	it := newTestIterator(t, db, IteratorOptions{})
+	it.Rewind()
+	keys, values := collect(it)
+	checkIteration(t, keys, values, []string{"forever", "long"}, map[string]string{"forever": "3", "long": "2"})
+
+	// A new write of the key replaces the expired value.
+	if err := db.Put("short", "4", nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "short", "4")
+}
+
+func TestWriteOptionsTTL(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("kept", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	if err := batch.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// The ttl of the value wins over the one of the WriteOptions.
+	if err := batch.PutWithTTL([]byte("b"), []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Deletions are not turned into expiring values.
+	if err := batch.Delete([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(&WriteOptions{TTL: testTTL}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * testTTL)
+	mustNotFind(t, db, "a")
+	mustGet(t, db, "b", "2")
+	mustNotFind(t, db, "kept")
+}
+
+func TestBatchHidesExpiredPendingWrites(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	batch := db.NewBatch(DefaultBatchOptions)
+	if err := batch.PutWithTTL([]byte("a"), []byte("1"), testTTL); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * testTTL)
+	if _, err := batch.Get([]byte("a")); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get of an expired pending write: %v", err)
+	}
+	if err := batch.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTLSurvivesFlushAndReopen(t *testing.T) {
+	options := compactionTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("short", "1", time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "2", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	fillMemTables(t, db, "key", 3000)
+	waitForCompaction(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, options)
+	mustGet(t, db, "long", "2")
+	time.Sleep(time.Second)
+	mustNotFind(t, db, "short")
+	mustGet(t, db, "long", "2")
+
+	// The expired value stays hidden through further compactions.
+	fillMemTables(t, db, "other", 3000)
+	waitForCompaction(t, db)
+	mustNotFind(t, db, "short")
+}
+
+func TestTTLReportsTheTimeLeft(t *testing.T) {
+	db := openTestDB(t, mergeTestOptions(t))
+	if _, err := db.TTL("missing"); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("TTL of a missing key: %v", err)
+	}
+	if err := db.Put("forever", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "2", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("short", "3", testTTL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge([]byte("merged"), []byte("4"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl, err := db.TTL("forever"); err != nil || ttl != NoTTL {
+		t.Fatalf("TTL of a key without expiry: %v %v", ttl, err)
+	}
+	if ttl, err := db.TTL("long"); err != nil || ttl <= time.Hour-time.Minute || ttl > time.Hour {
+		t.Fatalf("TTL of an expiring key: %v %v", ttl, err)
+	}
+	if ttl, err := db.TTL("merged"); err != nil || ttl != NoTTL {
+		t.Fatalf("TTL of a merged key: %v %v", ttl, err)
+	}
+
+	if err := db.PutWithTTL("deleted", "5", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange([]byte("deleted"), []byte("deletee"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("forever"), nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * testTTL)
+	for _, key := range []string{"short", "deleted", "forever"} {
+		if _, err := db.TTL(key); !errors.Is(err, _const.ErrorKeyNotFound) {
+			t.Fatalf("TTL of %q: %v", key, err)
+		}
+	}
+	if _, err := db.TTL(""); !errors.Is(err, _const.ErrorKeyIsEmpty) {
+		t.Fatalf("TTL of an empty key: %v", err)
+	}
+}
+
+func TestTTLWithOptionsReadsTheSnapshot(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	cf, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key", "1", time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.NewSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	if err := db.Put("key", "2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutCF(cf, "key", "3", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot gives the time to live of the value it reads.
+	options := &ReadOptions{Snapshot: snapshot}
+	if ttl, err := db.TTLWithOptions("key", options); err != nil || ttl <= time.Hour-time.Minute || ttl > time.Hour {
+		t.Fatalf("TTL in the snapshot: %v %v", ttl, err)
+	}
+	if ttl, err := db.TTLWithOptions("key", nil); err != nil || ttl != NoTTL {
+		t.Fatalf("TTL of the latest value: %v %v", ttl, err)
+	}
+	if ttl, err := db.TTLWithOptions("key", &ReadOptions{ColumnFamily: cf}); err != nil || ttl != NoTTL {
+		t.Fatalf("TTL in the column family: %v %v", ttl, err)
+	}
+	if _, err := db.TTLWithOptions("key", &ReadOptions{ColumnFamily: cf, Snapshot: snapshot}); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("TTL in the column family before its write: %v", err)
+	}
+}
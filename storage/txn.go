@@ -0,0 +1,145 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"math"
+	"sync"
+	"time"
+)
+
+// Txn is an optimistic read-modify-write transaction. Reads see the snapshot taken by
+// BeginTxn, writes are buffered in a Batch, and Commit fails with ErrTxnConflict if a key
+// the transaction read was written by another commit after the snapshot. No DB lock is
+// held between BeginTxn and Commit.
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot
+	batch    *Batch
+
+	m       sync.Mutex
+	readSet map[string]struct{}
+}
+
+// BeginTxn starts a transaction, it must be finished with Commit or Rollback.
+func (db *DB) BeginTxn() *Txn {
+	return &Txn{
+		db:       db,
+		snapshot: db.NewSnapshot(),
+		batch:    db.NewBatch(BatchOptions{}),
+		readSet:  make(map[string]struct{}),
+	}
+}
+
+// Get reads the key from the writes of the transaction, then from its snapshot.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, _const.ErrorKeyIsEmpty
+	}
+
+	txn.batch.m.RLock()
+	defer txn.batch.m.RUnlock()
+	if err := txn.batch.checkWritable(); err != nil {
+		return nil, err
+	}
+	value, read, err := txn.batch.get(nil, key, txn.snapshot)
+	if read {
+		txn.m.Lock()
+		txn.readSet[string(key)] = struct{}{}
+		txn.m.Unlock()
+	}
+	return value, err
+}
+
+func (txn *Txn) Put(key []byte, value []byte) error {
+	return txn.batch.Put(key, value)
+}
+
+// PutWithTTL writes the key, it expires ttl after the call.
+func (txn *Txn) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return txn.batch.PutWithTTL(key, value, ttl)
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	return txn.batch.Delete(key)
+}
+
+func (txn *Txn) DeleteRange(start, end []byte) error {
+	return txn.batch.DeleteRange(start, end)
+}
+
+func (txn *Txn) Merge(key []byte, operand []byte) error {
+	return txn.batch.Merge(key, operand)
+}
+
+// Commit checks the keys read by the transaction and applies its writes atomically.
+// The transaction is finished afterwards, even when the commit fails.
+func (txn *Txn) Commit(w *WriteOptions) error {
+	if w == nil {
+		w = &WriteOptions{}
+	}
+	defer txn.db.ReleaseSnapshot(txn.snapshot)
+
+	batch := txn.batch
+	batch.m.Lock()
+	defer batch.m.Unlock()
+	if batch.commited {
+		return _const.ErrorBatchCommited
+	}
+	if batch.rollbacked {
+		return _const.ErrorBatchRollbacked
+	}
+
+	var err error
+	if batch.empty() {
+		// A read-only transaction has nothing to write, it only checks its reads.
+		txn.db.m.RLock()
+		if txn.db.Closed {
+			err = _const.ErrorDBClosed
+		} else {
+			err = txn.checkConflict()
+		}
+		txn.db.m.RUnlock()
+		if err == nil {
+			batch.commited = true
+		}
+	} else {
+		err = batch.commit(w, func() error {
+			txn.db.m.RLock()
+			defer txn.db.m.RUnlock()
+			return txn.checkConflict()
+		})
+	}
+	if err == _const.ErrTxnConflict {
+		batch.pendingWrites = nil
+		batch.rollbacked = true
+	}
+	return err
+}
+
+// checkConflict must be called with db.m held, the commit queue makes sure that no batch is
+// committed between the check and the write of the transaction. A transaction reads and
+// writes the default column family.
+func (txn *Txn) checkConflict() error {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	cf := txn.db.defaultFamily
+	for key := range txn.readSet {
+		value, ok, err := cf.lookup([]byte(key), math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		if ok && value.Version > txn.snapshot.seq {
+			return _const.ErrTxnConflict
+		}
+		if cf.rangeDeleteSeq([]byte(key), math.MaxUint64) > txn.snapshot.seq {
+			return _const.ErrTxnConflict
+		}
+	}
+	return nil
+}
+
+// Rollback discards the writes of the transaction.
+func (txn *Txn) Rollback() error {
+	txn.db.ReleaseSnapshot(txn.snapshot)
+	return txn.batch.Rollback()
+}
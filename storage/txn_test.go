@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	_const "SmartStashDB/const"
+)
+
+func TestTxnCommits(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("counter", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.BeginTxn()
+	if value, err := txn.Get([]byte("counter")); err != nil || string(value) != "1" {
+		t.Fatalf("get counter: %q %v", value, err)
+	}
+	if err := txn.Put([]byte("counter"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	// The transaction reads its own writes.
+	if value, err := txn.Get([]byte("counter")); err != nil || string(value) != "2" {
+		t.Fatalf("get counter after put: %q %v", value, err)
+	}
+	mustGet(t, db, "counter", "1")
+
+	// A write to a key the transaction did not read is no conflict.
+	if err := db.Put("unrelated", "x", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, "counter", "2")
+	if err := txn.Put([]byte("counter"), []byte("3")); !errors.Is(err, _const.ErrorBatchCommited) {
+		t.Fatalf("put after commit: %v", err)
+	}
+}
+
+func TestTxnDetectsConflicts(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	if err := db.Put("counter", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.BeginTxn()
+	if _, err := txn.Get([]byte("counter")); err != nil {
+		t.Fatal(err)
+	}
+	// A missing key that was read conflicts with its creation as well.
+	if _, err := txn.Get([]byte("missing")); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get missing: %v", err)
+	}
+	if err := db.Put("counter", "5", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The transaction keeps reading its snapshot.
+	if value, err := txn.Get([]byte("counter")); err != nil || string(value) != "1" {
+		t.Fatalf("get counter after a concurrent write: %q %v", value, err)
+	}
+	if err := txn.Put([]byte("counter"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(nil); !errors.Is(err, _const.ErrTxnConflict) {
+		t.Fatalf("commit after a concurrent write: %v", err)
+	}
+	mustGet(t, db, "counter", "5")
+	if err := txn.Commit(nil); !errors.Is(err, _const.ErrorBatchRollbacked) {
+		t.Fatalf("commit of a conflicted transaction: %v", err)
+	}
+
+	txn = db.BeginTxn()
+	if _, err := txn.Get([]byte("missing")); !errors.Is(err, _const.ErrorKeyNotFound) {
+		t.Fatalf("get missing: %v", err)
+	}
+	if err := db.Put("missing", "now", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put([]byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(nil); !errors.Is(err, _const.ErrTxnConflict) {
+		t.Fatalf("commit after the creation of a read key: %v", err)
+	}
+	mustNotFind(t, db, "x")
+}
+
+func TestTxnRollback(t *testing.T) {
+	db := openTestDB(t, testOptions(t))
+	txn := db.BeginTxn()
+	if err := txn.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	mustNotFind(t, db, "a")
+	if _, err := txn.Get([]byte("a")); !errors.Is(err, _const.ErrorBatchRollbacked) {
+		t.Fatalf("get after rollback: %v", err)
+	}
+	// The snapshot of the transaction is released.
+	if err := db.Put("a", "2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.smallestSnapshot() != db.seq {
+		t.Fatal("the rolled back transaction still holds its snapshot")
+	}
+}
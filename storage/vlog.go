@@ -0,0 +1,592 @@
+package storage
+
+import (
+	_const "SmartStashDB/const"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	valueLogFileExt = ".VLOG"
+
+	// valuePointerMeta is the UserMeta of a version whose value is a pointer into the value log.
+	valuePointerMeta byte = 1
+
+	// maxValuePointerSize is the biggest encoded ChunkPosition a skip-list keeps for a value
+	// moved into the value log.
+	maxValuePointerSize = binary.MaxVarintLen32 * 4
+
+	// maxInlineValueSize is the biggest value a skip-list node holds, the node stores the
+	// length of the value with its meta bytes and its expiry time in 16 bits.
+	maxInlineValueSize = math.MaxUint16 - 2 - binary.MaxVarintLen64
+	// maxKeySize is the biggest key a skip-list node holds besides its sequence number.
+	maxKeySize = math.MaxUint16 - 8
+)
+
+// valueLog holds the values bigger than Options.ValueThreshold in append-only segment
+// files, the memtables and the tables only keep the position of the value. The segments
+// are shared by the column families, every entry records the family, the sequence number
+// and the key of its value, so that the garbage collection can tell whether the value is
+// still referenced.
+type valueLog struct {
+	wal       *TinyWAL
+	threshold int
+	// compression compresses the values, the value log has its own counters.
+	compression *compression
+
+	// gcMu lets one garbage collection run at a time.
+	gcMu sync.Mutex
+
+	// mu guards the retired segments. A segment rewritten by the garbage collection is
+	// deleted from the disk right away but stays open until the iterators that were
+	// created before, and may still hold pointers into it, are closed.
+	mu         sync.Mutex
+	generation uint64
+	readers    map[uint64]int
+	retired    []retiredSegment
+}
+
+type retiredSegment struct {
+	segment    *SegmentFile
+	generation uint64
+}
+
+// valueLogEntry is a value of the value log and the version it belongs to.
+type valueLogEntry struct {
+	family   uint32
+	seq      uint64
+	key      []byte
+	value    []byte
+	position *ChunkPosition
+	// expiresAt is the expiry time of the version, it is kept when the value is moved.
+	expiresAt uint64
+}
+
+func openValueLog(options Options) (*valueLog, error) {
+	vlog := &valueLog{
+		threshold:   options.ValueThreshold,
+		compression: newCompression(options.Compressor),
+		readers:     make(map[uint64]int),
+	}
+	if vlog.threshold == 0 {
+		vlog.threshold = DefaultOptions.ValueThreshold
+	}
+	fileSize := options.ValueLogFileSize
+	if fileSize == 0 {
+		fileSize = DefaultOptions.ValueLogFileSize
+	}
+	var err error
+	vlog.wal, err = OpenTinyWAL(WalOptions{
+		DirPath:        options.DirPath,
+		MemTableSize:   fileSize,
+		segmentFileExt: valueLogFileExt,
+		// The writers sync the value log themselves, before the WAL that points into it.
+		BytesPerSync: math.MaxUint64,
+		BlockCache:   options.BlockCache,
+		compression:  vlog.compression,
+		readOnly:     options.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vlog, nil
+}
+
+// An entry of the value log is the family id, the sequence number and the key of the
+// value followed by the value.
+func encodeValueLogEntry(family uint32, seq uint64, key, value []byte) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*3+len(key)+len(value))
+	buf = binary.AppendUvarint(buf, uint64(family))
+	buf = binary.AppendUvarint(buf, seq)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+func decodeValueLogEntry(data []byte) (*valueLogEntry, error) {
+	var fields [3]uint64
+	for i := range fields {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, _const.ErrorValueLogCorrupted
+		}
+		fields[i] = value
+		data = data[n:]
+	}
+	if uint64(len(data)) < fields[2] {
+		return nil, _const.ErrorValueLogCorrupted
+	}
+	return &valueLogEntry{
+		family: uint32(fields[0]),
+		seq:    fields[1],
+		key:    data[:fields[2]],
+		value:  data[fields[2]:],
+	}, nil
+}
+
+// needsValueLog reports whether the value of the record is moved into the value log.
+func (vlog *valueLog) needsValueLog(record *LogRecord) bool {
+	return record.Type == LogRecordNormal && (len(record.Value) > vlog.threshold || len(record.Value) > maxInlineValueSize)
+}
+
+// checkSizes fails with ErrorDataToLarge if a record of the request does not fit into a
+// skip-list node once the big values are moved into the value log, or if the part of the
+// request written into a family does not fit into an empty memtable of the family. It sets
+// the sizes of the request.
+func (vlog *valueLog) checkSizes(req *commitRequest) error {
+	req.sizes = make(map[*ColumnFamily]int64, len(req.writes))
+	for cf, writes := range req.writes {
+		var size int64
+		for _, record := range writes.records {
+			valueSize := len(record.Value)
+			if vlog.needsValueLog(record) {
+				valueSize = maxValuePointerSize
+			}
+			if len(record.Key) > maxKeySize || valueSize > maxInlineValueSize {
+				return _const.ErrorDataToLarge
+			}
+			size += sklEntrySize(len(record.Key), valueSize)
+		}
+		if size > int64(cf.options.MemTableSize) {
+			return _const.ErrorDataToLarge
+		}
+		req.sizes[cf] = size
+	}
+	return nil
+}
+
+// writeBatches moves the big values of the batches into the value log and replaces them by
+// their positions, it must be called with db.commitMu held once the sequence numbers are
+// assigned. The values are synced before the WAL that points to them.
+func (vlog *valueLog) writeBatches(batches []*commitRequest, sync bool) error {
+	written := false
+	for _, batch := range batches {
+		for cf, writes := range batch.writes {
+			for _, record := range writes.records {
+				if !vlog.needsValueLog(record) {
+					continue
+				}
+				position, err := vlog.wal.Write(encodeValueLogEntry(cf.id, batch.seq, record.Key, record.Value))
+				if err != nil {
+					return err
+				}
+				record.Type = LogRecordValuePointer
+				record.Value = position.Encode()
+				written = true
+			}
+		}
+	}
+	if written && sync {
+		return vlog.wal.Sync()
+	}
+	return nil
+}
+
+// read returns the value at the encoded position.
+func (vlog *valueLog) read(pointer []byte) ([]byte, error) {
+	position, err := DecodeChunkPosition(pointer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := vlog.wal.Read(position)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = vlog.readRetired(position)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry, err := decodeValueLogEntry(data)
+	if err != nil {
+		return nil, err
+	}
+	return entry.value, nil
+}
+
+func (vlog *valueLog) readRetired(position *ChunkPosition) ([]byte, error) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	for _, r := range vlog.retired {
+		if r.segment.segmentFileId == position.SegmentFileId {
+			data, _, err := r.segment.readInternal(position.BlockIndex, position.ChunkOffset)
+			return data, err
+		}
+	}
+	return nil, _const.ErrorValueLogCorrupted
+}
+
+// acquire pins the segments that are live now until release is called with the result.
+func (vlog *valueLog) acquire() uint64 {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	vlog.readers[vlog.generation]++
+	return vlog.generation
+}
+
+func (vlog *valueLog) release(generation uint64) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	if vlog.readers[generation]--; vlog.readers[generation] == 0 {
+		delete(vlog.readers, generation)
+	}
+	vlog.closeRetired()
+}
+
+// retire deletes the segment, it stays readable for the readers that pinned it.
+func (vlog *valueLog) retire(segment *SegmentFile) error {
+	// The readers that miss the segment in the WAL wait for vlog.mu before they look at
+	// the retired segments.
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	vlog.wal.mutex.Lock()
+	delete(vlog.wal.immutableSegment, segment.segmentFileId)
+	vlog.wal.mutex.Unlock()
+	if err := os.Remove(segment.fd.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	vlog.retired = append(vlog.retired, retiredSegment{segment: segment, generation: vlog.generation})
+	vlog.generation++
+	vlog.closeRetired()
+	return nil
+}
+
+// closeRetired closes the retired segments that no reader pinned, it must be called with
+// vlog.mu held.
+func (vlog *valueLog) closeRetired() {
+	kept := vlog.retired[:0]
+	for _, r := range vlog.retired {
+		pinned := false
+		for generation := range vlog.readers {
+			if generation <= r.generation {
+				pinned = true
+				break
+			}
+		}
+		if pinned {
+			kept = append(kept, r)
+			continue
+		}
+		_ = r.segment.Close()
+	}
+	vlog.retired = kept
+}
+
+// immutableSegments returns the segments that are no longer written, the oldest first.
+func (vlog *valueLog) immutableSegments() []*SegmentFile {
+	vlog.wal.mutex.RLock()
+	defer vlog.wal.mutex.RUnlock()
+	segments := make([]*SegmentFile, 0, len(vlog.wal.immutableSegment))
+	for _, segment := range vlog.wal.immutableSegment {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].segmentFileId < segments[j].segmentFileId })
+	return segments
+}
+
+func (vlog *valueLog) stats() ValueLogStats {
+	vlog.wal.mutex.RLock()
+	defer vlog.wal.mutex.RUnlock()
+	stats := ValueLogStats{
+		Segments:    len(vlog.wal.immutableSegment),
+		Compression: vlog.compression.stats(),
+	}
+	if active := vlog.wal.activeSegment; active != nil {
+		stats.Segments++
+		stats.Bytes = active.Size()
+	}
+	for _, segment := range vlog.wal.immutableSegment {
+		stats.Bytes += segment.Size()
+	}
+	return stats
+}
+
+func (vlog *valueLog) close() error {
+	vlog.mu.Lock()
+	for _, r := range vlog.retired {
+		_ = r.segment.Close()
+	}
+	vlog.retired = nil
+	vlog.mu.Unlock()
+	return vlog.wal.close()
+}
+
+// valueOf returns the value of a version, the value log is read if it holds a pointer.
+func (db *DB) valueOf(value y.ValueStruct) ([]byte, error) {
+	if value.UserMeta != valuePointerMeta {
+		return value.Value, nil
+	}
+	return db.vlog.read(value.Value)
+}
+
+// RunValueLogGC rewrites the oldest value log segment whose share of unreferenced values is
+// at least discardRatio: its live values are appended to the head of the value log, the
+// memtables are pointed to the new copies and the segment is deleted. A value is live while
+// the latest state or a snapshot reads it. A segment holding a live value that is no longer
+// the newest version of its key, kept by a snapshot or as the base of merge operands, is
+// only rewritten once the snapshot is released or the version is compacted away.
+// ErrorNoValueLogRewrite is returned if no segment qualifies.
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return _const.ErrorInvalidDiscardRatio
+	}
+	if db.options.ReadOnly {
+		return _const.ErrorReadOnlyDB
+	}
+	db.vlog.gcMu.Lock()
+	defer db.vlog.gcMu.Unlock()
+
+	for _, segment := range db.vlog.immutableSegments() {
+		usage, err := db.segmentUsage(segment, nil)
+		if err != nil {
+			return err
+		}
+		if usage.pinned || usage.totalBytes == 0 ||
+			float64(usage.totalBytes-usage.liveBytes) < discardRatio*float64(usage.totalBytes) {
+			continue
+		}
+		return db.rewriteValueLog(segment, usage.live)
+	}
+	return _const.ErrorNoValueLogRewrite
+}
+
+// valueLogUsage describes the live entries of a value log segment.
+type valueLogUsage struct {
+	live                  []*valueLogEntry
+	liveBytes, totalBytes int64
+	// pinned is set if a live entry can not be moved.
+	pinned bool
+}
+
+// segmentUsage checks the entries of the segment, only the given entries are checked if
+// they are not nil.
+func (db *DB) segmentUsage(segment *SegmentFile, entries []*valueLogEntry) (*valueLogUsage, error) {
+	usage := &valueLogUsage{}
+	check := func(entry *valueLogEntry) error {
+		db.m.RLock()
+		defer db.m.RUnlock()
+		if db.Closed {
+			return _const.ErrorDBClosed
+		}
+		live, movable, err := db.isLiveValue(entry)
+		if err != nil || !live {
+			return err
+		}
+		usage.live = append(usage.live, entry)
+		usage.liveBytes += int64(entry.position.ChunkSize)
+		usage.pinned = usage.pinned || !movable
+		return nil
+	}
+
+	if entries != nil {
+		for _, entry := range entries {
+			if err := check(entry); err != nil {
+				return nil, err
+			}
+		}
+		return usage, nil
+	}
+
+	reader := segment.NewSegmentReader()
+	for {
+		data, position, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := decodeValueLogEntry(data)
+		if err != nil {
+			return nil, err
+		}
+		entry.position = position
+		usage.totalBytes += int64(position.ChunkSize)
+		if err := check(entry); err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// isLiveValue reports whether a read may still return the entry: the version of the entry
+// is the value, or the base of the merge operands, that the latest state or a snapshot sees.
+// An expired value is never read again. A live entry is movable if its version is the
+// newest one of the key, only then can a copy with the same sequence number be written
+// into the active memtable without shadowing a newer version. It must be called with db.m held.
+func (db *DB) isLiveValue(entry *valueLogEntry) (live bool, movable bool, err error) {
+	cf := db.families[entry.family]
+	if cf == nil {
+		return false, false, nil
+	}
+	readTss := []uint64{db.seq}
+	db.snapshots.mu.Lock()
+	for e := db.snapshots.list.Front(); e != nil; e = e.Next() {
+		if seq := e.Value.(*Snapshot).seq; seq >= entry.seq && seq != readTss[len(readTss)-1] {
+			readTss = append(readTss, seq)
+		}
+	}
+	db.snapshots.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano())
+	for _, readTs := range readTss {
+		versions, err := cf.versions(entry.key, readTs)
+		if err != nil {
+			return false, false, err
+		}
+		for _, v := range versions {
+			if v.seq < entry.seq {
+				break
+			}
+			if v.seq > entry.seq || v.value.UserMeta != valuePointerMeta || isExpired(v.value, now) {
+				continue
+			}
+			position, err := DecodeChunkPosition(v.value.Value)
+			if err != nil {
+				return false, false, err
+			}
+			if position.SegmentFileId == entry.position.SegmentFileId &&
+				position.BlockIndex == entry.position.BlockIndex &&
+				position.ChunkOffset == entry.position.ChunkOffset {
+				entry.expiresAt = v.value.ExpiresAt
+				newest, _, err := cf.lookup(entry.key, math.MaxUint64)
+				return true, newest.Version == entry.seq, err
+			}
+		}
+	}
+	return false, false, nil
+}
+
+// rewriteValueLog moves the live values of the segment to the head of the value log and
+// deletes the segment. The commits, the flushes and the compactions wait meanwhile, so no
+// version of the moved values can be dropped before it points to the new copy.
+func (db *DB) rewriteValueLog(segment *SegmentFile, live []*valueLogEntry) error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.m.RLock()
+	if db.Closed {
+		db.m.RUnlock()
+		return _const.ErrorDBClosed
+	}
+	families := db.sortedFamilies()
+	db.m.RUnlock()
+	for _, cf := range families {
+		cf.bgMu.Lock()
+	}
+	defer func() {
+		for _, cf := range families {
+			cf.bgMu.Unlock()
+		}
+	}()
+
+	// A flush or a compaction may have dropped some of the versions since the segment was read.
+	usage, err := db.segmentUsage(segment, live)
+	if err != nil {
+		return err
+	}
+	if usage.pinned {
+		return _const.ErrorNoValueLogRewrite
+	}
+
+	var (
+		group     []*commitRequest
+		groupSize int64
+		sizes     = make(map[*ColumnFamily]int64)
+	)
+	for _, entry := range usage.live {
+		position, err := db.vlog.wal.Write(encodeValueLogEntry(entry.family, entry.seq, entry.key, entry.value))
+		if err != nil {
+			return err
+		}
+		db.m.RLock()
+		cf := db.families[entry.family]
+		db.m.RUnlock()
+		// The moved value keeps the sequence number of its version, the copy in the newer
+		// memtable shadows the old one.
+		record := &LogRecord{
+			Key:    entry.key,
+			Value:  position.Encode(),
+			Type:   LogRecordValuePointer,
+			Expire: entry.expiresAt,
+		}
+		size := sklEntrySize(len(entry.key), len(record.Value))
+		group = append(group, &commitRequest{
+			writes:  map[*ColumnFamily]*familyWrites{cf: {records: map[string]*LogRecord{string(entry.key): record}}},
+			sizes:   map[*ColumnFamily]int64{cf: size},
+			batchId: db.batchIds.Generate(),
+			sync:    true,
+			seq:     entry.seq,
+		})
+		groupSize += size
+		sizes[cf] += size
+		if groupSize >= maxCommitGroupSize || sizes[cf] >= int64(cf.options.MemTableSize/2) {
+			if err := db.relocateValues(group); err != nil {
+				return err
+			}
+			group, groupSize, sizes = nil, 0, make(map[*ColumnFamily]int64)
+		}
+	}
+	if err := db.relocateValues(group); err != nil {
+		return err
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+	return db.vlog.retire(segment)
+}
+
+// relocateValues writes the records of the moved values into the memtables, every record
+// is its own batch with the sequence number of its version. It must be called with
+// db.commitMu held.
+func (db *DB) relocateValues(batches []*commitRequest) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	if err := db.vlog.wal.Sync(); err != nil {
+		return err
+	}
+	var families []*ColumnFamily
+	for _, batch := range batches {
+		for cf := range batch.writes {
+			if !containsFamily(families, cf) {
+				families = append(families, cf)
+			}
+		}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+
+	sizes := groupSizes(batches)
+	mems := make([]*MemTable, len(families))
+	for i, cf := range families {
+		if err := cf.waitMemTableSpace(sizes[cf]); err != nil {
+			return err
+		}
+		mems[i] = cf.activeMem
+	}
+
+	for i, cf := range families {
+		if err := mems[i].logBatches(cf, batches); err != nil {
+			return err
+		}
+	}
+	for i, cf := range families {
+		mems[i].applyBatches(cf, batches)
+	}
+	return nil
+}
+
+func containsFamily(families []*ColumnFamily, cf *ColumnFamily) bool {
+	for _, family := range families {
+		if family == cf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	_const "SmartStashDB/const"
+)
+
+func vlogTestOptions(t *testing.T) Options {
+	options := mergeTestOptions(t)
+	options.ValueThreshold = 1024
+	options.ValueLogFileSize = 64 * 1024
+	return options
+}
+
+// bigValue is a value above the threshold of vlogTestOptions.
+func bigValue(key string, round int) string {
+	return fmt.Sprintf("%s-%d-", key, round) + string(bytes.Repeat([]byte{byte('a' + round)}, 4000))
+}
+
+func TestLargeValuesGoToTheValueLog(t *testing.T) {
+	options := vlogTestOptions(t)
+	db, err := OpenDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		value := bigValue(key, 0)
+		if i%2 == 0 {
+			value = key
+		}
+		if err := db.Put(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The base value of merge operands may be in the value log.
+	if err := db.Put("merged", bigValue("merged", 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	mustMerge(t, db, "merged", "+operand")
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ValueLog.Segments < 2 || stats.ValueLog.Bytes < 100*4000 {
+		t.Fatalf("the big values are not in the value log: %+v", stats.ValueLog)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < 200; i += 7 {
+			key := fmt.Sprintf("key-%05d", i)
+			want := bigValue(key, 0)
+			if i%2 == 0 {
+				want = key
+			}
+			mustGet(t, db, key, want)
+		}
+		mustGet(t, db, "merged", bigValue("merged", 0)+"+operand")
+		kvs, _, err := db.Scan([]byte("key-00001"), []byte("key-00002"), 0)
+		if err != nil || len(kvs) != 1 || string(kvs[0].Value) != bigValue("key-00001", 0) {
+			t.Fatalf("scan of a value in the value log: %d %v", len(kvs), err)
+		}
+	}
+	check(db)
+	fillMemTables(t, db, "filler", 3000)
+	waitForCompaction(t, db)
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestDB(t, options))
+}
+
+func TestValueLogGC(t *testing.T) {
+	options := vlogTestOptions(t)
+	db := openTestDB(t, options)
+	if err := db.RunValueLogGC(1); !errors.Is(err, _const.ErrorInvalidDiscardRatio) {
+		t.Fatalf("discard ratio 1: %v", err)
+	}
+
+	write := func(round int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%05d", i)
+			if err := db.Put(key, bigValue(key, round), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(0)
+	snapshot := db.NewSnapshot()
+	write(1)
+	before, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot still reads the values of the first round.
+	if err := db.RunValueLogGC(0.5); !errors.Is(err, _const.ErrorNoValueLogRewrite) {
+		t.Fatalf("gc while a snapshot reads the old values: %v", err)
+	}
+	value, err := db.GetWithOptions("key-00000", &ReadOptions{Snapshot: snapshot})
+	if err != nil || string(value) != bigValue("key-00000", 0) {
+		t.Fatalf("snapshot read: %d bytes, %v", len(value), err)
+	}
+	db.ReleaseSnapshot(snapshot)
+
+	rewritten := 0
+	for {
+		err := db.RunValueLogGC(0.5)
+		if errors.Is(err, _const.ErrorNoValueLogRewrite) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewritten++
+	}
+	after, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten == 0 || after.ValueLog.Bytes >= before.ValueLog.Bytes {
+		t.Fatalf("%d segments rewritten, %d bytes before and %d after", rewritten, before.ValueLog.Bytes, after.ValueLog.Bytes)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%05d", i)
+			mustGet(t, db, key, bigValue(key, 1))
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestDB(t, options))
+}
+
+func TestBigValuesOnlyCountTheirPointers(t *testing.T) {
+	options := vlogTestOptions(t)
+	db := openTestDB(t, options)
+
+	// The values of the batch are far bigger than the memtable, the memtable only keeps
+	// their positions.
+	batch := db.NewBatch(DefaultBatchOptions)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		if err := batch.Put([]byte(key), bytes.Repeat([]byte{byte(i)}, 10000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i += 3 {
+		mustGet(t, db, fmt.Sprintf("key-%05d", i), string(bytes.Repeat([]byte{byte(i)}, 10000)))
+	}
+
+	// Values kept inline still count in full.
+	batch = db.NewBatch(DefaultBatchOptions)
+	for i := 0; i < 100; i++ {
+		if err := batch.Put([]byte(fmt.Sprintf("inline-%05d", i)), bytes.Repeat([]byte{'v'}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Commit(nil); !errors.Is(err, _const.ErrorDataToLarge) {
+		t.Fatalf("commit of inline values bigger than the memtable: %v", err)
+	}
+}
+
+func TestValuesOver64KB(t *testing.T) {
+	options := testOptions(t)
+	options.ValueThreshold = math.MaxUint16
+	db := openTestDB(t, options)
+
+	sizes := map[string]int{
+		"inline":      maxInlineValueSize,
+		"over-inline": maxInlineValueSize + 1,
+		"max-uint16":  math.MaxUint16,
+		"over-uint16": math.MaxUint16 + 1,
+		"large":       200000,
+	}
+	values := make(map[string]string, len(sizes)+1)
+	for key, size := range sizes {
+		values[key] = string(bytes.Repeat([]byte{byte(size)}, size))
+		if err := db.Put(key, values[key], nil); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	values["ttl"] = string(bytes.Repeat([]byte{'t'}, math.MaxUint16))
+	if err := db.PutWithTTL("ttl", values["ttl"], time.Hour, nil); err != nil {
+		t.Fatalf("put ttl: %v", err)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for key, want := range values {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("get %s: %v", key, err)
+			}
+			if string(value) != want {
+				t.Fatalf("get %s: %d bytes, want %d", key, len(value), len(want))
+			}
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestDB(t, options))
+}
+
+func TestInvalidValueThreshold(t *testing.T) {
+	for _, threshold := range []int{-1, math.MaxUint16 + 1} {
+		options := testOptions(t)
+		options.ValueThreshold = threshold
+		db, err := OpenDB(options)
+		if err == nil {
+			_ = db.Close()
+		}
+		if !errors.Is(err, _const.ErrorInvalidThreshold) {
+			t.Fatalf("threshold %d: %v", threshold, err)
+		}
+	}
+}
+
+func TestZeroValueThresholdUsesTheDefault(t *testing.T) {
+	options := testOptions(t)
+	options.ValueThreshold = 0
+	db := openTestDB(t, options)
+	if db.vlog.threshold != DefaultOptions.ValueThreshold {
+		t.Fatalf("threshold %d, want %d", db.vlog.threshold, DefaultOptions.ValueThreshold)
+	}
+	value := string(bytes.Repeat([]byte{'v'}, DefaultOptions.ValueThreshold+1))
+	if err := db.Put("key", value, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("key"); err != nil || string(got) != value {
+		t.Fatalf("get: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestOversizedInlineData(t *testing.T) {
+	options := testOptions(t)
+	options.MergeOperator = concatOperator{}
+	db := openTestDB(t, options)
+
+	// Merge operands stay in the skip-list whatever their size.
+	operand := bytes.Repeat([]byte{'m'}, 70000)
+	if err := db.Merge([]byte("merge"), operand, nil); !errors.Is(err, _const.ErrorDataToLarge) {
+		t.Fatalf("merge of %d bytes: %v", len(operand), err)
+	}
+	key := string(bytes.Repeat([]byte{'k'}, maxKeySize+1))
+	if err := db.Put(key, "v", nil); !errors.Is(err, _const.ErrorDataToLarge) {
+		t.Fatalf("key of %d bytes: %v", len(key), err)
+	}
+}